@@ -13,6 +13,7 @@ import (
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/safe"
 	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
 )
 
 var askUrl = &survey.Input{
@@ -50,12 +51,16 @@ var urlParam = assist.Param{
 		if err != nil {
 			return "", err
 		}
-		switch u.Scheme {
-		case "sftp", "s3", "file":
-			break
-		default:
+		schemes := strings.Split(u.Scheme, "+")
+		backends, wrappers := storage.Schemes()
+		if !core.Contains(backends, schemes[len(schemes)-1]) {
 			return "", core.Errorf("Invalid URL scheme: %s", u.Scheme)
 		}
+		for _, w := range schemes[:len(schemes)-1] {
+			if !core.Contains(wrappers, w) {
+				return "", core.Errorf("Invalid URL scheme: %s", u.Scheme)
+			}
+		}
 		return arg, nil
 	},
 }
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/stregato/stash/cli/assist"
+	"github.com/stregato/stash/lib/config"
+	"github.com/stregato/stash/lib/storage"
+)
+
+var credNameParam = assist.Param{
+	Use:   "name",
+	Short: "The name of the credentials, used in the url with the cred parameter",
+}
+
+var credValueParam = assist.Param{
+	Use:   "value",
+	Short: "The credentials as a query string, e.g. user=alice&password=secret or a=key&s=secret; empty to remove them",
+}
+
+var credCmd = &assist.Command{
+	Use:    "cred",
+	Short:  "Save credentials encrypted in the config, so that urls can reference them with cred=<name>",
+	Params: []assist.Param{credNameParam, credValueParam},
+	Run: func(params map[string]string) error {
+		name := params["name"]
+		if params["value"] == "" {
+			return config.DelCredentials(DB, Identity, name)
+		}
+
+		credentials, err := storage.ParseCredentials(params["value"])
+		if err != nil {
+			return err
+		}
+		err = config.SetCredentials(DB, Identity, name, credentials)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Credentials %s saved; use cred=%s in the url\n", name, name)
+		return nil
+	},
+}
+
+func init() {
+	safeCmd.AddCommand(credCmd)
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/stregato/stash/cli/assist"
+	"github.com/stregato/stash/cli/styles"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/fs"
+)
+
+var versionPathParam = assist.Param{
+	Use:   "path",
+	Short: "The file in the safe",
+}
+
+var versionParam = assist.Param{
+	Use:   "version",
+	Short: "The version to restore, as shown by history",
+}
+
+func historyRun(params map[string]string) error {
+	s, name, err := getSafeAndPath(params["path"])
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := fs.Open(s)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	versions, err := f.Versions(name)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		creator := v.Creator.Nick()
+		if creator == "" {
+			creator = "-"
+		}
+		println(styles.UseStyle.Render(v.ID.String()), styles.ShortStyle.Render(strconv.Itoa(v.Size)),
+			styles.ShortStyle.Render(creator), styles.ShortStyle.Render(v.ModTime.String()))
+	}
+	return nil
+}
+
+func restoreRun(params map[string]string) error {
+	version, err := strconv.ParseUint(params["version"], 16, 64)
+	if err != nil {
+		return core.Errorf("Invalid version %s", params["version"])
+	}
+
+	s, name, err := getSafeAndPath(params["path"])
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := fs.Open(s)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	file, err := f.Restore(name, fs.FileID(version))
+	if err != nil {
+		return err
+	}
+	println(styles.ShortStyle.Render("restored as version " + file.ID.String()))
+	return nil
+}
+
+var historyCmd = &assist.Command{
+	Use:    "history",
+	Short:  "List the versions of a file in the safe, the latest first",
+	Params: []assist.Param{versionPathParam},
+	Run:    historyRun,
+}
+
+var restoreCmd = &assist.Command{
+	Use:    "restore",
+	Short:  "Restore a version of a file as the latest version",
+	Params: []assist.Param{versionPathParam, versionParam},
+	Run:    restoreRun,
+}
+
+func init() {
+	filesCmd.AddCommand(historyCmd)
+	filesCmd.AddCommand(restoreCmd)
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stregato/stash/cli/assist"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/fs"
+	"github.com/stregato/stash/lib/safe"
+)
+
+var policyPathParam = assist.Param{
+	Use:   "path",
+	Short: "The directory in the safe",
+}
+
+var policyGroupParam = assist.Param{
+	Use:   "group",
+	Short: "The group of the files put without one; empty to inherit",
+}
+
+var policyAllowedParam = assist.Param{
+	Use:   "allowed",
+	Short: "The groups allowed, separated by commas; empty to inherit",
+}
+
+var policyTagsParam = assist.Param{
+	Use:   "tags",
+	Short: "The tags added to new files, separated by commas; empty to inherit",
+}
+
+var policyVersionsParam = assist.Param{
+	Use:   "versions",
+	Short: "The number of versions to keep; empty to inherit",
+}
+
+var policyDaysParam = assist.Param{
+	Use:   "days",
+	Short: "The days under which versions are kept; empty to inherit",
+}
+
+// withPath opens the file system of a path in the form safe/dir and calls fn with the dir
+func withPath(params map[string]string, fn func(f *fs.FileSystem, name string) error) error {
+	s, name, err := getSafeAndPath(params["path"])
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := fs.Open(s)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f, name)
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func atoiOrZero(name, s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, core.Errorf("Invalid %s %s", name, s)
+	}
+	return v, nil
+}
+
+var policyCmd = &assist.Command{
+	Use:    "policy",
+	Short:  "Show the rules that apply to a directory",
+	Params: []assist.Param{policyPathParam},
+	Run: func(params map[string]string) error {
+		return withPath(params, func(f *fs.FileSystem, name string) error {
+			p, err := f.PolicyOf(name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("group: %s\nallowed: %v\ntags: %v\nversions: %d\ndays: %d\n", p.DefaultGroup,
+				p.AllowedGroups, p.DefaultTags, p.Retention.Versions, p.Retention.Days)
+			return nil
+		})
+	},
+}
+
+var setPolicyCmd = &assist.Command{
+	Use:   "set-policy",
+	Short: "Set the rules for a directory and its subdirectories; only administrators can",
+	Params: []assist.Param{policyPathParam, policyGroupParam, policyAllowedParam, policyTagsParam,
+		policyVersionsParam, policyDaysParam},
+	Run: func(params map[string]string) error {
+		versions, err := atoiOrZero("versions", params["versions"])
+		if err != nil {
+			return err
+		}
+		days, err := atoiOrZero("days", params["days"])
+		if err != nil {
+			return err
+		}
+		return withPath(params, func(f *fs.FileSystem, name string) error {
+			var allowed []safe.GroupName
+			for _, g := range splitList(params["allowed"]) {
+				allowed = append(allowed, safe.GroupName(g))
+			}
+			return f.SetPolicy(fs.DirPolicy{Dir: name, DefaultGroup: safe.GroupName(params["group"]),
+				AllowedGroups: allowed, DefaultTags: splitList(params["tags"]),
+				Retention: fs.Retention{Versions: versions, Days: days}})
+		})
+	},
+}
+
+var deletePolicyCmd = &assist.Command{
+	Use:    "del-policy",
+	Short:  "Remove the rules of a directory, so that the ones of the parent apply",
+	Params: []assist.Param{policyPathParam},
+	Run: func(params map[string]string) error {
+		return withPath(params, func(f *fs.FileSystem, name string) error {
+			return f.DeletePolicy(name)
+		})
+	},
+}
+
+func init() {
+	filesCmd.AddCommand(policyCmd)
+	filesCmd.AddCommand(setPolicyCmd)
+	filesCmd.AddCommand(deletePolicyCmd)
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/stregato/stash/cli/assist"
+)
+
+var repairCmd = &assist.Command{
+	Use:    "repair",
+	Short:  "Repair the redundant copies of a safe stored on a mirror or erasure coded store",
+	Params: []assist.Param{safeParam},
+	Run: func(params map[string]string) error {
+		s, err := getSafeByName(params["safe"])
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		n, err := s.Repair()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d objects repaired\n", n)
+		return nil
+	},
+}
+
+func init() {
+	safeCmd.AddCommand(repairCmd)
+}
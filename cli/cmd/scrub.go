@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/stregato/stash/cli/assist"
+	"github.com/stregato/stash/lib/core"
+	_ "github.com/stregato/stash/lib/fs"        // registers the checks of the file system
+	_ "github.com/stregato/stash/lib/messanger" // registers the checks of the messages
+	"github.com/stregato/stash/lib/safe"
+)
+
+var scrubModeParam = assist.Param{
+	Use:   "mode",
+	Short: "Empty to report the inconsistencies, delete to remove also orphans older than a day and stale locks",
+}
+
+var scrubCmd = &assist.Command{
+	Use:    "scrub",
+	Short:  "Check the consistency of a safe, e.g. headers without data or data left by interrupted uploads",
+	Params: []assist.Param{safeParam, scrubModeParam},
+	Run: func(params map[string]string) error {
+		if params["mode"] != "" && params["mode"] != "delete" {
+			return core.Errorf("Invalid mode %s, use delete or leave it empty", params["mode"])
+		}
+		s, err := getSafeByName(params["safe"])
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		report, err := s.Scrub(safe.ScrubOptions{Delete: params["mode"] == "delete"})
+		if err != nil {
+			return err
+		}
+		for _, issue := range report.Issues {
+			deleted := ""
+			if issue.Deleted {
+				deleted = " (deleted)"
+			}
+			fmt.Printf("%s %s: %s%s\n", issue.Kind, issue.Path, issue.Detail, deleted)
+		}
+		fmt.Printf("%d objects checked, %d issues\n", report.Checked, len(report.Issues))
+		return nil
+	},
+}
+
+func init() {
+	safeCmd.AddCommand(scrubCmd)
+}
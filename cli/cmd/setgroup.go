@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/stregato/stash/cli/assist"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/fs"
+	"github.com/stregato/stash/lib/safe"
+)
+
+var setGroupGroupParam = assist.Param{
+	Use:   "group",
+	Short: "The group that can read the file or the directory",
+}
+
+var setGroupModeParam = assist.Param{
+	Use:   "mode",
+	Short: "Empty to encrypt the headers again, rotate to encrypt also the content with new keys",
+}
+
+var setGroupCmd = &assist.Command{
+	Use:    "group",
+	Short:  "Change the group of a file, or of a directory with all its content",
+	Params: []assist.Param{versionPathParam, setGroupGroupParam, setGroupModeParam},
+	Run: func(params map[string]string) error {
+		if params["mode"] != "" && params["mode"] != "rotate" {
+			return core.Errorf("Invalid mode %s, use rotate or leave it empty", params["mode"])
+		}
+		return withPath(params, func(f *fs.FileSystem, name string) error {
+			groupName := safe.GroupName(params["group"])
+			options := fs.SetGroupOptions{RotateKey: params["mode"] == "rotate"}
+			file, err := f.Stat(name)
+			if err != nil {
+				return err
+			}
+			if !file.IsDir {
+				_, err = f.SetGroup(name, groupName, options)
+				return err
+			}
+			count, err := f.SetGroupTree(name, groupName, options)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d versions moved to group %s\n", count, groupName)
+			return nil
+		})
+	},
+}
+
+func init() {
+	filesCmd.AddCommand(setGroupCmd)
+}
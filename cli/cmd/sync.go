@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stregato/stash/cli/assist"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/fs"
+)
+
+// SyncInterval is the time between two syncs of the sync command
+var SyncInterval = 10 * time.Second
+
+// syncIgnoreFile lists the ignore patterns of a synced folder, one per line
+const syncIgnoreFile = ".stashignore"
+
+var syncLocalParam = assist.Param{
+	Use:   "local",
+	Short: "The local folder to keep in sync",
+}
+
+var syncRemoteParam = assist.Param{
+	Use:   "remote",
+	Short: "The folder in the safe to keep in sync",
+}
+
+var syncModeParam = assist.Param{
+	Use:   "mode",
+	Short: "upload, download or two-way; empty for two-way",
+}
+
+// readSyncIgnore returns the patterns in the ignore file of the local folder. The ignore file itself is always ignored,
+// so that each peer keeps its own
+func readSyncIgnore(local string) ([]string, error) {
+	patterns := []string{syncIgnoreFile}
+	data, err := os.ReadFile(filepath.Join(local, syncIgnoreFile))
+	if os.IsNotExist(err) {
+		return patterns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, nil
+}
+
+var syncCmd = &assist.Command{
+	Use:    "sync",
+	Short:  "Keep a local folder in sync with a folder in the safe until interrupted",
+	Params: []assist.Param{safeParam, syncLocalParam, syncRemoteParam, syncModeParam},
+	Run: func(params map[string]string) error {
+		return withFS(params, func(f *fs.FileSystem) error {
+			for {
+				ignore, err := readSyncIgnore(params["local"])
+				if err != nil {
+					return err
+				}
+				r, err := f.Sync(params["local"], params["remote"], fs.SyncPolicy{Mode: params["mode"],
+					Ignore: ignore})
+				if err != nil {
+					return err
+				}
+				for _, c := range []struct {
+					label string
+					names []string
+				}{{"uploaded", r.Uploaded}, {"downloaded", r.Downloaded}, {"deleted", r.Deleted},
+					{"conflict", r.Conflicts}, {"failed", r.Failed}} {
+					for _, name := range c.names {
+						fmt.Printf("%s %s %s\n", core.Now().Format(time.TimeOnly), c.label, name)
+					}
+				}
+				time.Sleep(SyncInterval)
+			}
+		})
+	},
+}
+
+func init() {
+	Root.AddCommand(syncCmd)
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+
+	"github.com/stregato/stash/cli/assist"
+	"github.com/stregato/stash/cli/styles"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/fs"
+)
+
+var trashIDParam = assist.Param{
+	Use:   "id",
+	Short: "The id of the deleted file, as shown by trash",
+}
+
+// withFS opens the file system of the safe in the params and runs fn on it
+func withFS(params map[string]string, fn func(f *fs.FileSystem) error) error {
+	s, err := getSafeByName(params["safe"])
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := fs.Open(s)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
+}
+
+var trashCmd = &assist.Command{
+	Use:    "trash",
+	Short:  "List the deleted files that can be restored",
+	Params: []assist.Param{safeParam},
+	Run: func(params map[string]string) error {
+		return withFS(params, func(f *fs.FileSystem) error {
+			items, err := f.ListTrash()
+			if err != nil {
+				return err
+			}
+			for _, item := range items {
+				deleter := item.Deleter.Nick()
+				if deleter == "" {
+					deleter = "-"
+				}
+				println(styles.UseStyle.Render(item.File.ID.String()),
+					styles.ShortStyle.Render(path.Join(item.File.Dir, item.File.Name)),
+					styles.ShortStyle.Render(deleter), styles.ShortStyle.Render(item.DeleteTime.String()))
+			}
+			return nil
+		})
+	},
+}
+
+var undeleteCmd = &assist.Command{
+	Use:    "undelete",
+	Short:  "Restore a deleted file from the trash",
+	Params: []assist.Param{safeParam, trashIDParam},
+	Run: func(params map[string]string) error {
+		id, err := strconv.ParseUint(params["id"], 16, 64)
+		if err != nil {
+			return core.Errorf("Invalid id %s", params["id"])
+		}
+		return withFS(params, func(f *fs.FileSystem) error {
+			file, err := f.Undelete(fs.FileID(id))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s restored\n", path.Join(file.Dir, file.Name))
+			return nil
+		})
+	},
+}
+
+var emptyTrashCmd = &assist.Command{
+	Use:    "empty-trash",
+	Short:  "Delete permanently the files in the trash",
+	Params: []assist.Param{safeParam},
+	Run: func(params map[string]string) error {
+		return withFS(params, func(f *fs.FileSystem) error {
+			n, err := f.EmptyTrash()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d files deleted\n", n)
+			return nil
+		})
+	},
+}
+
+func init() {
+	filesCmd.AddCommand(trashCmd)
+	filesCmd.AddCommand(undeleteCmd)
+	filesCmd.AddCommand(emptyTrashCmd)
+}
@@ -13,5 +13,44 @@ typedef struct Result{
 	char* err;
 } Result;
 
+// CredentialsCallback returns the credentials with the name as JSON, or NULL when they are unknown. The returned
+// string is owned by the caller and must stay valid until the next call.
+typedef char* (*CredentialsCallback)(char* name);
+
+static inline char* callCredentialsCallback(CredentialsCallback cb, char* name) {
+    return cb(name);
+}
+
+// StoreCallbacks implement a store in the bindings. Each function gets the url the store was opened with and returns
+// NULL on success or an error message, "file does not exist" for a missing file. File information is JSON with name,
+// size, modTime (RFC 3339) and isDir. Strings and data returned are owned by the caller and must stay valid until the
+// next call on the same thread.
+typedef struct StoreCallbacks {
+    char* (*readDir)(char* url, char* name, Data* out);
+    char* (*read)(char* url, char* name, long long from, long long to, Data* out);
+    char* (*write)(char* url, char* name, Data data);
+    char* (*stat)(char* url, char* name, Data* out);
+    char* (*remove)(char* url, char* name);
+} StoreCallbacks;
+
+static inline char* callReadDir(StoreCallbacks* cb, char* url, char* name, Data* out) {
+    return cb->readDir(url, name, out);
+}
+
+static inline char* callRead(StoreCallbacks* cb, char* url, char* name, long long from, long long to, Data* out) {
+    return cb->read(url, name, from, to, out);
+}
+
+static inline char* callWrite(StoreCallbacks* cb, char* url, char* name, Data data) {
+    return cb->write(url, name, data);
+}
+
+static inline char* callStat(StoreCallbacks* cb, char* url, char* name, Data* out) {
+    return cb->stat(url, name, out);
+}
+
+static inline char* callRemove(StoreCallbacks* cb, char* url, char* name) {
+    return cb->remove(url, name);
+}
 
 #endif
\ No newline at end of file
@@ -64,6 +64,14 @@ func SetConfigStruct(db *sqlx.DB, domain string, key string, v interface{}) erro
 	return SetConfigValue(db, domain, key, "", 0, data)
 }
 
+func DelConfigValue(db *sqlx.DB, domain string, key string) error {
+	_, err := db.Exec("STASH_DEL_CONFIG_KEY", sqlx.Args{"node": domain, "key": key})
+	if err != nil {
+		return core.Errorw(err, "cannot del config %s/%s: %v", domain, key)
+	}
+	return nil
+}
+
 func DelConfigNode(db *sqlx.DB, domain string) error {
 	_, err := db.Exec("STASH_DEL_CONFIG", sqlx.Args{"node": domain})
 	if err != nil {
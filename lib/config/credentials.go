@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Credentials keeps the store credentials in the config DB, encrypted with the public key of the identity. Each
+// identity has its own credentials, so that users sharing a DB do not see the names of the others
+type Credentials struct {
+	DB       *sqlx.DB
+	Identity *security.Identity
+}
+
+// credentialsKey is the key of credentials in the config DB
+func credentialsKey(id security.ID, name string) string {
+	return fmt.Sprintf("%s/%s", id, name)
+}
+
+func (c Credentials) GetCredentials(name string) (storage.Credentials, bool, error) {
+	var credentials storage.Credentials
+	_, _, data, ok := GetConfigValue(c.DB, CredentialsDomain, credentialsKey(c.Identity.Id, name))
+	if !ok {
+		return credentials, false, nil
+	}
+	data, err := security.EcDecrypt(c.Identity, data)
+	if err != nil {
+		return credentials, false, core.Errorw(err, "cannot decrypt credentials %s with identity %s: %v", name,
+			c.Identity.Id)
+	}
+	err = msgpack.Unmarshal(data, &credentials)
+	if err != nil {
+		return credentials, false, core.Errorw(err, "cannot unmarshal credentials %s: %v", name)
+	}
+	return credentials, true, nil
+}
+
+// SetCredentials saves the credentials in the config DB, encrypted with the public key of the identity
+func SetCredentials(db *sqlx.DB, identity *security.Identity, name string, credentials storage.Credentials) error {
+	data, err := msgpack.Marshal(credentials)
+	if err != nil {
+		return core.Errorw(err, "cannot marshal credentials %s: %v", name)
+	}
+	data, err = security.EcEncrypt(identity.Id, data)
+	if err != nil {
+		return core.Errorw(err, "cannot encrypt credentials %s: %v", name)
+	}
+	return SetConfigValue(db, CredentialsDomain, credentialsKey(identity.Id, name), "", 0, data)
+}
+
+// DelCredentials removes the credentials of the identity from the config DB
+func DelCredentials(db *sqlx.DB, identity *security.Identity, name string) error {
+	return DelConfigValue(db, CredentialsDomain, credentialsKey(identity.Id, name))
+}
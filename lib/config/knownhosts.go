@@ -0,0 +1,17 @@
+package config
+
+import "github.com/stregato/stash/lib/sqlx"
+
+// KnownHosts keeps the SFTP host keys trusted on first use in the config DB
+type KnownHosts struct {
+	DB *sqlx.DB
+}
+
+func (k KnownHosts) GetHostKey(host string) ([]byte, bool) {
+	_, _, key, ok := GetConfigValue(k.DB, KnownHostsDomain, host)
+	return key, ok
+}
+
+func (k KnownHosts) SetHostKey(host string, key []byte) error {
+	return SetConfigValue(k.DB, KnownHostsDomain, host, "", 0, key)
+}
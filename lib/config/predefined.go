@@ -1,8 +1,13 @@
 package config
 
 const (
-	KeystoreDomain   = "keystore"   // KeystoreDomain saves the safe url in the key and the keystore in the value
-	SettingsDomain   = "settings"   // SettingsDomain saves the setting in the key and the value in the value
-	GuardDomain      = "guard"      // GuardDomain saves the url and path in the key and the timestamp in the value
-	GroupChainDomain = "groupchain" // GroupChainDomain saves the safe url in the key and the value in the value
+	KeystoreDomain    = "keystore"    // KeystoreDomain saves the safe url in the key and the keystore in the value
+	SettingsDomain    = "settings"    // SettingsDomain saves the setting in the key and the value in the value
+	GuardDomain       = "guard"       // GuardDomain saves the url and path in the key and the timestamp in the value
+	GroupChainDomain  = "groupchain"  // GroupChainDomain saves the safe url in the key and the value in the value
+	KnownHostsDomain  = "knownhosts"  // KnownHostsDomain saves the SFTP host in the key and its trusted key in the value
+	CredentialsDomain = "credentials" // CredentialsDomain saves the identity and the credentials name in the key and the encrypted credentials in the value
+	PoliciesDomain    = "policies"    // PoliciesDomain saves the safe id in the key and the directory policies in the value
+	PacksDomain       = "packs"       // PacksDomain saves the safe id and the directory hash in the key and the segments read in the value
+	PendingDomain     = "pending"     // PendingDomain saves the safe id and the directory hash in the key and the packed headers not read yet in the value
 )
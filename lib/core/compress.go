@@ -0,0 +1,123 @@
+package core
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms applied before encryption
+const (
+	NoCompression   = "none" // NoCompression disables compression, even when the safe enables it
+	ZstdCompression = "zstd" // ZstdCompression compresses with zstd
+)
+
+// CompressionSample is the amount of data compressed to decide whether the rest is worth compressing
+const CompressionSample = 64 * 1024
+
+// MinCompressionRatio is the maximal ratio between compressed and original size for compression to be applied
+const MinCompressionRatio = 0.9
+
+// the encoder runs on a single goroutine, so that the same input always gives the same output, which resumable
+// uploads rely on
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+
+// IsCompressible compresses a sample of data and tells whether it shrinks enough. Already compressed data, such as
+// images or archives, does not.
+func IsCompressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	if len(sample) > CompressionSample {
+		sample = sample[:CompressionSample]
+	}
+	compressed := zstdEncoder.EncodeAll(sample, nil)
+	return float64(len(compressed)) < float64(len(sample))*MinCompressionRatio
+}
+
+// Compress compresses data with the algorithm when it is compressible. It returns the data and the algorithm actually
+// used, which is empty when the data is left as is.
+func Compress(data []byte, compression string) ([]byte, string) {
+	if compression != ZstdCompression || !IsCompressible(data) {
+		return data, ""
+	}
+	compressed := zstdEncoder.EncodeAll(data, nil)
+	if float64(len(compressed)) >= float64(len(data))*MinCompressionRatio {
+		return data, ""
+	}
+	return compressed, ZstdCompression
+}
+
+// Decompress reverts Compress
+func Decompress(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "", NoCompression:
+		return data, nil
+	case ZstdCompression:
+		data, err := zstdDecoder.DecodeAll(data, nil)
+		if IsErr(err, "cannot decompress data: %v") {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, Errorf("unsupported compression %s", compression)
+}
+
+// compressedTag starts the data of CompressTagged that carries its algorithm. Encodings such as msgpack maps and JSON
+// never start with it, so data without the tag is taken as uncompressed
+const compressedTag = 0
+
+// CompressTagged compresses data like Compress and prepends the algorithm, so that the encryption or the signature of
+// the data covers it as well
+func CompressTagged(data []byte, compression string) []byte {
+	compressed, used := Compress(data, compression)
+	if used == "" && (len(data) == 0 || data[0] != compressedTag) {
+		return data
+	}
+	tagged := append([]byte{compressedTag, byte(len(used))}, used...)
+	return append(tagged, compressed...)
+}
+
+// DecompressTagged reverts CompressTagged
+func DecompressTagged(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != compressedTag {
+		return data, nil
+	}
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return nil, Errorf("invalid tag of compressed data")
+	}
+	return Decompress(data[2+int(data[1]):], string(data[2:2+int(data[1])]))
+}
+
+// CompressStream compresses src into dest with the algorithm
+func CompressStream(dest io.Writer, src io.Reader, compression string) error {
+	if compression != ZstdCompression {
+		return Errorf("unsupported compression %s", compression)
+	}
+	w, err := zstd.NewWriter(dest, zstd.WithEncoderConcurrency(1))
+	if IsErr(err, "cannot create compressor: %v") {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// DecompressReader returns a reader that decompresses src with the algorithm
+func DecompressReader(src io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "", NoCompression:
+		return io.NopCloser(src), nil
+	case ZstdCompression:
+		r, err := zstd.NewReader(src)
+		if IsErr(err, "cannot create decompressor: %v") {
+			return nil, err
+		}
+		return r.IOReadCloser(), nil
+	}
+	return nil, Errorf("unsupported compression %s", compression)
+}
@@ -5,6 +5,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -22,6 +23,18 @@ var ErrNotAuthorized = fmt.Errorf("user is not authorized in the domain")
 var ErrInvalidId = fmt.Errorf("the id is invalid")
 
 var RecentLog []string
+var recentLogLock sync.Mutex
+
+// addRecentLog keeps the last MaxRecentErrors entries of the log
+func addRecentLog(entry string) {
+	recentLogLock.Lock()
+	defer recentLogLock.Unlock()
+	if len(RecentLog) >= MaxRecentErrors {
+		RecentLog = RecentLog[1 : MaxRecentErrors-1]
+	}
+	RecentLog = append(RecentLog, entry)
+}
+
 var MaxRecentErrors = 4096
 var MaxStacktraceOut = 30
 
@@ -65,10 +78,7 @@ func Errorf(format string, args ...interface{}) error {
 	} else {
 		logrus.Error(msg)
 	}
-	if len(RecentLog) >= MaxRecentErrors {
-		RecentLog = RecentLog[1 : MaxRecentErrors-1]
-	}
-	RecentLog = append(RecentLog, fmt.Sprintf("ERRO: %s", msg))
+	addRecentLog(fmt.Sprintf("ERRO: %s", msg))
 	return err
 }
 
@@ -79,10 +89,7 @@ func Errorw(err error, format string, args ...interface{}) error {
 	} else {
 		logrus.Error(msg)
 	}
-	if len(RecentLog) >= MaxRecentErrors {
-		RecentLog = RecentLog[1 : MaxRecentErrors-1]
-	}
-	RecentLog = append(RecentLog, fmt.Sprintf("ERRO: %s", msg))
+	addRecentLog(fmt.Sprintf("ERRO: %s", msg))
 	return err
 }
 
@@ -94,10 +101,7 @@ func IsErr(err error, msg string, args ...interface{}) bool {
 		} else {
 			logrus.Error(msg)
 		}
-		if len(RecentLog) >= MaxRecentErrors {
-			RecentLog = RecentLog[1 : MaxRecentErrors-1]
-		}
-		RecentLog = append(RecentLog, fmt.Sprintf("ERRO: %s", msg))
+		addRecentLog(fmt.Sprintf("ERRO: %s", msg))
 		return true
 	}
 	return false
@@ -111,10 +115,7 @@ func IsWarn(err error, msg string, args ...interface{}) bool {
 		} else {
 			logrus.Warn(msg)
 		}
-		if len(RecentLog) >= MaxRecentErrors {
-			RecentLog = RecentLog[1 : MaxRecentErrors-1]
-		}
-		RecentLog = append(RecentLog, fmt.Sprintf("ERRO: %s", msg))
+		addRecentLog(fmt.Sprintf("ERRO: %s", msg))
 		return true
 	}
 	return false
@@ -21,7 +21,7 @@ func Trace(format string, args ...any) {
 		if ok && details != nil {
 			msg = fmt.Sprintf("%s[%s:%d] - %s", path.Base(details.Name()), filepath.Base(file), no, msg)
 		}
-		RecentLog = append(RecentLog, fmt.Sprintf("INFO: %s", msg))
+		addRecentLog(fmt.Sprintf("INFO: %s", msg))
 		logrus.Info(msg)
 	}
 }
@@ -34,7 +34,7 @@ func Info(format string, args ...any) {
 		if ok && details != nil {
 			msg = fmt.Sprintf("%s[%s:%d] - %s", path.Base(details.Name()), filepath.Base(file), no, msg)
 		}
-		RecentLog = append(RecentLog, fmt.Sprintf("INFO: %s", msg))
+		addRecentLog(fmt.Sprintf("INFO: %s", msg))
 		logrus.Info(msg)
 	}
 }
@@ -47,10 +47,7 @@ func Debug(format string, args ...any) {
 		if ok && details != nil {
 			msg = fmt.Sprintf("%s[%s:%d] - %s", path.Base(details.Name()), filepath.Base(file), no, msg)
 		}
-		if len(RecentLog) >= MaxRecentErrors {
-			RecentLog = RecentLog[1 : MaxRecentErrors-1]
-		}
-		RecentLog = append(RecentLog, fmt.Sprintf("DEBU: %s", msg))
+		addRecentLog(fmt.Sprintf("DEBU: %s", msg))
 		logrus.Debug(msg)
 	}
 }
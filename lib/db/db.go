@@ -7,6 +7,7 @@ import (
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/safe"
 	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
 )
 
 type DB struct {
@@ -36,7 +37,7 @@ func Open(s *safe.Safe, groupName safe.GroupName, ddls DDLs) (DB, error) {
 		return DB{}, err
 	}
 
-	core.Info("Opening database on safe %s with group %s", s.URL, groupName)
+	core.Info("Opening database on safe %s with group %s", storage.Redact(s.URL), groupName)
 
 	return DB{s, nil, nil, groupName, counters}, nil
 }
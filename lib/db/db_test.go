@@ -2,11 +2,14 @@ package db
 
 import (
 	_ "embed"
+	"fmt"
+	"path"
 	"testing"
 
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/safe"
 	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
 
 	"github.com/stregato/stash/lib/sqlx"
 )
@@ -34,11 +37,40 @@ func TestExec(t *testing.T) {
 	err = tx.Commit()
 	core.TestErr(t, err, "cannot commit: %v")
 
+	// a large transaction is compressed when the safe enables compression
+	s.Config.Compression = core.ZstdCompression
+	tx, err = db.Transaction()
+	core.TestErr(t, err, "cannot start transaction: %v")
+	for i := 0; i < 50; i++ {
+		_, err = tx.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": fmt.Sprintf("compressible message %d", i), "cnt": i,
+			"ratio": 0.5, "bin": []byte("compressible data")})
+		core.TestErr(t, err, "cannot insert test data: %v")
+	}
+	err = tx.Commit()
+	core.TestErr(t, err, "cannot commit: %v")
+	ls, err := s.Store.ReadDir(path.Join(DBDir, safe.UserGroup.String()), storage.Filter{})
+	core.TestErr(t, err, "cannot list transactions: %v")
+	var compressed int
+	for _, l := range ls {
+		var stored Transaction
+		err = storage.ReadMsgPack(s.Store, path.Join(DBDir, safe.UserGroup.String(), l.Name()), &stored)
+		core.TestErr(t, err, "cannot read transaction: %v")
+		if stored.Compression == core.ZstdCompression {
+			compressed++
+			// the compression is signed with the updates
+			core.Assert(t, security.Verify(stored.Signer, signedPart(stored), stored.Signature), "invalid signature")
+			stored.Compression = ""
+			core.Assert(t, !security.Verify(stored.Signer, signedPart(stored), stored.Signature),
+				"changed compression is valid")
+		}
+	}
+	core.Assert(t, compressed == 1, "unexpected compressed transactions: %d", compressed)
+
 	_, err = db.Sync()
 	core.TestErr(t, err, "cannot sync: %v")
 
 	db.Safe.DB.GetConnection().Exec("DELETE FROM db_test")
-	db.Safe.DB.GetConnection().Exec("DELETE FROM STASH_STORE_TX")
+	db.Safe.DB.GetConnection().Exec("DELETE FROM mio_tx")
 
 	rows, err := db.Query("SELECT_TEST_DATA", sqlx.Args{})
 	core.TestErr(t, err, "cannot select test data: %v")
@@ -59,6 +91,11 @@ func TestExec(t *testing.T) {
 	err = rows.Scan(&msg, &cnt, &ratio, &bin)
 	core.TestErr(t, err, "cannot scan: %v")
 	core.Assert(t, msg == "hello world", "unexpected msg: %s", msg)
+	count := 1
+	for rows.Next() {
+		count++
+	}
+	core.Assert(t, count == 51, "unexpected number of rows after sync: %d", count)
 	rows.Close()
 
 	rows, err = db.Query("SELECT_TEST_DATA", sqlx.Args{})
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func TestPeers(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	bob := security.NewIdentityMust("bob")
+	carl := security.NewIdentityMust("carl")
+	peers := safe.NewTestPeers(t, "fault://db?err=0.1&partial=0.05&stale=0.3&latency=1ms&retry=10&retryBackoff=1ms",
+		alice, bob, carl)
+
+	var dbs []DB
+	for _, p := range peers {
+		d, err := Open(p, safe.UserGroup, DDLs{1.0: testDdl})
+		core.TestErr(t, err, "cannot open db on %s: %v", p.Identity.Id.Nick())
+		tx, err := d.Transaction()
+		core.TestErr(t, err, "cannot start transaction: %v")
+		_, err = tx.Exec("INSERT_TEST_DATA", sqlx.Args{"msg": p.Identity.Id.Nick(), "cnt": 1, "ratio": 0.5,
+			"bin": []byte{1}})
+		core.TestErr(t, err, "cannot insert test data: %v")
+		err = tx.Commit()
+		core.TestErr(t, err, "cannot commit on %s: %v", p.Identity.Id.Nick())
+		dbs = append(dbs, d)
+	}
+
+	// all the databases converge once the faults stop
+	for _, p := range peers {
+		storage.Unwrap(p.Store).(*storage.Fault).SetEnabled(false)
+		p.ResetTouch(DBDir)
+	}
+	for i, d := range dbs {
+		_, err := d.Sync()
+		core.TestErr(t, err, "cannot sync: %v")
+
+		rows, err := d.Query("SELECT_TEST_DATA", sqlx.Args{})
+		core.TestErr(t, err, "cannot select test data: %v")
+		var cnt int
+		for rows.Next() {
+			cnt++
+		}
+		rows.Close()
+		core.Assert(t, cnt == len(peers), "wrong number of rows on %s: %d", peers[i].Identity.Id.Nick(), cnt)
+
+		// transactions are applied only once
+		peers[i].ResetTouch(DBDir)
+		updates, err := d.Sync()
+		core.TestErr(t, err, "cannot sync: %v")
+		core.Assert(t, len(updates) == 0, "transactions applied twice on %s", peers[i].Identity.Id.Nick())
+		d.Close()
+		peers[i].Close()
+	}
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"path"
+	"sort"
 
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/safe"
@@ -31,7 +32,7 @@ func (d *DB) processTransaction(dir, id string, keys []safe.Key) ([]Update, erro
 		return nil, core.Errorf("wrong group name %s", tx.GroupName)
 	}
 
-	if !security.Verify(tx.Signer, tx.Updates, tx.Signature) {
+	if !security.Verify(tx.Signer, signedPart(tx), tx.Signature) {
 		return nil, core.Errorf("cannot verify transaction %s", id)
 	}
 
@@ -39,6 +40,10 @@ func (d *DB) processTransaction(dir, id string, keys []safe.Key) ([]Update, erro
 	if err != nil {
 		return nil, err
 	}
+	decrypted, err = core.Decompress(decrypted, tx.Compression)
+	if err != nil {
+		return nil, err
+	}
 
 	err = msgpack.Unmarshal(decrypted, &updates)
 	if err != nil {
@@ -107,17 +112,23 @@ func (d *DB) Sync() ([]Update, error) {
 	if err != nil {
 		return nil, err
 	}
+	var newIds []string
 	for _, l := range ls {
 		if l.Name() > lastId {
-			ids = append(ids, l.Name())
+			newIds = append(newIds, l.Name())
 		}
 	}
+	sort.Strings(newIds)
+	ids = append(ids, newIds...)
 
 	if len(ids) == 0 {
 		return nil, nil
 	}
 
 	for _, id := range ids {
+		if id > lastId {
+			lastId = id
+		}
 		if ignores.Contains(id) {
 			continue
 		}
@@ -127,10 +138,9 @@ func (d *DB) Sync() ([]Update, error) {
 			d.Safe.DB.Exec("STASH_STORE_TX", sqlx.Args{"groupName": groupName, "safeID": d.Safe.ID, "kind": "failed", "id": id})
 		}
 		updates = append(updates, u...)
-		lastId = id
 	}
 
-	_, err = d.Safe.DB.Exec("STASH_STORE_TX", sqlx.Args{"groupName": groupName, "safeID": d.Safe.ID, "kind": "last", "lastId": lastId})
+	_, err = d.Safe.DB.Exec("STASH_STORE_TX", sqlx.Args{"groupName": groupName, "safeID": d.Safe.ID, "kind": "last", "id": lastId})
 	if err != nil {
 		return nil, err
 	}
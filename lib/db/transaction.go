@@ -19,15 +19,25 @@ type Update struct {
 }
 
 type Transaction struct {
-	db        *DB
-	tx        *s.Tx
-	log       []Update
-	Updates   []byte         // Updates is a list of Update encoded in msgpack and encrypted
-	Version   float32        // Version is the highest version of the updates
-	GroupName safe.GroupName // GroupName is the name of the group that the transaction is for
-	KeyId     int            // KeyId is the id of the key used to encrypt the transaction
-	Signer    security.ID    // Signer is the id of the user that signed the transaction
-	Signature []byte         // Signature is the signature of the transaction
+	db          *DB
+	tx          *s.Tx
+	log         []Update
+	Updates     []byte         // Updates is a list of Update encoded in msgpack and encrypted
+	Version     float32        // Version is the highest version of the updates
+	GroupName   safe.GroupName // GroupName is the name of the group that the transaction is for
+	KeyId       int            // KeyId is the id of the key used to encrypt the transaction
+	Compression string         // Compression is applied to the updates before encryption
+	Signer      security.ID    // Signer is the id of the user that signed the transaction
+	Signature   []byte         // Signature is the signature of the updates and their compression
+}
+
+// signedPart returns the data that the signature covers. Transactions without compression sign only the updates, like
+// the ones written before compression existed
+func signedPart(t Transaction) []byte {
+	if t.Compression == "" {
+		return t.Updates
+	}
+	return append(append([]byte{}, t.Updates...), "\n"+t.Compression...)
 }
 
 func (sq *DB) Transaction() (*Transaction, error) {
@@ -72,26 +82,26 @@ func (t *Transaction) Commit() error {
 	}
 	lastKey := keys[len(keys)-1]
 
+	data, compression := core.Compress(data, t.db.Safe.Compression(""))
 	encrypted, err := security.EncryptAES(data, lastKey)
 	if err != nil {
 		return err
 	}
-	signature, err := security.Sign(t.db.Safe.Identity, encrypted)
+	transaction := Transaction{
+		Updates:     encrypted,
+		Version:     version,
+		GroupName:   t.db.groupName,
+		KeyId:       len(keys) - 1,
+		Compression: compression,
+		Signer:      t.db.Safe.Identity.Id,
+	}
+	transaction.Signature, err = security.Sign(t.db.Safe.Identity, signedPart(transaction))
 	if err != nil {
 		return err
 	}
 
-	transaction := Transaction{
-		Updates:   encrypted,
-		Version:   version,
-		GroupName: t.db.groupName,
-		KeyId:     len(keys) - 1,
-		Signer:    t.db.Safe.Identity.Id,
-		Signature: signature,
-	}
-
 	id := core.SnowIDString()
-	dest := path.Join(DBDir, t.db.groupName.String(), core.SnowIDString())
+	dest := path.Join(DBDir, t.db.groupName.String(), id)
 	err = storage.WriteMsgPack(t.db.Safe.Store, dest, transaction)
 	if err != nil {
 		return err
@@ -10,11 +10,18 @@ package main
 */
 import "C"
 import (
+	"encoding/base64"
 	"encoding/json"
+	"io"
+	iofs "io/fs"
+	"os"
+	"sort"
 	"strconv"
+	"time"
 	"unsafe"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stregato/stash/lib/config"
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/db"
 	"github.com/stregato/stash/lib/fs"
@@ -22,6 +29,7 @@ import (
 	"github.com/stregato/stash/lib/safe"
 	"github.com/stregato/stash/lib/security"
 	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
 )
 
 func cResult(v any, hnd uint64, err error) C.Result {
@@ -73,6 +81,8 @@ var (
 	dbs_         core.Registry[*db.DB]
 	transactions core.Registry[*db.Transaction]
 	rows         core.Registry[*sqlx.Rows]
+	readers      core.Registry[*fs.Reader]
+	writers      core.Registry[*fs.Writer]
 	messangers   core.Registry[*messanger.Messenger]
 )
 
@@ -99,6 +109,237 @@ func stash_setLogLevel(level *C.char) C.Result {
 	return cResult(nil, 0, nil)
 }
 
+// stash_setCacheDir sets the folder used by stores opened with the cache=true parameter. Mobile applications should
+// use a folder inside their sandbox.
+//
+//export stash_setCacheDir
+func stash_setCacheDir(dir *C.char) C.Result {
+	storage.DefaultCacheDir = C.GoString(dir)
+	return cResult(nil, 0, nil)
+}
+
+// callbackCredentials asks the bindings for the credentials referenced in store urls
+type callbackCredentials struct {
+	cb C.CredentialsCallback
+}
+
+func (c callbackCredentials) GetCredentials(name string) (storage.Credentials, bool, error) {
+	var credentials storage.Credentials
+
+	nameC := C.CString(name)
+	defer C.free(unsafe.Pointer(nameC))
+	res := C.callCredentialsCallback(c.cb, nameC)
+	if res == nil {
+		return credentials, false, nil
+	}
+	err := json.Unmarshal([]byte(C.GoString(res)), &credentials)
+	if err != nil {
+		return credentials, false, core.Errorw(err, "invalid credentials %s from callback: %v", name)
+	}
+	return credentials, true, nil
+}
+
+// stash_setCredentialsCallback sets a function that returns the credentials referenced by name in store urls with the
+// cred parameter. The callback is asked before the other providers; a NULL callback removes it.
+//
+//export stash_setCredentialsCallback
+func stash_setCredentialsCallback(cb C.CredentialsCallback) C.Result {
+	if cb == nil {
+		storage.SetCredentialProvider(storage.CallbackProvider, nil)
+	} else {
+		storage.SetCredentialProvider(storage.CallbackProvider, callbackCredentials{cb})
+	}
+	return cResult(nil, 0, nil)
+}
+
+// stash_setCredentials saves credentials in the database, encrypted with the identity. Store urls reference them by
+// name with the cred parameter.
+//
+//export stash_setCredentials
+func stash_setCredentials(dbH C.ulonglong, identity, name, credentials *C.char) C.Result {
+	var identityG security.Identity
+	var credentialsG storage.Credentials
+
+	err := cInput(nil, identity, &identityG)
+	err = cInput(err, credentials, &credentialsG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	d, err := dbs.Get(uint64(dbH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	err = config.SetCredentials(d, &identityG, C.GoString(name), credentialsG)
+	return cResult(nil, 0, err)
+}
+
+// callbackFileInfo is the information of a file in a store implemented by the bindings
+type callbackFileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// callbackStore is a store implemented by the bindings with callbacks
+type callbackStore struct {
+	url string
+	cb  C.StoreCallbacks
+}
+
+func (c *callbackStore) err(res *C.char, op, name string) error {
+	if res == nil {
+		return nil
+	}
+	msg := C.GoString(res)
+	if msg == os.ErrNotExist.Error() {
+		return os.ErrNotExist
+	}
+	return core.Errorf("cannot %s %s in %s: %s", op, name, c, msg)
+}
+
+func (c *callbackStore) ReadDir(name string, filter storage.Filter) ([]iofs.FileInfo, error) {
+	var out C.Data
+	urlC, nameC := C.CString(c.url), C.CString(name)
+	defer C.free(unsafe.Pointer(urlC))
+	defer C.free(unsafe.Pointer(nameC))
+
+	err := c.err(C.callReadDir(&c.cb, urlC, nameC, &out), "list", name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []callbackFileInfo
+	err = json.Unmarshal(C.GoBytes(out.ptr, C.int(out.len)), &entries)
+	if core.IsErr(err, "invalid list of %s from callback store: %v", name) {
+		return nil, err
+	}
+
+	var infos []iofs.FileInfo
+	for _, e := range entries {
+		info := storage.NewFileInfo(e.Name, e.Size, e.IsDir, e.ModTime)
+		if filter.Match(info) {
+			infos = append(infos, info)
+		}
+	}
+	if filter.MaxResults > 0 && int64(len(infos)) > filter.MaxResults {
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		infos = infos[:filter.MaxResults]
+	}
+	return infos, nil
+}
+
+func (c *callbackStore) Read(name string, rang *storage.Range, dest io.Writer, progress chan int64) error {
+	var out C.Data
+	urlC, nameC := C.CString(c.url), C.CString(name)
+	defer C.free(unsafe.Pointer(urlC))
+	defer C.free(unsafe.Pointer(nameC))
+
+	from, to := int64(0), int64(-1)
+	if rang != nil {
+		from, to = rang.From, rang.To
+	}
+	err := c.err(C.callRead(&c.cb, urlC, nameC, C.longlong(from), C.longlong(to), &out), "read", name)
+	if err != nil {
+		return err
+	}
+	n, err := dest.Write(C.GoBytes(out.ptr, C.int(out.len)))
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress <- int64(n)
+	}
+	return nil
+}
+
+func (c *callbackStore) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	data, err := io.ReadAll(source)
+	if core.IsErr(err, "cannot read source for %s: %v", name) {
+		return err
+	}
+	urlC, nameC := C.CString(c.url), C.CString(name)
+	defer C.free(unsafe.Pointer(urlC))
+	defer C.free(unsafe.Pointer(nameC))
+	ptr := C.CBytes(data)
+	defer C.free(ptr)
+
+	err = c.err(C.callWrite(&c.cb, urlC, nameC, C.Data{ptr, C.size_t(len(data))}), "write", name)
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress <- int64(len(data))
+	}
+	return nil
+}
+
+func (c *callbackStore) Stat(name string) (iofs.FileInfo, error) {
+	var out C.Data
+	urlC, nameC := C.CString(c.url), C.CString(name)
+	defer C.free(unsafe.Pointer(urlC))
+	defer C.free(unsafe.Pointer(nameC))
+
+	err := c.err(C.callStat(&c.cb, urlC, nameC, &out), "stat", name)
+	if err != nil {
+		return nil, err
+	}
+	var e callbackFileInfo
+	err = json.Unmarshal(C.GoBytes(out.ptr, C.int(out.len)), &e)
+	if core.IsErr(err, "invalid stat of %s from callback store: %v", name) {
+		return nil, err
+	}
+	return storage.NewFileInfo(e.Name, e.Size, e.IsDir, e.ModTime), nil
+}
+
+func (c *callbackStore) Delete(name string) error {
+	urlC, nameC := C.CString(c.url), C.CString(name)
+	defer C.free(unsafe.Pointer(urlC))
+	defer C.free(unsafe.Pointer(nameC))
+	return c.err(C.callRemove(&c.cb, urlC, nameC), "delete", name)
+}
+
+func (c *callbackStore) ID() string {
+	return c.url
+}
+
+func (c *callbackStore) Close() error {
+	return nil
+}
+
+func (c *callbackStore) String() string {
+	return storage.Redact(c.url)
+}
+
+func (c *callbackStore) Describe() storage.Description {
+	return storage.Description{}
+}
+
+// stash_registerStore adds a backend for urls with the scheme, implemented by the callbacks. NULL callbacks remove
+// the backend. The wrappers such as retry and cache compose with it, e.g. cache+myscheme://...
+//
+//export stash_registerStore
+func stash_registerStore(scheme *C.char, callbacks *C.StoreCallbacks) C.Result {
+	if callbacks == nil {
+		storage.Register(C.GoString(scheme), nil)
+		return cResult(nil, 0, nil)
+	}
+	cb := *callbacks
+	storage.Register(C.GoString(scheme), func(connectionUrl string, _ storage.OpenOptions) (storage.Store, error) {
+		return &callbackStore{url: connectionUrl, cb: cb}, nil
+	})
+	return cResult(nil, 0, nil)
+}
+
+// stash_getSchemes returns the schemes of the registered backends and wrappers
+//
+//export stash_getSchemes
+func stash_getSchemes() C.Result {
+	backends, wrappers := storage.Schemes()
+	return cResult(map[string][]string{"backends": backends, "wrappers": wrappers}, 0, nil)
+}
+
 //export stash_test
 func stash_test(nick *C.char) C.Result {
 	print(C.GoString(nick))
@@ -281,6 +522,25 @@ func stash_getKeys(safeH C.ulonglong, groupName *C.char, expectedMinimumLenght C
 	return cResult(keys, 0, err)
 }
 
+// stash_scrub checks the consistency of the specified safe and optionally deletes orphans. The function returns a report with the issues found.
+//
+//export stash_scrub
+func stash_scrub(safeH C.ulonglong, options *C.char) C.Result {
+	s, err := safes.Get(uint64(safeH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	var optionsG safe.ScrubOptions
+	err = cInput(err, options, &optionsG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	report, err := s.Scrub(optionsG)
+	return cResult(report, 0, err)
+}
+
 // stash_openFS opens a file system in the specified safe. The function returns a handle to the file system.
 //
 //export stash_openFS
@@ -419,7 +679,119 @@ func stash_getData(fsH C.ulonglong, src, options *C.char) C.Result {
 	return cResult(data, 0, err)
 }
 
-// stash_delete deletes the specified file in the file system.
+// stash_open opens the latest version of the specified file for reading. The function returns the file information and a handle to the reader.
+//
+//export stash_open
+func stash_open(fsH C.ulonglong, path *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	r, err := f.Open(C.GoString(path))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+	return cResult(r.File(), readers.Add(r), nil)
+}
+
+// stash_read reads up to the specified number of bytes from the reader. The function returns the data encoded in base64, which is empty at the end of the file.
+//
+//export stash_read
+func stash_read(readerH C.ulonglong, size C.int) C.Result {
+	r, err := readers.Get(uint64(readerH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	data := make([]byte, int(size))
+	n, err := io.ReadFull(r, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return cResult(base64.StdEncoding.EncodeToString(data[:n]), 0, err)
+}
+
+// stash_seek sets the position of the reader for the next read. Whence is 0 for the start, 1 for the current position and 2 for the end. The function returns the new position.
+//
+//export stash_seek
+func stash_seek(readerH C.ulonglong, offset C.longlong, whence C.int) C.Result {
+	r, err := readers.Get(uint64(readerH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	pos, err := r.Seek(int64(offset), int(whence))
+	return cResult(pos, 0, err)
+}
+
+// stash_closeReader closes the specified reader.
+//
+//export stash_closeReader
+func stash_closeReader(readerH C.ulonglong) C.Result {
+	r, err := readers.Get(uint64(readerH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	err = r.Close()
+	readers.Remove(uint64(readerH))
+	return cResult(nil, 0, err)
+}
+
+// stash_create creates a new version of the specified file, which is uploaded as it is written. The function returns a handle to the writer.
+//
+//export stash_create
+func stash_create(fsH C.ulonglong, path, options *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	var optionsG fs.PutOptions
+	err = cInput(err, options, &optionsG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	w, err := f.Create(C.GoString(path), optionsG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+	return cResult(nil, writers.Add(w), nil)
+}
+
+// stash_write writes the specified data to the writer.
+//
+//export stash_write
+func stash_write(writerH C.ulonglong, data C.Data) C.Result {
+	w, err := writers.Get(uint64(writerH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	_, err = w.Write(C.GoBytes(unsafe.Pointer(data.ptr), C.int(data.len)))
+	return cResult(nil, 0, err)
+}
+
+// stash_closeWriter completes the file of the specified writer. The function returns the file information.
+//
+//export stash_closeWriter
+func stash_closeWriter(writerH C.ulonglong) C.Result {
+	w, err := writers.Get(uint64(writerH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	err = w.Close()
+	writers.Remove(uint64(writerH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+	return cResult(w.File(), 0, nil)
+}
+
+// stash_delete deletes the specified file in the file system, or a directory with all its content.
 //
 //export stash_delete
 func stash_delete(fsH C.ulonglong, path *C.char) C.Result {
@@ -432,6 +804,270 @@ func stash_delete(fsH C.ulonglong, path *C.char) C.Result {
 	return cResult(nil, 0, err)
 }
 
+// stash_deleteVersion deletes the specified version of a file in the file system.
+//
+//export stash_deleteVersion
+func stash_deleteVersion(fsH C.ulonglong, path *C.char, version C.ulonglong) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	err = f.DeleteVersion(C.GoString(path), fs.FileID(version))
+	return cResult(nil, 0, err)
+}
+
+// stash_versions returns the versions of the specified file in the file system, the latest first.
+//
+//export stash_versions
+func stash_versions(fsH C.ulonglong, path *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	versions, err := f.Versions(C.GoString(path))
+	return cResult(versions, 0, err)
+}
+
+// stash_restore makes a copy of the specified version the latest version of the file. The function returns the file information.
+//
+//export stash_restore
+func stash_restore(fsH C.ulonglong, path *C.char, version C.ulonglong) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	file, err := f.Restore(C.GoString(path), fs.FileID(version))
+	return cResult(file, 0, err)
+}
+
+// stash_prune deletes the versions of the specified file that the retention does not keep. The function returns the number of deleted versions.
+//
+//export stash_prune
+func stash_prune(fsH C.ulonglong, path, retention *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	var retentionG fs.Retention
+	err = cInput(err, retention, &retentionG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	deleted, err := f.Prune(C.GoString(path), retentionG)
+	return cResult(deleted, 0, err)
+}
+
+// stash_listTrash returns the deleted files that can be restored from the trash.
+//
+//export stash_listTrash
+func stash_listTrash(fsH C.ulonglong) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	items, err := f.ListTrash()
+	return cResult(items, 0, err)
+}
+
+// stash_undelete restores the file with the specified id from the trash. The function returns the file information.
+//
+//export stash_undelete
+func stash_undelete(fsH C.ulonglong, id C.ulonglong) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	file, err := f.Undelete(fs.FileID(id))
+	return cResult(file, 0, err)
+}
+
+// stash_emptyTrash deletes permanently the files in the trash. The function returns the number of deleted files.
+//
+//export stash_emptyTrash
+func stash_emptyTrash(fsH C.ulonglong) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	deleted, err := f.EmptyTrash()
+	return cResult(deleted, 0, err)
+}
+
+// stash_collectChunks deletes the chunks of deduplicated files that no file references. The function returns the number of deleted chunks.
+//
+//export stash_collectChunks
+func stash_collectChunks(fsH C.ulonglong) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	deleted, err := f.CollectChunks()
+	return cResult(deleted, 0, err)
+}
+
+// stash_mkdir creates a directory in the file system, which exists also when empty. The function returns the directory information.
+//
+//export stash_mkdir
+func stash_mkdir(fsH C.ulonglong, path *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	dir, err := f.Mkdir(C.GoString(path))
+	return cResult(dir, 0, err)
+}
+
+// stash_rmdir removes an empty directory in the file system.
+//
+//export stash_rmdir
+func stash_rmdir(fsH C.ulonglong, path *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	err = f.Rmdir(C.GoString(path))
+	return cResult(nil, 0, err)
+}
+
+// stash_move moves a file or a directory with all its content in the file system.
+//
+//export stash_move
+func stash_move(fsH C.ulonglong, oldPath, newPath *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	err = f.Move(C.GoString(oldPath), C.GoString(newPath))
+	return cResult(nil, 0, err)
+}
+
+// stash_syncFolder synchronizes a local directory with a directory in the file system once, according to the policy. The function returns the changes.
+//
+//export stash_syncFolder
+func stash_syncFolder(fsH C.ulonglong, localDir, remoteDir, policy *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	var policyG fs.SyncPolicy
+	err = cInput(err, policy, &policyG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	result, err := f.Sync(C.GoString(localDir), C.GoString(remoteDir), policyG)
+	return cResult(result, 0, err)
+}
+
+// stash_setGroup changes the group of the specified file, with all its versions, or directory. The function returns the updated file.
+//
+//export stash_setGroup
+func stash_setGroup(fsH C.ulonglong, path, groupName, options *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	var optionsG fs.SetGroupOptions
+	err = cInput(err, options, &optionsG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	file, err := f.SetGroup(C.GoString(path), safe.GroupName(C.GoString(groupName)), optionsG)
+	return cResult(file, 0, err)
+}
+
+// stash_setGroupTree changes the group of the specified directory with all its content. The function returns the number of versions written again.
+//
+//export stash_setGroupTree
+func stash_setGroupTree(fsH C.ulonglong, dir, groupName, options *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	var optionsG fs.SetGroupOptions
+	err = cInput(err, options, &optionsG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	count, err := f.SetGroupTree(C.GoString(dir), safe.GroupName(C.GoString(groupName)), optionsG)
+	return cResult(count, 0, err)
+}
+
+// stash_setPolicy signs and stores the policy of a directory. Only administrators can set policies.
+//
+//export stash_setPolicy
+func stash_setPolicy(fsH C.ulonglong, policy *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	var policyG fs.DirPolicy
+	err = cInput(err, policy, &policyG)
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	err = f.SetPolicy(policyG)
+	return cResult(nil, 0, err)
+}
+
+// stash_deletePolicy removes the policy of the specified directory.
+//
+//export stash_deletePolicy
+func stash_deletePolicy(fsH C.ulonglong, dir *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	err = f.DeletePolicy(C.GoString(dir))
+	return cResult(nil, 0, err)
+}
+
+// stash_policies returns the policies of the directories in the file system.
+//
+//export stash_policies
+func stash_policies(fsH C.ulonglong) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	policies, err := f.Policies()
+	return cResult(policies, 0, err)
+}
+
+// stash_policyOf returns the rules that apply to the specified directory.
+//
+//export stash_policyOf
+func stash_policyOf(fsH C.ulonglong, dir *C.char) C.Result {
+	f, err := fss.Get(uint64(fsH))
+	if err != nil {
+		return cResult(nil, 0, err)
+	}
+
+	policy, err := f.PolicyOf(C.GoString(dir))
+	return cResult(policy, 0, err)
+}
+
 // stash_rename renames the specified file in the file system.
 //
 //export stash_rename
@@ -6,110 +6,122 @@ import (
 
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
 )
 
-var triggerAsync = make(chan FileID, 16)
+// AsyncInterval is the period between two retries of the pending async operations
+var AsyncInterval = 5 * time.Second
+
+// uploadLock serializes the async operations, since different file systems may share the same safe
 var uploadLock sync.Mutex
-var activeUploads = make(map[*FileSystem]*time.Timer)
 
 func (fs *FileSystem) HasPutCompleted(id FileID) bool {
 	err := fs.S.DB.QueryRow("STASH_GET_FILE_ASYNC", sqlx.Args{"id": id, "safeID": fs.S.ID})
 	return err == sqlx.ErrNoRows
 }
 
+// triggerAsync starts an async operation without waiting for the next period. When the job is busy, the operation
+// runs at the next period.
+func (fs *FileSystem) triggerAsync(id FileID) {
+	select {
+	case fs.trigger <- id:
+	default:
+	}
+}
+
+// startUploadJob runs the pending async operations, including the ones interrupted by a previous run, until the file
+// system is closed. Interrupted uploads continue from the last part saved.
 func (fs *FileSystem) startUploadJob() {
-	uploadLock.Lock()
-	timer := time.NewTimer(time.Duration(5) * time.Second)
-	activeUploads[fs] = timer
-	uploadLock.Unlock()
+	defer fs.job.Done()
+	ticker := time.NewTicker(AsyncInterval)
+	defer ticker.Stop()
+
+	fs.runPendingAsync()
 	for {
-		var cleanup []string
 		select {
-		case _, ok := <-timer.C:
-			if !ok {
-				delete(activeUploads, fs)
-				return
-			}
-			uploadLock.Lock()
-
-			rows, err := fs.S.DB.Query("STASH_GET_FILES_ASYNC", sqlx.Args{"safeID": fs.S.ID})
-			if err != nil {
-				core.Info("cannot get files async: %v", err)
-				continue
-			}
+		case <-fs.stop:
+			return
+		case <-ticker.C:
+			fs.runPendingAsync()
+		case id := <-fs.trigger:
+			fs.runAsync(id)
+		}
+	}
+}
 
-			for rows.Next() {
-				var (
-					id        uint64
-					file      File
-					data      []byte
-					deleteSrc bool
-					localCopy string
-					operation string
-				)
-				err := rows.Scan(&id, &file, &data, &deleteSrc, &localCopy, &operation)
-				if err != nil {
-					core.Info("cannot scan file async: %v", err)
-					continue
-				}
-				switch operation {
-				case "put":
-					err = fs.putSync(file, localCopy, data, deleteSrc)
-				case "get":
-					err = fs.getSync(file, localCopy, nil)
-				}
-				if err != nil {
-					core.Info("cannot put file async: %v", err)
-					continue
-				}
-				cleanup = append(cleanup, file.ID.String())
-			}
-			rows.Close()
-		case id := <-triggerAsync:
-			var (
-				file      File
-				data      []byte
-				deleteSrc bool
-				localCopy string
-				operation string
-			)
-			uploadLock.Lock()
-			err := fs.S.DB.QueryRow("STASH_GET_FILE_ASYNC", sqlx.Args{"id": id, "safeID": fs.S.ID},
-				&file, &data, &deleteSrc, &localCopy, &operation)
-			if err != nil {
-				core.Info("cannot get file async: %v", err)
-				continue
-			}
-			switch operation {
-			case "put":
-				err = fs.putSync(file, localCopy, data, deleteSrc)
-			case "get":
-				err = fs.getSync(file, localCopy, nil)
-			}
-			if err != nil {
-				core.Info("cannot put file async: %v", err)
-				continue
-			}
-			cleanup = append(cleanup, file.ID.String())
+func (fs *FileSystem) runPendingAsync() {
+	rows, err := fs.S.DB.Query("STASH_GET_FILES_ASYNC", sqlx.Args{"safeID": fs.S.ID})
+	if core.IsErr(err, "cannot get files async: %v") {
+		return
+	}
+	var ids []FileID
+	for rows.Next() {
+		var (
+			id        FileID
+			file      File
+			data      []byte
+			deleteSrc bool
+			localCopy string
+			operation string
+			upload    storage.Upload
+		)
+		err := rows.Scan(&id, &file, &data, &deleteSrc, &localCopy, &operation, &upload)
+		if !core.IsErr(err, "cannot scan file async: %v") {
+			ids = append(ids, id)
 		}
+	}
+	rows.Close()
 
-		for _, id := range cleanup {
-			_, err := fs.S.DB.Exec("STASH_DEL_FILE_ASYNC", sqlx.Args{"id": id, "safeID": fs.S.ID})
-			if err != nil {
-				core.Info("cannot delete file async: %v", err)
-				continue
-			}
+	for _, id := range ids {
+		select {
+		case <-fs.stop:
+			return
+		default:
+			fs.runAsync(id)
 		}
-		uploadLock.Unlock()
 	}
 }
 
-func (fs *FileSystem) stopUploadJob() {
+// runAsync executes an async operation and removes it when it succeeds. The operation is read again under the lock,
+// since another job may have completed it already.
+func (fs *FileSystem) runAsync(id FileID) {
+	var (
+		file      File
+		data      []byte
+		deleteSrc bool
+		localCopy string
+		operation string
+		upload    storage.Upload
+	)
 	uploadLock.Lock()
-	timer, ok := activeUploads[fs]
-	if ok {
-		timer.Stop()
-		delete(activeUploads, fs)
+	defer uploadLock.Unlock()
+
+	err := fs.S.DB.QueryRow("STASH_GET_FILE_ASYNC", sqlx.Args{"id": id, "safeID": fs.S.ID},
+		&file, &data, &deleteSrc, &localCopy, &operation, &upload)
+	if err == sqlx.ErrNoRows || core.IsErr(err, "cannot get file async %s: %v", id) {
+		return
+	}
+
+	switch operation {
+	case "put":
+		save := func(u storage.Upload) error {
+			_, err := fs.S.DB.Exec("STASH_SET_FILE_ASYNC_UPLOAD", sqlx.Args{"id": id, "safeID": fs.S.ID, "upload": u})
+			return err
+		}
+		_, err = fs.putSync(file, localCopy, data, deleteSrc, &upload, save)
+	case "get":
+		err = fs.getSync(file, localCopy, nil, nil)
 	}
-	uploadLock.Unlock()
+	if core.IsErr(err, "cannot %s file %s async: %v", operation, id) {
+		return
+	}
+
+	_, err = fs.S.DB.Exec("STASH_DEL_FILE_ASYNC", sqlx.Args{"id": id, "safeID": fs.S.ID})
+	core.IsErr(err, "cannot delete file async %s: %v", id)
+}
+
+// stopUploadJob ends the async job and waits for the operation in progress
+func (fs *FileSystem) stopUploadJob() {
+	fs.stopOnce.Do(func() { close(fs.stop) })
+	fs.job.Wait()
 }
@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math/bits"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ChunksDir holds the chunks of deduplicated bodies, named by their hash keyed with the group key
+var ChunksDir = path.Join(FSDir, "chunks")
+
+var (
+	ChunkMinSize = 256 * 1024      // ChunkMinSize is the minimal size of a chunk, except the last one
+	ChunkAvgSize = 1024 * 1024     // ChunkAvgSize is the expected size of a chunk
+	ChunkMaxSize = 4 * 1024 * 1024 // ChunkMaxSize is the maximal size of a chunk
+
+	// ChunkGracePeriod protects recent chunks from garbage collection, since a put writes the chunks before the header
+	// that references them
+	ChunkGracePeriod = 24 * time.Hour
+)
+
+// Chunk is a part of a deduplicated body
+type Chunk struct {
+	Hash string `json:"hash"` // Hash is the keyed hash of the content and the name of the chunk
+	Size int64  `json:"size"` // Size is the size of the content
+}
+
+// chunkCompressions are the compressions of stored chunks, recorded in their first byte, since a chunk is shared by
+// files with different compression settings
+var chunkCompressions = []string{"", core.ZstdCompression}
+
+// Manifest lists the chunks of a deduplicated body
+type Manifest struct {
+	KeyID  int     `json:"keyId"`  // KeyID is the group key used for the hashes and the encryption of the chunks
+	Chunks []Chunk `json:"chunks"` // Chunks are the parts of the body in order
+}
+
+// gear is the table of random values of the FastCDC rolling hash. It is generated with splitmix64 from a fixed seed,
+// since the chunk boundaries, and therefore deduplication, depend on it.
+var gear = func() [256]uint64 {
+	var g [256]uint64
+	x := uint64(0x5374617368434443)
+	for i := range g {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		g[i] = z ^ (z >> 31)
+	}
+	return g
+}()
+
+// cutPoint returns the length of the next chunk in data with FastCDC. Before the average size a stricter mask makes a
+// cut less likely and after it a looser one makes it more likely, so that chunk sizes stay close to the average.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= ChunkMinSize {
+		return n
+	}
+	if n > ChunkMaxSize {
+		n = ChunkMaxSize
+	}
+	normal := ChunkAvgSize
+	if normal > n {
+		normal = n
+	}
+
+	avgBits := bits.Len(uint(ChunkAvgSize)) - 1
+	maskS := ^uint64(0) << (64 - avgBits - 2)
+	maskL := ^uint64(0) << (64 - avgBits + 2)
+
+	var fp uint64
+	i := ChunkMinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker splits a stream in content-defined chunks
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, ChunkMaxSize)}
+}
+
+// next returns the next chunk or io.EOF at the end of the stream. The chunk is valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	for !c.eof && c.n < len(c.buf) {
+		m, err := c.r.Read(c.buf[c.n:])
+		c.n += m
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := cutPoint(c.buf[:c.n])
+	chunk := append([]byte(nil), c.buf[:cut]...)
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
+
+// chunkHash returns the hash of the content keyed with the group key, so that the name of a chunk does not reveal its
+// content to users outside the group
+func chunkHash(key safe.Key, data []byte) (string, error) {
+	h, err := blake2b.New256(key)
+	if core.IsErr(err, "cannot create chunk hash: %v") {
+		return "", err
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChunks splits the source in chunks and writes the ones that are not in the store yet. Chunks that exist but are
+// close to the end of the grace period are written again, so that a concurrent garbage collection keeps them.
+func writeChunks(s *safe.Safe, src io.Reader, file File) (Manifest, error) {
+	keys, err := s.GetKeys(file.GroupName, 0)
+	if err != nil {
+		return Manifest{}, err
+	}
+	manifest := Manifest{KeyID: len(keys) - 1}
+	key := keys[manifest.KeyID]
+
+	var written, reused int
+	c := newChunker(src)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Manifest{}, err
+		}
+
+		hash, err := chunkHash(key, data)
+		if err != nil {
+			return Manifest{}, err
+		}
+		chunk := Chunk{Hash: hash, Size: int64(len(data))}
+		name := path.Join(ChunksDir, hash)
+
+		manifest.Chunks = append(manifest.Chunks, chunk)
+		stat, err := s.Store.Stat(name)
+		if err == nil && core.Since(stat.ModTime()) < ChunkGracePeriod/2 {
+			reused++
+			continue
+		}
+
+		data, compression := core.Compress(data, file.Compression)
+		data = append([]byte{byte(slices.Index(chunkCompressions, compression))}, data...)
+		data, err = security.EncryptAES(data, key)
+		if err != nil {
+			return Manifest{}, err
+		}
+		err = storage.WriteFile(s.Store, name, data)
+		if err != nil {
+			return Manifest{}, err
+		}
+		written++
+	}
+	core.Info("body of %s split in %d chunks, %d written and %d reused", file.ID, len(manifest.Chunks), written,
+		reused)
+	return manifest, nil
+}
+
+// readChunks writes the content of the chunks in the range to dest. Only the chunks that overlap the range are read.
+func readChunks(s *safe.Safe, file File, dest io.Writer, rang *storage.Range) error {
+	keys, err := s.GetKeys(file.GroupName, file.Manifest.KeyID+1)
+	if err != nil {
+		return err
+	}
+	if file.Manifest.KeyID >= len(keys) {
+		return core.Errorf("invalid key id %d for group %s", file.Manifest.KeyID, file.GroupName)
+	}
+	key := keys[file.Manifest.KeyID]
+
+	from, to := int64(0), int64(file.Size)
+	if rang != nil {
+		from, to = rang.From, rang.To
+	}
+
+	var offset int64
+	for _, chunk := range file.Manifest.Chunks {
+		start, end := offset, offset+chunk.Size
+		offset = end
+		if end <= from || start >= to {
+			continue
+		}
+
+		var b bytes.Buffer
+		err := s.Store.Read(path.Join(ChunksDir, chunk.Hash), nil, &b, nil)
+		if err != nil {
+			return core.Errorw(err, "cannot read chunk %s of %s: %v", chunk.Hash, file.ID)
+		}
+		data, err := security.DecryptAES(b.Bytes(), key)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 || int(data[0]) >= len(chunkCompressions) {
+			return core.Errorf("invalid chunk %s of %s", chunk.Hash, file.ID)
+		}
+		data, err = core.Decompress(data[1:], chunkCompressions[data[0]])
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != chunk.Size {
+			return core.Errorf("chunk %s of %s has size %d instead of %d", chunk.Hash, file.ID, len(data), chunk.Size)
+		}
+
+		data = data[max(from-start, 0):min(to-start, chunk.Size)]
+		_, err = dest.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollectChunks deletes the chunks that no header references and that are older than ChunkGracePeriod. It reads all
+// the headers, so it fails when the user cannot decrypt some of them, since their chunks would be lost.
+func (fs *FileSystem) CollectChunks() (int, error) {
+	referenced := core.Set[string]{}
+	err := walkHeaders(fs.S, func(name string, f File, err error) error {
+		if err != nil {
+			return core.Errorw(err, "cannot read header %s, chunks are not collected: %v", name)
+		}
+		for _, chunk := range f.Manifest.Chunks {
+			referenced.Add(chunk.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	chunks, err := fs.S.Store.ReadDir(ChunksDir, storage.Filter{OnlyFiles: true})
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	var deleted int
+	for _, chunk := range chunks {
+		if referenced.Contains(chunk.Name()) || core.Since(chunk.ModTime()) < ChunkGracePeriod {
+			continue
+		}
+		err = fs.S.Store.Delete(path.Join(ChunksDir, chunk.Name()))
+		if core.IsErr(err, "cannot delete chunk %s: %v", chunk.Name()) {
+			continue
+		}
+		deleted++
+	}
+	core.Info("collected %d of %d chunks, %d referenced", deleted, len(chunks), len(referenced))
+	return deleted, nil
+}
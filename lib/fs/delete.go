@@ -1,38 +1,103 @@
 package fs
 
 import (
+	"os"
 	"path"
 
-	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/sqlx"
 )
 
+// Delete removes all the versions of a file, or a directory with all the versions of its files. When the trash is
+// enabled in the safe config, the files are moved to the trash.
 func (fs *FileSystem) Delete(name string) error {
 	file, err := fs.Stat(name)
 	if err != nil {
 		return err
 	}
-
-	err = fs.S.Store.Delete(path.Join(HeadersDir, hashDir(file.Dir), file.ID.String()))
+	r := removals{}
+	if file.IsDir {
+		err = fs.deleteTree(name, r)
+	} else {
+		err = fs.deleteVersions(name, r)
+	}
+	err = r.write(fs.S, err)
 	if err != nil {
 		return err
 	}
+	return fs.purgeExpired()
+}
 
-	err = fs.S.Store.Delete(path.Join(DataDir, file.ID.String()))
+// DeleteVersion removes a version of a file, so that the previous version takes its place when it is the latest.
+// When the trash is enabled in the safe config, the version is moved to the trash.
+func (fs *FileSystem) DeleteVersion(name string, version FileID) error {
+	file, err := fs.StatVersion(name, version)
+	if err != nil {
+		return err
+	}
+	r := removals{}
+	err = r.write(fs.S, fs.removeVersion(file, file.ID, r))
 	if err != nil {
 		return err
 	}
+	return fs.purgeExpired()
+}
 
-	_, err = fs.S.DB.Exec("STASH_DELETE_FILE", sqlx.Args{"safeID": fs.S.ID, "id": file.ID.Uint64()})
+// deleteVersions removes all the versions of a file, since the previous version would otherwise take its place
+func (fs *FileSystem) deleteVersions(name string, r removals) error {
+	versions, err := fs.Versions(name)
 	if err != nil {
 		return err
 	}
+	if len(versions) == 0 {
+		return os.ErrNotExist
+	}
+	for _, v := range versions {
+		err = fs.removeVersion(v, versions[0].ID, r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeVersion deletes a version or, when the trash is enabled in the safe config, moves it to the trash with the
+// latest version deleted in the same operation
+func (fs *FileSystem) removeVersion(file File, latest FileID, r removals) error {
+	if fs.S.Config.TrashDays > 0 {
+		return fs.trashVersion(file, latest, r)
+	}
+	return fs.deleteVersion(file, r)
+}
+
+// purgeExpired removes the files in the trash older than the retention, when the trash is enabled
+func (fs *FileSystem) purgeExpired() error {
+	if fs.S.Config.TrashDays == 0 {
+		return nil
+	}
+	_, err := fs.purgeTrash(false)
+	return err
+}
 
-	dir := core.Dir(file.Dir)
-	_, err = fs.S.DB.Exec("STASH_DELETE_DIR", sqlx.Args{"safeID": fs.S.ID, "dir": dir})
+// deleteVersion removes the header and the body of a version of a file
+func (fs *FileSystem) deleteVersion(file File, r removals) error {
+	err := r.deleteHeader(fs.S, file.Dir, file.ID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// the chunks of a deduplicated body may be shared and are removed by CollectChunks
+	if !file.Dedup {
+		err = fs.S.Store.Delete(path.Join(DataDir, file.ID.String()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return fs.deleteFromDB(file)
+}
+
+// deleteFromDB removes a version from the local DB. Its directory stays until Rmdir or Delete removes it.
+func (fs *FileSystem) deleteFromDB(file File) error {
+	_, err := fs.S.DB.Exec("STASH_DELETE_FILE", sqlx.Args{"safeID": fs.S.ID, "id": file.ID.Uint64()})
+	return err
 }
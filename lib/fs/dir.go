@@ -0,0 +1,244 @@
+package fs
+
+import (
+	"hash/fnv"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/sqlx"
+)
+
+// dirID is the ID of the header of a directory. It depends only on the path, so that users creating the same
+// directory write the same header.
+func dirID(dir string) FileID {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(dir))
+	return FileID(hasher.Sum64())
+}
+
+// touchDirs marks a directory and its ancestors as updated, so that other users sync their headers
+func (fs *FileSystem) touchDirs(dir string) {
+	for dir != "" {
+		fs.S.Touch(HeadersDir, hashDir(dir))
+		dir = core.Dir(dir)
+	}
+}
+
+// Mkdir creates a directory with an encrypted header, so that it exists also when it is empty
+func (fs *FileSystem) Mkdir(name string) (File, error) {
+	dir, base := core.SplitPath(name)
+	if base == "" {
+		return File{}, core.Errorf("invalid directory name %s", name)
+	}
+	file, err := fs.Stat(name)
+	if err == nil && !file.IsDir {
+		return File{}, os.ErrExist
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return File{}, err
+	}
+	return fs.writeDir(dir, base, "")
+}
+
+// writeDir writes the header of a directory and adds it to the DB. Without a group, the directory takes the one of its
+// parent.
+func (fs *FileSystem) writeDir(dir, name string, groupName safe.GroupName) (File, error) {
+	var err error
+	if groupName == "" {
+		groupName, err = fs.calculateGroup(dir)
+		if err != nil {
+			return File{}, err
+		}
+	}
+	file := File{
+		ID:        dirID(path.Join(dir, name)),
+		Dir:       dir,
+		Name:      name,
+		IsDir:     true,
+		GroupName: groupName,
+		Creator:   fs.S.Identity.Id,
+		ModTime:   core.Now(),
+	}
+	_, err = writeHeader(fs.S, file)
+	if err != nil {
+		return File{}, err
+	}
+	err = writeFileToDB(fs.S, file)
+	if err != nil {
+		return File{}, err
+	}
+	fs.touchDirs(dir)
+	core.Info("created dir %s", file.Path())
+	return file, nil
+}
+
+// removeDir deletes the header of a directory, when it has one, and its row in the DB
+func (fs *FileSystem) removeDir(name string, r removals) error {
+	dir, base := core.SplitPath(name)
+	err := r.deleteHeader(fs.S, dir, dirID(name))
+	if err != nil {
+		return err
+	}
+	_, err = fs.S.DB.Exec("STASH_DELETE_DIR_ENTRY", sqlx.Args{"safeID": fs.S.ID, "dir": dir, "name": base})
+	if err != nil {
+		return err
+	}
+	fs.touchDirs(dir)
+	return nil
+}
+
+// Rmdir removes an empty directory
+func (fs *FileSystem) Rmdir(name string) error {
+	file, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !file.IsDir {
+		return core.Errorf("ErrNotDir: %s is not a directory", name)
+	}
+	files, err := fs.List(name, ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name != "" {
+			return core.Errorf("ErrNotEmpty: directory %s is not empty", name)
+		}
+	}
+	r := removals{}
+	return r.write(fs.S, fs.removeDir(name, r))
+}
+
+// walkTree calls fn on all the versions of the files in a directory and its subdirectories. It returns the
+// directories, each before its subdirectories.
+func (fs *FileSystem) walkTree(dir string, fn func(file File) error) ([]string, error) {
+	dirs := []string{dir}
+	for i := 0; i < len(dirs); i++ {
+		err := syncHeaders(fs.S, dirs[i])
+		if err != nil {
+			return nil, err
+		}
+		files, err := searchFiles(fs.S, dirs[i], time.Time{}, time.Time{}, "", "", "", "", 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			switch {
+			case f.Name == "":
+			case f.IsDir:
+				dirs = append(dirs, path.Join(dirs[i], f.Name))
+			default:
+				err = fn(f)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// deleteTree deletes, or moves to the trash, all the versions of the files in a directory and its subdirectories
+func (fs *FileSystem) deleteTree(name string, r removals) error {
+	var files []File
+	dirs, err := fs.walkTree(name, func(file File) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	latest := map[string]FileID{}
+	for _, file := range files {
+		latest[file.Path()] = max(latest[file.Path()], file.ID)
+	}
+	for _, file := range files {
+		err = fs.removeVersion(file, latest[file.Path()], r)
+		if err != nil {
+			return err
+		}
+	}
+	slices.Reverse(dirs)
+	for _, dir := range dirs {
+		err = fs.removeDir(dir, r)
+		if err != nil {
+			return err
+		}
+	}
+	core.Info("deleted %s with %d files and %d directories", name, len(files), len(dirs))
+	return nil
+}
+
+// Move moves a file or a directory with all its content. The headers of the content are written again under the
+// buckets of the new directories. A moved directory keeps its group, so the content is encrypted again only when
+// the directory had no group and the destination has a different one.
+func (fs *FileSystem) Move(old, new string) error {
+	file, err := fs.Stat(old)
+	if err != nil {
+		return err
+	}
+	if !file.IsDir {
+		_, err = fs.Rename(old, new)
+		return err
+	}
+
+	if new == old || strings.HasPrefix(new, old+"/") {
+		return core.Errorf("cannot move %s into itself", old)
+	}
+	_, err = fs.Stat(new)
+	if err == nil {
+		return os.ErrExist
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	rehome := func(dir string) string {
+		return path.Join(new, strings.TrimPrefix(dir, old))
+	}
+	var files []File
+	dirs, err := fs.walkTree(old, func(file File) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the directories are written first, so that the files find the group of their new directory
+	for _, dir := range dirs {
+		groupName, err := fs.ownGroup(dir)
+		if err != nil {
+			return err
+		}
+		parent, name := core.SplitPath(rehome(dir))
+		_, err = fs.writeDir(parent, name, groupName)
+		if err != nil {
+			return err
+		}
+	}
+	r := removals{}
+	for _, file := range files {
+		_, err = fs.moveVersion(file, rehome(file.Dir), file.Name, r)
+		if err != nil {
+			return r.write(fs.S, err)
+		}
+	}
+	slices.Reverse(dirs)
+	for _, dir := range dirs {
+		err = fs.removeDir(dir, r)
+		if err != nil {
+			return r.write(fs.S, err)
+		}
+	}
+	err = r.write(fs.S, nil)
+	if err != nil {
+		return err
+	}
+	core.Info("moved %s to %s with %d files and %d directories", old, new, len(files), len(dirs))
+	return nil
+}
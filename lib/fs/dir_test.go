@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+)
+
+func TestDirs(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	_, err = f.Mkdir("a/empty")
+	core.TestErr(t, err, "cannot create dir: %v")
+	file, err := f.Stat("a/empty")
+	core.TestErr(t, err, "cannot stat dir: %v")
+	core.Assert(t, file.IsDir, "dir not found")
+
+	// the directory header is synced to a fresh DB
+	_, err = s.DB.Exec("STASH_DELETE_DIR_ENTRY", map[string]any{"safeID": s.ID, "dir": "a", "name": "empty"})
+	core.TestErr(t, err, "cannot delete dir row: %v")
+	err = syncHeaders(s, "a")
+	core.TestErr(t, err, "cannot sync headers: %v")
+	_, err = f.Stat("a/empty")
+	core.TestErr(t, err, "dir not restored from its header: %v")
+
+	for _, name := range []string{"a/x", "a/b/y", "a/b/c/z"} {
+		_, err = f.PutData(name, []byte(name), PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+	}
+	err = f.Rmdir("a/b")
+	core.Assert(t, err != nil, "non empty dir removed")
+
+	err = f.Move("a", "d/e")
+	core.TestErr(t, err, "cannot move dir: %v")
+	_, err = f.Stat("a/b/y")
+	core.Assert(t, err != nil, "file still in the old dir")
+	data, err := f.GetData("d/e/b/c/z", GetOptions{})
+	core.TestErr(t, err, "cannot get moved file: %v")
+	core.Assert(t, string(data) == "a/b/c/z", "unexpected data: %s", data)
+	file, err = f.Stat("d/e/empty")
+	core.TestErr(t, err, "empty dir not moved: %v")
+	core.Assert(t, file.IsDir, "moved dir is not a dir")
+
+	err = f.Rmdir("d/e/empty")
+	core.TestErr(t, err, "cannot remove empty dir: %v")
+	_, err = f.Stat("d/e/empty")
+	core.Assert(t, err != nil, "removed dir still exists")
+
+	err = f.Delete("d/e/b")
+	core.TestErr(t, err, "cannot delete dir: %v")
+	_, err = f.Stat("d/e/b/y")
+	core.Assert(t, err != nil, "file in deleted dir still exists")
+	files, err := f.List("d/e", ListOptions{})
+	core.TestErr(t, err, "cannot list dir: %v")
+	core.Assert(t, len(files) == 1 && files[0].Name == "x", "unexpected files: %v", files)
+
+	report, err := s.Scrub(safe.ScrubOptions{})
+	core.TestErr(t, err, "cannot scrub: %v")
+	core.Assert(t, len(report.Issues) == 0, "unexpected issues: %v", report.Issues)
+}
+
+func TestMoveFailure(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	bob := security.NewIdentityMust("bob")
+	for seed := 1; seed <= 3; seed++ {
+		peers := safe.NewTestPeers(t, fmt.Sprintf("fault://move-failure-%d", seed), alice, bob)
+		fa, err := Open(peers[0])
+		core.TestErr(t, err, "cannot open fs: %v")
+		var expected []string
+		for i := 0; i < 6; i++ {
+			name := fmt.Sprintf("%d", i)
+			_, err = fa.PutData("a/"+name, []byte(name), PutOptions{})
+			core.TestErr(t, err, "cannot put data: %v")
+			expected = append(expected, name)
+		}
+		fa.Close()
+
+		// alice moves the directory on a store that fails half of the writes
+		u := strings.Split(peers[0].URL, "?")[0] + fmt.Sprintf("?seed=%d&err=0.5&ops=write", seed)
+		faulty, err := safe.Open(peers[0].DB, alice, u)
+		core.TestErr(t, err, "cannot open safe on the fault store: %v")
+		ff, err := Open(faulty)
+		core.TestErr(t, err, "cannot open fs: %v")
+		T := core.T
+		core.T = nil // injected failures are logged as errors
+		err = ff.Move("a", "b")
+		core.T = T
+		ff.Close()
+		core.Assert(t, err != nil, "move did not fail with seed %d", seed)
+
+		// every file is in the old or in the new directory for bob
+		fb, err := Open(peers[1])
+		core.TestErr(t, err, "cannot open fs: %v")
+		var names []string
+		for _, dir := range []string{"a", "b"} {
+			peers[1].ResetTouch(HeadersDir, hashDir(dir))
+			files, err := fb.List(dir, ListOptions{})
+			core.TestErr(t, err, "cannot list files: %v")
+			for _, file := range files {
+				if !file.IsDir && !slices.Contains(names, file.Name) {
+					names = append(names, file.Name)
+				}
+			}
+		}
+		fb.Close()
+		slices.Sort(names)
+		core.Assert(t, slices.Equal(names, expected), "files lost by an interrupted move with seed %d: %v", seed, names)
+	}
+}
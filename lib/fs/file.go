@@ -36,6 +36,9 @@ type File struct {
 	LocalCopy     string         `json:"localCopy"`
 	CopyTime      time.Time      `json:"copyTime"`
 	EncryptionKey []byte         `json:"encryptionKey"`
+	Compression   string         `json:"compression"` // Compression is applied to the body before encryption, e.g. zstd
+	Dedup         bool           `json:"dedup"`       // Dedup stores the body as chunks shared with other files
+	Manifest      Manifest       `json:"manifest"`    // Manifest lists the chunks of the body when Dedup is set
 }
 
 func (fileID FileID) String() string {
@@ -46,6 +49,12 @@ func (fileID FileID) Uint64() uint64 {
 	return uint64(fileID)
 }
 
+// parseFileID returns the ID in its string form
+func parseFileID(s string) (FileID, error) {
+	id, err := strconv.ParseUint(s, 16, 64)
+	return FileID(id), err
+}
+
 func (f File) Path() string {
 	return path.Join(f.Dir, f.Name)
 }
@@ -53,7 +62,7 @@ func (f File) Path() string {
 type FileWrap struct {
 	Group        safe.GroupName
 	EncryptionId int
-	Data         []byte
+	Data         []byte // Data is the header, compressed with the algorithm in front (see core.CompressTagged) and encrypted
 }
 
 func hashDir(dir string) string {
@@ -80,6 +89,7 @@ func writeHeader(s *safe.Safe, f File) (string, error) {
 		return "", core.Errorf("failed to marshal file header of %s/%s: %w", f.Dir, f.Name, err)
 	}
 
+	data = core.CompressTagged(data, s.Compression(""))
 	core.Info("encrypting header %s/%s", f.Dir, f.Name)
 	data, err = security.EncryptAES(data, lastKey)
 	if err != nil {
@@ -101,14 +111,20 @@ func writeHeader(s *safe.Safe, f File) (string, error) {
 }
 
 func readHeader(s *safe.Safe, dir, name string) (File, error) {
-	src := path.Join(HeadersDir, hashDir(dir), name)
+	return readHeaderAt(s, path.Join(HeadersDir, hashDir(dir), name))
+}
 
+func readHeaderAt(s *safe.Safe, src string) (File, error) {
 	var fw FileWrap
 	err := storage.ReadMsgPack(s.Store, src, &fw)
 	if err != nil {
 		return File{}, err
 	}
+	return unwrapHeader(s, fw, src)
+}
 
+// unwrapHeader decrypts a header with the key of its group
+func unwrapHeader(s *safe.Safe, fw FileWrap, src string) (File, error) {
 	keys, err := s.GetKeys(fw.Group, fw.EncryptionId+1)
 	if err != nil {
 		return File{}, err
@@ -122,25 +138,53 @@ func readHeader(s *safe.Safe, dir, name string) (File, error) {
 	if err != nil {
 		return File{}, err
 	}
+	data, err = core.DecompressTagged(data)
+	if err != nil {
+		return File{}, err
+	}
 
 	f := File{}
 	err = msgpack.Unmarshal(data, &f)
 	if err != nil {
-		return File{}, core.Errorf("failed to unmarshal file header of %s/%s: %w", dir, name, err)
+		return File{}, core.Errorf("failed to unmarshal file header %s: %w", src, err)
 	}
 	core.Info("read header %s/%s with id %d", f.Dir, f.Name, f.ID)
 	return f, nil
 }
 
+// syncHeaders adds the headers of a directory to the DB, first the packed ones and then the loose ones. When the
+// loose headers are many, they are packed, and when the segments are many, they are compacted.
 func syncHeaders(s *safe.Safe, dir string) error {
-	ls, err := s.Store.ReadDir(path.Join(HeadersDir, hashDir(dir)), storage.Filter{})
+	segments, err := syncSegments(s, dir)
+	if err != nil {
+		return err
+	}
+	loose, err := syncLoose(s, dir)
+	if err != nil {
+		return err
+	}
+	if len(loose) < PackThreshold {
+		loose = nil
+	}
+	if len(loose) > 0 || segments >= CompactThreshold {
+		err = packHeaders(s, dir, loose, segments >= CompactThreshold)
+		if err != nil {
+			core.Info("failed to pack headers of %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// syncLoose adds the headers of a directory that are not packed to the DB and returns them as stored
+func syncLoose(s *safe.Safe, dir string) ([]PackedHeader, error) {
+	ls, err := s.Store.ReadDir(path.Join(HeadersDir, hashDir(dir)), storage.Filter{OnlyFiles: true})
 	if os.IsNotExist(err) {
-		return nil
+		return nil, nil
 	}
 	core.Info("found %d headers in %s", len(ls), dir)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var lastID string
@@ -148,17 +192,25 @@ func syncHeaders(s *safe.Safe, dir string) error {
 	if r.Intn(10) == 0 {
 		err = s.DB.QueryRow("STASH_GET_LAST_ID", sqlx.Args{"safeID": s.ID}, &lastID)
 		if err != nil && err != sqlx.ErrNoRows {
-			return err
+			return nil, err
 		}
 	}
 
+	var loose []PackedHeader
 	for _, l := range ls {
 		name := l.Name()
 		if name <= lastID || strings.HasPrefix(name, ".") {
 			core.Info("skipping header %s/%s", dir, name)
 			continue
 		}
-		f, err := readHeader(s, dir, name)
+		src := path.Join(HeadersDir, hashDir(dir), name)
+		data, err := storage.ReadFile(s.Store, src)
+		if err != nil {
+			log.Error("failed to read header %s/%s: %w", dir, l.Name(), err)
+			continue
+		}
+		loose = append(loose, PackedHeader{Name: name, Data: data})
+		f, err := decodeHeader(s, data, src)
 		if err != nil {
 			log.Error("failed to read header %s/%s: %w", dir, l.Name(), err)
 			continue
@@ -169,12 +221,24 @@ func syncHeaders(s *safe.Safe, dir string) error {
 			continue
 		}
 	}
-	return nil
+	return loose, nil
 }
 
 const STASH_STORE_FILE = "STASH_STORE_FILE"
 
 func writeFileToDB(s *safe.Safe, f File) error {
+	// a directory is a row with id 0 in its parent
+	if f.IsDir {
+		storeDirs(s, f.Path())
+		_, err := s.DB.Exec("STASH_SET_DIR_GROUP", sqlx.Args{"safeID": s.ID, "dir": f.Dir, "name": f.Name,
+			"groupName": f.GroupName})
+		if err != nil {
+			return err
+		}
+		core.Info("stored dir %s with group %s", f.Path(), f.GroupName)
+		return nil
+	}
+
 	tags := fmt.Sprintf(" %s ", strings.Join(f.Tags, " "))
 	if len(tags) > 4096 {
 		return core.Errorf("ErrTags: tags too long: %d", len(tags))
@@ -183,29 +247,35 @@ func writeFileToDB(s *safe.Safe, f File) error {
 	args := sqlx.Args{"safeID": s.ID, "name": f.Name, "dir": f.Dir, "id": f.ID.Uint64(),
 		"creator": f.Creator, "groupName": f.GroupName, "tags": tags,
 		"encryptionKey": f.EncryptionKey, "modTime": f.ModTime, "size": f.Size,
-		"localCopy": f.LocalCopy, "copyTime": core.Now(), "attributes": f.Attributes}
+		"localCopy": f.LocalCopy, "copyTime": core.Now(), "attributes": f.Attributes, "compression": f.Compression,
+		"manifest": f.Manifest}
 	_, err := s.DB.Exec(STASH_STORE_FILE, args)
 	if err != nil {
 		return err
 	}
 
-	dir := f.Dir
+	storeDirs(s, f.Dir)
+	core.Info("stored file %s/%s with id %d, args %+v", f.Dir, f.Name, f.ID, args)
+	return err
+}
+
+// storeDirs adds the rows of a directory and its ancestors to the DB
+func storeDirs(s *safe.Safe, dir string) {
 	for dir != "" {
 		var name string
 		dir, name = core.SplitPath(dir)
-		if name != "" {
-			res, err := s.DB.Exec("STASH_STORE_DIR", sqlx.Args{"safeID": s.ID, "dir": dir, "name": name})
-			if err != nil {
-				core.Errorf("failed to store dir %s/%s: %w", dir, name, err)
-			}
-			count, _ := res.RowsAffected()
-			if count > 0 {
-				core.Info("stored dir %s", path.Join(dir, name))
-			}
+		if name == "" {
+			continue
+		}
+		res, err := s.DB.Exec("STASH_STORE_DIR", sqlx.Args{"safeID": s.ID, "dir": dir, "name": name})
+		if core.IsErr(err, "failed to store dir %s/%s: %v", dir, name) {
+			continue
+		}
+		count, _ := res.RowsAffected()
+		if count > 0 {
+			core.Info("stored dir %s", path.Join(dir, name))
 		}
 	}
-	core.Info("stored file %s/%s with id %d, args %+v", f.Dir, f.Name, f.ID, args)
-	return err
 }
 
 const STASH_GET_FILES_BY_DIR = "STASH_GET_FILES_BY_DIR"
@@ -233,10 +303,11 @@ func searchFiles(s *safe.Safe, dir string, after, before time.Time, prefix, suff
 		var f File
 		var tags string
 		err := rows.Scan(&f.ID, &f.Name, &f.Dir, &f.GroupName, &tags, &f.ModTime, &f.Size, &f.Creator,
-			&f.Attributes, &f.LocalCopy, &f.CopyTime, &f.EncryptionKey)
+			&f.Attributes, &f.LocalCopy, &f.CopyTime, &f.EncryptionKey, &f.Compression, &f.Manifest)
 		if err != nil {
 			return nil, err
 		}
+		f.Dedup = len(f.Manifest.Chunks) > 0
 		f.Tags = strings.Split(strings.TrimSpace(tags), " ")
 		f.IsDir = f.ID == 0
 		files = append(files, f)
@@ -2,6 +2,7 @@ package fs
 
 import (
 	"path"
+	"sync"
 
 	"github.com/stregato/stash/lib/safe"
 )
@@ -18,5 +19,9 @@ var (
 )
 
 type FileSystem struct {
-	S *safe.Safe
+	S        *safe.Safe
+	trigger  chan FileID   // trigger starts an async operation
+	stop     chan struct{} // stop ends the async job
+	stopOnce sync.Once
+	job      sync.WaitGroup // job tracks the async job, so that Close returns when it no longer uses the safe
 }
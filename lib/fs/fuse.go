@@ -5,45 +5,119 @@ package fs
 
 import (
 	"context"
+	"encoding/json"
+	"io"
 	"os"
 	"path"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	fsb "bazil.org/fuse/fs"
+	"github.com/stregato/stash/lib/core"
 )
 
+// TagsXattr is the extended attribute that holds the tags of a file, separated by commas. Any other attribute in the
+// user namespace maps to an entry of File.Attributes.
+const TagsXattr = "user.stash.tags"
+
+const xattrPrefix = "user."
+
 // Define a struct for the whole filesystem
 type FuseFS struct {
-	fs *FileSystem
+	fs    *FileSystem
+	nodes map[string]*FuseFile // nodes are shared by path, so that all the handles of a file use the same buffer
+	mu    sync.Mutex
+}
+
+func newFuseFS(fs *FileSystem) *FuseFS {
+	return &FuseFS{fs: fs, nodes: map[string]*FuseFile{}}
 }
 
 // Root method that gets the root node for the filesystem
 func (f *FuseFS) Root() (fsb.Node, error) {
-	return &Dir{f.fs, ""}, nil
+	return &Dir{f.fs, "", f}, nil
+}
+
+// node returns the node of a file, creating it when missing
+func (f *FuseFS) node(name string, file File) *FuseFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, ok := f.nodes[name]
+	if !ok {
+		n = &FuseFile{file: file, f: f.fs, ffs: f, name: name}
+		f.nodes[name] = n
+	}
+	return n
+}
+
+// rename moves the nodes of a file or of the content of a directory to the new path
+func (f *FuseFS) rename(oldPath, newPath string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, n := range f.nodes {
+		if name != oldPath && !strings.HasPrefix(name, oldPath+"/") {
+			continue
+		}
+		delete(f.nodes, name)
+		n.mu.Lock()
+		n.name = newPath + strings.TrimPrefix(name, oldPath)
+		n.file.Dir, n.file.Name = core.SplitPath(n.name)
+		n.mu.Unlock()
+		f.nodes[n.name] = n
+	}
+}
+
+func (f *FuseFS) forget(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.nodes, name)
+}
+
+// inodeOf returns an inode that does not change with the versions of a file
+func inodeOf(name string) uint64 {
+	if name == "" {
+		return 1
+	}
+	return dirID(name).Uint64()
 }
 
 // Define a struct for a directory (the root directory in this case)
 type Dir struct {
 	f    *FileSystem
 	name string
+	ffs  *FuseFS
 }
 
 // Attr fills in the attributes for the directory
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = 1
+	a.Inode = inodeOf(d.name)
 	a.Mode = os.ModeDir | 0755
+	a.Nlink = 2
+	a.Uid, a.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+	if d.name != "" {
+		file, err := d.f.Stat(d.name)
+		if err == nil {
+			a.Mtime, a.Ctime = file.ModTime, file.ModTime
+		}
+	}
 	return nil
 }
 
 // Lookup looks up a specific entry in the directory
 func (d *Dir) Lookup(ctx context.Context, name string) (fsb.Node, error) {
-	file, err := d.f.Stat(path.Join(d.name, name))
+	name = path.Join(d.name, name)
+	file, err := d.f.Stat(name)
+	if err == nil && file.IsDir {
+		return &Dir{d.f, name, d.ffs}, nil
+	}
 	if err == nil {
-		return &FuseFile{
-			file: file,
-			f:    *d.f,
-		}, nil
+		n := d.ffs.node(name, file)
+		n.update(file)
+		return n, nil
 	}
 	if os.IsNotExist(err) {
 		return nil, fuse.Errno(syscall.ENOENT)
@@ -76,7 +150,7 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		}
 
 		dirent = append(dirent, fuse.Dirent{
-			Inode: l.ID.Uint64(),
+			Inode: inodeOf(path.Join(d.name, l.Name)),
 			Name:  l.Name,
 			Type:  typ,
 		})
@@ -86,79 +160,472 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	return dirent, nil
 }
 
-// Implement Create method for creating files
+// Create creates an empty file and opens it. The content is uploaded when the file is flushed.
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fsb.Node, fsb.Handle, error) {
-	file, err := d.f.PutData(path.Join(d.name, req.Name), []byte{}, PutOptions{})
+	name := path.Join(d.name, req.Name)
+	file, err := d.f.PutData(name, []byte{}, PutOptions{})
 	if err != nil {
 		return nil, nil, err
 	}
-	f := &FuseFile{
-		file: file,
-		f:    *d.f,
+	n := d.ffs.node(name, file)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.file, n.fresh = file, true
+	n.open++
+	n.attr(&resp.Attr)
+	return n, &fuseHandle{node: n}, nil
+}
+
+// Mkdir creates a directory that exists also when empty
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fsb.Node, error) {
+	name := path.Join(d.name, req.Name)
+	_, err := d.f.Mkdir(name)
+	if err == os.ErrExist {
+		return nil, fuse.Errno(syscall.EEXIST)
 	}
-	resp.Node = fuse.NodeID(file.ID)
-	resp.Attr = fuse.Attr{
-		Inode: file.ID.Uint64(),
-		Mode:  req.Mode,
+	if err != nil {
+		return nil, err
 	}
-	return f, f, nil
+	return &Dir{d.f, name, d.ffs}, nil
 }
 
+// Remove deletes a file or, when req.Dir is set, an empty directory
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	err := d.f.Delete(path.Join(d.name, req.Name))
-	if err != nil {
+	name := path.Join(d.name, req.Name)
+	if req.Dir {
+		err := d.f.Rmdir(name)
+		if err != nil && strings.HasPrefix(err.Error(), "ErrNotEmpty") {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		return err
+	}
+	err := d.f.Delete(name)
+	if os.IsNotExist(err) {
 		return fuse.Errno(syscall.ENOENT)
 	}
+	if err != nil {
+		return err
+	}
+	d.ffs.forget(name)
 	return nil
 }
 
-func (d *Dir) Rmdir(ctx context.Context, req *fuse.RemoveRequest) error {
-	return fuse.Errno(syscall.EPERM)
-}
-
+// Rename moves a file with all its versions, replacing the target, or a directory with all its content
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fsb.Node) error {
 	newDirPath := newDir.(*Dir).name
 	oldPath := path.Join(d.name, req.OldName)
 	newPath := path.Join(newDirPath, req.NewName)
 
-	_, err := d.f.Rename(oldPath, newPath)
+	file, err := d.f.Stat(oldPath)
 	if err != nil {
 		return err
 	}
-	return nil
+	if file.IsDir {
+		err = d.f.Move(oldPath, newPath)
+		if err != nil {
+			return err
+		}
+		d.ffs.rename(oldPath, newPath)
+		return nil
+	}
 
+	target, err := d.f.Stat(newPath)
+	if err == nil && target.IsDir {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	if err == nil {
+		err = d.f.Delete(newPath)
+		if err != nil {
+			return err
+		}
+		d.ffs.forget(newPath)
+	}
+	versions, err := d.f.Versions(oldPath)
+	if err != nil {
+		return err
+	}
+	slices.Reverse(versions)
+	dir, name := core.SplitPath(newPath)
+	r := removals{}
+	for _, v := range versions {
+		_, err = d.f.moveVersion(v, dir, name, r)
+		if err != nil {
+			break
+		}
+	}
+	err = r.write(d.f.S, err)
+	if err != nil {
+		return err
+	}
+	d.ffs.rename(oldPath, newPath)
+	return nil
 }
 
-// File represents a file in the filesystem
+// File represents a file in the filesystem. Writes go to a local buffer, a temporary file with the whole content,
+// which is uploaded as a new version when the file is flushed.
 type FuseFile struct {
-	file File
-	f    FileSystem
+	file    File
+	f       *FileSystem
+	ffs     *FuseFS
+	name    string
+	buf     *os.File // buf holds the content while the file is written
+	dirty   bool     // dirty is set when buf has changes not uploaded yet
+	fresh   bool     // fresh is set when the version is the empty one made by Create, which the first flush replaces
+	modTime time.Time
+	open    int
+	mu      sync.Mutex
+}
+
+// fuseHandle is an open file. Reads use the buffer of the node when there is one, or range reads of the version
+// open at the time of the first read.
+type fuseHandle struct {
+	node   *FuseFile
+	reader *Reader
+}
+
+// update replaces the version of a file that is not being written
+func (f *FuseFile) update(file File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buf == nil {
+		f.file = file
+	}
+}
+
+func (f *FuseFile) size() int64 {
+	if f.buf != nil {
+		stat, err := f.buf.Stat()
+		if err == nil {
+			return stat.Size()
+		}
+	}
+	return int64(f.file.Size)
+}
+
+func (f *FuseFile) attr(a *fuse.Attr) {
+	a.Inode = inodeOf(f.name)
+	a.Mode = 0644
+	a.Nlink = 1
+	a.Uid, a.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+	a.Size = uint64(f.size())
+	a.Blocks = (a.Size + 511) / 512
+	a.Mtime = f.file.ModTime
+	if f.dirty {
+		a.Mtime = f.modTime
+	}
+	a.Ctime = a.Mtime
 }
 
 // Attr sets the attributes for the file
 func (f *FuseFile) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = f.file.ID.Uint64()
-	a.Mode = 0666
-	a.Size = uint64(f.file.Size)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attr(a)
+	return nil
+}
+
+// Open returns a handle of the file. Opening with O_TRUNC empties the content.
+func (f *FuseFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fsb.Handle, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Flags&fuse.OpenTruncate != 0 && !req.Flags.IsReadOnly() {
+		err := f.truncate(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f.open++
+	return &fuseHandle{node: f}, nil
+}
+
+// buffer creates the buffer of the file, with the content of the current version unless it is truncated to zero
+func (f *FuseFile) buffer(load bool) error {
+	if f.buf != nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp("", "stash-fuse-")
+	if core.IsErr(err, "cannot create buffer for %s: %v", f.name) {
+		return err
+	}
+	if load && f.file.Size > 0 {
+		err = f.f.getSync(f.file, "", tmp, nil)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	f.buf = tmp
 	return nil
 }
 
-// ReadAll reads the data from the file
-func (f *FuseFile) ReadAll(ctx context.Context) ([]byte, error) {
-	name := path.Join(f.file.Dir, f.file.Name)
-	return f.f.GetData(name, GetOptions{})
+func (f *FuseFile) truncate(size int64) error {
+	err := f.buffer(size > 0)
+	if err != nil {
+		return err
+	}
+	err = f.buf.Truncate(size)
+	if err != nil {
+		return err
+	}
+	f.dirty, f.modTime = true, core.Now()
+	return nil
 }
 
-func (f *FuseFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	name := path.Join(f.file.Dir, f.file.Name)
-	file, err := f.f.PutData(name, req.Data, PutOptions{ID: f.file.ID})
+// flush uploads the buffer as a new version, which keeps the group, tags and attributes of the previous one
+func (f *FuseFile) flush() error {
+	if !f.dirty {
+		return nil
+	}
+	_, err := f.buf.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	options := PutOptions{GroupName: f.file.GroupName, Tags: f.file.Tags, Attributes: f.file.Attributes}
+	if f.fresh {
+		options.ID = f.file.ID
+	}
+	w, err := f.f.Create(f.name, options)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f.buf)
+	if err != nil {
+		w.abort(err)
+		return err
+	}
+	err = w.Close()
 	if err != nil {
 		return err
 	}
-	resp.Size = file.Size
+	file := w.File()
+	if f.fresh {
+		// the version replaces the empty one, which is not in the listing since it has the same ID
+		err = writeFileToDB(f.f.S, file)
+		if err != nil {
+			return err
+		}
+		if file.Dedup {
+			f.f.S.Store.Delete(path.Join(DataDir, file.ID.String()))
+		}
+	}
+	f.file, f.dirty, f.fresh = file, false, false
+	core.Info("flushed %s with size %d", f.name, file.Size)
+	return nil
+}
+
+// release uploads the changes and drops the buffer when no handle is open
+func (f *FuseFile) release() error {
+	err := f.flush()
+	if err != nil || f.open > 0 || f.buf == nil {
+		return err
+	}
+	f.buf.Close()
+	os.Remove(f.buf.Name())
+	f.buf = nil
+	return nil
+}
+
+// Setattr changes the size of the file. Modes, owners and times are fixed, so the other changes are ignored.
+func (f *FuseFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Valid.Size() {
+		err := f.truncate(int64(req.Size))
+		if err != nil {
+			return err
+		}
+		if f.open == 0 {
+			err = f.release()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	f.attr(&resp.Attr)
 	return nil
 }
 
 func (f *FuseFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flush()
+}
+
+// Forget drops the node unless it has content not uploaded yet
+func (f *FuseFile) Forget() {
+	f.ffs.mu.Lock()
+	defer f.ffs.mu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open == 0 && f.buf == nil && f.ffs.nodes[f.name] == f {
+		delete(f.ffs.nodes, f.name)
+	}
+}
+
+// Read reads a range of the file
+func (h *fuseHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	n := h.node
+	n.mu.Lock()
+	buf := make([]byte, req.Size)
+	if n.buf != nil {
+		defer n.mu.Unlock()
+		c, err := n.buf.ReadAt(buf, req.Offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		resp.Data = buf[:c]
+		return nil
+	}
+	if h.reader == nil {
+		h.reader = &Reader{fs: n.f, file: n.file}
+	}
+	n.mu.Unlock()
+
+	c, err := h.reader.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	resp.Data = buf[:c]
+	return nil
+}
+
+// Write writes to the buffer of the file
+func (h *fuseHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n := h.node
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	err := n.buffer(true)
+	if err != nil {
+		return err
+	}
+	c, err := n.buf.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		return err
+	}
+	n.dirty, n.modTime = true, core.Now()
+	resp.Size = c
+	return nil
+}
+
+// Flush uploads the changes when the file is closed
+func (h *fuseHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.node.mu.Lock()
+	defer h.node.mu.Unlock()
+	return h.node.flush()
+}
+
+func (h *fuseHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if h.reader != nil {
+		h.reader.Close()
+	}
+	h.node.mu.Lock()
+	defer h.node.mu.Unlock()
+	h.node.open--
+	return h.node.release()
+}
+
+// xattrs returns the extended attributes of the file
+func (f *FuseFile) xattrs() map[string][]byte {
+	xattrs := map[string][]byte{}
+	if len(f.file.Tags) > 0 {
+		xattrs[TagsXattr] = []byte(strings.Join(f.file.Tags, ","))
+	}
+	for k, v := range f.file.Attributes {
+		if s, ok := v.(string); ok {
+			xattrs[xattrPrefix+k] = []byte(s)
+		} else if data, err := json.Marshal(v); err == nil {
+			xattrs[xattrPrefix+k] = data
+		}
+	}
+	return xattrs
+}
+
+func (f *FuseFile) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.xattrs()[req.Name]
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = value
+	return nil
+}
+
+func (f *FuseFile) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.xattrs() {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	resp.Append(names...)
+	return nil
+}
+
+func (f *FuseFile) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if !strings.HasPrefix(req.Name, xattrPrefix) {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	value := string(req.Xattr)
+	return f.setMeta(func(file *File) {
+		if req.Name == TagsXattr {
+			file.Tags = nil
+			for _, tag := range strings.Split(value, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					file.Tags = append(file.Tags, tag)
+				}
+			}
+			return
+		}
+		attributes := map[string]any{}
+		for k, v := range file.Attributes {
+			attributes[k] = v
+		}
+		attributes[strings.TrimPrefix(req.Name, xattrPrefix)] = value
+		file.Attributes = attributes
+	})
+}
+
+func (f *FuseFile) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	f.mu.Lock()
+	_, ok := f.xattrs()[req.Name]
+	f.mu.Unlock()
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	return f.setMeta(func(file *File) {
+		if req.Name == TagsXattr {
+			file.Tags = nil
+			return
+		}
+		attributes := map[string]any{}
+		for k, v := range file.Attributes {
+			attributes[k] = v
+		}
+		delete(attributes, strings.TrimPrefix(req.Name, xattrPrefix))
+		file.Attributes = attributes
+	})
+}
+
+// setMeta changes the tags or attributes of the current version and writes its header again. While the file is
+// written, the change goes to the next version.
+func (f *FuseFile) setMeta(change func(file *File)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file := f.file
+	change(&file)
+	if !f.dirty {
+		_, err := writeHeader(f.f.S, file)
+		if err != nil {
+			return err
+		}
+		err = writeFileToDB(f.f.S, file)
+		if err != nil {
+			return err
+		}
+	}
+	f.file = file
 	return nil
 }
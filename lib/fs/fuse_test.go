@@ -0,0 +1,113 @@
+//go:build linux
+// +build linux
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+)
+
+func TestFuse(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	ctx := context.Background()
+	ffs := newFuseFS(f)
+	root, err := ffs.Root()
+	core.TestErr(t, err, "cannot get root: %v")
+	dir := root.(*Dir)
+
+	// writes at offsets go to the buffer and are uploaded on flush
+	node, handle, err := dir.Create(ctx, &fuse.CreateRequest{Name: "x"}, &fuse.CreateResponse{})
+	core.TestErr(t, err, "cannot create file: %v")
+	h := handle.(*fuseHandle)
+	err = h.Write(ctx, &fuse.WriteRequest{Data: []byte("world"), Offset: 6}, &fuse.WriteResponse{})
+	core.TestErr(t, err, "cannot write: %v")
+	err = h.Write(ctx, &fuse.WriteRequest{Data: []byte("hello "), Offset: 0}, &fuse.WriteResponse{})
+	core.TestErr(t, err, "cannot write: %v")
+	err = h.Release(ctx, &fuse.ReleaseRequest{})
+	core.TestErr(t, err, "cannot release: %v")
+
+	data, err := f.GetData("x", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, string(data) == "hello world", "unexpected data: %s", data)
+	versions, err := f.Versions("x")
+	core.TestErr(t, err, "cannot list versions: %v")
+	core.Assert(t, len(versions) == 1, "expected 1 version, got %d", len(versions))
+
+	var attr fuse.Attr
+	err = node.Attr(ctx, &attr)
+	core.TestErr(t, err, "cannot get attr: %v")
+	core.Assert(t, attr.Size == 11 && attr.Inode == inodeOf("x") && !attr.Mtime.IsZero(), "unexpected attr %+v", attr)
+
+	// range reads
+	n, err := dir.Lookup(ctx, "x")
+	core.TestErr(t, err, "cannot lookup: %v")
+	file := n.(*FuseFile)
+	core.Assert(t, file == node, "node not shared")
+	handle, err = file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	core.TestErr(t, err, "cannot open: %v")
+	h = handle.(*fuseHandle)
+	var read fuse.ReadResponse
+	err = h.Read(ctx, &fuse.ReadRequest{Offset: 6, Size: 100}, &read)
+	core.TestErr(t, err, "cannot read: %v")
+	core.Assert(t, string(read.Data) == "world", "unexpected read: %s", read.Data)
+	err = h.Release(ctx, &fuse.ReleaseRequest{})
+	core.TestErr(t, err, "cannot release: %v")
+
+	// truncate makes a new version
+	err = file.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 5}, &fuse.SetattrResponse{})
+	core.TestErr(t, err, "cannot truncate: %v")
+	data, err = f.GetData("x", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, string(data) == "hello", "unexpected data after truncate: %s", data)
+
+	// extended attributes
+	err = file.Setxattr(ctx, &fuse.SetxattrRequest{Name: TagsXattr, Xattr: []byte("a, b")})
+	core.TestErr(t, err, "cannot set tags: %v")
+	err = file.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.color", Xattr: []byte("red")})
+	core.TestErr(t, err, "cannot set attribute: %v")
+	stat, err := f.Stat("x")
+	core.TestErr(t, err, "cannot stat: %v")
+	core.Assert(t, len(stat.Tags) == 2 && stat.Attributes["color"] == "red", "unexpected meta %v %v", stat.Tags,
+		stat.Attributes)
+	var list fuse.ListxattrResponse
+	err = file.Listxattr(ctx, &fuse.ListxattrRequest{}, &list)
+	core.TestErr(t, err, "cannot list xattrs: %v")
+	core.Assert(t, bytes.Equal(list.Xattr, []byte("user.color\x00"+TagsXattr+"\x00")), "unexpected list %q", list.Xattr)
+	err = file.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.color"})
+	core.TestErr(t, err, "cannot remove xattr: %v")
+	var value fuse.GetxattrResponse
+	err = file.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.color"}, &value)
+	core.Assert(t, err == fuse.ErrNoXattr, "attribute not removed")
+
+	// directories
+	_, err = dir.Mkdir(ctx, &fuse.MkdirRequest{Name: "d"})
+	core.TestErr(t, err, "cannot mkdir: %v")
+	err = dir.Rename(ctx, &fuse.RenameRequest{OldName: "x", NewName: "d/y"}, dir)
+	core.TestErr(t, err, "cannot rename: %v")
+	core.Assert(t, file.name == "d/y", "node not renamed: %s", file.name)
+	entries, err := dir.ReadDirAll(ctx)
+	core.TestErr(t, err, "cannot read dir: %v")
+	core.Assert(t, len(entries) == 1 && entries[0].Name == "d" && entries[0].Inode == inodeOf("d"),
+		"unexpected entries %+v", entries)
+
+	// remove deletes all the versions
+	n, err = dir.Lookup(ctx, "d")
+	core.TestErr(t, err, "cannot lookup dir: %v")
+	err = n.(*Dir).Remove(ctx, &fuse.RemoveRequest{Name: "y"})
+	core.TestErr(t, err, "cannot remove: %v")
+	_, err = f.Stat("d/y")
+	core.Assert(t, err != nil, "file not removed")
+}
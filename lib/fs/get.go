@@ -2,6 +2,7 @@ package fs
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"os"
 	"path"
@@ -9,10 +10,13 @@ import (
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/security"
 	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
 )
 
 type GetOptions struct {
-	Async bool
+	Async   bool           `json:"async"`   // get the file asynchronously
+	Range   *storage.Range `json:"range"`   // get only the bytes in the range. When nil, the whole file is read
+	Version FileID         `json:"version"` // get a version of the file returned by Versions. When 0, the latest is read
 }
 
 func (f *FileSystem) GetData(src string, options GetOptions) ([]byte, error) {
@@ -22,12 +26,12 @@ func (f *FileSystem) GetData(src string, options GetOptions) ([]byte, error) {
 		return nil, core.Errorf("GetData does not support async mode. Use GetFile instead")
 	}
 
-	file, err := f.Stat(src)
+	file, err := f.StatVersion(src, options.Version)
 	if err != nil {
 		return nil, err
 	}
 
-	err = f.getSync(file, "", &dest)
+	err = f.getSync(file, "", &dest, options.Range)
 	if err != nil {
 		return nil, err
 	}
@@ -36,30 +40,39 @@ func (f *FileSystem) GetData(src string, options GetOptions) ([]byte, error) {
 }
 
 func (f *FileSystem) GetFile(src, dest string, options GetOptions) (File, error) {
-	file, err := f.Stat(src)
+	file, err := f.StatVersion(src, options.Version)
 	if err != nil {
 		return File{}, err
 	}
 
 	if options.Async {
+		if options.Range != nil {
+			return File{}, core.Errorf("GetFile does not support ranges in async mode")
+		}
 		_, err = f.S.DB.Exec("STASH_INSERT_FILE_ASYNC", sqlx.Args{"id": file.ID, "safeID": f.S.ID,
 			"operation": "get", "file": file, "data": nil, "localCopy": dest, "deleteSrc": false})
 		if err != nil {
 			return File{}, err
 		}
-		triggerAsync <- file.ID
+		f.triggerAsync(file.ID)
 		return file, nil
 	}
 
-	err = f.getSync(file, dest, nil)
+	err = f.getSync(file, dest, nil, options.Range)
 	if err != nil {
 		return File{}, err
 	}
 	return file, nil
 }
 
-func (f *FileSystem) getSync(file File, localPath string, dest io.Writer) error {
+// getSync reads the file into the local path or the writer. Since the content is encrypted with AES in CTR mode,
+// a range is read directly from the store and decrypted from its offset.
+func (f *FileSystem) getSync(file File, localPath string, dest io.Writer, rang *storage.Range) error {
 	encryptionKey := file.EncryptionKey
+	if rang != nil && (rang.From < 0 || rang.From > rang.To || rang.To > int64(file.Size)) {
+		return core.Errorf("invalid range %d-%d for %s/%s with size %d", rang.From, rang.To, file.Dir, file.Name,
+			file.Size)
+	}
 
 	if dest == nil {
 		if localPath == "" {
@@ -74,14 +87,30 @@ func (f *FileSystem) getSync(file File, localPath string, dest io.Writer) error
 		dest = destFile
 	}
 
-	dest, err := security.DecryptWriter(dest, encryptionKey[0:32], encryptionKey[32:48])
-	if err != nil {
-		return err
-	}
+	if file.Dedup {
+		err := readChunks(f.S, file, dest, rang)
+		if err != nil {
+			return err
+		}
+	} else if file.Compression != "" {
+		err := f.getCompressed(file, dest, rang)
+		if err != nil {
+			return err
+		}
+	} else {
+		var offset int64
+		if rang != nil {
+			offset = rang.From
+		}
+		dest, err := security.DecryptWriterAt(dest, encryptionKey[0:32], encryptionKey[32:48], offset)
+		if err != nil {
+			return err
+		}
 
-	err = f.S.Store.Read(path.Join(DataDir, file.ID.String()), nil, dest, nil)
-	if err != nil {
-		return err
+		err = f.S.Store.Read(path.Join(DataDir, file.ID.String()), rang, dest, nil)
+		if err != nil {
+			return err
+		}
 	}
 
 	if localPath != "" {
@@ -91,3 +120,40 @@ func (f *FileSystem) getSync(file File, localPath string, dest io.Writer) error
 
 	return nil
 }
+
+// getCompressed reads and decompresses a compressed body. Since offsets in the compressed data do not match the
+// content, a range is read from the start of the body and the bytes before it are discarded.
+func (f *FileSystem) getCompressed(file File, dest io.Writer, rang *storage.Range) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		r, err := core.DecompressReader(pr, file.Compression)
+		if err == nil {
+			var src io.Reader = r
+			if rang != nil {
+				_, err = io.CopyN(io.Discard, r, rang.From)
+				src = io.LimitReader(r, rang.To-rang.From)
+			}
+			if err == nil {
+				_, err = io.Copy(dest, src)
+			}
+			r.Close()
+		}
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	w, err := security.DecryptWriterAt(pw, file.EncryptionKey[0:32], file.EncryptionKey[32:48], 0)
+	if err == nil {
+		err = f.S.Store.Read(path.Join(DataDir, file.ID.String()), nil, w, nil)
+	}
+	if errors.Is(err, io.ErrClosedPipe) {
+		err = nil // the range is complete
+	}
+	pw.CloseWithError(err)
+	if err != nil {
+		<-done
+		return err
+	}
+	return <-done
+}
@@ -0,0 +1,238 @@
+package fs
+
+import (
+	"cmp"
+	"io"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
+)
+
+type SetGroupOptions struct {
+	// RotateKey encrypts the body with a new key, so that users who read the old header cannot read the body. Since
+	// the body is written again, each version gets a new ID.
+	RotateKey bool `json:"rotateKey"`
+}
+
+// ownGroup returns the group on the header of a directory, or an empty string when the directory has no header
+func (fs *FileSystem) ownGroup(dir string) (safe.GroupName, error) {
+	if dir == "" {
+		return "", nil
+	}
+	parent, name := core.SplitPath(dir)
+	var groupName safe.GroupName
+	err := fs.S.DB.QueryRow(STASH_GET_GROUP_NAME, sqlx.Args{"safeID": fs.S.ID, "dir": parent, "name": name},
+		&groupName)
+	if err != nil && err != sqlx.ErrNoRows {
+		return "", err
+	}
+	return groupName, nil
+}
+
+// dirGroup returns the group of the closest directory with a default group in its policy or a group on its header,
+// or an empty string when none has one. In the same directory the policy wins.
+func (fs *FileSystem) dirGroup(dir string) (safe.GroupName, error) {
+	policies, err := fs.policies()
+	if err != nil {
+		return "", err
+	}
+	for ; ; dir = core.Dir(dir) {
+		if p, ok := policies[dir]; ok && p.DefaultGroup != "" {
+			return p.DefaultGroup, nil
+		}
+		groupName, err := fs.ownGroup(dir)
+		if err != nil || groupName != "" || dir == "" {
+			return groupName, err
+		}
+	}
+}
+
+// SetGroup changes the group of a file, with all its versions, or of a directory. The header of a file is encrypted
+// with the latest key of the group, while the body is encrypted again only when it is deduplicated, since the chunks
+// use the group key, or when the options rotate the key. The group of a directory applies to the files put in it
+// later; use SetGroupTree to change also the content.
+func (fs *FileSystem) SetGroup(name string, groupName safe.GroupName, options SetGroupOptions) (File, error) {
+	file, err := fs.Stat(name)
+	if err != nil {
+		return File{}, err
+	}
+	if file.IsDir {
+		err = fs.allowGroup(name, groupName)
+		if err != nil {
+			return File{}, err
+		}
+		return fs.writeDir(file.Dir, file.Name, groupName)
+	}
+
+	versions, err := fs.Versions(name)
+	if err != nil {
+		return File{}, err
+	}
+	// the oldest versions are written first, so that new IDs keep the order of the versions
+	slices.Reverse(versions)
+	r := removals{}
+	for _, v := range versions {
+		file, err = fs.setVersionGroup(v, groupName, options.RotateKey, r)
+		if err != nil {
+			break
+		}
+	}
+	err = r.write(fs.S, err)
+	if err != nil {
+		return File{}, err
+	}
+	fs.touchDirs(file.Dir)
+	return file, nil
+}
+
+// SetGroupTree changes the group of a directory, its subdirectories and all the versions of the files in them. It
+// returns the number of versions written again.
+func (fs *FileSystem) SetGroupTree(dir string, groupName safe.GroupName, options SetGroupOptions) (int, error) {
+	if dir != "" {
+		file, err := fs.Stat(dir)
+		if err != nil {
+			return 0, err
+		}
+		if !file.IsDir {
+			return 0, core.Errorf("ErrNotDir: %s is not a directory", dir)
+		}
+	}
+
+	var files []File
+	dirs, err := fs.walkTree(dir, func(file File) error {
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range dirs {
+		if d == "" {
+			continue
+		}
+		_, err = fs.writeDir(core.Dir(d), path.Base(d), groupName)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	slices.SortFunc(files, func(a, b File) int { return cmp.Compare(a.ID, b.ID) })
+	var count int
+	r := removals{}
+	for _, file := range files {
+		if file.GroupName == groupName && !options.RotateKey {
+			continue
+		}
+		_, err = fs.setVersionGroup(file, groupName, options.RotateKey, r)
+		if err != nil {
+			break
+		}
+		count++
+	}
+	err = r.write(fs.S, err)
+	if err != nil {
+		return count, err
+	}
+	for _, d := range dirs {
+		fs.touchDirs(d)
+	}
+	core.Info("set group %s on %s: %d versions and %d directories", groupName, dir, count, len(dirs))
+	return count, nil
+}
+
+// setVersionGroup writes a version again for a group and returns it. When the key is rotated, the version gets a
+// new ID and the old one is deleted.
+func (fs *FileSystem) setVersionGroup(file File, groupName safe.GroupName, rotateKey bool, r removals) (File, error) {
+	if file.GroupName == groupName && !rotateKey {
+		return file, nil
+	}
+	err := fs.allowGroup(file.Dir, groupName)
+	if err != nil {
+		return File{}, err
+	}
+	updated, err := fs.encryptBody(file, groupName, rotateKey)
+	if err != nil {
+		return File{}, err
+	}
+
+	_, err = writeHeader(fs.S, updated)
+	if err != nil {
+		if updated.ID != file.ID {
+			fs.S.Store.Delete(path.Join(DataDir, updated.ID.String()))
+		}
+		return File{}, err
+	}
+	err = writeFileToDB(fs.S, updated)
+	if err != nil {
+		return File{}, err
+	}
+	if updated.ID != file.ID {
+		err = fs.deleteVersion(file, r)
+		if err != nil {
+			return File{}, err
+		}
+	}
+	core.Info("set group %s on %s version %s, now %s", groupName, file.Path(), file.ID, updated.ID)
+	return updated, nil
+}
+
+// encryptBody prepares the body of a version for a group. A deduplicated body is split again in chunks encrypted
+// with the group key; otherwise, with rotateKey, the stored body is encrypted with a new key under a new ID. The
+// header is not written.
+func (fs *FileSystem) encryptBody(file File, groupName safe.GroupName, rotateKey bool) (File, error) {
+	updated := file
+	updated.GroupName = groupName
+	if !file.Dedup && !rotateKey {
+		return updated, nil
+	}
+
+	tmp, err := os.CreateTemp("", "stash-encrypt-")
+	if core.IsErr(err, "cannot create temporary file for encryption: %v") {
+		return File{}, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	if file.Dedup {
+		err = readChunks(fs.S, file, tmp, nil)
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			updated.Manifest, err = writeChunks(fs.S, tmp, updated)
+		}
+		if err != nil {
+			return File{}, err
+		}
+		return updated, nil
+	}
+
+	// the stored bytes are encrypted again as they are, so that a compressed body stays compressed
+	w, err := security.DecryptWriterAt(tmp, file.EncryptionKey[0:32], file.EncryptionKey[32:48], 0)
+	if err != nil {
+		return File{}, err
+	}
+	err = fs.S.Store.Read(path.Join(DataDir, file.ID.String()), nil, w, nil)
+	if err != nil {
+		return File{}, err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return File{}, err
+	}
+	updated.ID = FileID(core.SnowID())
+	updated.EncryptionKey = core.GenerateRandomBytes(48)
+	err = writeBody(fs.S, path.Join(DataDir, updated.ID.String()), tmp, updated.EncryptionKey, &storage.Upload{}, nil)
+	if err != nil {
+		return File{}, err
+	}
+	return updated, nil
+}
@@ -0,0 +1,74 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+)
+
+func TestSetGroup(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	_, err := s.UpdateGroup("team", safe.Grant, alice.Id)
+	core.TestErr(t, err, "cannot create group: %v")
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	_, err = f.PutData("a/x", []byte("first"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	_, err = f.PutData("a/x", []byte("second"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	_, err = f.PutData("a/y", []byte("dedup"), PutOptions{Dedup: true})
+	core.TestErr(t, err, "cannot put data: %v")
+
+	file, err := f.SetGroup("a/x", "team", SetGroupOptions{RotateKey: true})
+	core.TestErr(t, err, "cannot set group: %v")
+	core.Assert(t, file.GroupName == "team", "unexpected group %s", file.GroupName)
+	versions, err := f.Versions("a/x")
+	core.TestErr(t, err, "cannot list versions: %v")
+	core.Assert(t, len(versions) == 2, "expected 2 versions, got %d", len(versions))
+	for _, v := range versions {
+		core.Assert(t, v.GroupName == "team", "version %s not in the group", v.ID)
+	}
+	data, err := f.GetData("a/x", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, string(data) == "second", "unexpected data: %s", data)
+
+	// the header is encrypted for the new group
+	s.DB.Exec("STASH_DELETE_FILE", map[string]any{"safeID": s.ID, "id": file.ID.Uint64()})
+	err = syncHeaders(s, "a")
+	core.TestErr(t, err, "cannot sync headers: %v")
+	file, err = f.Stat("a/x")
+	core.TestErr(t, err, "cannot stat file: %v")
+	core.Assert(t, file.GroupName == "team", "header not in the group")
+
+	// files moved in a directory with a group take its group
+	_, err = f.Mkdir("b")
+	core.TestErr(t, err, "cannot create dir: %v")
+	_, err = f.SetGroup("b", "team", SetGroupOptions{})
+	core.TestErr(t, err, "cannot set group of dir: %v")
+	file, err = f.Rename("a/y", "b/y")
+	core.TestErr(t, err, "cannot rename: %v")
+	core.Assert(t, file.GroupName == "team", "moved file not in the group of the dir")
+	data, err = f.GetData("b/y", GetOptions{})
+	core.TestErr(t, err, "cannot get moved data: %v")
+	core.Assert(t, string(data) == "dedup", "unexpected data: %s", data)
+	file, err = f.PutData("b/z", []byte("new"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	core.Assert(t, file.GroupName == "team", "new file not in the group of the dir")
+
+	count, err := f.SetGroupTree("b", safe.UserGroup, SetGroupOptions{})
+	core.TestErr(t, err, "cannot set group of tree: %v")
+	core.Assert(t, count == 2, "expected 2 versions, got %d", count)
+	file, err = f.Stat("b/y")
+	core.TestErr(t, err, "cannot stat file: %v")
+	core.Assert(t, file.GroupName == safe.UserGroup, "file not in the user group")
+	data, err = f.GetData("b/y", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, string(data) == "dedup", "unexpected data: %s", data)
+}
@@ -0,0 +1,182 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// StdFS exposes the latest version of the files as a read-only io/fs.FS, so that fs.WalkDir, template.ParseFS and
+// http.FileServer work on a safe. Names are slash-separated paths without a leading slash, with "." for the root.
+type StdFS struct {
+	fs *FileSystem
+}
+
+// StdFS returns the file system as an io/fs.FS
+func (fs *FileSystem) StdFS() *StdFS {
+	return &StdFS{fs}
+}
+
+// HTTPFileSystem returns the file system as an http.FileSystem
+func (fs *FileSystem) HTTPFileSystem() http.FileSystem {
+	return http.FS(fs.StdFS())
+}
+
+// fileInfo maps a File onto io/fs.FileInfo. Sys returns the File.
+type fileInfo struct {
+	file File
+}
+
+func (i fileInfo) Name() string {
+	if i.file.Name == "" {
+		return "."
+	}
+	return i.file.Name
+}
+
+func (i fileInfo) Size() int64 {
+	return int64(i.file.Size)
+}
+
+func (i fileInfo) Mode() iofs.FileMode {
+	if i.file.IsDir {
+		return iofs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i fileInfo) ModTime() time.Time           { return i.file.ModTime }
+func (i fileInfo) IsDir() bool                  { return i.file.IsDir }
+func (i fileInfo) Sys() any                     { return i.file }
+func (i fileInfo) Type() iofs.FileMode          { return i.Mode().Type() }
+func (i fileInfo) Info() (iofs.FileInfo, error) { return i, nil }
+
+// stat returns the file with a name valid for io/fs, where the root is a directory
+func (s *StdFS) stat(op, name string) (File, error) {
+	if !iofs.ValidPath(name) {
+		return File{}, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	if name == "." {
+		return File{IsDir: true}, nil
+	}
+	file, err := s.fs.Stat(name)
+	if os.IsNotExist(err) {
+		return File{}, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+	}
+	if err != nil {
+		return File{}, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+	return file, nil
+}
+
+func (s *StdFS) Stat(name string) (iofs.FileInfo, error) {
+	file, err := s.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{file}, nil
+}
+
+// ReadDir returns the entries of a directory sorted by name, with the latest version of each file
+func (s *StdFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	file, err := s.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !file.IsDir {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	if name == "." {
+		name = ""
+	}
+	ls, err := s.fs.List(name, ListOptions{})
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	latest := map[string]File{}
+	for _, l := range ls {
+		if l.Name == "" {
+			continue
+		}
+		// directories have ID 0, so that a file with the same name wins like in Stat
+		if f, ok := latest[l.Name]; !ok || l.ID > f.ID {
+			latest[l.Name] = l
+		}
+	}
+	entries := make([]iofs.DirEntry, 0, len(latest))
+	for _, f := range latest {
+		entries = append(entries, fileInfo{f})
+	}
+	slices.SortFunc(entries, func(a, b iofs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (s *StdFS) Open(name string) (iofs.File, error) {
+	file, err := s.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if file.IsDir {
+		return &stdDir{fs: s, name: name, info: fileInfo{file}}, nil
+	}
+	return &stdFile{Reader: &Reader{fs: s.fs, file: file}}, nil
+}
+
+// stdFile is an open file, which supports Seek and ReadAt for http.ServeContent and similar
+type stdFile struct {
+	*Reader
+}
+
+func (f *stdFile) Stat() (iofs.FileInfo, error) {
+	return fileInfo{f.file}, nil
+}
+
+// stdDir is an open directory, whose entries are read on the first call to ReadDir
+type stdDir struct {
+	fs      *StdFS
+	name    string
+	info    fileInfo
+	entries []iofs.DirEntry
+	read    bool
+}
+
+func (d *stdDir) Stat() (iofs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *stdDir) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *stdDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries, or all the remaining ones when n <= 0
+func (d *stdDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
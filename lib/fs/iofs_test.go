@@ -0,0 +1,65 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+)
+
+func TestStdFS(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	_, err = f.PutData("a/x.txt", []byte("old"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	_, err = f.PutData("a/x.txt", []byte("hello"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	_, err = f.PutData("a/b/y.txt", []byte("world"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	_, err = f.Mkdir("empty")
+	core.TestErr(t, err, "cannot create dir: %v")
+
+	std := f.StdFS()
+	err = fstest.TestFS(std, "a/x.txt", "a/b/y.txt", "empty")
+	core.TestErr(t, err, "invalid fs: %v")
+
+	data, err := iofs.ReadFile(std, "a/x.txt")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "hello", "unexpected data: %s", data)
+
+	var walked []string
+	err = iofs.WalkDir(std, ".", func(name string, d iofs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	})
+	core.TestErr(t, err, "cannot walk: %v")
+	core.Assert(t, len(walked) == 6, "unexpected walk: %v", walked)
+
+	_, err = std.Open("missing")
+	core.Assert(t, errors.Is(err, iofs.ErrNotExist), "unexpected error %v", err)
+
+	server := httptest.NewServer(http.FileServer(f.HTTPFileSystem()))
+	defer server.Close()
+	req, err := http.NewRequest("GET", server.URL+"/a/b/y.txt", nil)
+	core.TestErr(t, err, "cannot create request: %v")
+	req.Header.Set("Range", "bytes=1-3")
+	resp, err := http.DefaultClient.Do(req)
+	core.TestErr(t, err, "cannot get file: %v")
+	defer resp.Body.Close()
+	data, err = io.ReadAll(resp.Body)
+	core.TestErr(t, err, "cannot read body: %v")
+	core.Assert(t, resp.StatusCode == http.StatusPartialContent && string(data) == "orl", "unexpected response %d %s",
+		resp.StatusCode, data)
+}
@@ -28,7 +28,7 @@ func (fs *FileSystem) Mount(mountPoint string) error {
 	}
 	defer c.Close()
 
-	err = fsb.Serve(c, &FuseFS{fs: fs})
+	err = fsb.Serve(c, newFuseFS(fs))
 	if err != nil {
 		return err
 	}
@@ -3,7 +3,8 @@ package fs
 import "github.com/stregato/stash/lib/safe"
 
 func Open(S *safe.Safe) (*FileSystem, error) {
-	fs := &FileSystem{S: S}
+	fs := &FileSystem{S: S, trigger: make(chan FileID, 16), stop: make(chan struct{})}
+	fs.job.Add(1)
 	go fs.startUploadJob()
 	return fs, nil
 }
@@ -0,0 +1,545 @@
+package fs
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stregato/stash/lib/config"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/crypto/blake2b"
+)
+
+// PacksDir holds the segments that pack the headers of each directory, so that a sync reads a few objects instead
+// of one for each file
+var PacksDir = path.Join(FSDir, "packs")
+
+// PackThreshold is the number of loose headers in a directory above which a sync packs them in a segment
+var PackThreshold = 64
+
+// CompactThreshold is the number of segments in a directory above which a sync compacts them in one
+var CompactThreshold = 32
+
+// PackedHeader is a header as stored, still encrypted for the group of its file
+type PackedHeader struct {
+	Name string `msgpack:"n"`
+	Data []byte `msgpack:"d"`
+}
+
+// Segment is an immutable part of the headers of a directory. Segments are applied in the order of their names and
+// Removed lists the headers deleted after they were packed, which are removed before the headers of the segment are
+// added. Each header keeps its encryption, so that users read
+// only the ones of their groups, while the segment is signed by the user who wrote it.
+type Segment struct {
+	Headers   []PackedHeader `msgpack:"h"`
+	Removed   []string       `msgpack:"r"`
+	Timestamp int64          `msgpack:"t"` // Timestamp is the time of the write in microseconds, when the signer must be a user
+	Signer    security.ID    `msgpack:"s"`
+	Signature []byte         `msgpack:"g"`
+}
+
+// pendingHeaders are the packed headers that the user could not read yet, usually because they belong to a group the
+// user is not in. They are read again when the groups change.
+type pendingHeaders struct {
+	Changes  int                 `msgpack:"c"` // Changes is the length of the group chain at the last attempt
+	Segments map[string][]string `msgpack:"s"` // Segments has the names of the pending headers in each segment
+}
+
+func hashOfSegment(seg Segment) []byte {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	h.Write([]byte(seg.Signer))
+	h.Write([]byte(fmt.Sprintf("\n%d", seg.Timestamp)))
+	for _, p := range seg.Headers {
+		h.Write([]byte(fmt.Sprintf("\n%s %d ", p.Name, len(p.Data))))
+		h.Write(p.Data)
+	}
+	h.Write([]byte(fmt.Sprintf("\n%v", seg.Removed)))
+	return h.Sum(nil)
+}
+
+func writeSegment(s *safe.Safe, dir string, seg Segment) error {
+	name, err := segmentName(s, hashDir(dir))
+	if err != nil {
+		return err
+	}
+	return putSegment(s, dir, name, seg)
+}
+
+// putSegment signs a segment and writes it with a name in the bucket of a directory
+func putSegment(s *safe.Safe, dir, name string, seg Segment) error {
+	var err error
+	seg.Timestamp = core.Now().UnixMicro()
+	seg.Signer = s.Identity.Id
+	seg.Signature, err = security.Sign(s.Identity, hashOfSegment(seg))
+	if err != nil {
+		return err
+	}
+	name = path.Join(PacksDir, hashDir(dir), name)
+	err = storage.WriteMsgPack(s.Store, name, seg)
+	if err != nil {
+		return err
+	}
+	core.Info("wrote segment %s of %s with %d headers and %d removed", name, dir, len(seg.Headers), len(seg.Removed))
+	return nil
+}
+
+// segmentName returns the name of a new segment in a bucket of the packs. Names start with a sequence of fixed length
+// that follows the names already in the bucket, so that their order is the order of the writes also when the clocks
+// of the users differ.
+func segmentName(s *safe.Safe, hash string) (string, error) {
+	names, err := listSegments(s, hash)
+	if err != nil {
+		return "", err
+	}
+	seq := core.SnowID()
+	if len(names) > 0 {
+		last, err := strconv.ParseUint(names[len(names)-1][:min(16, len(names[len(names)-1]))], 16, 64)
+		if err == nil && last >= seq {
+			seq = last + 1
+		}
+	}
+	return fmt.Sprintf("%016x", seq), nil
+}
+
+// listSegments returns the names of the segments in a bucket of the packs, in the order they are applied
+func listSegments(s *safe.Safe, hash string) ([]string, error) {
+	ls, err := s.Store.ReadDir(path.Join(PacksDir, hash), storage.Filter{OnlyFiles: true})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, l := range ls {
+		if !strings.HasPrefix(l.Name(), ".") {
+			names = append(names, l.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// readSegment reads a segment and checks that it is signed by a user of the safe at the time of the write, so that
+// segments stay valid after their signer leaves
+func readSegment(s *safe.Safe, name string, chain safe.GroupChain) (Segment, error) {
+	var seg Segment
+	err := storage.ReadMsgPack(s.Store, name, &seg)
+	if err != nil {
+		return Segment{}, err
+	}
+	if !security.Verify(seg.Signer, hashOfSegment(seg), seg.Signature) {
+		return Segment{}, core.Errorf("invalid signature on segment %s", name)
+	}
+	for _, users := range chain.GroupsAt(time.UnixMicro(seg.Timestamp), s.CreatorID) {
+		if users.Contains(seg.Signer) {
+			return seg, nil
+		}
+	}
+	return Segment{}, core.Errorf("segment %s signed by %s, who is not a user of the safe", name, seg.Signer.Nick())
+}
+
+// decodeHeader returns the file in a header as stored
+func decodeHeader(s *safe.Safe, data []byte, src string) (File, error) {
+	var fw FileWrap
+	err := msgpack.Unmarshal(data, &fw)
+	if err != nil {
+		return File{}, core.Errorf("failed to unmarshal header %s: %w", src, err)
+	}
+	return unwrapHeader(s, fw, src)
+}
+
+// syncSegments adds the headers in the segments of a directory that were not read yet to the DB and removes the
+// deleted ones. Headers that cannot be read are kept pending and read again when the groups change. It returns the
+// number of segments in the directory.
+func syncSegments(s *safe.Safe, dir string) (int, error) {
+	hash := hashDir(dir)
+	names, err := listSegments(s, hash)
+	if err != nil || len(names) == 0 {
+		return 0, err
+	}
+	count := len(names)
+
+	var known []string
+	key := path.Join(s.ID, hash)
+	err = config.GetConfigStruct(s.DB, config.PacksDomain, key, &known)
+	if err != nil && err != sqlx.ErrNoRows {
+		return 0, err
+	}
+	var pending pendingHeaders
+	err = config.GetConfigStruct(s.DB, config.PendingDomain, key, &pending)
+	if err != nil && err != sqlx.ErrNoRows {
+		return 0, err
+	}
+	if pending.Segments == nil {
+		pending.Segments = map[string][]string{}
+	}
+	// segments replaced by a compaction are forgotten, since the compacted segment has their headers
+	known = slices.DeleteFunc(known, func(n string) bool { return !slices.Contains(names, n) })
+	maps.DeleteFunc(pending.Segments, func(n string, _ []string) bool { return !slices.Contains(names, n) })
+	names = slices.DeleteFunc(names, func(n string) bool { return slices.Contains(known, n) })
+
+	chain, err := safe.SyncGroupChain(s)
+	if err != nil {
+		return 0, err
+	}
+	retry := len(pending.Segments) > 0 && len(chain.Changes) != pending.Changes
+	if len(names) == 0 && !retry {
+		return count, nil
+	}
+
+	// read returns the names of the headers in a segment that cannot be decoded or stored
+	read := func(name string, seg Segment, only []string) []string {
+		var failed []string
+		for _, p := range seg.Headers {
+			if only != nil && !slices.Contains(only, p.Name) {
+				continue
+			}
+			f, err := decodeHeader(s, p.Data, path.Join(PacksDir, hash, name, p.Name))
+			if err != nil {
+				// headers of groups the user is not in
+				failed = append(failed, p.Name)
+				continue
+			}
+			err = writeFileToDB(s, f)
+			if core.IsErr(err, "failed to write packed header %s/%s to DB: %v", dir, p.Name) {
+				failed = append(failed, p.Name)
+			}
+		}
+		return failed
+	}
+
+	if retry {
+		for name, headers := range pending.Segments {
+			seg, err := readSegment(s, path.Join(PacksDir, hash, name), chain)
+			if os.IsNotExist(err) {
+				delete(pending.Segments, name)
+				continue
+			}
+			if core.IsErr(err, "cannot read segment %s: %v", name) {
+				continue
+			}
+			pending.Segments[name] = read(name, seg, headers)
+		}
+	}
+
+	for _, name := range names {
+		seg, err := readSegment(s, path.Join(PacksDir, hash, name), chain)
+		if os.IsNotExist(err) {
+			// replaced by a compaction after the listing
+			continue
+		}
+		if core.IsErr(err, "cannot read segment %s: %v", name) {
+			continue
+		}
+		// later versions and removals supersede the pending headers of earlier segments
+		for n, headers := range pending.Segments {
+			pending.Segments[n] = slices.DeleteFunc(headers, func(h string) bool {
+				return slices.Contains(seg.Removed, h) ||
+					slices.ContainsFunc(seg.Headers, func(p PackedHeader) bool { return p.Name == h })
+			})
+		}
+		for _, r := range seg.Removed {
+			err = removePacked(s, dir, r)
+			if err != nil {
+				return 0, err
+			}
+		}
+		pending.Segments[name] = read(name, seg, nil)
+		known = append(known, name)
+	}
+	maps.DeleteFunc(pending.Segments, func(_ string, headers []string) bool { return len(headers) == 0 })
+	pending.Changes = len(chain.Changes)
+
+	core.Info("read %d segments of %s, %d with pending headers", len(names), dir, len(pending.Segments))
+	err = config.SetConfigStruct(s.DB, config.PendingDomain, key, pending)
+	if err != nil {
+		return 0, err
+	}
+	return count, config.SetConfigStruct(s.DB, config.PacksDomain, key, known)
+}
+
+// removePacked removes from the DB a header deleted after it was packed. The header of a directory is found by
+// its ID, which depends on the path.
+func removePacked(s *safe.Safe, dir, name string) error {
+	id, err := parseFileID(name)
+	if err != nil {
+		return nil
+	}
+	// IDs of directories may not fit the DB, but they are never in the rows of files
+	if id <= math.MaxInt64 {
+		_, err = s.DB.Exec("STASH_DELETE_FILE_IN_DIR", sqlx.Args{"safeID": s.ID, "dir": dir, "id": id.Uint64()})
+		if err != nil {
+			return err
+		}
+	}
+	files, err := searchFiles(s, dir, time.Time{}, time.Time{}, "", "", "", "", 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir && f.Name != "" && dirID(f.Path()) == id {
+			_, err = s.DB.Exec("STASH_DELETE_DIR_ENTRY", sqlx.Args{"safeID": s.ID, "dir": dir, "name": f.Name})
+			return err
+		}
+	}
+	return nil
+}
+
+// packedHeaders applies the segments in a bucket of the packs and returns the headers that are not removed, by
+// name, with the path of the segment that holds each
+func packedHeaders(s *safe.Safe, hash string) (map[string]PackedHeader, map[string]string, error) {
+	names, err := listSegments(s, hash)
+	if err != nil || len(names) == 0 {
+		return nil, nil, err
+	}
+	chain, err := safe.SyncGroupChain(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headers := map[string]PackedHeader{}
+	segments := map[string]string{}
+	for _, name := range names {
+		name = path.Join(PacksDir, hash, name)
+		seg, err := readSegment(s, name, chain)
+		if os.IsNotExist(err) {
+			// a compaction replaced the segments after the listing
+			return packedHeaders(s, hash)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range seg.Removed {
+			delete(headers, r)
+			delete(segments, r)
+		}
+		for _, p := range seg.Headers {
+			headers[p.Name] = p
+			segments[p.Name] = name
+		}
+	}
+	return headers, segments, nil
+}
+
+// readRawHeader returns a header as stored, loose or packed
+func readRawHeader(s *safe.Safe, dir string, id FileID) ([]byte, error) {
+	data, err := storage.ReadFile(s.Store, path.Join(HeadersDir, hashDir(dir), id.String()))
+	if !os.IsNotExist(err) {
+		return data, err
+	}
+	headers, _, err := packedHeaders(s, hashDir(dir))
+	if err != nil {
+		return nil, err
+	}
+	p, ok := headers[id.String()]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return p.Data, nil
+}
+
+// removals collects the headers removed by an operation in each directory, so that a single segment for each
+// directory records them. The removal must be recorded, since the header may be packed and other users have it in
+// their DB.
+type removals map[string][]string
+
+// deleteHeader deletes the header of a version and records its removal
+func (r removals) deleteHeader(s *safe.Safe, dir string, id FileID) error {
+	err := s.Store.Delete(path.Join(HeadersDir, hashDir(dir), id.String()))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.add(dir, id)
+	return nil
+}
+
+// add records the removal of a header that is replaced in place
+func (r removals) add(dir string, id FileID) {
+	r[dir] = append(r[dir], id.String())
+}
+
+// write writes the segments with the removals and returns the error of the operation, when there is one. The
+// segments are written also after a failure, so that the headers deleted before it do not stay in the DB of the
+// other users.
+func (r removals) write(s *safe.Safe, err error) error {
+	var dirs []string
+	for dir := range r {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	for _, dir := range dirs {
+		werr := writeSegment(s, dir, Segment{Removed: r[dir]})
+		if err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// packHeaders writes the loose headers of a directory in a segment and, with compact, compacts the segments. It
+// does nothing when another user is packing the directory.
+func packHeaders(s *safe.Safe, dir string, headers []PackedHeader, compact bool) error {
+	lock, err := storage.Lock(s.Store, path.Join(PacksDir, hashDir(dir)), "pack", 0)
+	if err != nil || lock == nil {
+		// another user is packing the directory
+		return err
+	}
+	defer storage.Unlock(lock)
+
+	if len(headers) > 0 {
+		err = packLoose(s, dir, headers)
+		if err != nil {
+			return err
+		}
+	}
+	if !compact {
+		return nil
+	}
+	return compactSegments(s, dir)
+}
+
+// packLoose writes the loose headers of a directory in a segment and deletes them. Headers deleted while the
+// segment is written are recorded as removed, so that the segment does not bring them back.
+func packLoose(s *safe.Safe, dir string, headers []PackedHeader) error {
+	hash := hashDir(dir)
+	loose := func() (core.Set[string], error) {
+		ls, err := s.Store.ReadDir(path.Join(HeadersDir, hash), storage.Filter{OnlyFiles: true})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		set := core.Set[string]{}
+		for _, l := range ls {
+			set.Add(l.Name())
+		}
+		return set, nil
+	}
+
+	before, err := loose()
+	if err != nil {
+		return err
+	}
+	headers = slices.DeleteFunc(headers, func(p PackedHeader) bool { return !before.Contains(p.Name) })
+	if len(headers) == 0 {
+		return nil
+	}
+	err = writeSegment(s, dir, Segment{Headers: headers})
+	if err != nil {
+		return err
+	}
+
+	after, err := loose()
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for _, p := range headers {
+		if !after.Contains(p.Name) {
+			removed = append(removed, p.Name)
+			continue
+		}
+		err = s.Store.Delete(path.Join(HeadersDir, hash, p.Name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		err = writeSegment(s, dir, Segment{Removed: removed})
+		if err != nil {
+			return err
+		}
+	}
+	core.Info("packed %d headers of %s, %d deleted meanwhile", len(headers), dir, len(removed))
+	return nil
+}
+
+// compactSegments writes the headers of a directory that are not removed in a new segment and deletes the segments
+// it replaces. The new segment keeps the removed names, so that users who did not read a removal yet still apply it.
+// Its name follows the replaced segments and precedes the ones written meanwhile.
+func compactSegments(s *safe.Safe, dir string) error {
+	hash := hashDir(dir)
+	names, err := listSegments(s, hash)
+	if err != nil || len(names) < 2 {
+		return err
+	}
+	chain, err := safe.SyncGroupChain(s)
+	if err != nil {
+		return err
+	}
+	headers := map[string]PackedHeader{}
+	removed := core.Set[string]{}
+	for _, name := range names {
+		seg, err := readSegment(s, path.Join(PacksDir, hash, name), chain)
+		if err != nil {
+			return err
+		}
+		for _, r := range seg.Removed {
+			delete(headers, r)
+			removed.Add(r)
+		}
+		for _, p := range seg.Headers {
+			headers[p.Name] = p
+		}
+	}
+
+	// headers written again after their removal, as after an undelete, are loose and must not be removed again
+	ls, err := s.Store.ReadDir(path.Join(HeadersDir, hash), storage.Filter{OnlyFiles: true})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, l := range ls {
+		removed.Remove(l.Name())
+	}
+
+	seg := Segment{Removed: removed.Slice()}
+	slices.Sort(seg.Removed)
+	for _, p := range headers {
+		seg.Headers = append(seg.Headers, p)
+	}
+	slices.SortFunc(seg.Headers, func(a, b PackedHeader) int { return strings.Compare(a.Name, b.Name) })
+	err = putSegment(s, dir, names[len(names)-1]+"c", seg)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = s.Store.Delete(path.Join(PacksDir, hash, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	core.Info("compacted %d segments of %s with %d headers and %d removed", len(names), dir, len(seg.Headers),
+		len(seg.Removed))
+	return nil
+}
+
+// Pack writes the loose headers of a directory in a segment and compacts the segments, which sync does when they are
+// more than PackThreshold and CompactThreshold. It returns the number of headers packed.
+func (fs *FileSystem) Pack(dir string) (int, error) {
+	_, err := syncSegments(fs.S, dir)
+	if err != nil {
+		return 0, err
+	}
+	headers, err := syncLoose(fs.S, dir)
+	if err != nil {
+		return 0, err
+	}
+	err = packHeaders(fs.S, dir, headers, true)
+	if err != nil {
+		return 0, err
+	}
+	return len(headers), nil
+}
@@ -0,0 +1,295 @@
+package fs
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stregato/stash/lib/config"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func TestPack(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	threshold := PackThreshold
+	PackThreshold = 4
+	defer func() { PackThreshold = threshold }()
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	for i := 0; i < 6; i++ {
+		_, err = f.PutData(fmt.Sprintf("a/%d", i), []byte{byte(i)}, PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+	}
+	_, err = f.Mkdir("a/b")
+	core.TestErr(t, err, "cannot create dir: %v")
+	ls, err := s.Store.ReadDir(path.Join(HeadersDir, hashDir("a")), storage.Filter{OnlyFiles: true})
+	core.TestErr(t, err, "cannot list headers: %v")
+	var loose int
+	for _, l := range ls {
+		if !strings.HasPrefix(l.Name(), ".") {
+			loose++
+		}
+	}
+	core.Assert(t, loose < PackThreshold, "headers not packed: %d loose", loose)
+
+	// files deleted after packing stay deleted
+	err = f.Delete("a/1")
+	core.TestErr(t, err, "cannot delete file: %v")
+	err = f.Rmdir("a/b")
+	core.TestErr(t, err, "cannot remove dir: %v")
+	_, err = f.Rename("a/2", "c/2")
+	core.TestErr(t, err, "cannot rename file: %v")
+
+	// a new DB reads the segments and the loose headers
+	for _, name := range []string{"0", "3", "4", "5"} {
+		file, err := f.Stat("a/" + name)
+		core.TestErr(t, err, "cannot stat file: %v")
+		err = f.deleteFromDB(file)
+		core.TestErr(t, err, "cannot delete row: %v")
+	}
+	err = config.DelConfigValue(s.DB, config.PacksDomain, path.Join(s.ID, hashDir("a")))
+	core.TestErr(t, err, "cannot reset segments: %v")
+	err = syncHeaders(s, "a")
+	core.TestErr(t, err, "cannot sync headers: %v")
+
+	files, err := f.List("a", ListOptions{})
+	core.TestErr(t, err, "cannot list files: %v")
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	core.Assert(t, len(files) == 4, "expected 4 files, got %v", names)
+	data, err := f.GetData("a/5", GetOptions{})
+	core.TestErr(t, err, "cannot get packed file: %v")
+	core.Assert(t, len(data) == 1 && data[0] == 5, "unexpected data: %v", data)
+
+	// a packed header goes to the trash and back
+	s.Config.TrashDays = 1
+	file, err := f.Stat("a/0")
+	core.TestErr(t, err, "cannot stat file: %v")
+	err = f.Delete("a/0")
+	core.TestErr(t, err, "cannot trash packed file: %v")
+	_, err = f.Undelete(file.ID)
+	core.TestErr(t, err, "cannot undelete file: %v")
+	_, err = f.GetData("a/0", GetOptions{})
+	core.TestErr(t, err, "cannot get undeleted file: %v")
+
+	report, err := s.Scrub(safe.ScrubOptions{})
+	core.TestErr(t, err, "cannot scrub: %v")
+	core.Assert(t, len(report.Issues) == 0, "unexpected issues: %v", report.Issues)
+}
+
+func TestPackGroups(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	bob := security.NewIdentityMust("bob")
+	peers := safe.NewTestPeers(t, "mem://pack-groups", alice, bob)
+
+	threshold := PackThreshold
+	PackThreshold = 2
+	defer func() { PackThreshold = threshold }()
+
+	fa, err := Open(peers[0])
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer fa.Close()
+	fb, err := Open(peers[1])
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer fb.Close()
+
+	names := func(f *FileSystem) []string {
+		err := syncHeaders(f.S, "a")
+		core.TestErr(t, err, "cannot sync headers: %v")
+		files, err := f.List("a", ListOptions{})
+		core.TestErr(t, err, "cannot list files: %v")
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		return names
+	}
+
+	// bob packs his files, alice packs a file of a group bob is not in
+	_, err = peers[0].UpdateGroup("team", safe.Grant, alice.Id)
+	core.TestErr(t, err, "cannot create group: %v")
+	for i := 0; i < 3; i++ {
+		_, err = fb.PutData(fmt.Sprintf("a/%d", i), []byte{byte(i)}, PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+	}
+	_, err = fa.PutData("a/secret", []byte("secret"), PutOptions{GroupName: "team"})
+	core.TestErr(t, err, "cannot put data: %v")
+	_, err = fa.Pack("a")
+	core.TestErr(t, err, "cannot pack: %v")
+	ls := names(fb)
+	core.Assert(t, len(ls) == 3, "unexpected files for bob: %v", ls)
+
+	// the header is read once bob joins the group
+	_, err = peers[0].UpdateGroup("team", safe.Grant, bob.Id)
+	core.TestErr(t, err, "cannot grant group: %v")
+	ls = names(fb)
+	core.Assert(t, len(ls) == 4, "pending header not read after the grant: %v", ls)
+
+	// the segments of bob stay valid after he leaves
+	_, err = peers[0].UpdateGroup(safe.UserGroup, safe.Revoke, bob.Id)
+	core.TestErr(t, err, "cannot revoke bob: %v")
+	_, err = peers[0].UpdateGroup("team", safe.Revoke, bob.Id)
+	core.TestErr(t, err, "cannot revoke bob: %v")
+	for _, name := range []string{"0", "1", "2"} {
+		file, err := fa.Stat("a/" + name)
+		core.TestErr(t, err, "cannot stat file: %v")
+		err = fa.deleteFromDB(file)
+		core.TestErr(t, err, "cannot delete row: %v")
+	}
+	err = config.DelConfigValue(peers[0].DB, config.PacksDomain, path.Join(peers[0].ID, hashDir("a")))
+	core.TestErr(t, err, "cannot reset segments: %v")
+	ls = names(fa)
+	core.Assert(t, len(ls) == 4, "segments of a former user rejected: %v", ls)
+}
+
+func TestPackSkew(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	bob := security.NewIdentityMust("bob")
+	carl := security.NewIdentityMust("carl")
+	peers := safe.NewTestPeers(t, "fault://pack-skew", alice, bob, carl)
+
+	var fss []*FileSystem
+	for _, p := range peers {
+		f, err := Open(p)
+		core.TestErr(t, err, "cannot open fs: %v")
+		defer f.Close()
+		fss = append(fss, f)
+	}
+	names := func(i int) []string {
+		err := syncHeaders(peers[i], "a")
+		core.TestErr(t, err, "cannot sync headers: %v")
+		files, err := fss[i].List("a", ListOptions{})
+		core.TestErr(t, err, "cannot list files: %v")
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	// alice packs with a clock one hour ahead, so her segment has the name of a later write
+	for i := 0; i < 3; i++ {
+		_, err := fss[0].PutData(fmt.Sprintf("a/%d", i), []byte{byte(i)}, PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+	}
+	n, err := fss[0].Pack("a")
+	core.TestErr(t, err, "cannot pack: %v")
+	core.Assert(t, n == 3, "unexpected number of packed headers: %d", n)
+	segments, err := listSegments(peers[0], hashDir("a"))
+	core.TestErr(t, err, "cannot list segments: %v")
+	core.Assert(t, len(segments) == 1, "unexpected segments: %v", segments)
+	seq, err := strconv.ParseUint(segments[0], 16, 64)
+	core.TestErr(t, err, "cannot parse segment name: %v")
+	ahead := path.Join(PacksDir, hashDir("a"), fmt.Sprintf("%016x", seq+uint64(time.Hour/time.Millisecond)<<22))
+	err = storage.CopyFile(peers[0].Store, ahead, peers[0].Store, path.Join(PacksDir, hashDir("a"), segments[0]))
+	core.TestErr(t, err, "cannot move segment ahead: %v")
+	err = peers[0].Store.Delete(path.Join(PacksDir, hashDir("a"), segments[0]))
+	core.TestErr(t, err, "cannot move segment ahead: %v")
+
+	// bob deletes a packed file with his clock, and carl does not see it again
+	ls := names(1)
+	core.Assert(t, slices.Equal(ls, []string{"0", "1", "2"}), "unexpected files for bob: %v", ls)
+	err = fss[1].Delete("a/1")
+	core.TestErr(t, err, "cannot delete file: %v")
+	ls = names(2)
+	core.Assert(t, slices.Equal(ls, []string{"0", "2"}), "deleted file back for carl: %v", ls)
+}
+
+func TestPackCompact(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	bob := security.NewIdentityMust("bob")
+	carl := security.NewIdentityMust("carl")
+	peers := safe.NewTestPeers(t, "mem://pack-compact", alice, bob, carl)
+
+	var fss []*FileSystem
+	for _, p := range peers {
+		f, err := Open(p)
+		core.TestErr(t, err, "cannot open fs: %v")
+		defer f.Close()
+		fss = append(fss, f)
+	}
+	names := func(i int) []string {
+		err := syncHeaders(peers[i], "a")
+		core.TestErr(t, err, "cannot sync headers: %v")
+		files, err := fss[i].List("a", ListOptions{})
+		core.TestErr(t, err, "cannot list files: %v")
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	segments := func(dir string) int {
+		ls, err := listSegments(peers[0], hashDir(dir))
+		core.TestErr(t, err, "cannot list segments: %v")
+		return len(ls)
+	}
+
+	_, err := fss[0].Mkdir("a/b")
+	core.TestErr(t, err, "cannot create dir: %v")
+	for i := 0; i < 6; i++ {
+		_, err = fss[0].PutData(fmt.Sprintf("a/%d", i), []byte{byte(i)}, PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+		_, err = fss[0].PutData(fmt.Sprintf("a/b/%d", i), []byte{byte(i)}, PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+	}
+	_, err = fss[0].Pack("a")
+	core.TestErr(t, err, "cannot pack: %v")
+	ls := names(1)
+	core.Assert(t, slices.Equal(ls, []string{"0", "1", "2", "3", "4", "5", "b"}), "unexpected files for bob: %v", ls)
+
+	// a delete writes one segment for each directory, whatever the number of files
+	before, beforeB := segments("a"), segments("a/b")
+	err = fss[0].Delete("a/b")
+	core.TestErr(t, err, "cannot delete dir: %v")
+	core.Assert(t, segments("a") == before+1, "unexpected segments in a: %d", segments("a"))
+	core.Assert(t, segments("a/b") == beforeB+1, "unexpected segments in a/b: %d", segments("a/b"))
+
+	// the segments are compacted in one, which bob applies after the removals he did not read and carl from scratch
+	err = fss[0].Delete("a/0")
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = fss[0].Rename("a/1", "a/x")
+	core.TestErr(t, err, "cannot rename file: %v")
+	_, err = fss[0].Pack("a")
+	core.TestErr(t, err, "cannot pack: %v")
+	core.Assert(t, segments("a") == 1, "segments not compacted: %d", segments("a"))
+
+	expected := []string{"2", "3", "4", "5", "x"}
+	for i := range peers {
+		ls = names(i)
+		core.Assert(t, slices.Equal(ls, expected), "unexpected files on %s: %v", peers[i].Identity.Id.Nick(), ls)
+	}
+	data, err := fss[2].GetData("a/x", GetOptions{})
+	core.TestErr(t, err, "cannot get renamed file: %v")
+	core.Assert(t, len(data) == 1 && data[0] == 1, "unexpected data: %v", data)
+
+	// the segments are compacted also by a sync, when they are many
+	threshold := CompactThreshold
+	CompactThreshold = 3
+	defer func() { CompactThreshold = threshold }()
+	for _, name := range []string{"a/2", "a/3"} {
+		err = fss[0].Delete(name)
+		core.TestErr(t, err, "cannot delete file: %v")
+	}
+	ls = names(1)
+	core.Assert(t, slices.Equal(ls, expected[2:]), "unexpected files for bob: %v", ls)
+	core.Assert(t, segments("a") == 1, "segments not compacted by sync: %d", segments("a"))
+	ls = names(2)
+	core.Assert(t, slices.Equal(ls, expected[2:]), "unexpected files for carl: %v", ls)
+}
@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func TestPeers(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	bob := security.NewIdentityMust("bob")
+	peers := safe.NewTestPeers(t, "fault://fs?err=0.1&partial=0.05&stale=0.3&latency=1ms&retry=10&retryBackoff=1ms",
+		alice, bob)
+
+	var fss []*FileSystem
+	for _, p := range peers {
+		f, err := Open(p)
+		core.TestErr(t, err, "cannot open fs on %s: %v", p.Identity.Id.Nick())
+		defer f.Close()
+		for i := 0; i < 2; i++ {
+			name := fmt.Sprintf("shared/%s-%d", p.Identity.Id.Nick(), i)
+			_, err = f.PutData(name, []byte(name), PutOptions{})
+			core.TestErr(t, err, "cannot put %s: %v", name)
+		}
+		fss = append(fss, f)
+	}
+
+	// each peer lists and reads the files of the other once the faults stop
+	for _, p := range peers {
+		storage.Unwrap(p.Store).(*storage.Fault).SetEnabled(false)
+	}
+	expected := []string{"alice-0", "alice-1", "bob-0", "bob-1"}
+	list := func(i int) []string {
+		peers[i].ResetTouch(HeadersDir, hashDir("shared"))
+		files, err := fss[i].List("shared", ListOptions{})
+		core.TestErr(t, err, "cannot list files on %s: %v", peers[i].Identity.Id.Nick())
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	for i, f := range fss {
+		names := list(i)
+		core.Assert(t, slices.Equal(names, expected), "unexpected files on %s: %v", peers[i].Identity.Id.Nick(), names)
+		for _, name := range names {
+			data, err := f.GetData("shared/"+name, GetOptions{})
+			core.TestErr(t, err, "cannot get %s on %s: %v", name, peers[i].Identity.Id.Nick())
+			core.Assert(t, string(data) == "shared/"+name, "unexpected data of %s: %s", name, data)
+		}
+	}
+
+	// a delete on a peer reaches the other
+	err := fss[1].Delete("shared/alice-0")
+	core.TestErr(t, err, "cannot delete file: %v")
+	for i := range fss {
+		names := list(i)
+		core.Assert(t, slices.Equal(names, expected[1:]), "unexpected files on %s after delete: %v",
+			peers[i].Identity.Id.Nick(), names)
+	}
+}
@@ -0,0 +1,301 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stregato/stash/lib/config"
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/crypto/blake2b"
+)
+
+// PoliciesDir holds the directory policies, one for each directory, encrypted for the user group
+var PoliciesDir = path.Join(FSDir, "policies")
+
+// DirPolicy sets the rules for the files in a directory and its subdirectories. Each rule applies from the closest
+// directory that sets it. Policies are signed by an administrator, so that all users enforce the same rules.
+type DirPolicy struct {
+	Dir           string           `json:"dir"`
+	DefaultGroup  safe.GroupName   `json:"defaultGroup"`  // DefaultGroup is the group of files put without one
+	AllowedGroups []safe.GroupName `json:"allowedGroups"` // AllowedGroups are the only groups files can have; empty for any
+	DefaultTags   []string         `json:"defaultTags"`   // DefaultTags are added to the tags of new files
+	Retention     Retention        `json:"retention"`     // Retention prunes the versions instead of the safe config
+	Deleted       bool             `json:"deleted"`       // Deleted marks the tombstone of a deleted policy
+	Signer        security.ID      `json:"signer"`
+	ModTime       time.Time        `json:"modTime"`
+	Signature     []byte           `json:"signature"`
+}
+
+func hashOfPolicy(p DirPolicy) []byte {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	h.Write([]byte(fmt.Sprintf("%s\n%s\n%v\n%s\n%d %d\n%t\n%s %d", p.Dir, p.DefaultGroup, p.AllowedGroups,
+		strings.Join(p.DefaultTags, " "), p.Retention.Versions, p.Retention.Days, p.Deleted, p.Signer,
+		p.ModTime.UnixNano())))
+	return h.Sum(nil)
+}
+
+// isAdmin returns true when the user can sign policies
+func (fs *FileSystem) isAdmin(id security.ID) (bool, error) {
+	if id == fs.S.CreatorID {
+		return true, nil
+	}
+	groups, err := fs.S.GetGroups()
+	if err != nil {
+		return false, err
+	}
+	return groups[safe.AdminGroup].Contains(id), nil
+}
+
+// SetPolicy signs and stores the policy of a directory, replacing the previous one. Only administrators can set
+// policies.
+func (fs *FileSystem) SetPolicy(policy DirPolicy) error {
+	admin, err := fs.isAdmin(fs.S.Identity.Id)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return core.Errorf("ErrNotAdmin: only administrators can set policies")
+	}
+	if policy.DefaultGroup != "" && len(policy.AllowedGroups) > 0 &&
+		!slices.Contains(policy.AllowedGroups, policy.DefaultGroup) {
+		return core.Errorf("default group %s is not in the allowed groups", policy.DefaultGroup)
+	}
+	policy.Deleted = false
+
+	err = fs.writePolicy(policy)
+	if err != nil {
+		return err
+	}
+	core.Info("set policy on %s: %+v", policy.Dir, policy)
+	return nil
+}
+
+// writePolicy signs and stores a policy or a tombstone and reads the policies again
+func (fs *FileSystem) writePolicy(policy DirPolicy) error {
+	var err error
+	policy.Signer = fs.S.Identity.Id
+	policy.ModTime = core.Now()
+	policy.Signature, err = security.Sign(fs.S.Identity, hashOfPolicy(policy))
+	if err != nil {
+		return err
+	}
+
+	keys, err := fs.S.GetKeys(safe.UserGroup, 0)
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(policy)
+	if err != nil {
+		return core.Errorf("failed to marshal policy of %s: %w", policy.Dir, err)
+	}
+	data, err = security.EncryptAES(data, keys[len(keys)-1])
+	if err != nil {
+		return err
+	}
+	fw := FileWrap{Group: safe.UserGroup, EncryptionId: len(keys) - 1, Data: data}
+	err = storage.WriteMsgPack(fs.S.Store, path.Join(PoliciesDir, hashDir(policy.Dir)), fw)
+	if err != nil {
+		return err
+	}
+	fs.S.Touch(PoliciesDir)
+
+	_, err = fs.syncPolicies()
+	return err
+}
+
+// DeletePolicy removes the policy of a directory, so that the rules of the parent directories apply. The policy is
+// replaced by a signed tombstone, since other users keep a policy that disappears from the store.
+func (fs *FileSystem) DeletePolicy(dir string) error {
+	admin, err := fs.isAdmin(fs.S.Identity.Id)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return core.Errorf("ErrNotAdmin: only administrators can delete policies")
+	}
+	return fs.writePolicy(DirPolicy{Dir: dir, Deleted: true})
+}
+
+// Policies returns the policies of the directories
+func (fs *FileSystem) Policies() ([]DirPolicy, error) {
+	policies, err := fs.policies()
+	if err != nil {
+		return nil, err
+	}
+	var ls []DirPolicy
+	for _, p := range policies {
+		ls = append(ls, p)
+	}
+	slices.SortFunc(ls, func(a, b DirPolicy) int { return strings.Compare(a.Dir, b.Dir) })
+	return ls, nil
+}
+
+// policies returns the valid policies by directory. Like the group chain, they are kept in the local DB and read
+// again from the store when another user changes them.
+func (fs *FileSystem) policies() (map[string]DirPolicy, error) {
+	var policies map[string]DirPolicy
+	err := config.GetConfigStruct(fs.S.DB, config.PoliciesDomain, fs.S.ID, &policies)
+	if err == nil && !fs.S.IsUpdated(PoliciesDir) {
+		return livePolicies(policies), nil
+	}
+	return fs.syncPolicies()
+}
+
+// livePolicies returns the policies without the tombstones
+func livePolicies(policies map[string]DirPolicy) map[string]DirPolicy {
+	live := map[string]DirPolicy{}
+	for dir, p := range policies {
+		if !p.Deleted {
+			live[dir] = p
+		}
+	}
+	return live
+}
+
+// syncPolicies reads the policies from the store and keeps the ones signed by an administrator. The local DB keeps
+// the policies and tombstones read before, so that a policy older than the known one or missing from the store
+// without a tombstone does not change the rules.
+func (fs *FileSystem) syncPolicies() (map[string]DirPolicy, error) {
+	ls, err := fs.S.Store.ReadDir(PoliciesDir, storage.Filter{OnlyFiles: true})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var known map[string]DirPolicy
+	err = config.GetConfigStruct(fs.S.DB, config.PoliciesDomain, fs.S.ID, &known)
+	if err != nil && err != sqlx.ErrNoRows {
+		return nil, err
+	}
+
+	policies := map[string]DirPolicy{}
+	for _, l := range ls {
+		if strings.HasPrefix(l.Name(), ".") {
+			continue
+		}
+		p, err := fs.readPolicy(path.Join(PoliciesDir, l.Name()))
+		if core.IsErr(err, "cannot read policy %s: %v", l.Name()) {
+			continue
+		}
+		if hashDir(p.Dir) != l.Name() || !security.Verify(p.Signer, hashOfPolicy(p), p.Signature) {
+			core.Info("invalid signature on policy %s", l.Name())
+			continue
+		}
+		admin, err := fs.isAdmin(p.Signer)
+		if err != nil {
+			return nil, err
+		}
+		if !admin {
+			core.Info("policy %s signed by %s, who is not an administrator", l.Name(), p.Signer.Nick())
+			continue
+		}
+		if k, ok := known[p.Dir]; ok && p.ModTime.Before(k.ModTime) {
+			core.Info("policy %s is older than the one read before", l.Name())
+			continue
+		}
+		policies[p.Dir] = p
+	}
+	for dir, k := range known {
+		if _, ok := policies[dir]; ok {
+			continue
+		}
+		// the known policy stays while its signer is an administrator
+		admin, err := fs.isAdmin(k.Signer)
+		if err != nil {
+			return nil, err
+		}
+		if admin {
+			core.Info("policy of %s is missing, old or invalid in the store, keeping the one read before", dir)
+			policies[dir] = k
+		}
+	}
+
+	err = config.SetConfigStruct(fs.S.DB, config.PoliciesDomain, fs.S.ID, policies)
+	if err != nil {
+		return nil, err
+	}
+	policies = livePolicies(policies)
+	core.Info("synced %d policies", len(policies))
+	return policies, nil
+}
+
+func (fs *FileSystem) readPolicy(name string) (DirPolicy, error) {
+	var fw FileWrap
+	err := storage.ReadMsgPack(fs.S.Store, name, &fw)
+	if err != nil {
+		return DirPolicy{}, err
+	}
+	keys, err := fs.S.GetKeys(fw.Group, fw.EncryptionId+1)
+	if err != nil {
+		return DirPolicy{}, err
+	}
+	if fw.EncryptionId >= len(keys) {
+		return DirPolicy{}, core.Errorf("invalid encryption id %d for group %s", fw.EncryptionId, fw.Group)
+	}
+	data, err := security.DecryptAES(fw.Data, keys[fw.EncryptionId])
+	if err != nil {
+		return DirPolicy{}, err
+	}
+	var p DirPolicy
+	err = msgpack.Unmarshal(data, &p)
+	if err != nil {
+		return DirPolicy{}, core.Errorf("failed to unmarshal policy %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// PolicyOf returns the rules that apply to a directory, each taken from the closest directory that sets it
+func (fs *FileSystem) PolicyOf(dir string) (DirPolicy, error) {
+	policies, err := fs.policies()
+	if err != nil {
+		return DirPolicy{}, err
+	}
+
+	effective := DirPolicy{Dir: dir}
+	for d := dir; ; d = core.Dir(d) {
+		if p, ok := policies[d]; ok {
+			if effective.DefaultGroup == "" {
+				effective.DefaultGroup = p.DefaultGroup
+			}
+			if len(effective.AllowedGroups) == 0 {
+				effective.AllowedGroups = p.AllowedGroups
+			}
+			if len(effective.DefaultTags) == 0 {
+				effective.DefaultTags = p.DefaultTags
+			}
+			if effective.Retention == (Retention{}) {
+				effective.Retention = p.Retention
+			}
+		}
+		if d == "" {
+			return effective, nil
+		}
+	}
+}
+
+// allows returns true when files in the directory can have the group
+func (p DirPolicy) allows(groupName safe.GroupName) bool {
+	return len(p.AllowedGroups) == 0 || slices.Contains(p.AllowedGroups, groupName)
+}
+
+// allowGroup returns an error when the policy of the directory does not allow the group
+func (fs *FileSystem) allowGroup(dir string, groupName safe.GroupName) error {
+	policy, err := fs.PolicyOf(dir)
+	if err != nil {
+		return err
+	}
+	if !policy.allows(groupName) {
+		return core.Errorf("ErrGroupNotAllowed: group %s is not allowed in %s", groupName, dir)
+	}
+	return nil
+}
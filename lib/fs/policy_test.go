@@ -0,0 +1,86 @@
+package fs
+
+import (
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func TestPolicy(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	_, err := s.UpdateGroup("team", safe.Grant, alice.Id)
+	core.TestErr(t, err, "cannot create group: %v")
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	err = f.SetPolicy(DirPolicy{Dir: "team", DefaultGroup: "team", AllowedGroups: []safe.GroupName{"team"},
+		DefaultTags: []string{"shared"}, Retention: Retention{Versions: 1}})
+	core.TestErr(t, err, "cannot set policy: %v")
+	err = f.SetPolicy(DirPolicy{Dir: "team/drafts", DefaultTags: []string{"draft"}})
+	core.TestErr(t, err, "cannot set policy: %v")
+
+	file, err := f.PutData("team/drafts/x", []byte("first"), PutOptions{Tags: []string{"mine"}})
+	core.TestErr(t, err, "cannot put data: %v")
+	core.Assert(t, file.GroupName == "team", "default group not applied: %s", file.GroupName)
+	core.Assert(t, slices.Equal(file.Tags, []string{"mine", "draft"}), "unexpected tags %v", file.Tags)
+
+	_, err = f.PutData("team/y", []byte("data"), PutOptions{GroupName: safe.UserGroup})
+	core.Assert(t, err != nil, "group not allowed by the policy was accepted")
+
+	// the retention of the policy replaces the one in the config
+	_, err = f.PutData("team/drafts/x", []byte("second"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	versions, err := f.Versions("team/drafts/x")
+	core.TestErr(t, err, "cannot list versions: %v")
+	core.Assert(t, len(versions) == 1, "expected 1 version, got %d", len(versions))
+
+	// policies are read again from the store and a changed policy does not match the signature
+	policies, err := f.syncPolicies()
+	core.TestErr(t, err, "cannot sync policies: %v")
+	core.Assert(t, len(policies) == 2, "expected 2 policies, got %d", len(policies))
+	p := policies["team"]
+	p.AllowedGroups = append(p.AllowedGroups, safe.UserGroup)
+	core.Assert(t, !security.Verify(p.Signer, hashOfPolicy(p), p.Signature), "changed policy is valid")
+
+	// an older policy and a policy removed without a tombstone do not change the rules
+	name := path.Join(PoliciesDir, hashDir("team"))
+	old, err := storage.ReadFile(s.Store, name)
+	core.TestErr(t, err, "cannot read policy: %v")
+	err = f.SetPolicy(DirPolicy{Dir: "team", DefaultGroup: "team", DefaultTags: []string{"shared", "new"}})
+	core.TestErr(t, err, "cannot set policy: %v")
+	err = storage.WriteFile(s.Store, name, old)
+	core.TestErr(t, err, "cannot restore old policy: %v")
+	policies, err = f.syncPolicies()
+	core.TestErr(t, err, "cannot sync policies: %v")
+	core.Assert(t, len(policies["team"].DefaultTags) == 2, "older policy accepted: %v", policies["team"])
+	err = s.Store.Delete(name)
+	core.TestErr(t, err, "cannot delete policy file: %v")
+	policies, err = f.syncPolicies()
+	core.TestErr(t, err, "cannot sync policies: %v")
+	_, ok := policies["team"]
+	core.Assert(t, ok, "policy dropped without a tombstone")
+
+	// a delete leaves a signed tombstone
+	err = f.DeletePolicy("team/drafts")
+	core.TestErr(t, err, "cannot delete policy: %v")
+	tombstone, err := f.readPolicy(path.Join(PoliciesDir, hashDir("team/drafts")))
+	core.TestErr(t, err, "cannot read tombstone: %v")
+	core.Assert(t, tombstone.Deleted && security.Verify(tombstone.Signer, hashOfPolicy(tombstone),
+		tombstone.Signature), "invalid tombstone: %+v", tombstone)
+	policy, err := f.PolicyOf("team/drafts")
+	core.TestErr(t, err, "cannot get policy: %v")
+	core.Assert(t, slices.Equal(policy.DefaultTags, []string{"shared", "new"}), "parent policy not applied: %v",
+		policy.DefaultTags)
+	ls, err := f.Policies()
+	core.TestErr(t, err, "cannot list policies: %v")
+	core.Assert(t, len(ls) == 1, "tombstone listed as a policy: %v", ls)
+}
@@ -1,16 +1,18 @@
 package fs
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
+	"slices"
 
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/safe"
 	"github.com/stregato/stash/lib/security"
 	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
 )
 
 type PutOptions struct {
@@ -20,10 +22,16 @@ type PutOptions struct {
 	GroupName  safe.GroupName `json:"groupName"`  // the group name of the file. If empty, the group name is calculated from the directory
 	Tags       []string       `json:"tags"`       // the tags of the file
 	Attributes map[string]any `json:"attributes"` // the attributes of the file
+	// Compression is applied before encryption: zstd, none, or empty for the safe default. Incompressible files are
+	// stored as they are
+	Compression string `json:"compression"`
+	// Dedup splits the body in content-defined chunks, so that identical parts of files in the same group are stored
+	// once. The safe config can enable it for all files
+	Dedup bool `json:"dedup"`
 }
 
 func (fs *FileSystem) PutData(dest string, src []byte, options PutOptions) (File, error) {
-	file, err := fs.createHeader(dest, len(src), options)
+	file, err := fs.createHeader(dest, len(src), src, options)
 	if err != nil {
 		return File{}, err
 	}
@@ -35,15 +43,10 @@ func (fs *FileSystem) PutData(dest string, src []byte, options PutOptions) (File
 		if err != nil {
 			return File{}, err
 		}
-		triggerAsync <- file.ID
+		fs.triggerAsync(file.ID)
 		return file, nil
 	}
-	err = fs.putSync(file, "", src, options.DeleteSrc)
-	if err != nil {
-		return File{}, err
-	}
-
-	return file, nil
+	return fs.putSync(file, "", src, options.DeleteSrc, &storage.Upload{}, nil)
 }
 
 func (fs *FileSystem) PutFile(dest string, src string, options PutOptions) (File, error) {
@@ -52,7 +55,11 @@ func (fs *FileSystem) PutFile(dest string, src string, options PutOptions) (File
 		return File{}, err
 	}
 
-	file, err := fs.createHeader(dest, int(stat.Size()), options)
+	sample, err := readSample(src, options)
+	if err != nil {
+		return File{}, err
+	}
+	file, err := fs.createHeader(dest, int(stat.Size()), sample, options)
 	if err != nil {
 		return File{}, err
 	}
@@ -64,24 +71,41 @@ func (fs *FileSystem) PutFile(dest string, src string, options PutOptions) (File
 
 	if options.Async {
 		core.Info("putting file %s asynchronously", dest)
-		_, err = fs.S.DB.Exec("STASH_INSERT_FILE_ASYNC", sqlx.Args{"id": file.ID,
+		_, err = fs.S.DB.Exec("STASH_INSERT_FILE_ASYNC", sqlx.Args{"id": file.ID, "safeID": fs.S.ID,
 			"operation": "put", "file": file, "data": nil, "localCopy": src, "deleteSrc": options.DeleteSrc})
 		if err != nil {
 			return File{}, err
 		}
-		triggerAsync <- file.ID
+		fs.triggerAsync(file.ID)
 
 		return file, nil
 	}
 
-	err = fs.putSync(file, src, nil, options.DeleteSrc)
+	return fs.putSync(file, src, nil, options.DeleteSrc, &storage.Upload{}, nil)
+}
+
+// readSample reads the beginning of a file to check whether it is compressible
+func readSample(src string, options PutOptions) ([]byte, error) {
+	if options.Compression == core.NoCompression {
+		return nil, nil
+	}
+	f, err := os.Open(src)
 	if err != nil {
-		return File{}, err
+		return nil, err
 	}
-	return file, nil
+	defer f.Close()
+
+	sample := make([]byte, core.CompressionSample)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return sample[:n], nil
 }
 
-func (fs *FileSystem) createHeader(dest string, size int, options PutOptions) (File, error) {
+// createHeader returns the header of a new file. The body is compressed when compression is enabled and the sample of
+// the content is compressible.
+func (fs *FileSystem) createHeader(dest string, size int, sample []byte, options PutOptions) (File, error) {
 	var err error
 	dir, name := core.SplitPath(dest)
 
@@ -94,11 +118,30 @@ func (fs *FileSystem) createHeader(dest string, size int, options PutOptions) (F
 		}
 	}
 
+	policy, err := fs.PolicyOf(dir)
+	if err != nil {
+		return File{}, err
+	}
+	if !policy.allows(groupName) {
+		return File{}, core.Errorf("ErrGroupNotAllowed: group %s is not allowed in %s", groupName, dir)
+	}
+	tags := options.Tags
+	for _, tag := range policy.DefaultTags {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
 	id := options.ID
 	if id == 0 {
 		id = FileID(core.SnowID())
 	}
 
+	compression := fs.S.Compression(options.Compression)
+	if compression != "" && !core.IsCompressible(sample) {
+		compression = ""
+	}
+
 	return File{
 		ID:            id,
 		Dir:           dir,
@@ -107,13 +150,19 @@ func (fs *FileSystem) createHeader(dest string, size int, options PutOptions) (F
 		Creator:       fs.S.Identity.Id,
 		Size:          size,
 		ModTime:       core.Now(),
-		Tags:          options.Tags,
+		Tags:          tags,
 		Attributes:    options.Attributes,
 		EncryptionKey: core.GenerateRandomBytes(48),
+		Compression:   compression,
+		Dedup:         size > 0 && (options.Dedup || fs.S.Config.Dedup),
 	}, nil
 }
 
-func (fs *FileSystem) putSync(file File, localPath string, data []byte, deleteSrc bool) error {
+// putSync writes the body and the header of a file and returns the header. The body is uploaded in parts when the
+// store supports it, so that an interrupted upload continues from the state passed to save. A deduplicated body is
+// written as chunks instead, which are compressed one by one.
+func (fs *FileSystem) putSync(file File, localPath string, data []byte, deleteSrc bool, upload *storage.Upload,
+	save func(storage.Upload) error) (File, error) {
 	var err error
 	var src io.ReadSeeker
 
@@ -125,67 +174,85 @@ func (fs *FileSystem) putSync(file File, localPath string, data []byte, deleteSr
 		core.Info("putting file %s from local file %s", file.ID, localPath)
 		f, err := os.Open(file.LocalCopy)
 		if err != nil {
-			return err
+			return File{}, err
 		}
 		src = f
 		defer f.Close()
 	default:
-		return core.Errorf("no data source provided for file %s", file.ID)
+		return File{}, core.Errorf("no data source provided for file %s", file.ID)
 	}
 
-	// write the body
-	err = writeBody(fs.S, path.Join(DataDir, file.ID.String()), src, file.EncryptionKey)
-	if err != nil {
-		return err
-	}
+	if file.Dedup {
+		// unreferenced chunks are left to CollectChunks, since other files may share them
+		file.Manifest, err = writeChunks(fs.S, src, file)
+		if err != nil {
+			return File{}, err
+		}
+		_, err = writeHeader(fs.S, file)
+		if err != nil {
+			return File{}, err
+		}
+	} else {
+		if file.Compression != "" {
+			compressed, cleanup, err := compressBody(src, data != nil, file.Compression)
+			if err != nil {
+				return File{}, err
+			}
+			defer cleanup()
+			src = compressed
+		}
 
-	_, err = writeHeader(fs.S, file)
-	if err != nil {
-		fs.S.Store.Delete(path.Join(DataDir, file.ID.String()))
-		return err
+		// write the body
+		err = writeBody(fs.S, path.Join(DataDir, file.ID.String()), src, file.EncryptionKey, upload, save)
+		if err != nil {
+			return File{}, err
+		}
+
+		_, err = writeHeader(fs.S, file)
+		if err != nil {
+			fs.S.Store.Delete(path.Join(DataDir, file.ID.String()))
+			return File{}, err
+		}
 	}
 
 	if deleteSrc && file.LocalCopy != "" {
 		os.Remove(file.LocalCopy)
 	}
 
-	err = syncHeaders(fs.S, file.Dir)
+	fs.afterPut(file)
+	return file, nil
+}
+
+// afterPut adds a new file to the DB, notifies the other users and prunes the old versions
+func (fs *FileSystem) afterPut(file File) {
+	err := syncHeaders(fs.S, file.Dir)
 	if err != nil {
 		core.Info("failed to sync headers: %v", err)
 	}
 
-	dir := file.Dir
-	for dir != "" {
-		fs.S.Touch(HeadersDir, hashDir(dir))
-		dir = core.Dir(dir)
-	}
+	fs.touchDirs(file.Dir)
 
-	return nil
+	_, err = fs.Prune(file.Path(), Retention{})
+	if err != nil {
+		core.Info("failed to prune versions of %s: %v", file.Path(), err)
+	}
 }
 
+// calculateGroup returns the group of new files in a directory: the group of the closest directory with one, or the
+// user group
 func (fs *FileSystem) calculateGroup(dir string) (safe.GroupName, error) {
-	var groupName safe.GroupName
-	for {
-		err := fs.S.DB.QueryRow(STASH_GET_GROUP_NAME, sqlx.Args{"safeID": fs.S.ID, "dir": dir, "name": ""}, &groupName)
-		if err != sqlx.ErrNoRows && err != nil {
-			return "", err
-		}
-		if groupName != "" {
-			return groupName, nil
-		}
-		if dir == "" {
-			return safe.UserGroup, nil
-		}
-		index := strings.LastIndex(dir, "/")
-		if index == -1 {
-			dir = ""
-		} else {
-			dir = dir[:index]
-		}
+	groupName, err := fs.dirGroup(dir)
+	if err != nil {
+		return "", err
 	}
+	if groupName == "" {
+		return safe.UserGroup, nil
+	}
+	return groupName, nil
 }
 
-func writeBody(s *safe.Safe, dest string, src io.ReadSeeker, key []byte) error {
+func writeBody(s *safe.Safe, dest string, src io.ReadSeeker, key []byte, upload *storage.Upload,
+	save func(storage.Upload) error) error {
 	aesKey := key[:32]
 	aesIV := key[32:]
 	r, err := security.EncryptReader(src, aesKey, aesIV)
@@ -193,5 +260,36 @@ func writeBody(s *safe.Safe, dest string, src io.ReadSeeker, key []byte) error {
 		return err
 	}
 	core.Info("writing body to %s", dest)
-	return s.Store.Write(dest, r, nil)
+	return storage.WriteResumable(s.Store, dest, r, upload, save, nil)
+}
+
+// compressBody compresses the source in memory or, for local files, in a temporary file, so that the result can be
+// uploaded in parts. The compression is deterministic, so that an interrupted upload continues on the same content.
+func compressBody(src io.ReadSeeker, inMemory bool, compression string) (io.ReadSeeker, func(), error) {
+	if inMemory {
+		var b bytes.Buffer
+		err := core.CompressStream(&b, src, compression)
+		if err != nil {
+			return nil, nil, err
+		}
+		return core.NewBytesReader(b.Bytes()), func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "stash-compress-")
+	if core.IsErr(err, "cannot create temporary file for compression: %v") {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	err = core.CompressStream(tmp, src, compression)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return tmp, cleanup, nil
 }
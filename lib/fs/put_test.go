@@ -1,13 +1,17 @@
 package fs
 
 import (
+	"bytes"
 	"os"
+	"path"
 	"testing"
 	"time"
 
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/safe"
 	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
 )
 
 func TestPutData(t *testing.T) {
@@ -34,6 +38,13 @@ func TestPutData(t *testing.T) {
 	data, err := f.GetData("sub/test", GetOptions{})
 	core.TestErr(t, err, "cannot get data: %v")
 	core.Assert(t, string(data) == "hello world", "unexpected data: %s", data)
+
+	data, err = f.GetData("sub/test", GetOptions{Range: &storage.Range{From: 6, To: 11}})
+	core.TestErr(t, err, "cannot get range: %v")
+	core.Assert(t, string(data) == "world", "unexpected range data: %s", data)
+
+	_, err = f.GetData("sub/test", GetOptions{Range: &storage.Range{From: 6, To: 12}})
+	core.Assert(t, err != nil, "range beyond the end should fail")
 }
 func TestPutFile(t *testing.T) {
 	alice := security.NewIdentityMust("alice")
@@ -57,6 +68,61 @@ func TestPutFile(t *testing.T) {
 	core.Assert(t, string(data) == "hello world", "unexpected data: %s", data)
 }
 
+func TestPutCompressed(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 1000)
+	file, err := f.PutData("text", text, PutOptions{Compression: core.ZstdCompression})
+	core.TestErr(t, err, "cannot put data: %v")
+	core.Assert(t, file.Compression == core.ZstdCompression, "text not compressed")
+	stat, err := s.Store.Stat(path.Join(DataDir, file.ID.String()))
+	core.TestErr(t, err, "cannot stat body: %v")
+	core.Assert(t, stat.Size() < int64(len(text))/10, "body not compressed: %d", stat.Size())
+
+	file, err = f.Stat("text")
+	core.TestErr(t, err, "cannot stat file: %v")
+	core.Assert(t, file.Compression == core.ZstdCompression, "compression not recorded")
+	data, err := f.GetData("text", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, bytes.Equal(data, text), "unexpected data")
+	data, err = f.GetData("text", GetOptions{Range: &storage.Range{From: 4, To: 9}})
+	core.TestErr(t, err, "cannot get range: %v")
+	core.Assert(t, string(data) == "quick", "unexpected range data: %s", data)
+
+	// random data is stored as it is
+	random := core.GenerateRandomBytes(4096)
+	file, err = f.PutData("random", random, PutOptions{Compression: core.ZstdCompression})
+	core.TestErr(t, err, "cannot put data: %v")
+	core.Assert(t, file.Compression == "", "random data compressed")
+
+	// the safe policy applies unless the put disables it
+	s.Config.Compression = core.ZstdCompression
+	tf := path.Join(t.TempDir(), "text")
+	err = os.WriteFile(tf, text, 0644)
+	core.TestErr(t, err, "cannot write temp file: %v")
+	file, err = f.PutFile("file", tf, PutOptions{})
+	core.TestErr(t, err, "cannot put file: %v")
+	core.Assert(t, file.Compression == core.ZstdCompression, "file not compressed with the safe policy")
+	data, err = f.GetData("file", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, bytes.Equal(data, text), "unexpected data")
+	file, err = f.PutData("plain", text, PutOptions{Compression: core.NoCompression})
+	core.TestErr(t, err, "cannot put data: %v")
+	core.Assert(t, file.Compression == "", "compression not disabled")
+
+	// headers carry their compression inside the encrypted data
+	for _, h := range [][]byte{text, {0, 1, 2}, nil} {
+		d, err := core.DecompressTagged(core.CompressTagged(h, core.ZstdCompression))
+		core.TestErr(t, err, "cannot decompress header: %v")
+		core.Assert(t, bytes.Equal(d, h), "unexpected header %v", d)
+	}
+}
+
 func TestAsyncPutData(t *testing.T) {
 	alice := security.NewIdentityMust("alice")
 	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
@@ -77,3 +143,118 @@ func TestAsyncPutData(t *testing.T) {
 	core.TestErr(t, err, "cannot get data: %v")
 	core.Assert(t, string(data) == "hello world", "unexpected data: %s", data)
 }
+
+func TestAsyncPutClose(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	// the safe and its DB can be closed as soon as the file system is, even with a pending put
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	_, err = f.PutData("test", core.GenerateRandomBytes(1024*1024), PutOptions{Async: true})
+	core.TestErr(t, err, "cannot put data: %v")
+	f.Close()
+	s.Close()
+	s.DB.Close()
+}
+
+func TestAsyncPutResume(t *testing.T) {
+	partSize := storage.PartSize
+	storage.PartSize = 1024
+	defer func() { storage.PartSize = partSize }()
+
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+	data := core.GenerateRandomBytes(10 * 1024)
+
+	// the upload stops after three parts, as for a crash, before the file system starts the async job
+	f := &FileSystem{S: s}
+	file, err := f.createHeader("big", len(data), data, PutOptions{})
+	core.TestErr(t, err, "cannot create header: %v")
+	_, err = s.DB.Exec("STASH_INSERT_FILE_ASYNC", sqlx.Args{"id": file.ID, "safeID": s.ID,
+		"operation": "put", "file": file, "data": data, "localCopy": "", "deleteSrc": false})
+	core.TestErr(t, err, "cannot insert async put: %v")
+
+	var parts int
+	save := func(u storage.Upload) error {
+		_, err := s.DB.Exec("STASH_SET_FILE_ASYNC_UPLOAD", sqlx.Args{"id": file.ID, "safeID": s.ID, "upload": u})
+		core.TestErr(t, err, "cannot save upload: %v")
+		if parts++; parts == 3 {
+			return os.ErrDeadlineExceeded
+		}
+		return nil
+	}
+	_, err = f.putSync(file, "", data, false, &storage.Upload{}, save)
+	core.Assert(t, err != nil, "interrupted put did not fail")
+
+	var upload storage.Upload
+	err = s.DB.QueryRow("STASH_GET_FILE_ASYNC", sqlx.Args{"id": file.ID, "safeID": s.ID},
+		&file, &data, new(bool), new(string), new(string), &upload)
+	core.TestErr(t, err, "cannot get async put: %v")
+	core.Assert(t, upload.Offset == 3*1024, "wrong saved offset %d", upload.Offset)
+
+	f, err = Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+	for i := 0; !f.HasPutCompleted(file.ID); i++ {
+		core.Assert(t, i < 100, "async put not resumed")
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	got, err := f.GetData("big", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, bytes.Equal(got, data), "wrong content after resume")
+}
+
+func TestDedup(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	minSize, avgSize, maxSize, grace := ChunkMinSize, ChunkAvgSize, ChunkMaxSize, ChunkGracePeriod
+	ChunkMinSize, ChunkAvgSize, ChunkMaxSize = 1024, 4096, 16384
+	defer func() { ChunkMinSize, ChunkAvgSize, ChunkMaxSize, ChunkGracePeriod = minSize, avgSize, maxSize, grace }()
+
+	countChunks := func() int {
+		chunks, err := s.Store.ReadDir(ChunksDir, storage.Filter{OnlyFiles: true})
+		core.TestErr(t, err, "cannot list chunks: %v")
+		return len(chunks)
+	}
+
+	data := core.GenerateRandomBytes(256 * 1024)
+	file, err := f.PutData("a", data, PutOptions{Dedup: true})
+	core.TestErr(t, err, "cannot put data: %v")
+	core.Assert(t, file.Dedup && len(file.Manifest.Chunks) > 1, "body not split in chunks")
+	_, err = s.Store.Stat(path.Join(DataDir, file.ID.String()))
+	core.Assert(t, err != nil, "body written for a deduplicated file")
+	count := countChunks()
+	core.Assert(t, count == len(file.Manifest.Chunks), "unexpected number of chunks: %d", count)
+
+	// an insertion changes only the chunks around it
+	modified := append(append(append([]byte{}, data[:100000]...), []byte("inserted")...), data[100000:]...)
+	s.Config.Dedup = true
+	_, err = f.PutData("b", modified, PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	core.Assert(t, countChunks() <= count+3, "chunks not shared: %d of %d", countChunks(), count)
+
+	got, err := f.GetData("b", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, bytes.Equal(got, modified), "unexpected data")
+	got, err = f.GetData("b", GetOptions{Range: &storage.Range{From: 99990, To: 100020}})
+	core.TestErr(t, err, "cannot get range: %v")
+	core.Assert(t, bytes.Equal(got, modified[99990:100020]), "unexpected range data")
+
+	// after deleting a file only the chunks of the other stay
+	err = f.Delete("b")
+	core.TestErr(t, err, "cannot delete file: %v")
+	ChunkGracePeriod = 0
+	deleted, err := f.CollectChunks()
+	core.TestErr(t, err, "cannot collect chunks: %v")
+	core.Assert(t, countChunks() == count, "unexpected chunks after collection: %d, deleted %d", countChunks(), deleted)
+	got, err = f.GetData("a", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, bytes.Equal(got, data), "unexpected data after collection")
+}
@@ -2,11 +2,14 @@ package fs
 
 import (
 	"os"
-	"path"
 
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
 	"github.com/stregato/stash/lib/sqlx"
 )
 
+// Rename renames the latest version of a file. A file moved to another directory takes the group of the directory,
+// when it has one.
 func (fs *FileSystem) Rename(old, new string) (File, error) {
 	file, err := fs.Stat(old)
 	if err != nil {
@@ -17,28 +20,72 @@ func (fs *FileSystem) Rename(old, new string) (File, error) {
 		return File{}, os.ErrPermission
 	}
 
-	err = fs.S.Store.Delete(path.Join(HeadersDir, hashDir(file.Dir), file.ID.String()))
+	dir, name := core.SplitPath(new)
+	r := removals{}
+	file, err = fs.moveVersion(file, dir, name, r)
+	err = r.write(fs.S, err)
 	if err != nil {
 		return File{}, err
 	}
+	return file, nil
+}
 
+// moveVersion writes the header of a version under its new directory and removes the old one. When the version moves
+// to a directory with a different group, it is encrypted for that group.
+func (fs *FileSystem) moveVersion(file File, dir, name string, r removals) (File, error) {
 	oldName := file.Name
 	oldDir := file.Dir
-	file.Name = path.Base(new)
-	file.Dir = path.Dir(new)
-	if file.Dir == "." {
-		file.Dir = ""
+	var groupName safe.GroupName
+	if dir != oldDir {
+		var err error
+		groupName, err = fs.dirGroup(dir)
+		if err != nil {
+			return File{}, err
+		}
+	}
+	if groupName != "" && groupName != file.GroupName {
+		var err error
+		file, err = fs.encryptBody(file, groupName, false)
+		if err != nil {
+			return File{}, err
+		}
+	}
+
+	err := fs.allowGroup(dir, file.GroupName)
+	if err != nil {
+		return File{}, err
 	}
+
+	// the new header is written before the old one is removed, so that an interruption leaves a duplicate and not a
+	// lost file. In the same directory the header is replaced in place and only its removal is recorded.
+	file.Name = name
+	file.Dir = dir
 	_, err = writeHeader(fs.S, file)
 	if err != nil {
 		return File{}, err
 	}
+	if dir != oldDir {
+		err = r.deleteHeader(fs.S, oldDir, file.ID)
+		if err != nil {
+			return File{}, err
+		}
+	} else {
+		r.add(oldDir, file.ID)
+	}
 
 	_, err = fs.S.DB.Exec("STASH_RENAME_FILE", sqlx.Args{"safeID": fs.S.ID, "oldDir": oldDir, "oldName": oldName,
 		"newDir": file.Dir, "newName": file.Name, "id": file.ID.Uint64()})
 	if err != nil {
 		return File{}, err
 	}
+	if groupName != "" {
+		err = writeFileToDB(fs.S, file)
+		if err != nil {
+			return File{}, err
+		}
+	}
+	storeDirs(fs.S, file.Dir)
+	fs.touchDirs(file.Dir)
 
 	return file, nil
 }
@@ -0,0 +1,178 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func init() {
+	safe.RegisterScrubber("fs", scrub)
+}
+
+// walkHeaders reads all the headers in the store, including the packed ones and the ones in the trash, and calls fn with the path and the content of each, or the error
+// when the header cannot be read. It stops at the first error returned by fn.
+func walkHeaders(s *safe.Safe, fn func(name string, f File, err error) error) error {
+	dirs, err := s.Store.ReadDir(HeadersDir, storage.Filter{OnlyFolders: true})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	loose := core.Set[string]{}
+	for _, dir := range dirs {
+		headers, err := s.Store.ReadDir(path.Join(HeadersDir, dir.Name()), storage.Filter{OnlyFiles: true})
+		if err != nil {
+			return err
+		}
+		for _, h := range headers {
+			if strings.HasPrefix(h.Name(), ".") {
+				continue
+			}
+			name := path.Join(HeadersDir, dir.Name(), h.Name())
+			loose.Add(path.Join(dir.Name(), h.Name()))
+			f, err := readHeaderAt(s, name)
+			err = fn(name, f, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// a packed header has the path of its segment followed by its name
+	packs, err := s.Store.ReadDir(PacksDir, storage.Filter{OnlyFolders: true})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range packs {
+		headers, segments, err := packedHeaders(s, dir.Name())
+		if err != nil {
+			err = fn(path.Join(PacksDir, dir.Name()), File{}, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for name, p := range headers {
+			if loose.Contains(path.Join(dir.Name(), name)) {
+				continue
+			}
+			src := path.Join(segments[name], name)
+			f, err := decodeHeader(s, p.Data, src)
+			err = fn(src, f, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// trashed headers still own their bodies and chunks
+	trash, err := s.Store.ReadDir(TrashDir, storage.Filter{OnlyFiles: true})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, h := range trash {
+		if strings.HasSuffix(h.Name(), tombstoneExt) {
+			continue
+		}
+		name := path.Join(TrashDir, h.Name())
+		f, err := readHeaderAt(s, name)
+		err = fn(name, f, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrub checks that every header decrypts and that its body or chunks exist with the expected size. Bodies and chunks
+// that no header references are orphans. Unreferenced bodies and chunks are deleted only when all the headers are
+// readable.
+func scrub(s *safe.Safe, options safe.ScrubOptions, report *safe.ScrubReport) error {
+	headers := core.Set[string]{}
+	chunks := core.Set[string]{}
+	unreadable := false
+	err := walkHeaders(s, func(name string, f File, err error) error {
+		report.Checked++
+		headers.Add(path.Base(name))
+		if err != nil {
+			report.Add(safe.IssueUnreadable, name, err.Error())
+			unreadable = true
+			return nil
+		}
+
+		if f.IsDir {
+			return nil
+		}
+		if f.Dedup {
+			for _, chunk := range f.Manifest.Chunks {
+				chunks.Add(chunk.Hash)
+			}
+			return nil
+		}
+		body := path.Join(DataDir, f.ID.String())
+		stat, err := s.Store.Stat(body)
+		switch {
+		case os.IsNotExist(err):
+			report.Add(safe.IssueMissing, body, fmt.Sprintf("body of %s/%s", f.Dir, f.Name))
+		case err != nil:
+			report.Add(safe.IssueUnreadable, body, err.Error())
+		case f.Compression == "" && stat.Size() != int64(f.Size):
+			// encryption keeps the length, while compression changes it in a way the header does not record
+			report.Add(safe.IssueSize, body, fmt.Sprintf("size %d instead of %d", stat.Size(), f.Size))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bodies, err := s.Store.ReadDir(DataDir, storage.Filter{OnlyFiles: true})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, body := range bodies {
+		report.Checked++
+		if headers.Contains(body.Name()) {
+			continue
+		}
+		name := path.Join(DataDir, body.Name())
+		if unreadable {
+			// the header may be in a segment that cannot be read
+			report.Add(safe.IssueOrphan, name, "body without header, kept since some headers are unreadable")
+			continue
+		}
+		report.Remove(s, options, name, safe.IssueOrphan, "body without header",
+			core.Since(body.ModTime()) >= options.GracePeriod)
+	}
+
+	ls, err := s.Store.ReadDir(ChunksDir, storage.Filter{OnlyFiles: true})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stored := core.Set[string]{}
+	for _, chunk := range ls {
+		report.Checked++
+		stored.Add(chunk.Name())
+		if chunks.Contains(chunk.Name()) {
+			continue
+		}
+		name := path.Join(ChunksDir, chunk.Name())
+		if unreadable {
+			report.Add(safe.IssueOrphan, name, "chunk without header, kept since some headers are unreadable")
+			continue
+		}
+		// a put references chunks only after writing them, so the grace period must cover the one of chunks
+		report.Remove(s, options, name, safe.IssueOrphan, "chunk without header",
+			core.Since(chunk.ModTime()) >= max(options.GracePeriod, ChunkGracePeriod))
+	}
+	for hash := range chunks {
+		if !stored.Contains(hash) {
+			report.Add(safe.IssueMissing, path.Join(ChunksDir, hash), "chunk of a deduplicated file")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func TestScrub(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	_, err = f.PutData("ok", []byte("hello world"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	report, err := s.Scrub(safe.ScrubOptions{})
+	core.TestErr(t, err, "cannot scrub: %v")
+	core.Assert(t, len(report.Issues) == 0, "unexpected issues: %v", report.Issues)
+
+	// a header without body, a body with the wrong size and a body without header
+	missing, err := f.PutData("missing", []byte("hello world"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	err = s.Store.Delete(path.Join(DataDir, missing.ID.String()))
+	core.TestErr(t, err, "cannot delete body: %v")
+	truncated, err := f.PutData("truncated", []byte("hello world"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	err = storage.WriteFile(s.Store, path.Join(DataDir, truncated.ID.String()), []byte("hello"))
+	core.TestErr(t, err, "cannot truncate body: %v")
+	orphan := path.Join(DataDir, "1234")
+	err = storage.WriteFile(s.Store, orphan, []byte("orphan"))
+	core.TestErr(t, err, "cannot write orphan: %v")
+
+	kinds := map[string]string{}
+	report, err = s.Scrub(safe.ScrubOptions{Delete: true})
+	core.TestErr(t, err, "cannot scrub: %v")
+	for _, issue := range report.Issues {
+		kinds[issue.Path] = issue.Kind
+		core.Assert(t, !issue.Deleted, "%s deleted within the grace period", issue.Path)
+	}
+	core.Assert(t, len(report.Issues) == 3, "unexpected issues: %v", report.Issues)
+	core.Assert(t, kinds[path.Join(DataDir, missing.ID.String())] == safe.IssueMissing, "missing body not found")
+	core.Assert(t, kinds[path.Join(DataDir, truncated.ID.String())] == safe.IssueSize, "wrong size not found")
+	core.Assert(t, kinds[orphan] == safe.IssueOrphan, "orphan body not found")
+
+	report, err = s.Scrub(safe.ScrubOptions{Delete: true, GracePeriod: time.Nanosecond})
+	core.TestErr(t, err, "cannot scrub: %v")
+	core.Assert(t, len(report.Issues) == 3, "unexpected issues: %v", report.Issues)
+	_, err = s.Store.Stat(orphan)
+	core.Assert(t, err != nil, "orphan not deleted")
+}
+
+func TestScrubUnreadableSegment(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	threshold := PackThreshold
+	PackThreshold = 2
+	defer func() { PackThreshold = threshold }()
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		file, err := f.PutData(fmt.Sprintf("a/%d", i), []byte("hello world"), PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+		bodies = append(bodies, path.Join(DataDir, file.ID.String()))
+	}
+	segments, err := listSegments(s, hashDir("a"))
+	core.TestErr(t, err, "cannot list segments: %v")
+	core.Assert(t, len(segments) > 0, "headers not packed")
+
+	// the bodies of the headers in a segment that cannot be read are kept
+	name := path.Join(PacksDir, hashDir("a"), segments[0])
+	var seg Segment
+	err = storage.ReadMsgPack(s.Store, name, &seg)
+	core.TestErr(t, err, "cannot read segment: %v")
+	seg.Signature[0] ^= 0xff
+	err = storage.WriteMsgPack(s.Store, name, seg)
+	core.TestErr(t, err, "cannot tamper segment: %v")
+	report, err := s.Scrub(safe.ScrubOptions{Delete: true, GracePeriod: time.Nanosecond})
+	core.TestErr(t, err, "cannot scrub: %v")
+	unreadable := false
+	for _, issue := range report.Issues {
+		core.Assert(t, !issue.Deleted, "%s deleted with unreadable headers", issue.Path)
+		unreadable = unreadable || issue.Kind == safe.IssueUnreadable
+	}
+	core.Assert(t, unreadable, "unreadable segment not reported: %v", report.Issues)
+	for _, body := range bodies {
+		_, err = s.Store.Stat(body)
+		core.TestErr(t, err, "body %s deleted: %v", body)
+	}
+}
@@ -9,22 +9,44 @@ import (
 )
 
 func (f *FileSystem) Stat(name string) (File, error) {
+	return f.StatVersion(name, 0)
+}
+
+// StatVersion returns the information of a version of a file, or of the latest one when version is 0
+func (f *FileSystem) StatVersion(name string, version FileID) (File, error) {
 	dir, name := core.SplitPath(name)
 
 	var file File
 	var tags string
-	err := f.S.DB.QueryRow("STASH_GET_FILE_BY_NAME", sqlx.Args{"safeID": f.S.ID, "dir": dir, "name": name},
-		&file.ID, &file.GroupName, &tags, &file.ModTime, &file.Size, &file.Creator, &file.Attributes,
-		&file.LocalCopy, &file.CopyTime, &file.EncryptionKey)
+	var err error
+	if version == 0 {
+		err = f.S.DB.QueryRow("STASH_GET_FILE_BY_NAME", sqlx.Args{"safeID": f.S.ID, "dir": dir, "name": name},
+			statFields(&file, &tags)...)
+	} else {
+		err = f.S.DB.QueryRow("STASH_GET_FILE_VERSION", sqlx.Args{"safeID": f.S.ID, "dir": dir, "name": name,
+			"id": version.Uint64()}, statFields(&file, &tags)...)
+	}
 	if err == sqlx.ErrNoRows {
 		return File{}, os.ErrNotExist
 	}
 	if err != nil {
 		return File{}, err
 	}
+	file.setStat(dir, name, tags)
+	return file, nil
+}
+
+// statFields returns the destinations of the columns read by Stat
+func statFields(file *File, tags *string) []any {
+	return []any{&file.ID, &file.GroupName, tags, &file.ModTime, &file.Size, &file.Creator, &file.Attributes,
+		&file.LocalCopy, &file.CopyTime, &file.EncryptionKey, &file.Compression, &file.Manifest}
+}
+
+// setStat completes a file read with statFields
+func (file *File) setStat(dir, name, tags string) {
 	file.Name = name
 	file.Dir = dir
 	file.Tags = strings.Split(strings.TrimSpace(tags), " ")
 	file.IsDir = file.ID == 0
-	return file, nil
+	file.Dedup = len(file.Manifest.Chunks) > 0
 }
@@ -0,0 +1,242 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/storage"
+)
+
+// ReadAhead is the number of bytes a Reader fetches from the store with each range read
+var ReadAhead = 1024 * 1024
+
+// Reader reads the content of a file with range reads as it is consumed
+type Reader struct {
+	fs        *FileSystem
+	file      File
+	pos       int64
+	buf       []byte
+	bufPos    int64         // bufPos is the offset of buf in the content
+	stream    io.ReadCloser // stream decompresses a compressed body, which has no random access
+	streamPos int64
+	mu        sync.Mutex
+}
+
+// Open returns a reader of the latest version of a file. The content is fetched and decrypted in ranges as it is
+// read, while a compressed body is read from the start and again after a seek backwards.
+func (fs *FileSystem) Open(name string) (*Reader, error) {
+	file, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if file.IsDir {
+		return nil, core.Errorf("ErrIsDir: %s is a directory", name)
+	}
+	return &Reader{fs: fs, file: file}, nil
+}
+
+// File returns the header of the file being read
+func (r *Reader) File() File {
+	return r.file
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.read(p)
+}
+
+func (r *Reader) read(p []byte) (int, error) {
+	if r.pos >= int64(r.file.Size) {
+		return 0, io.EOF
+	}
+	if r.pos < r.bufPos || r.pos >= r.bufPos+int64(len(r.buf)) {
+		err := r.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[r.pos-r.bufPos:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// fill reads the content from the position into the buffer
+func (r *Reader) fill() error {
+	end := min(r.pos+int64(ReadAhead), int64(r.file.Size))
+	if r.file.Compression == "" || r.file.Dedup {
+		var b bytes.Buffer
+		err := r.fs.getSync(r.file, "", &b, &storage.Range{From: r.pos, To: end})
+		if err != nil {
+			return err
+		}
+		r.buf, r.bufPos = b.Bytes(), r.pos
+		return nil
+	}
+
+	if r.stream == nil || r.streamPos > r.pos {
+		r.closeStream()
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(r.fs.getSync(r.file, "", pw, nil))
+		}()
+		r.stream, r.streamPos = pr, 0
+	}
+	_, err := io.CopyN(io.Discard, r.stream, r.pos-r.streamPos)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, end-r.pos)
+	_, err = io.ReadFull(r.stream, buf)
+	if err != nil {
+		return err
+	}
+	r.streamPos = end
+	r.buf, r.bufPos = buf, r.pos
+	return nil
+}
+
+// ReadAt reads from an offset without changing the position of Read
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	pos := r.pos
+	defer func() { r.pos = pos }()
+
+	r.pos = off
+	var n int
+	for n < len(p) {
+		m, err := r.read(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += int64(r.file.Size)
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *Reader) closeStream() {
+	if r.stream != nil {
+		r.stream.Close()
+		r.stream = nil
+	}
+}
+
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeStream()
+	r.buf = nil
+	return nil
+}
+
+// Writer writes a new file as the content is written. The content is split in chunks, which are encrypted and
+// uploaded one at a time, so that the memory in use does not depend on the size of the file.
+type Writer struct {
+	fs   *FileSystem
+	file File
+	pw   *io.PipeWriter
+	size int64
+	done chan error
+}
+
+// Create returns a writer of a new version of a file. The file is stored in chunks like a deduplicated file, since
+// stores need the size of a body before the upload, and it is visible only after Close.
+func (fs *FileSystem) Create(name string, options PutOptions) (*Writer, error) {
+	file, err := fs.createHeader(name, 0, nil, options)
+	if err != nil {
+		return nil, err
+	}
+	file.Compression = fs.S.Compression(options.Compression)
+	file.Dedup = true
+
+	pr, pw := io.Pipe()
+	w := &Writer{fs: fs, file: file, pw: pw, done: make(chan error, 1)}
+	go func() {
+		manifest, err := writeChunks(fs.S, pr, file)
+		w.file.Manifest = manifest
+		// a failed upload fails the next write
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// File returns the header of the file, which is complete after Close
+func (w *Writer) File() File {
+	return w.file
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// abort stops the upload after a failure of the source
+func (w *Writer) abort(err error) {
+	if w.done != nil {
+		w.pw.CloseWithError(err)
+		<-w.done
+		w.done = nil
+	}
+}
+
+// Close uploads the last chunk and writes the header of the file
+func (w *Writer) Close() error {
+	if w.done == nil {
+		return os.ErrClosed
+	}
+	w.pw.Close()
+	err := <-w.done
+	w.done = nil
+	if err != nil {
+		return err
+	}
+
+	w.file.Size = int(w.size)
+	w.file.ModTime = core.Now()
+	if w.size == 0 {
+		// a file without chunks has an empty body instead
+		w.file.Dedup = false
+		w.file.Compression = ""
+		err = writeBody(w.fs.S, path.Join(DataDir, w.file.ID.String()), core.NewBytesReader(nil),
+			w.file.EncryptionKey, &storage.Upload{}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = writeHeader(w.fs.S, w.file)
+	if err != nil {
+		return err
+	}
+	w.fs.afterPut(w.file)
+	core.Info("created %s with id %s and size %d", w.file.Path(), w.file.ID, w.file.Size)
+	return nil
+}
@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+)
+
+func TestStream(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	readAhead := ReadAhead
+	ReadAhead = 1000
+	defer func() { ReadAhead = readAhead }()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	for _, compression := range []string{core.NoCompression, core.ZstdCompression} {
+		w, err := f.Create("a/x", PutOptions{Compression: compression})
+		core.TestErr(t, err, "cannot create file: %v")
+		for i := 0; i < len(content); i += 3000 {
+			_, err = w.Write(content[i:min(i+3000, len(content))])
+			core.TestErr(t, err, "cannot write: %v")
+		}
+		err = w.Close()
+		core.TestErr(t, err, "cannot close writer: %v")
+		core.Assert(t, w.File().Size == len(content), "unexpected size %d", w.File().Size)
+
+		data, err := f.GetData("a/x", GetOptions{})
+		core.TestErr(t, err, "cannot get data: %v")
+		core.Assert(t, bytes.Equal(data, content), "unexpected data with compression %s", compression)
+
+		r, err := f.Open("a/x")
+		core.TestErr(t, err, "cannot open file: %v")
+		data, err = io.ReadAll(r)
+		core.TestErr(t, err, "cannot read: %v")
+		core.Assert(t, bytes.Equal(data, content), "unexpected read with compression %s", compression)
+
+		_, err = r.Seek(-100, io.SeekEnd)
+		core.TestErr(t, err, "cannot seek: %v")
+		data, err = io.ReadAll(r)
+		core.TestErr(t, err, "cannot read after seek: %v")
+		core.Assert(t, bytes.Equal(data, content[len(content)-100:]), "unexpected tail")
+
+		buf := make([]byte, 2500)
+		_, err = r.ReadAt(buf, 1234)
+		core.TestErr(t, err, "cannot read at offset: %v")
+		core.Assert(t, bytes.Equal(buf, content[1234:3734]), "unexpected data at offset")
+		err = r.Close()
+		core.TestErr(t, err, "cannot close reader: %v")
+	}
+
+	// a compressed body without chunks is read as a stream
+	file, err := f.PutData("a/z", content, PutOptions{Compression: core.ZstdCompression})
+	core.TestErr(t, err, "cannot put data: %v")
+	core.Assert(t, file.Compression == core.ZstdCompression && !file.Dedup, "file not compressed")
+	r, err := f.Open("a/z")
+	core.TestErr(t, err, "cannot open file: %v")
+	buf := make([]byte, 3000)
+	for _, off := range []int64{5000, 100, 12000} {
+		_, err = r.ReadAt(buf, off)
+		core.TestErr(t, err, "cannot read at %d: %v", off)
+		core.Assert(t, bytes.Equal(buf, content[off:off+3000]), "unexpected data at %d", off)
+	}
+	r.Close()
+
+	w, err := f.Create("a/empty", PutOptions{})
+	core.TestErr(t, err, "cannot create file: %v")
+	err = w.Close()
+	core.TestErr(t, err, "cannot close writer: %v")
+	data, err := f.GetData("a/empty", GetOptions{})
+	core.TestErr(t, err, "cannot get empty file: %v")
+	core.Assert(t, len(data) == 0, "unexpected data in empty file")
+}
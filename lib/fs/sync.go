@@ -0,0 +1,407 @@
+package fs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/sqlx"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Directions of a sync
+const (
+	SyncUpload   = "upload"   // SyncUpload makes the safe follow the local directory
+	SyncDownload = "download" // SyncDownload makes the local directory follow the safe
+	SyncTwoWay   = "two-way"  // SyncTwoWay propagates the changes on both sides
+)
+
+// SyncHashAttribute is the attribute with the hash of the content of the files uploaded by Sync
+const SyncHashAttribute = "syncHash"
+
+// syncTempPrefix is the prefix of the temporary files of a download, which are ignored by Sync
+const syncTempPrefix = ".stash-sync-"
+
+type SyncPolicy struct {
+	Mode   string   `json:"mode"`   // Mode is one of SyncUpload, SyncDownload and SyncTwoWay; empty for two-way
+	Ignore []string `json:"ignore"` // Ignore are glob patterns matched against the relative path and the name
+}
+
+type SyncResult struct {
+	Uploaded   []string `json:"uploaded"`   // Uploaded are the files written to the safe
+	Downloaded []string `json:"downloaded"` // Downloaded are the files written to the local directory
+	Deleted    []string `json:"deleted"`    // Deleted are the files removed on either side
+	Conflicts  []string `json:"conflicts"`  // Conflicts are the copies of files changed on both sides
+	Failed     []string `json:"failed"`     // Failed are the files that could not be synced and are tried again
+}
+
+// syncState is what was on both sides after the last sync of a file
+type syncState struct {
+	modTime  time.Time
+	size     int64
+	hash     string
+	remoteID FileID
+}
+
+// syncer holds the state of a sync between a local and a remote directory
+type syncer struct {
+	fs        *FileSystem
+	localDir  string
+	remoteDir string
+	policy    SyncPolicy
+	states    map[string]syncState
+	result    SyncResult
+}
+
+// Sync synchronizes a local directory with a directory in the safe. Local changes are detected by modification time
+// and hash, remote ones by the ID of the latest version. The state after each sync is kept in the DB, so that deletes
+// propagate as well. When a file changed on both sides, the local one is kept as a conflict copy.
+func (fs *FileSystem) Sync(localDir, remoteDir string, policy SyncPolicy) (SyncResult, error) {
+	if policy.Mode == "" {
+		policy.Mode = SyncTwoWay
+	}
+	if policy.Mode != SyncUpload && policy.Mode != SyncDownload && policy.Mode != SyncTwoWay {
+		return SyncResult{}, core.Errorf("invalid sync mode %s", policy.Mode)
+	}
+	localDir, err := filepath.Abs(localDir)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	err = os.MkdirAll(localDir, 0755)
+	if err != nil {
+		return SyncResult{}, err
+	}
+
+	s := &syncer{fs: fs, localDir: localDir, remoteDir: strings.Trim(remoteDir, "/"), policy: policy}
+	err = s.readStates()
+	if err != nil {
+		return SyncResult{}, err
+	}
+	locals, err := s.listLocal()
+	if err != nil {
+		return SyncResult{}, err
+	}
+	remotes, err := s.listRemote()
+	if err != nil {
+		return SyncResult{}, err
+	}
+
+	names := core.Set[string]{}
+	for name := range locals {
+		names.Add(name)
+	}
+	for name := range remotes {
+		names.Add(name)
+	}
+	for name := range s.states {
+		names.Add(name)
+	}
+	for name := range names {
+		local, hasLocal := locals[name]
+		remote, hasRemote := remotes[name]
+		err = s.syncFile(name, local, hasLocal, remote, hasRemote)
+		if core.IsErr(err, "cannot sync %s: %v", name) {
+			s.result.Failed = append(s.result.Failed, name)
+		}
+	}
+	core.Info("synced %s with %s: %d uploaded, %d downloaded, %d deleted, %d conflicts, %d failed", localDir,
+		remoteDir, len(s.result.Uploaded), len(s.result.Downloaded), len(s.result.Deleted), len(s.result.Conflicts),
+		len(s.result.Failed))
+	return s.result, nil
+}
+
+// syncFile decides what to do with a file given the two sides and the state of the last sync
+func (s *syncer) syncFile(name string, local os.FileInfo, hasLocal bool, remote File, hasRemote bool) error {
+	state, synced := s.states[name]
+	localChanged, hash, err := s.localChanged(name, local, hasLocal, state, synced)
+	if err != nil {
+		return err
+	}
+	remoteChanged := hasRemote && (!synced || remote.ID != state.remoteID)
+
+	switch s.policy.Mode {
+	case SyncUpload:
+		switch {
+		case hasLocal && (localChanged || !hasRemote || remoteChanged):
+			return s.upload(name, local, hash, remote)
+		case !hasLocal && hasRemote && synced:
+			return s.deleteRemote(name)
+		case !hasLocal && !hasRemote && synced:
+			return s.forget(name)
+		}
+	case SyncDownload:
+		switch {
+		case hasRemote && (remoteChanged || !hasLocal || localChanged):
+			return s.download(name, remote)
+		case !hasRemote && hasLocal && synced:
+			return s.deleteLocal(name)
+		case !hasLocal && !hasRemote && synced:
+			return s.forget(name)
+		}
+	default:
+		switch {
+		case hasLocal && hasRemote && (localChanged || !synced) && remoteChanged:
+			if remote.Attributes[SyncHashAttribute] == hash {
+				return s.setState(name, remote)
+			}
+			err = s.keepConflict(name, local, hash)
+			if err != nil {
+				return err
+			}
+			return s.download(name, remote)
+		case hasLocal && localChanged:
+			return s.upload(name, local, hash, remote)
+		case hasRemote && (remoteChanged || !hasLocal && !synced):
+			return s.download(name, remote)
+		case !hasLocal && hasRemote && synced:
+			return s.deleteRemote(name)
+		case hasLocal && !hasRemote && synced:
+			return s.deleteLocal(name)
+		case !hasLocal && !hasRemote && synced:
+			return s.forget(name)
+		}
+	}
+	return nil
+}
+
+// localChanged tells whether the local file differs from the last sync. The hash is computed only when the
+// modification time or the size changed, or when there is no state.
+func (s *syncer) localChanged(name string, local os.FileInfo, hasLocal bool, state syncState,
+	synced bool) (bool, string, error) {
+	if !hasLocal {
+		return false, "", nil
+	}
+	if synced && local.ModTime().Equal(state.modTime) && local.Size() == state.size {
+		return false, state.hash, nil
+	}
+	hash, err := hashFile(filepath.Join(s.localDir, filepath.FromSlash(name)))
+	if err != nil {
+		return false, "", err
+	}
+	return !synced || hash != state.hash, hash, nil
+}
+
+func (s *syncer) upload(name string, local os.FileInfo, hash string, remote File) error {
+	attributes := map[string]any{}
+	for k, v := range remote.Attributes {
+		attributes[k] = v
+	}
+	attributes[SyncHashAttribute] = hash
+	file, err := s.fs.PutFile(path.Join(s.remoteDir, name), filepath.Join(s.localDir, filepath.FromSlash(name)),
+		PutOptions{Tags: remote.Tags, Attributes: attributes})
+	if err != nil {
+		return err
+	}
+	s.result.Uploaded = append(s.result.Uploaded, name)
+	return s.writeState(name, syncState{modTime: local.ModTime(), size: local.Size(), hash: hash,
+		remoteID: file.ID})
+}
+
+// download writes the remote file to a temporary file and then replaces the local one, so that a failure does not
+// leave a partial file
+func (s *syncer) download(name string, remote File) error {
+	dest := filepath.Join(s.localDir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), syncTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = s.fs.getSync(remote, "", tmp, nil)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(tmp.Name(), remote.ModTime, remote.ModTime)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), dest)
+	if err != nil {
+		return err
+	}
+	s.result.Downloaded = append(s.result.Downloaded, name)
+	return s.setState(name, remote)
+}
+
+// keepConflict renames the local file, so that the remote one can take its place, and uploads the copy
+func (s *syncer) keepConflict(name string, local os.FileInfo, hash string) error {
+	ext := path.Ext(name)
+	conflict := fmt.Sprintf("%s (conflict %s %s)%s", strings.TrimSuffix(name, ext), s.fs.S.Identity.Id.Nick(),
+		core.Now().Format("2006-01-02 150405"), ext)
+	err := os.Rename(filepath.Join(s.localDir, filepath.FromSlash(name)),
+		filepath.Join(s.localDir, filepath.FromSlash(conflict)))
+	if err != nil {
+		return err
+	}
+	s.result.Conflicts = append(s.result.Conflicts, conflict)
+	return s.upload(conflict, local, hash, File{})
+}
+
+// deleteRemote removes all the versions of a remote file, since the previous version would otherwise come back
+func (s *syncer) deleteRemote(name string) error {
+	r := removals{}
+	err := r.write(s.fs.S, s.fs.deleteVersions(path.Join(s.remoteDir, name), r))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.result.Deleted = append(s.result.Deleted, name)
+	return s.forget(name)
+}
+
+func (s *syncer) deleteLocal(name string) error {
+	err := os.Remove(filepath.Join(s.localDir, filepath.FromSlash(name)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.result.Deleted = append(s.result.Deleted, name)
+	return s.forget(name)
+}
+
+// setState records the local file as it is after a sync with the remote one
+func (s *syncer) setState(name string, remote File) error {
+	filename := filepath.Join(s.localDir, filepath.FromSlash(name))
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	hash, err := hashFile(filename)
+	if err != nil {
+		return err
+	}
+	return s.writeState(name, syncState{modTime: stat.ModTime(), size: stat.Size(), hash: hash, remoteID: remote.ID})
+}
+
+func (s *syncer) writeState(name string, state syncState) error {
+	_, err := s.fs.S.DB.Exec("STASH_SET_SYNC_STATE", sqlx.Args{"safeID": s.fs.S.ID, "localDir": s.localDir,
+		"remoteDir": s.remoteDir, "path": name, "modTime": state.modTime, "size": state.size, "hash": state.hash,
+		"remoteID": state.remoteID.Uint64()})
+	if err != nil {
+		return err
+	}
+	s.states[name] = state
+	return nil
+}
+
+func (s *syncer) forget(name string) error {
+	_, err := s.fs.S.DB.Exec("STASH_DEL_SYNC_STATE", sqlx.Args{"safeID": s.fs.S.ID, "localDir": s.localDir,
+		"remoteDir": s.remoteDir, "path": name})
+	delete(s.states, name)
+	return err
+}
+
+func (s *syncer) readStates() error {
+	rows, err := s.fs.S.DB.Query("STASH_GET_SYNC_STATE", sqlx.Args{"safeID": s.fs.S.ID, "localDir": s.localDir,
+		"remoteDir": s.remoteDir})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.states = map[string]syncState{}
+	for rows.Next() {
+		var name string
+		var state syncState
+		err = rows.Scan(&name, &state.modTime, &state.size, &state.hash, &state.remoteID)
+		if err != nil {
+			return err
+		}
+		s.states[name] = state
+	}
+	return nil
+}
+
+// ignored tells whether a relative path matches an ignore pattern, either as a whole or by its name
+func (s *syncer) ignored(name string) bool {
+	base := path.Base(name)
+	if strings.HasPrefix(base, syncTempPrefix) {
+		return true
+	}
+	for _, pattern := range s.policy.Ignore {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listLocal returns the local files by their path relative to the local directory
+func (s *syncer) listLocal() (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+	err := filepath.WalkDir(s.localDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == s.localDir {
+			return nil
+		}
+		rel, err := filepath.Rel(s.localDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if s.ignored(name) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[name] = info
+		return nil
+	})
+	return files, err
+}
+
+// listRemote returns the latest version of the remote files by their path relative to the remote directory
+func (s *syncer) listRemote() (map[string]File, error) {
+	files := map[string]File{}
+	_, err := s.fs.walkTree(s.remoteDir, func(file File) error {
+		name := strings.TrimPrefix(strings.TrimPrefix(file.Path(), s.remoteDir), "/")
+		if s.ignored(name) {
+			return nil
+		}
+		if latest, ok := files[name]; !ok || file.ID > latest.ID {
+			files[name] = file
+		}
+		return nil
+	})
+	return files, err
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+)
+
+func TestSync(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	a, b := t.TempDir(), t.TempDir()
+	write := func(dir, name, content string) {
+		name = filepath.Join(dir, name)
+		core.TestErr(t, os.MkdirAll(filepath.Dir(name), 0755), "cannot create dir: %v")
+		core.TestErr(t, os.WriteFile(name, []byte(content), 0644), "cannot write file: %v")
+	}
+	read := func(dir, name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+	sync := func(dir string, mode string) SyncResult {
+		r, err := f.Sync(dir, "shared", SyncPolicy{Mode: mode, Ignore: []string{"*.tmp"}})
+		core.TestErr(t, err, "cannot sync: %v")
+		core.Assert(t, len(r.Failed) == 0, "failed files: %v", r.Failed)
+		return r
+	}
+
+	write(a, "doc.txt", "hello")
+	write(a, "sub/note.txt", "note")
+	write(a, "skip.tmp", "ignored")
+	r := sync(a, "")
+	core.Assert(t, len(r.Uploaded) == 2, "unexpected uploads: %v", r.Uploaded)
+	r = sync(b, "")
+	core.Assert(t, len(r.Downloaded) == 2, "unexpected downloads: %v", r.Downloaded)
+	core.Assert(t, read(b, "sub/note.txt") == "note", "file not downloaded")
+	r = sync(a, "")
+	core.Assert(t, len(r.Uploaded)+len(r.Downloaded) == 0, "unexpected changes: %+v", r)
+
+	// a change and a delete propagate
+	write(b, "doc.txt", "hello world")
+	os.Remove(filepath.Join(b, "sub/note.txt"))
+	r = sync(b, "")
+	core.Assert(t, len(r.Uploaded) == 1 && len(r.Deleted) == 1, "unexpected sync: %+v", r)
+	r = sync(a, "")
+	core.Assert(t, read(a, "doc.txt") == "hello world", "change not downloaded")
+	_, err = os.Stat(filepath.Join(a, "sub/note.txt"))
+	core.Assert(t, os.IsNotExist(err), "delete not propagated")
+
+	// both sides change the same file
+	time.Sleep(10 * time.Millisecond)
+	write(a, "doc.txt", "from a")
+	write(b, "doc.txt", "from b")
+	sync(a, "")
+	r = sync(b, "")
+	core.Assert(t, len(r.Conflicts) == 1, "conflict not detected: %+v", r)
+	core.Assert(t, read(b, "doc.txt") == "from a", "remote version not kept")
+	core.Assert(t, read(b, r.Conflicts[0]) == "from b", "local version not kept")
+	core.Assert(t, strings.Contains(r.Conflicts[0], "conflict"), "unexpected conflict name: %s", r.Conflicts[0])
+
+	// download only does not upload local changes
+	write(b, "local.txt", "local")
+	r = sync(b, SyncDownload)
+	core.Assert(t, len(r.Uploaded) == 0, "download mode uploaded: %v", r.Uploaded)
+}
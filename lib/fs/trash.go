@@ -0,0 +1,266 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TrashDir holds the headers of deleted files, each with a tombstone, until the trash is purged
+var TrashDir = path.Join(FSDir, "trash")
+
+// tombstoneExt is the extension of the tombstone next to a header in the trash
+const tombstoneExt = ".tomb"
+
+// Tombstone records who deleted a file and when. The signature covers the header, so that a tombstone cannot be moved
+// to another file.
+type Tombstone struct {
+	ID         FileID      `json:"id"`
+	Latest     FileID      `json:"latest,omitempty"` // Latest is the latest version of the file, trashed with this one
+	Deleter    security.ID `json:"deleter"`
+	DeleteTime time.Time   `json:"deleteTime"`
+	Signature  []byte      `json:"signature"`
+}
+
+// TrashItem is a deleted file that can be restored with Undelete
+type TrashItem struct {
+	File       File        `json:"file"`
+	Versions   int         `json:"versions"` // Versions is the number of versions deleted with the file
+	Deleter    security.ID `json:"deleter"`
+	DeleteTime time.Time   `json:"deleteTime"`
+
+	latest FileID
+}
+
+func hashOfTombstone(t Tombstone, header []byte) []byte {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	h.Write([]byte(fmt.Sprintf("%s %s %d", t.ID, t.Deleter, t.DeleteTime.UnixNano())))
+	if t.Latest != 0 {
+		h.Write([]byte(fmt.Sprintf(" %s", t.Latest)))
+	}
+	h.Write(header)
+	return h.Sum(nil)
+}
+
+// trashVersion moves the header of a version to the trash with a signed tombstone. The tombstone links the version to
+// the latest version deleted with it, so that they are restored together. The body stays in place until the trash is
+// purged.
+func (fs *FileSystem) trashVersion(file File, latest FileID, r removals) error {
+	header, err := readRawHeader(fs.S, file.Dir, file.ID)
+	if err != nil {
+		return err
+	}
+
+	t := Tombstone{ID: file.ID, Latest: latest, Deleter: fs.S.Identity.Id, DeleteTime: core.Now()}
+	t.Signature, err = security.Sign(fs.S.Identity, hashOfTombstone(t, header))
+	if err != nil {
+		return err
+	}
+	dest := path.Join(TrashDir, file.ID.String())
+	err = storage.WriteFile(fs.S.Store, dest, header)
+	if err != nil {
+		return err
+	}
+	err = storage.WriteJSON(fs.S.Store, dest+tombstoneExt, t, nil)
+	if err != nil {
+		fs.S.Store.Delete(dest)
+		return err
+	}
+	err = r.deleteHeader(fs.S, file.Dir, file.ID)
+	if err != nil {
+		return err
+	}
+
+	err = fs.deleteFromDB(file)
+	if err != nil {
+		return err
+	}
+	core.Info("moved %s/%s with id %s to the trash", file.Dir, file.Name, file.ID)
+	return nil
+}
+
+// readTrash returns the items in the trash whose tombstone is valid
+func (fs *FileSystem) readTrash() ([]TrashItem, error) {
+	ls, err := fs.S.Store.ReadDir(TrashDir, storage.Filter{OnlyFiles: true})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var items []TrashItem
+	for _, l := range ls {
+		if !strings.HasSuffix(l.Name(), tombstoneExt) {
+			continue
+		}
+		item, err := fs.readTrashItem(path.Join(TrashDir, strings.TrimSuffix(l.Name(), tombstoneExt)))
+		if err != nil {
+			// headers of groups the user is not in stay in the trash for the other users
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// readTrashItem reads a header in the trash and checks that its tombstone is signed for it
+func (fs *FileSystem) readTrashItem(name string) (TrashItem, error) {
+	var t Tombstone
+	err := storage.ReadJSON(fs.S.Store, name+tombstoneExt, &t, nil)
+	if core.IsErr(err, "cannot read tombstone %s: %v", name) {
+		return TrashItem{}, err
+	}
+	header, err := storage.ReadFile(fs.S.Store, name)
+	if core.IsErr(err, "cannot read trashed header %s: %v", name) {
+		return TrashItem{}, err
+	}
+	if !security.Verify(t.Deleter, hashOfTombstone(t, header), t.Signature) {
+		return TrashItem{}, core.Errorf("invalid signature on tombstone %s", name)
+	}
+	file, err := readHeaderAt(fs.S, name)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if file.ID != t.ID {
+		return TrashItem{}, core.Errorf("tombstone %s is for file %s", name, t.ID)
+	}
+	return TrashItem{File: file, Versions: 1, Deleter: t.Deleter, DeleteTime: t.DeleteTime, latest: t.Latest}, nil
+}
+
+// group returns the ID shared by the versions deleted together
+func (item TrashItem) group() FileID {
+	if item.latest != 0 {
+		return item.latest
+	}
+	return item.File.ID
+}
+
+// ListTrash returns the deleted files that can be restored, after purging the expired ones. The versions deleted
+// together are listed as their latest version.
+func (fs *FileSystem) ListTrash() ([]TrashItem, error) {
+	_, err := fs.purgeTrash(false)
+	if err != nil {
+		return nil, err
+	}
+	items, err := fs.readTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []TrashItem
+	groups := map[FileID]int{}
+	for _, item := range items {
+		i, ok := groups[item.group()]
+		if !ok {
+			groups[item.group()] = len(files)
+			files = append(files, item)
+			continue
+		}
+		versions := files[i].Versions + 1
+		if item.File.ID > files[i].File.ID {
+			files[i] = item
+		}
+		files[i].Versions = versions
+	}
+	return files, nil
+}
+
+// Undelete moves a file from the trash back to the file system, with the other versions deleted together. Like the
+// listing of the trash, it requires a valid tombstone. It returns the latest version restored.
+func (fs *FileSystem) Undelete(id FileID) (File, error) {
+	item, err := fs.readTrashItem(path.Join(TrashDir, id.String()))
+	if err != nil {
+		return File{}, err
+	}
+	items := []TrashItem{item}
+	if item.latest != 0 {
+		all, err := fs.readTrash()
+		if err != nil {
+			return File{}, err
+		}
+		items = slices.DeleteFunc(all, func(i TrashItem) bool { return i.group() != item.group() })
+	}
+
+	var latest File
+	for _, item := range items {
+		err = fs.restoreItem(item)
+		if err != nil {
+			return File{}, err
+		}
+		if item.File.ID > latest.ID {
+			latest = item.File
+		}
+	}
+	return latest, nil
+}
+
+// restoreItem moves the header of a version from the trash back to its directory
+func (fs *FileSystem) restoreItem(item TrashItem) error {
+	file := item.File
+	src := path.Join(TrashDir, file.ID.String())
+	err := storage.CopyFile(fs.S.Store, path.Join(HeadersDir, hashDir(file.Dir), file.ID.String()), fs.S.Store, src)
+	if err != nil {
+		return err
+	}
+	err = writeFileToDB(fs.S, file)
+	if err != nil {
+		return err
+	}
+	fs.touchDirs(file.Dir)
+
+	fs.S.Store.Delete(src + tombstoneExt)
+	fs.S.Store.Delete(src)
+	core.Info("restored %s/%s with id %s from the trash", file.Dir, file.Name, file.ID)
+	return nil
+}
+
+// EmptyTrash deletes all the files in the trash. It returns the number of deleted files.
+func (fs *FileSystem) EmptyTrash() (int, error) {
+	return fs.purgeTrash(true)
+}
+
+// purgeTrash deletes the files in the trash older than the retention in the safe config, or all of them
+func (fs *FileSystem) purgeTrash(all bool) (int, error) {
+	items, err := fs.readTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	retention := time.Duration(fs.S.Config.TrashDays) * 24 * time.Hour
+	var deleted int
+	for _, item := range items {
+		if !all && core.Since(item.DeleteTime) < retention {
+			continue
+		}
+		// the chunks of a deduplicated body may be shared and are removed by CollectChunks
+		if !item.File.Dedup {
+			err = fs.S.Store.Delete(path.Join(DataDir, item.File.ID.String()))
+			if err != nil && !os.IsNotExist(err) {
+				return deleted, err
+			}
+		}
+		name := path.Join(TrashDir, item.File.ID.String())
+		err = fs.S.Store.Delete(name)
+		if err != nil {
+			return deleted, err
+		}
+		fs.S.Store.Delete(name + tombstoneExt)
+		deleted++
+	}
+	if deleted > 0 {
+		core.Info("purged %d of %d files from the trash", deleted, len(items))
+	}
+	return deleted, nil
+}
@@ -0,0 +1,97 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func TestTrash(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+	s.Config.TrashDays = 1
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	file, err := f.PutData("dir/test", []byte("hello world"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	err = f.Delete("dir/test")
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = f.Stat("dir/test")
+	core.Assert(t, err != nil, "deleted file still visible")
+	_, err = s.Store.Stat(path.Join(DataDir, file.ID.String()))
+	core.TestErr(t, err, "body of trashed file deleted: %v")
+
+	items, err := f.ListTrash()
+	core.TestErr(t, err, "cannot list trash: %v")
+	core.Assert(t, len(items) == 1, "unexpected number of trashed files: %d", len(items))
+	core.Assert(t, items[0].File.ID == file.ID && items[0].Deleter == alice.Id, "unexpected trashed file")
+
+	_, err = f.Undelete(file.ID)
+	core.TestErr(t, err, "cannot undelete file: %v")
+	data, err := f.GetData("dir/test", GetOptions{})
+	core.TestErr(t, err, "cannot get undeleted file: %v")
+	core.Assert(t, string(data) == "hello world", "unexpected data: %s", data)
+	items, err = f.ListTrash()
+	core.TestErr(t, err, "cannot list trash: %v")
+	core.Assert(t, len(items) == 0, "undeleted file still in the trash")
+
+	err = f.Delete("dir/test")
+	core.TestErr(t, err, "cannot delete file: %v")
+	report, err := s.Scrub(safe.ScrubOptions{})
+	core.TestErr(t, err, "cannot scrub: %v")
+	core.Assert(t, len(report.Issues) == 0, "trashed body reported: %v", report.Issues)
+
+	// a tombstone that does not match its signature restores nothing
+	tombstone := path.Join(TrashDir, file.ID.String()) + tombstoneExt
+	original, err := storage.ReadFile(s.Store, tombstone)
+	core.TestErr(t, err, "cannot read tombstone: %v")
+	var tomb Tombstone
+	err = storage.ReadJSON(s.Store, tombstone, &tomb, nil)
+	core.TestErr(t, err, "cannot read tombstone: %v")
+	tomb.DeleteTime = tomb.DeleteTime.Add(-time.Hour)
+	err = storage.WriteJSON(s.Store, tombstone, tomb, nil)
+	core.TestErr(t, err, "cannot tamper tombstone: %v")
+	_, err = f.Undelete(file.ID)
+	core.Assert(t, err != nil, "file restored with a forged tombstone")
+	_, err = f.Stat("dir/test")
+	core.Assert(t, err != nil, "file restored with a forged tombstone")
+	err = storage.WriteFile(s.Store, tombstone, original)
+	core.TestErr(t, err, "cannot restore tombstone: %v")
+
+	n, err := f.EmptyTrash()
+	core.TestErr(t, err, "cannot empty trash: %v")
+	core.Assert(t, n == 1, "unexpected number of purged files: %d", n)
+	_, err = s.Store.Stat(path.Join(DataDir, file.ID.String()))
+	core.Assert(t, err != nil, "body of purged file not deleted")
+
+	// all the versions go to the trash and come back together
+	for _, content := range []string{"v1", "v2"} {
+		file, err = f.PutData("dir/versions", []byte(content), PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+	}
+	err = f.Delete("dir/versions")
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = f.Stat("dir/versions")
+	core.Assert(t, os.IsNotExist(err), "previous version visible after trash: %v", err)
+	items, err = f.ListTrash()
+	core.TestErr(t, err, "cannot list trash: %v")
+	core.Assert(t, len(items) == 1 && items[0].File.ID == file.ID && items[0].Versions == 2,
+		"unexpected trashed files: %+v", items)
+	_, err = f.Undelete(items[0].File.ID)
+	core.TestErr(t, err, "cannot undelete file: %v")
+	versions, err := f.Versions("dir/versions")
+	core.TestErr(t, err, "cannot get versions: %v")
+	core.Assert(t, len(versions) == 2 && versions[0].ID == file.ID, "versions not restored: %v", versions)
+	items, err = f.ListTrash()
+	core.TestErr(t, err, "cannot list trash: %v")
+	core.Assert(t, len(items) == 0, "restored versions still in the trash: %+v", items)
+}
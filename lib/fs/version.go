@@ -0,0 +1,133 @@
+package fs
+
+import (
+	"path"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
+)
+
+// Retention decides which versions of a file are kept. A version is kept when any rule keeps it and the latest
+// version is always kept. Without rules all versions are kept.
+type Retention struct {
+	Versions int `json:"versions"` // Versions is the number of most recent versions to keep
+	Days     int `json:"days"`     // Days is the age in days under which versions are kept
+}
+
+// Versions returns the versions of a file, the latest first. Each version has its own ID, which identifies it in
+// GetOptions and Restore.
+func (f *FileSystem) Versions(name string) ([]File, error) {
+	dir, name := core.SplitPath(name)
+	if f.S.IsUpdated(HeadersDir, hashDir(dir)) {
+		err := syncHeaders(f.S, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := f.S.DB.Query("STASH_GET_FILE_VERSIONS", sqlx.Args{"safeID": f.S.ID, "dir": dir, "name": name})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []File
+	for rows.Next() {
+		var file File
+		var tags string
+		err = rows.Scan(statFields(&file, &tags)...)
+		if err != nil {
+			return nil, err
+		}
+		file.setStat(dir, name, tags)
+		versions = append(versions, file)
+	}
+	return versions, nil
+}
+
+// Restore makes a copy of a version the latest version of the file. The body is copied as it is, since the copy keeps
+// the encryption key, while a deduplicated body shares the chunks.
+func (f *FileSystem) Restore(name string, version FileID) (File, error) {
+	file, err := f.StatVersion(name, version)
+	if err != nil {
+		return File{}, err
+	}
+
+	src := file.ID
+	file.ID = FileID(core.SnowID())
+	file.ModTime = core.Now()
+	file.LocalCopy = ""
+	file.CopyTime = time.Time{}
+	if !file.Dedup {
+		err = storage.CopyFile(f.S.Store, path.Join(DataDir, file.ID.String()), f.S.Store,
+			path.Join(DataDir, src.String()))
+		if err != nil {
+			return File{}, err
+		}
+	}
+
+	_, err = writeHeader(f.S, file)
+	if err != nil {
+		f.S.Store.Delete(path.Join(DataDir, file.ID.String()))
+		return File{}, err
+	}
+	err = writeFileToDB(f.S, file)
+	if err != nil {
+		return File{}, err
+	}
+	f.touchDirs(file.Dir)
+	core.Info("restored version %s of %s as %s", src, name, file.ID)
+
+	_, err = f.Prune(name, Retention{})
+	if err != nil {
+		return File{}, err
+	}
+	return file, nil
+}
+
+// Prune deletes the versions of a file that the retention does not keep. An empty retention uses the one in the policy
+// of the directory or in the safe config. It returns the number of deleted versions.
+func (f *FileSystem) Prune(name string, retention Retention) (int, error) {
+	if retention == (Retention{}) {
+		policy, err := f.PolicyOf(core.Dir(name))
+		if err != nil {
+			return 0, err
+		}
+		retention = policy.Retention
+	}
+	if retention == (Retention{}) {
+		retention = Retention{Versions: f.S.Config.KeepVersions, Days: f.S.Config.KeepDays}
+	}
+	if retention == (Retention{}) {
+		return 0, nil
+	}
+
+	versions, err := f.Versions(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	r := removals{}
+	for i, v := range versions {
+		if i == 0 || i < retention.Versions ||
+			core.Since(v.ModTime) < time.Duration(retention.Days)*24*time.Hour {
+			continue
+		}
+		err = f.deleteVersion(v, r)
+		if err != nil {
+			break
+		}
+		deleted++
+	}
+	err = r.write(f.S, err)
+	if err != nil {
+		return deleted, err
+	}
+	if deleted > 0 {
+		core.Info("pruned %d of %d versions of %s", deleted, len(versions), name)
+	}
+	return deleted, nil
+}
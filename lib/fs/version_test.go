@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+)
+
+func TestVersions(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+
+	f, err := Open(s)
+	core.TestErr(t, err, "cannot open fs: %v")
+	defer f.Close()
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		_, err = f.PutData("dir/test", []byte(content), PutOptions{})
+		core.TestErr(t, err, "cannot put data: %v")
+	}
+	versions, err := f.Versions("dir/test")
+	core.TestErr(t, err, "cannot get versions: %v")
+	core.Assert(t, len(versions) == 3, "unexpected number of versions: %d", len(versions))
+
+	data, err := f.GetData("dir/test", GetOptions{Version: versions[2].ID})
+	core.TestErr(t, err, "cannot get version: %v")
+	core.Assert(t, string(data) == "v1", "unexpected version data: %s", data)
+
+	file, err := f.Restore("dir/test", versions[2].ID)
+	core.TestErr(t, err, "cannot restore version: %v")
+	core.Assert(t, file.ID != versions[2].ID, "restore did not create a new version")
+	data, err = f.GetData("dir/test", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, string(data) == "v1", "unexpected data after restore: %s", data)
+
+	// the safe config prunes the versions on put
+	s.Config.KeepVersions = 2
+	_, err = f.PutData("dir/test", []byte("v4"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	versions, err = f.Versions("dir/test")
+	core.TestErr(t, err, "cannot get versions: %v")
+	core.Assert(t, len(versions) == 2, "versions not pruned: %d", len(versions))
+	data, err = f.GetData("dir/test", GetOptions{Version: versions[1].ID})
+	core.TestErr(t, err, "cannot get version: %v")
+	core.Assert(t, string(data) == "v1", "unexpected version data: %s", data)
+
+	n, err := f.Prune("dir/test", Retention{Versions: 1})
+	core.TestErr(t, err, "cannot prune: %v")
+	core.Assert(t, n == 1, "unexpected number of pruned versions: %d", n)
+	n, err = f.Prune("dir/test", Retention{Days: 1})
+	core.TestErr(t, err, "cannot prune: %v")
+	core.Assert(t, n == 0, "latest version pruned")
+
+	// deleting a version brings back the previous one, while delete removes them all
+	latest, err := f.PutData("dir/test", []byte("v5"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	err = f.DeleteVersion("dir/test", latest.ID)
+	core.TestErr(t, err, "cannot delete version: %v")
+	data, err = f.GetData("dir/test", GetOptions{})
+	core.TestErr(t, err, "cannot get data: %v")
+	core.Assert(t, string(data) == "v4", "unexpected data after deleting a version: %s", data)
+	_, err = f.PutData("dir/test", []byte("v6"), PutOptions{})
+	core.TestErr(t, err, "cannot put data: %v")
+	err = f.Delete("dir/test")
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = f.Stat("dir/test")
+	core.Assert(t, os.IsNotExist(err), "previous version visible after delete: %v", err)
+}
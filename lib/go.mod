@@ -1,9 +1,10 @@
 module github.com/stregato/stash/lib
 
-go 1.21.3
+go 1.22
 
 require (
 	github.com/Azure/azure-pipeline-go v0.2.3
+	github.com/Azure/azure-storage-blob-go v0.15.0
 	github.com/aws/aws-sdk-go-v2 v1.25.1
 	github.com/aws/aws-sdk-go-v2/config v1.18.45
 	github.com/aws/aws-sdk-go-v2/credentials v1.13.43
@@ -12,6 +13,8 @@ require (
 	github.com/ecies/go/v2 v2.0.9
 	github.com/ethereum/go-ethereum v1.13.5
 	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/reedsolomon v1.10.0
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/pkg/sftp v1.13.6
 	github.com/stretchr/testify v1.8.4
@@ -41,6 +44,7 @@ require (
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.2.0 // indirect
 	github.com/go-stack/stack v1.8.1 // indirect
 	github.com/holiman/uint256 v1.2.3 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.14 // indirect
 	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-ieproxy v0.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
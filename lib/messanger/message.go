@@ -16,6 +16,7 @@ type Message struct {
 	Text         string      `json:"text"`
 	Data         []byte      `json:"data"`
 	File         string      `json:"file"`
+	Compression  string      `json:"compression,omitempty"` // Compression is applied to text and data before encryption
 }
 
 func (id MessageID) String() string {
@@ -54,6 +54,29 @@ func TestBroadcast(t *testing.T) {
 	s.Close()
 }
 
+func TestCompressedMessage(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	s := safe.NewTestSafe(t, alice, "local", alice.Id, true)
+	s.Config.Compression = core.ZstdCompression
+
+	c := Open(s)
+	text := string(bytes.Repeat([]byte("hello world "), 100))
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, 100)
+	err := c.Broadcast(safe.UserGroup, Message{Text: text, Data: data})
+	core.TestErr(t, err, "cannot broadcast to user group: %v")
+
+	ms, err := c.Receive("")
+	core.TestErr(t, err, "cannot receive: %v")
+	core.Assert(t, len(ms) == 1, "received messages: %v", ms)
+	core.Assert(t, ms[0].Text == text, "received text: %s", ms[0].Text)
+	core.Assert(t, bytes.Equal(ms[0].Data, data), "received data: %v", ms[0].Data)
+
+	// the text is not compressible enough, so neither is compressed
+	_, _, compression := compress([]byte("hi"), data, core.ZstdCompression)
+	core.Assert(t, compression == "", "short text compressed")
+	s.Close()
+}
+
 func TestSend(t *testing.T) {
 	alice := security.NewIdentityMust("alice")
 	bob := security.NewIdentityMust("bob")
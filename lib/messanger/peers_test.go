@@ -0,0 +1,43 @@
+package messanger
+
+import (
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func TestPeers(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	bob := security.NewIdentityMust("bob")
+	carl := security.NewIdentityMust("carl")
+	peers := safe.NewTestPeers(t, "fault://messanger?err=0.1&partial=0.05&latency=1ms&retry=10&retryBackoff=1ms",
+		alice, bob, carl)
+
+	for _, p := range peers {
+		err := Open(p).Broadcast(safe.UserGroup, Message{Text: "hello from " + p.Identity.Id.Nick()})
+		core.TestErr(t, err, "cannot broadcast from %s: %v", p.Identity.Id.Nick())
+	}
+
+	// every peer receives each message exactly once
+	for _, p := range peers {
+		storage.Unwrap(p.Store).(*storage.Fault).SetEnabled(false)
+	}
+	for _, p := range peers {
+		c := Open(p)
+		ms, err := c.Receive("")
+		core.TestErr(t, err, "cannot receive on %s: %v", p.Identity.Id.Nick())
+		texts := core.NewSet[string]()
+		for _, m := range ms {
+			core.Assert(t, texts.Add(m.Text), "duplicate message on %s: %s", p.Identity.Id.Nick(), m.Text)
+		}
+		core.Assert(t, len(texts) == len(peers), "wrong number of messages on %s: %v", p.Identity.Id.Nick(), texts)
+
+		ms, err = c.Receive("")
+		core.TestErr(t, err, "cannot receive on %s: %v", p.Identity.Id.Nick())
+		core.Assert(t, len(ms) == 0, "messages received twice on %s", p.Identity.Id.Nick())
+		p.Close()
+	}
+}
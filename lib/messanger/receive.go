@@ -61,7 +61,7 @@ func (c *Messenger) Receive(filter string) ([]Message, error) {
 		}
 	}
 
-	core.Info("received %d messages from safe %s", len(messages), c.S.URL)
+	core.Info("received %d messages from safe %s", len(messages), storage.Redact(c.S.URL))
 	return messages, nil
 }
 
@@ -101,6 +101,10 @@ func (c *Messenger) receiveMessage(dest string, file fs.FileInfo) (Message, erro
 		if err != nil {
 			return Message{}, err
 		}
+		data, err = core.Decompress(data, m.Compression)
+		if err != nil {
+			return Message{}, err
+		}
 		m.Text = string(data)
 	}
 	if m.Data != nil {
@@ -108,8 +112,12 @@ func (c *Messenger) receiveMessage(dest string, file fs.FileInfo) (Message, erro
 		if err != nil {
 			return Message{}, err
 		}
-		m.Data = data
+		m.Data, err = core.Decompress(data, m.Compression)
+		if err != nil {
+			return Message{}, err
+		}
 	}
+	m.Compression = ""
 	return m, nil
 }
 
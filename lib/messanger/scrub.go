@@ -0,0 +1,45 @@
+package messanger
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/safe"
+	"github.com/stregato/stash/lib/storage"
+)
+
+func init() {
+	safe.RegisterScrubber("messanger", scrub)
+}
+
+// scrub reports the attachments whose message was never written, since a send writes the attachment first
+func scrub(s *safe.Safe, options safe.ScrubOptions, report *safe.ScrubReport) error {
+	dests, err := s.Store.ReadDir(MessangerDir, storage.Filter{OnlyFolders: true})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dest := range dests {
+		dir := path.Join(MessangerDir, dest.Name())
+		ls, err := s.Store.ReadDir(dir, storage.Filter{OnlyFiles: true})
+		if err != nil {
+			return err
+		}
+		messages := core.Set[string]{}
+		for _, l := range ls {
+			if !strings.HasSuffix(l.Name(), ".data") {
+				messages.Add(l.Name())
+			}
+		}
+		for _, l := range ls {
+			report.Checked++
+			id, ok := strings.CutSuffix(l.Name(), ".data")
+			if ok && !messages.Contains(id) {
+				report.Remove(s, options, path.Join(dir, l.Name()), safe.IssueOrphan, "attachment without message",
+					core.Since(l.ModTime()) >= options.GracePeriod)
+			}
+		}
+	}
+	return nil
+}
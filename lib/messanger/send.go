@@ -57,8 +57,10 @@ func (c *Messenger) send(m Message) error {
 		}
 		m.File = core.EncodeBinary(data)
 	}
+	var text []byte
+	text, m.Data, m.Compression = compress([]byte(m.Text), m.Data, c.S.Compression(""))
 	if m.Text != "" {
-		data, err := security.EncryptAES([]byte(m.Text), key)
+		data, err := security.EncryptAES(text, key)
 		if err != nil {
 			return err
 		}
@@ -80,3 +82,17 @@ func (c *Messenger) send(m Message) error {
 
 	return nil
 }
+
+// compress compresses text and data when both are compressible, so that a single algorithm applies to the message
+func compress(text, data []byte, compression string) ([]byte, []byte, string) {
+	if compression == "" {
+		return text, data, ""
+	}
+	compressedText, textCompression := core.Compress(text, compression)
+	compressedData, dataCompression := core.Compress(data, compression)
+	if (len(text) > 0 && textCompression == "") || (len(data) > 0 && dataCompression == "") ||
+		(len(text) == 0 && len(data) == 0) {
+		return text, data, ""
+	}
+	return compressedText, compressedData, compression
+}
@@ -46,5 +46,28 @@ func hashOfConfig(config Config) []byte {
 	}
 	h.Write([]byte(config.Description))
 	h.Write([]byte(fmt.Sprintf("%d", config.Quota)))
+	if config.Compression != "" {
+		h.Write([]byte(config.Compression))
+	}
+	if config.Dedup {
+		h.Write([]byte("dedup"))
+	}
+	if config.KeepVersions != 0 || config.KeepDays != 0 {
+		h.Write([]byte(fmt.Sprintf("%d %d", config.KeepVersions, config.KeepDays)))
+	}
+	if config.TrashDays != 0 {
+		h.Write([]byte(fmt.Sprintf("trash %d", config.TrashDays)))
+	}
 	return h.Sum(nil)
 }
+
+// Compression returns the compression to apply: the one requested, unless empty, or the one in the safe config
+func (s *Safe) Compression(requested string) string {
+	if requested == "" {
+		requested = s.Config.Compression
+	}
+	if requested == core.NoCompression {
+		return ""
+	}
+	return requested
+}
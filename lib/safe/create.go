@@ -7,16 +7,17 @@ import (
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/security"
 	"github.com/stregato/stash/lib/sqlx"
+	"github.com/stregato/stash/lib/storage"
 )
 
 func Create(db *sqlx.DB, identity *security.Identity, url string, config Config) (*Safe, error) {
 	u, err := urllib.Parse(url)
 	if err != nil {
-		return nil, core.Errorw(err, "invalid url %s : %v", url)
+		return nil, core.Errorw(err, "invalid url %s : %v", storage.Redact(url))
 	}
 	parts := strings.Split(strings.TrimLeft(u.Path, "/"), "/")
 	if len(parts) < 2 {
-		return nil, core.Errorf("missing creator id and safe name in %s", url)
+		return nil, core.Errorf("missing creator id and safe name in %s", storage.Redact(url))
 	}
 	if parts[len(parts)-2] != identity.Id.String() {
 		return nil, core.Errorf("creator id %s does not match identity %s", parts[len(parts)-2], identity.Id.String())
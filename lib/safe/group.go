@@ -74,6 +74,21 @@ func (s *Safe) GetGroups() (Groups, error) {
 	return g.Groups, nil
 }
 
+// GroupsAt returns the groups as they were at the provided time, replaying the changes of the chain until then
+func (g GroupChain) GroupsAt(t time.Time, creatorId security.ID) Groups {
+	groups := Groups{}
+	for _, gc := range g.Changes {
+		if gc.Timestamp > t.UnixMicro() {
+			break
+		}
+		err := applyChange(gc, groups, creatorId)
+		if err != nil {
+			core.Info("failed to apply group change: %v", err)
+		}
+	}
+	return groups
+}
+
 func (s *Safe) UpdateGroup(groupName GroupName, change Change, users ...security.ID) (Groups, error) {
 
 	var lastSignature []byte
@@ -229,14 +244,14 @@ func addChanges(g GroupChain, remoteGcs []GroupChange, batchId int, creatorId se
 	localGcs := g.Changes
 
 	i, offset := 0, batchId*batchSize
-	for i := 0; i+offset < len(localGcs) && i < len(remoteGcs); i++ {
+	for ; i+offset < len(localGcs) && i < len(remoteGcs); i++ {
 		if firstMismatch == -1 && !changeEqual(localGcs[i+offset], remoteGcs[i]) {
 			firstMismatch = i
 		}
 	}
 
 	hasFork := firstMismatch != -1
-	localEnd := i == offset+len(localGcs)
+	localEnd := i+offset == len(localGcs)
 	remoteEnd := i == len(remoteGcs)
 
 	var err error
@@ -266,7 +281,7 @@ func addChanges(g GroupChain, remoteGcs []GroupChange, batchId int, creatorId se
 
 	if !hasFork && localEnd && !remoteEnd { // the local chain is a prefix of the remote chain
 		core.Info("local group chain is a prefix of the remote group chain")
-		changes := append(localGcs, remoteGcs[offset:]...)
+		changes := append(localGcs, remoteGcs[i:]...)
 		return 1, GroupChain{Changes: changes, Groups: groups}
 	}
 
@@ -35,10 +35,15 @@ type KeyData struct {
 
 var keysCache = cache.New(time.Minute, time.Hour)
 
+// keysCacheKey includes the identity, since users of the same process must not share the keys of their groups
+func keysCacheKey(s *Safe, groupName GroupName) string {
+	return path.Join(s.ID, s.Identity.Id.String(), groupName.String())
+}
+
 // GetKeys returns the encryption keys for the given group. If the user is not authorized to access the keys, it returns a AuthErr.
 // The parameter expectedMinLength is used to check if the number of keys is at least the expected value. If it is 0, the check is skipped.
 func (s *Safe) GetKeys(groupName GroupName, expectedMinLength int) ([]Key, error) {
-	k, found := keysCache.Get(fmt.Sprintf("%s/%s", s.Store.ID(), groupName))
+	k, found := keysCache.Get(keysCacheKey(s, groupName))
 	if found {
 		keys, ok := k.([]Key)
 		if ok && (expectedMinLength == 0 || len(keys) >= expectedMinLength) {
@@ -61,7 +66,7 @@ func (s *Safe) GetKeys(groupName GroupName, expectedMinLength int) ([]Key, error
 func syncKeys(s *Safe, groupName GroupName, groups Groups) ([]Key, error) {
 	var keys []Key
 	var err error
-	_keys, ok := keysCache.Get(path.Join(s.ID, groupName.String()))
+	_keys, ok := keysCache.Get(keysCacheKey(s, groupName))
 	if ok {
 		keys = _keys.([]Key)
 	} else {
@@ -95,7 +100,7 @@ func syncKeys(s *Safe, groupName GroupName, groups Groups) ([]Key, error) {
 	if err != nil {
 		return nil, err
 	}
-	keysCache.Set(fmt.Sprintf("%s/%s", s.ID, groupName), keys, cache.DefaultExpiration)
+	keysCache.Set(keysCacheKey(s, groupName), keys, cache.DefaultExpiration)
 	s.Touch(KeysDir)
 	return keys, nil
 }
@@ -125,7 +130,7 @@ func updateKeys(c *Safe, groupName GroupName, groups Groups, createNewDataKey bo
 	if err != nil {
 		return nil, err
 	}
-	keysCache.Set(fmt.Sprintf("%s/%s", c.Store.ID(), groupName), keys, cache.DefaultExpiration)
+	keysCache.Set(keysCacheKey(c, groupName), keys, cache.DefaultExpiration)
 
 	return keys, nil
 }
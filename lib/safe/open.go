@@ -2,13 +2,16 @@ package safe
 
 import (
 	_ "embed"
+	"fmt"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 
 	url_ "net/url"
 
+	"github.com/stregato/stash/lib/config"
 	"github.com/stregato/stash/lib/core"
 	"github.com/stregato/stash/lib/security"
 	"github.com/stregato/stash/lib/sqlx"
@@ -21,20 +24,24 @@ var nextHndLock sync.Mutex
 func connect(db *sqlx.DB, identity *security.Identity, url string) (*Safe, error) {
 	u, err := url_.Parse(url)
 	if err != nil {
-		return nil, core.Errorw(err, "invalid url %s : %v", url)
+		return nil, core.Errorw(err, "invalid url %s : %v", storage.Redact(url))
 	}
 
 	parts := strings.Split(strings.TrimLeft(u.Path, "/"), "/")
 	if len(parts) < 2 {
-		return nil, core.Errorf("missing creator hash and safe name in %s", url)
+		return nil, core.Errorf("missing creator hash and safe name in %s", storage.Redact(url))
 	}
 
 	creatorId, err := security.CastID(parts[len(parts)-2])
 	if err != nil {
-		return nil, core.Errorf("invalid creator id in %s", url)
+		return nil, core.Errorf("invalid creator id in %s", storage.Redact(url))
 	}
 
-	store, err := storage.Open(url)
+	// SFTP host keys trusted on first use and store credentials are kept in the config DB
+	store, err := storage.OpenWith(url, storage.OpenOptions{
+		HostKeys:    config.KnownHosts{DB: db},
+		Credentials: config.Credentials{DB: db, Identity: identity},
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -73,9 +80,10 @@ func NewTestSafe(t *testing.T, identity *security.Identity, storeId string, crea
 	core.T = t
 	db := sqlx.NewTestDB(t, persistent)
 
-	urls := storage.LoadTestURLs()
-
-	url := urls[storeId]
+	url := storeId
+	if !strings.Contains(storeId, "://") {
+		url = storage.LoadTestURLs()[storeId]
+	}
 	if url == "" {
 		t.Fatalf("unknown store id %s", storeId)
 	}
@@ -93,3 +101,40 @@ func NewTestSafe(t *testing.T, identity *security.Identity, storeId string, crea
 
 	return s
 }
+
+// NewTestPeers creates a safe on the provided url with the first identity as creator, grants the other identities
+// access to the user group and opens the safe for each of them. Each peer has its own database. On a fault store,
+// each peer gets a different seed so that it experiences a different schedule of failures.
+func NewTestPeers(t *testing.T, url string, identities ...*security.Identity) []*Safe {
+	core.T = t
+	u, err := url_.Parse(url)
+	core.TestErr(t, err, "cannot parse url %s", url)
+	u.Path = path.Join(u.Path, identities[0].Id.String(), "test")
+
+	var peers []*Safe
+	for i, identity := range identities {
+		if u.Scheme == "fault" {
+			q := u.Query()
+			q.Set("seed", strconv.Itoa(i+1))
+			u.RawQuery = q.Encode()
+		}
+
+		db, err := sqlx.Open(path.Join(t.TempDir(), fmt.Sprintf("peer-%d.db", i)))
+		core.TestErr(t, err, "cannot open db for peer %d: %v", i)
+
+		var s *Safe
+		if i == 0 {
+			s, err = Create(db, identity, u.String(), Config{})
+			core.TestErr(t, err, "cannot create safe %s: %v", u.String())
+			for _, other := range identities[1:] {
+				_, err = s.UpdateGroup(UserGroup, Grant, other.Id)
+				core.TestErr(t, err, "cannot grant access to %s: %v", other.Id)
+			}
+		} else {
+			s, err = Open(db, identity, u.String())
+			core.TestErr(t, err, "cannot open safe %s: %v", u.String())
+		}
+		peers = append(peers, s)
+	}
+	return peers
+}
@@ -0,0 +1,44 @@
+package safe
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/security"
+	"github.com/stregato/stash/lib/storage"
+)
+
+// faultURL simulates an unreliable store. Retries hide the transient errors from the upper layers
+const faultURL = "fault://peers?err=0.1&partial=0.05&stale=0.3&latency=1ms&skew=2s&retry=10&retryBackoff=1ms"
+
+func TestPeers(t *testing.T) {
+	alice := security.NewIdentityMust("alice")
+	bob := security.NewIdentityMust("bob")
+	carl := security.NewIdentityMust("carl")
+	peers := NewTestPeers(t, faultURL, alice, bob, carl)
+	defer func() {
+		for _, p := range peers {
+			p.Close()
+		}
+	}()
+
+	_, err := peers[0].UpdateGroup(AdminGroup, Grant, bob.Id)
+	core.TestErr(t, err, "cannot grant admin to bob: %v")
+
+	// the groups converge on all peers once the faults stop
+	for _, p := range peers {
+		storage.Unwrap(p.Store).(*storage.Fault).SetEnabled(false)
+		p.ResetTouch(GroupDir)
+	}
+	expected, err := peers[0].GetGroups()
+	core.TestErr(t, err, "cannot get groups: %v")
+	for _, p := range peers[1:] {
+		groups, err := p.GetGroups()
+		core.TestErr(t, err, "cannot get groups on %s: %v", p.Identity.Id.Nick())
+		core.Assert(t, reflect.DeepEqual(groups, expected), "groups diverge on %s: %s != %s",
+			p.Identity.Id.Nick(), groups, expected)
+	}
+	core.Assert(t, expected[AdminGroup].Contains(bob.Id), "bob is not admin: %s", expected)
+	core.Assert(t, expected[UserGroup].Contains(carl.Id), "carl is not user: %s", expected)
+}
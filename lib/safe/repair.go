@@ -0,0 +1,11 @@
+package safe
+
+import (
+	"github.com/stregato/stash/lib/storage"
+)
+
+// Repair fixes the missing or divergent copies of the data when the store is redundant, e.g. a mirror or an erasure
+// coded store. It returns the number of repaired objects
+func (s *Safe) Repair() (int, error) {
+	return storage.Repair(s.Store, "")
+}
@@ -0,0 +1,109 @@
+package safe
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"github.com/stregato/stash/lib/storage"
+)
+
+// DefaultScrubGracePeriod protects recent orphans, which may belong to an operation in progress
+var DefaultScrubGracePeriod = 24 * time.Hour
+
+// Kinds of inconsistencies found by Scrub
+const (
+	IssueUnreadable = "unreadable" // IssueUnreadable is an object that cannot be read or decrypted
+	IssueMissing    = "missing"    // IssueMissing is an object referenced by another that does not exist
+	IssueSize       = "size"       // IssueSize is an object with a different size than expected
+	IssueOrphan     = "orphan"     // IssueOrphan is an object that nothing references
+	IssueStaleLock  = "stale lock" // IssueStaleLock is a lock that expired without being released
+)
+
+type ScrubOptions struct {
+	Delete      bool          `json:"delete"`      // delete orphans and stale locks
+	GracePeriod time.Duration `json:"gracePeriod"` // orphans younger than this are not deleted; 0 for DefaultScrubGracePeriod
+}
+
+type Issue struct {
+	Kind    string `json:"kind"`    // Kind is one of the Issue constants
+	Path    string `json:"path"`    // Path is the location of the object in the store
+	Detail  string `json:"detail"`  // Detail describes the problem
+	Deleted bool   `json:"deleted"` // Deleted is true when the object has been removed
+}
+
+type ScrubReport struct {
+	Checked int     `json:"checked"` // Checked is the number of objects checked
+	Issues  []Issue `json:"issues"`  // Issues are the inconsistencies found
+}
+
+// Scrubber checks the objects of a layer on top of the safe, e.g. the file system, and adds the problems to the report
+type Scrubber func(s *Safe, options ScrubOptions, report *ScrubReport) error
+
+var scrubbers = map[string]Scrubber{}
+var scrubberNames []string
+
+// RegisterScrubber adds a check to Scrub. Layers register their checks in init, since the safe does not know their
+// layout.
+func RegisterScrubber(name string, scrubber Scrubber) {
+	if _, ok := scrubbers[name]; !ok {
+		scrubberNames = append(scrubberNames, name)
+	}
+	scrubbers[name] = scrubber
+}
+
+// lockDirs are the folders where the safe takes locks
+var lockDirs = []string{KeysDir, GroupDir}
+
+// Scrub walks the store and reports the inconsistencies left by interrupted operations, such as bodies without a
+// header or expired locks. With the Delete option, orphans older than the grace period are removed.
+func (s *Safe) Scrub(options ScrubOptions) (ScrubReport, error) {
+	if options.GracePeriod == 0 {
+		options.GracePeriod = DefaultScrubGracePeriod
+	}
+
+	var report ScrubReport
+	for _, dir := range lockDirs {
+		dir = path.Join(dir, storage.LockDir)
+		ls, err := s.Store.ReadDir(dir, storage.Filter{OnlyFiles: true})
+		if err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+		for _, l := range ls {
+			report.Checked++
+			if core.Since(l.ModTime()) < storage.LockExpire {
+				continue
+			}
+			report.Remove(s, options, path.Join(dir, l.Name()), IssueStaleLock, "lock expired without release", true)
+		}
+	}
+
+	for _, name := range scrubberNames {
+		err := scrubbers[name](s, options, &report)
+		if err != nil {
+			return report, core.Errorw(err, "scrub of %s failed: %v", name)
+		}
+	}
+	core.Info("scrubbed safe %s: %d objects checked, %d issues", storage.Redact(s.URL), report.Checked,
+		len(report.Issues))
+	return report, nil
+}
+
+// Add records an issue that is not fixed automatically
+func (r *ScrubReport) Add(kind, path, detail string) {
+	r.Issues = append(r.Issues, Issue{Kind: kind, Path: path, Detail: detail})
+	core.Info("scrub found %s %s: %s", kind, path, detail)
+}
+
+// Remove records an orphan and deletes it when the options allow and it has expired, i.e. it is older than the grace
+// period
+func (r *ScrubReport) Remove(s *Safe, options ScrubOptions, name, kind, detail string, expired bool) {
+	issue := Issue{Kind: kind, Path: name, Detail: detail}
+	if options.Delete && expired {
+		err := s.Store.Delete(name)
+		issue.Deleted = !core.IsErr(err, "cannot delete %s: %v", name)
+	}
+	r.Issues = append(r.Issues, issue)
+	core.Info("scrub found %s %s: %s, deleted %t", kind, name, detail, issue.Deleted)
+}
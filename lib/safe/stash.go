@@ -13,7 +13,14 @@ import (
 type Config struct {
 	Quota       int64
 	Description string
-	Signature   []byte
+	Compression string `yaml:",omitempty"` // Compression is applied to files, messages and transactions, e.g. zstd
+	Dedup       bool   `yaml:",omitempty"` // Dedup splits files in chunks stored once per group
+	// KeepVersions and KeepDays prune the old versions of a file: a version is kept when it is among the most recent
+	// KeepVersions or younger than KeepDays. Zero values keep all versions
+	KeepVersions int `yaml:",omitempty"`
+	KeepDays     int `yaml:",omitempty"`
+	TrashDays    int `yaml:",omitempty"` // TrashDays moves deleted files to the trash and purges them after the days
+	Signature    []byte
 }
 
 type Safe struct {
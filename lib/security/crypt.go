@@ -9,6 +9,8 @@ import (
 type EncryptingReadSeeker struct {
 	inputSeeker io.ReadSeeker
 	cipher      cipher.Stream
+	block       cipher.Block
+	iv          []byte
 }
 
 func (er *EncryptingReadSeeker) Read(p []byte) (n int, err error) {
@@ -19,8 +21,36 @@ func (er *EncryptingReadSeeker) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// Seek moves the input and aligns the key stream to the new position, so that a retry after a partial read
+// produces the same cipher text
 func (er *EncryptingReadSeeker) Seek(offset int64, whence int) (int64, error) {
-	return er.inputSeeker.Seek(offset, whence)
+	pos, err := er.inputSeeker.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	er.cipher = newCTRAt(er.block, er.iv, pos)
+	return pos, nil
+}
+
+// newCTRAt returns a CTR stream positioned at the provided offset
+func newCTRAt(block cipher.Block, iv []byte, offset int64) cipher.Stream {
+	counter := make([]byte, len(iv))
+	copy(counter, iv)
+
+	// add the number of blocks to the counter, which is a big endian integer
+	carry := uint64(offset / int64(block.BlockSize()))
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(block, counter)
+	if skip := offset % int64(block.BlockSize()); skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return stream
 }
 
 func EncryptReader(inputSeeker io.ReadSeeker, key []byte, iv []byte) (io.ReadSeeker, error) {
@@ -34,6 +64,8 @@ func EncryptReader(inputSeeker io.ReadSeeker, key []byte, iv []byte) (io.ReadSee
 	return &EncryptingReadSeeker{
 		inputSeeker: inputSeeker,
 		cipher:      stream,
+		block:       block,
+		iv:          iv,
 	}, nil
 }
 
@@ -43,20 +75,25 @@ type DecryptingWriter2 struct {
 }
 
 func (dw *DecryptingWriter2) Write(p []byte) (n int, err error) {
-	dw.cipher.XORKeyStream(p, p)
-	return dw.outputWriter.Write(p)
+	// the writer must not modify p, so the decryption uses a separate buffer
+	b := make([]byte, len(p))
+	dw.cipher.XORKeyStream(b, p)
+	return dw.outputWriter.Write(b)
 }
 
 func DecryptWriter(outputWriter io.Writer, key []byte, iv []byte) (io.Writer, error) {
+	return DecryptWriterAt(outputWriter, key, iv, 0)
+}
+
+// DecryptWriterAt decrypts data that starts at the provided offset of the cipher text, e.g. the result of a range read
+func DecryptWriterAt(outputWriter io.Writer, key []byte, iv []byte, offset int64) (io.Writer, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-
 	return &DecryptingWriter2{
 		outputWriter: outputWriter,
-		cipher:       stream,
+		cipher:       newCTRAt(block, iv, offset),
 	}, nil
 }
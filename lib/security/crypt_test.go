@@ -0,0 +1,46 @@
+package security
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+func TestEncryptReaderSeek(t *testing.T) {
+	key := GenerateBytesKey(32)
+	iv := bytes.Repeat([]byte{0xff}, 16)
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	r, err := EncryptReader(bytes.NewReader(data), key, iv)
+	core.TestErr(t, err, "cannot create encrypt reader: %v")
+	full, _ := io.ReadAll(r)
+
+	for _, offset := range []int64{0, 1, 16, 17, 4097} {
+		r.Seek(offset, io.SeekStart)
+		part, _ := io.ReadAll(r)
+		core.Assert(t, bytes.Equal(part, full[offset:]), "wrong cipher text after seek to %d", offset)
+	}
+}
+
+func TestDecryptWriterAt(t *testing.T) {
+	key := GenerateBytesKey(32)
+	iv := GenerateBytesKey(16)
+	data := core.GenerateRandomBytes(10000)
+
+	r, err := EncryptReader(bytes.NewReader(data), key, iv)
+	core.TestErr(t, err, "cannot create encrypt reader: %v")
+	encrypted, _ := io.ReadAll(r)
+
+	for _, offset := range []int64{0, 1, 15, 16, 17, 4097, 9999} {
+		var b bytes.Buffer
+		w, err := DecryptWriterAt(&b, key, iv, offset)
+		core.TestErr(t, err, "cannot create decrypt writer: %v")
+		w.Write(encrypted[offset:])
+		core.Assert(t, bytes.Equal(b.Bytes(), data[offset:]), "wrong plain text from offset %d", offset)
+	}
+}
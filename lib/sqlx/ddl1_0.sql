@@ -19,6 +19,9 @@ INSERT INTO mio_configs(node,k,s,i,b) VALUES(:node,:key,:s,:i,:b)
 -- STASH_DEL_CONFIG
 DELETE FROM mio_configs WHERE node=:node
 
+-- STASH_DEL_CONFIG_KEY
+DELETE FROM mio_configs WHERE node=:node AND k=:key
+
 -- STASH_LIST_CONFIG
 SELECT k FROM mio_configs WHERE node=:node
 
@@ -37,9 +40,17 @@ CREATE TABLE IF NOT EXISTS mio_files (
     localCopy       VARCHAR(4096)   NOT NULL,
     copyTime    INTEGER         NOT NULL,
     attributes      BLOB,
+    compression     VARCHAR(16)     NOT NULL DEFAULT '',
+    manifest        BLOB,
     PRIMARY KEY(safeID, name, dir, id)
 );
 
+-- INIT
+ALTER TABLE mio_files ADD COLUMN compression VARCHAR(16) NOT NULL DEFAULT ''
+
+-- INIT
+ALTER TABLE mio_files ADD COLUMN manifest BLOB
+
 -- INIT
 CREATE INDEX IF NOT EXISTS idx_mio_files_id ON mio_files(id)
 
@@ -57,10 +68,12 @@ CREATE INDEX IF NOT EXISTS idx_mio_files_name ON mio_files(name)
 
 -- STASH_STORE_FILE
 INSERT INTO mio_files(safeID,name,dir,id,creator,groupName,tags,encryptionKey,modTime,size,localCopy, 
-    copyTime, attributes) VALUES(:safeID,:name,:dir,:id,:creator,:groupName,:tags,:encryptionKey,
-    :modTime,:size,:localCopy,:copyTime,:attributes) ON CONFLICT(safeID,name,dir,id) DO UPDATE
+    copyTime, attributes, compression, manifest) VALUES(:safeID,:name,:dir,:id,:creator,:groupName,:tags,
+    :encryptionKey,:modTime,:size,:localCopy,:copyTime,:attributes,:compression,:manifest)
+    ON CONFLICT(safeID,name,dir,id) DO UPDATE
     SET creator=:creator,groupName=:groupName,tags=:tags,encryptionKey=:encryptionKey,modTime=:modTime,
-    size=:size,localCopy=:localCopy,copyTime=:copyTime,attributes=:attributes
+    size=:size,localCopy=:localCopy,copyTime=:copyTime,attributes=:attributes,compression=:compression,
+    manifest=:manifest
     WHERE id=:id AND safeID=:safeID AND name=:name AND dir=:dir
 
 -- STASH_STORE_DIR
@@ -76,8 +89,8 @@ UPDATE mio_files SET localCopy=:localCopy, copyTime=:copyTime
 SELECT id FROM mio_files WHERE dir=:dir ORDER BY id DESC LIMIT 1
 
 -- STASH_GET_FILES_BY_DIR
-SELECT id,name,dir,groupName,tags,modTime,size,creator,attributes,localCopy,copyTime,encryptionKey 
-    FROM mio_files WHERE dir=:dir AND safeID=:safeID
+SELECT id,name,dir,groupName,tags,modTime,size,creator,attributes,localCopy,copyTime,encryptionKey,compression,
+    manifest FROM mio_files WHERE dir=:dir AND safeID=:safeID
     AND (:name = '' OR name = :name)
     AND (:groupName = '' OR groupName = :groupName)
     AND (:tag = '' OR tags LIKE '% ' || :tag || ' %')
@@ -90,17 +103,31 @@ SELECT id,name,dir,groupName,tags,modTime,size,creator,attributes,localCopy,copy
     LIMIT CASE WHEN :limit = 0 THEN -1 ELSE :limit END OFFSET :offset
 
 -- STASH_GET_FILE_BY_NAME
-SELECT  id,groupName,tags,modTime,size,creator,attributes,localCopy,copyTime,encryptionKey  
-    FROM mio_files WHERE safeID=:safeID AND dir=:dir AND name=:name ORDER BY id DESC LIMIT 1
+SELECT  id,groupName,tags,modTime,size,creator,attributes,localCopy,copyTime,encryptionKey,compression,
+    manifest FROM mio_files WHERE safeID=:safeID AND dir=:dir AND name=:name ORDER BY id DESC LIMIT 1
+
+-- STASH_GET_FILE_VERSION
+SELECT  id,groupName,tags,modTime,size,creator,attributes,localCopy,copyTime,encryptionKey,compression,
+    manifest FROM mio_files WHERE safeID=:safeID AND dir=:dir AND name=:name AND id=:id
+
+-- STASH_GET_FILE_VERSIONS
+SELECT  id,groupName,tags,modTime,size,creator,attributes,localCopy,copyTime,encryptionKey,compression,
+    manifest FROM mio_files WHERE safeID=:safeID AND dir=:dir AND name=:name AND id>0 ORDER BY id DESC
 
 -- STASH_GET_GROUP_NAME 
-SELECT DISTINCT groupName FROM mio_files WHERE safeID=:safeID AND dir = :dir AND name = :name 
+SELECT groupName FROM mio_files WHERE safeID=:safeID AND dir = :dir AND name = :name AND id=0
+
+-- STASH_SET_DIR_GROUP
+UPDATE mio_files SET groupName=:groupName WHERE safeID=:safeID AND dir=:dir AND name=:name AND id=0
 
 -- STASH_DELETE_FILE
 DELETE FROM mio_files WHERE safeID=:safeID AND id=:id
 
--- STASH_DELETE_DIR
-DELETE FROM mio_files WHERE safeID=:safeID AND dir=:dir AND id=0 AND NOT EXISTS(SELECT 1 FROM mio_files WHERE safeID=:safeID AND dir=:dir AND id>0)
+-- STASH_DELETE_FILE_IN_DIR
+DELETE FROM mio_files WHERE safeID=:safeID AND dir=:dir AND id=:id
+
+-- STASH_DELETE_DIR_ENTRY
+DELETE FROM mio_files WHERE safeID=:safeID AND dir=:dir AND name=:name AND id=0
 
 -- STASH_RENAME_FILE
 UPDATE mio_files SET name=:newName, dir=:newDir WHERE safeID=:safeID AND id=:id AND name=:oldName AND dir=:oldDir
@@ -114,22 +141,55 @@ CREATE TABLE IF NOT EXISTS mio_file_async (
     operation   VARCHAR(0)      NOT NULL,
     file        BLOB NOT        NULL,
     data        BLOB,
+    upload      BLOB,
     CONSTRAINT pk_mio_file_async PRIMARY KEY(safeID,id)
 );
 
+-- INIT
+ALTER TABLE mio_file_async ADD COLUMN upload BLOB
+
 -- STASH_INSERT_FILE_ASYNC
 INSERT INTO mio_file_async(safeID,id,deleteSrc,localCopy,operation,file,data) 
     VALUES(:safeID,:id,:deleteSrc,:localCopy,:operation,:file,:data)
 
 -- STASH_GET_FILE_ASYNC
-SELECT file,data, deleteSrc, localCopy, operation FROM mio_file_async WHERE safeID=:safeID AND id=:id
+SELECT file,data, deleteSrc, localCopy, operation, upload FROM mio_file_async WHERE safeID=:safeID AND id=:id
 
 -- STASH_GET_FILES_ASYNC
-SELECT id,file,data, deleteSrc, localCopy, operation FROM mio_file_async WHERE safeID=:safeID
+SELECT id,file,data, deleteSrc, localCopy, operation, upload FROM mio_file_async WHERE safeID=:safeID
+
+-- STASH_SET_FILE_ASYNC_UPLOAD
+UPDATE mio_file_async SET upload=:upload WHERE safeID=:safeID AND id=:id
 
 -- STASH_DEL_FILE_ASYNC
 DELETE FROM mio_file_async WHERE safeID=:safeID AND id=:id
 
+-- INIT
+CREATE TABLE IF NOT EXISTS mio_sync (
+    safeID      VARCHAR(256)    NOT NULL,
+    localDir    VARCHAR(4096)   NOT NULL,
+    remoteDir   VARCHAR(4096)   NOT NULL,
+    path        VARCHAR(4096)   NOT NULL,
+    modTime     INTEGER         NOT NULL,
+    size        INTEGER         NOT NULL,
+    hash        VARCHAR(128)    NOT NULL,
+    remoteID    INTEGER         NOT NULL,
+    PRIMARY KEY(safeID, localDir, remoteDir, path)
+)
+
+-- STASH_GET_SYNC_STATE
+SELECT path, modTime, size, hash, remoteID FROM mio_sync 
+    WHERE safeID=:safeID AND localDir=:localDir AND remoteDir=:remoteDir
+
+-- STASH_SET_SYNC_STATE
+INSERT INTO mio_sync(safeID,localDir,remoteDir,path,modTime,size,hash,remoteID) 
+    VALUES(:safeID,:localDir,:remoteDir,:path,:modTime,:size,:hash,:remoteID)
+    ON CONFLICT(safeID,localDir,remoteDir,path) DO UPDATE
+    SET modTime=:modTime,size=:size,hash=:hash,remoteID=:remoteID
+
+-- STASH_DEL_SYNC_STATE
+DELETE FROM mio_sync WHERE safeID=:safeID AND localDir=:localDir AND remoteDir=:remoteDir AND path=:path
+
 -- INIT
 CREATE TABLE IF NOT EXISTS mio_tx (
     safeID      TEXT, 
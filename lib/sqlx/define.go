@@ -32,6 +32,10 @@ func (db *DB) Define(version float32, ddl string) error {
 			}
 			if header == "INIT" {
 				_, err := db.Db.Exec(query)
+				// columns added to existing tables are already in the tables created with the new definition
+				if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+					continue
+				}
 				if core.IsErr(err, "cannot execute SQL Init stmt (line %d) '%s': %v\n", line, query, err) {
 					return err
 				}
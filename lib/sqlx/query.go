@@ -203,7 +203,9 @@ func (rw *Rows) Scan(dest ...interface{}) (err error) {
 				}(i, b)
 			}
 		case "BLOB", "TEXT":
-			if _, ok := dest[i].(*string); !ok {
+			switch dest[i].(type) {
+			case *string, *[]byte:
+			default:
 				var kind = reflect.TypeOf(dest[i]).Elem().Kind()
 				if kind == reflect.Slice || kind == reflect.Map || kind == reflect.Struct {
 					var data []byte
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/stregato/stash/lib/core"
+)
+
+// AzureBlob is a store on an Azure Blob Storage container
+type AzureBlob struct {
+	container azblob.ContainerURL
+	id        string
+	dir       string
+}
+
+// OpenAzureBlob opens a store on Azure Blob Storage. The url is in the format
+// azblob://host/container/dir?a=account&k=key where host defaults to account.blob.core.windows.net. The endpoint
+// parameter replaces the service url, e.g. http%3A%2F%2F127.0.0.1%3A10000%2Fdevstoreaccount1 for the Azurite emulator.
+func OpenAzureBlob(connectionUrl string) (Store, error) {
+	u, err := url.Parse(connectionUrl)
+	if core.IsErr(err, "invalid url '%s': %v", Redact(connectionUrl)) {
+		return nil, err
+	}
+	if u.Scheme != "azblob" {
+		return nil, core.Errorf("invalid scheme: %s", u.Scheme)
+	}
+
+	q := u.Query()
+	accountName := q.Get("a")
+	accountKey := q.Get("k")
+
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, core.Errorf("missing container in %s", Redact(connectionUrl))
+	}
+	containerName := parts[0]
+	var dir string
+	if len(parts) > 1 {
+		dir = parts[1]
+	}
+
+	endpoint := azureEndpoint(u, accountName, "blob")
+	e, err := url.Parse(endpoint)
+	if core.IsErr(err, "invalid endpoint '%s': %v", endpoint) {
+		return nil, err
+	}
+	repr := fmt.Sprintf("azblob://%s/%s", e.Host, path.Join(e.Path, containerName, dir))
+
+	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return nil, core.Errorf("cannot create Azure credential for %s: %v", repr, err)
+	}
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+
+	containerUrl, err := url.Parse(endpoint + "/" + containerName)
+	if core.IsErr(err, "invalid container url for %s: %v", repr) {
+		return nil, err
+	}
+
+	b := &AzureBlob{
+		container: azblob.NewContainerURL(*containerUrl, p),
+		id:        repr,
+		dir:       dir,
+	}
+
+	err = b.createContainerIfNeeded()
+	return b, err
+}
+
+// azureEndpoint returns the service url from the endpoint parameter, the host or the account name
+func azureEndpoint(u *url.URL, accountName, service string) string {
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		return strings.TrimRight(endpoint, "/")
+	}
+	if u.Host != "" {
+		return "https://" + u.Host
+	}
+	return fmt.Sprintf("https://%s.%s.core.windows.net", accountName, service)
+}
+
+func (b *AzureBlob) createContainerIfNeeded() error {
+	_, err := b.container.Create(context.Background(), azblob.Metadata{}, azblob.PublicAccessNone)
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) && storageErr.ServiceCode() == azblob.ServiceCodeContainerAlreadyExists {
+		return nil
+	}
+	if core.IsErr(err, "cannot create container for %s: %v", b) {
+		return b.mapError(err)
+	}
+	return nil
+}
+
+func (b *AzureBlob) ID() string {
+	return b.id
+}
+
+func (b *AzureBlob) key(name string) string {
+	return strings.TrimLeft(path.Join(b.dir, name), "/")
+}
+
+func (b *AzureBlob) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	ctx := context.Background()
+
+	var offset int64
+	var count int64 = azblob.CountToEnd
+	if rang != nil {
+		if rang.To <= rang.From {
+			return nil
+		}
+		offset = rang.From
+		count = rang.To - rang.From
+	}
+
+	blobUrl := b.container.NewBlobURL(b.key(name))
+	resp, err := blobUrl.Download(ctx, offset, count, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		err = b.mapError(err)
+		if os.IsNotExist(err) || core.IsErr(err, "cannot read %s/%s: %v", b, name) {
+			return err
+		}
+	}
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+
+	_, err = io.Copy(&progressWriter{w: dest, progress: progress}, body)
+	if core.IsErr(err, "cannot read %s/%s: %v", b, name) {
+		return err
+	}
+	return nil
+}
+
+func (b *AzureBlob) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	return b.WriteIf(name, source, Condition{}, progress)
+}
+
+// WriteIf uploads the file only when the condition holds on the service side
+func (b *AzureBlob) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	var ac azblob.BlobAccessConditions
+	if cond.IfNotExists {
+		ac.ModifiedAccessConditions.IfNoneMatch = azblob.ETagAny
+	}
+	ac.ModifiedAccessConditions.IfUnmodifiedSince = cond.IfUnmodifiedSince
+
+	size, err := source.Seek(0, io.SeekEnd)
+	if core.IsErr(err, "cannot seek source for '%s': %v", name) {
+		return err
+	}
+	source.Seek(0, io.SeekStart)
+
+	blobUrl := b.container.NewBlockBlobURL(b.key(name))
+	_, err = blobUrl.Upload(context.Background(), source, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, ac,
+		azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{}, azblob.ImmutabilityPolicyOptions{})
+	err = b.mapError(err)
+	if errors.Is(err, ErrConditionNotMet) {
+		return err
+	}
+	if core.IsErr(err, "cannot write %s/%s: %v", b, name) {
+		return err
+	}
+	if progress != nil {
+		progress <- size
+	}
+	return nil
+}
+
+func (b *AzureBlob) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
+	ctx := context.Background()
+
+	prefix := b.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+	options := azblob.ListBlobsSegmentOptions{Prefix: prefix + f.Prefix}
+
+	var infos []fs.FileInfo
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ls, err := b.container.ListBlobsHierarchySegment(ctx, marker, "/", options)
+		if err != nil {
+			core.IsErr(err, "cannot list %s/%s: %v", b, dir)
+			return nil, b.mapError(err)
+		}
+		marker = ls.NextMarker
+
+		if !f.OnlyFiles {
+			for _, item := range ls.Segment.BlobPrefixes {
+				info := simpleFileInfo{
+					name:  strings.TrimSuffix(strings.TrimPrefix(item.Name, prefix), "/"),
+					isDir: true,
+				}
+				if matchFilter(info, f) {
+					infos = append(infos, info)
+				}
+			}
+		}
+		if !f.OnlyFolders {
+			for _, item := range ls.Segment.BlobItems {
+				info := simpleFileInfo{
+					name:    strings.TrimPrefix(item.Name, prefix),
+					modTime: item.Properties.LastModified,
+				}
+				if item.Properties.ContentLength != nil {
+					info.size = *item.Properties.ContentLength
+				}
+				if matchFilter(info, f) {
+					infos = append(infos, info)
+				}
+			}
+		}
+		if f.MaxResults != 0 && int64(len(infos)) >= f.MaxResults {
+			infos = infos[:f.MaxResults]
+			break
+		}
+	}
+	return infos, nil
+}
+
+func (b *AzureBlob) Stat(name string) (fs.FileInfo, error) {
+	ctx := context.Background()
+
+	props, err := b.container.NewBlobURL(b.key(name)).GetProperties(ctx, azblob.BlobAccessConditions{},
+		azblob.ClientProvidedKeyOptions{})
+	if err == nil {
+		return simpleFileInfo{
+			name:    path.Base(name),
+			size:    props.ContentLength(),
+			modTime: props.LastModified(),
+		}, nil
+	}
+	err = b.mapError(err)
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// blob storage has no folders, so a folder exists when some blob has it as prefix
+	ls, err := b.container.ListBlobsHierarchySegment(ctx, azblob.Marker{}, "/",
+		azblob.ListBlobsSegmentOptions{Prefix: b.key(name) + "/", MaxResults: 1})
+	if err != nil {
+		return nil, b.mapError(err)
+	}
+	if len(ls.Segment.BlobItems) > 0 || len(ls.Segment.BlobPrefixes) > 0 {
+		return simpleFileInfo{
+			name:  path.Base(name),
+			isDir: true,
+		}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Delete deletes a blob or all the blobs in a folder
+func (b *AzureBlob) Delete(name string) error {
+	ctx := context.Background()
+
+	_, err := b.container.NewBlobURL(b.key(name)).Delete(ctx, azblob.DeleteSnapshotsOptionInclude,
+		azblob.BlobAccessConditions{})
+	err = b.mapError(err)
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	var found bool
+	prefix := b.key(name) + "/"
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ls, err := b.container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return b.mapError(err)
+		}
+		marker = ls.NextMarker
+		for _, item := range ls.Segment.BlobItems {
+			_, err = b.container.NewBlobURL(item.Name).Delete(ctx, azblob.DeleteSnapshotsOptionInclude,
+				azblob.BlobAccessConditions{})
+			if core.IsErr(err, "cannot delete %s: %v", item.Name) {
+				return b.mapError(err)
+			}
+			found = true
+		}
+	}
+	if !found {
+		return os.ErrNotExist
+	}
+	core.Info("deleted %s in %s", name, b)
+	return nil
+}
+
+func (b *AzureBlob) mapError(err error) error {
+	var storageErr azblob.StorageError
+	if !errors.As(err, &storageErr) {
+		return err
+	}
+	switch storageErr.ServiceCode() {
+	case azblob.ServiceCodeBlobNotFound, azblob.ServiceCodeContainerNotFound, azblob.ServiceCodeResourceNotFound:
+		return fs.ErrNotExist
+	case azblob.ServiceCodeBlobAlreadyExists, azblob.ServiceCodeConditionNotMet:
+		return ErrConditionNotMet
+	}
+	if storageErr.Response() != nil && storageErr.Response().StatusCode == http.StatusPreconditionFailed {
+		return ErrConditionNotMet
+	}
+	return err
+}
+
+// IsRetryable returns true for throttling, timeouts and server errors
+func (b *AzureBlob) IsRetryable(err error) bool {
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) {
+		switch storageErr.ServiceCode() {
+		case azblob.ServiceCodeServerBusy, azblob.ServiceCodeOperationTimedOut, azblob.ServiceCodeInternalError:
+			return true
+		}
+		if resp := storageErr.Response(); resp != nil {
+			code := resp.StatusCode
+			return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+		}
+	}
+	return isTransient(err)
+}
+
+func (b *AzureBlob) Close() error {
+	return nil
+}
+
+func (b *AzureBlob) String() string {
+	return b.id
+}
+
+// Describe implements Store.
+func (*AzureBlob) Describe() Description {
+	return Description{
+		ReadCost:  0.0000004,
+		WriteCost: 0.000005,
+	}
+}
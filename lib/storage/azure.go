@@ -3,10 +3,13 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strings"
 
@@ -15,20 +18,19 @@ import (
 	"github.com/stregato/stash/lib/core"
 )
 
-// Addr        string
-// AccountName string
-// AccountKey  string
-// Share       string
-
+// Azure is a store on an Azure Files share
 type Azure struct {
-	p   pipeline.Pipeline
-	id  string
-	dir string
+	p    pipeline.Pipeline
+	id   string
+	base string
+	dir  string
 }
 
+// OpenAzure opens a store on Azure Files. The url is in the format azure://host/share/dir?a=account&k=key where host
+// defaults to account.file.core.windows.net. The endpoint parameter replaces the service url, e.g. for an emulator.
 func OpenAzure(connectionUrl string) (Store, error) {
 	u, err := url.Parse(connectionUrl)
-	if core.IsErr(err, "invalid url '%s': %v", connectionUrl) {
+	if core.IsErr(err, "invalid url '%s': %v", Redact(connectionUrl)) {
 		return nil, err
 	}
 
@@ -36,8 +38,17 @@ func OpenAzure(connectionUrl string) (Store, error) {
 	accountName := q.Get("a")
 	accountKey := q.Get("k")
 
-	dir := strings.TrimLeft(u.Path, "/")
-	repr := fmt.Sprintf("azure://%s/%s", u.Host, dir)
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, core.Errorf("missing share in %s", Redact(connectionUrl))
+	}
+	var dir string
+	if len(parts) > 1 {
+		dir = parts[1]
+	}
+	endpoint := azureEndpoint(u, accountName, "file")
+	repr := fmt.Sprintf("azure://%s/%s", strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://"),
+		path.Join(parts[0], dir))
 
 	credential, err := azfile.NewSharedKeyCredential(accountName, accountKey)
 	if err != nil {
@@ -47,9 +58,10 @@ func OpenAzure(connectionUrl string) (Store, error) {
 	p := azfile.NewPipeline(credential, azfile.PipelineOptions{})
 
 	a := &Azure{
-		p:   p,
-		id:  repr,
-		dir: dir,
+		p:    p,
+		id:   repr,
+		base: endpoint + "/" + parts[0],
+		dir:  dir,
 	}
 	return a, nil
 }
@@ -59,46 +71,62 @@ func (a *Azure) ID() string {
 }
 
 func (a *Azure) MkdirAll(name string) error {
-	if name == "" {
+	name = path.Join(a.dir, name)
+	if name == "" || name == "." {
 		return nil
 	}
 	ctx := context.Background()
-	directoryUrl, err := a.getDirectoryUrl(name)
+	directoryUrl, err := a.shareUrl(name)
 	if err != nil {
 		return err
 	}
-	_, err = directoryUrl.GetProperties(ctx)
+	_, err = azfile.NewDirectoryURL(directoryUrl, a.p).GetProperties(ctx)
 	if err == nil {
 		return nil
 	}
 
 	d := ""
 	for _, p := range strings.Split(name, "/") {
-		directoryUrl, _ = a.getDirectoryUrl(d)
-		directoryUrl = directoryUrl.NewDirectoryURL(p)
-		_, err = directoryUrl.Create(ctx, azfile.Metadata{}, azfile.SMBProperties{})
+		d = path.Join(d, p)
+		u, err := a.shareUrl(d)
 		if err != nil {
 			return err
 		}
-		d = path.Join(d, p)
+		_, err = azfile.NewDirectoryURL(u, a.p).Create(ctx, azfile.Metadata{}, azfile.SMBProperties{})
+		var storageErr azfile.StorageError
+		if errors.As(err, &storageErr) && storageErr.ServiceCode() == azfile.ServiceCodeResourceAlreadyExists {
+			continue
+		}
+		if err != nil {
+			return a.mapError(err)
+		}
 	}
 	return nil
 }
 
+// shareUrl returns the url of a path relative to the root of the share
+func (a *Azure) shareUrl(name string) (url.URL, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/%s", a.base, strings.TrimLeft(name, "/")))
+	if err != nil {
+		return url.URL{}, err
+	}
+	return *u, nil
+}
+
 func (a *Azure) getFileUrl(name string) (azfile.FileURL, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/%s", a.dir, name))
+	u, err := a.shareUrl(path.Join(a.dir, name))
 	if err != nil {
 		return azfile.FileURL{}, err
 	}
-	return azfile.NewFileURL(*u, a.p), nil
+	return azfile.NewFileURL(u, a.p), nil
 }
 
 func (a *Azure) getDirectoryUrl(name string) (azfile.DirectoryURL, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/%s", a.dir, name))
+	u, err := a.shareUrl(path.Join(a.dir, name))
 	if err != nil {
 		return azfile.DirectoryURL{}, err
 	}
-	return azfile.NewDirectoryURL(*u, a.p), nil
+	return azfile.NewDirectoryURL(u, a.p), nil
 }
 
 func (a *Azure) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
@@ -109,6 +137,9 @@ func (a *Azure) Read(name string, rang *Range, dest io.Writer, progress chan int
 	var count int64 = azfile.CountToEnd
 
 	if rang != nil {
+		if rang.To <= rang.From {
+			return nil
+		}
 		offset = rang.From
 		count = rang.To - rang.From
 	}
@@ -120,12 +151,12 @@ func (a *Azure) Read(name string, rang *Range, dest io.Writer, progress chan int
 
 	resp, err := fileURL.Download(ctx, offset, count, false)
 	if err != nil {
-		return err
+		return a.mapError(err)
 	}
 	r := resp.Body(azfile.RetryReaderOptions{MaxRetryRequests: 3})
 	defer r.Close()
 
-	_, err = io.Copy(dest, r)
+	_, err = io.Copy(&progressWriter{w: dest, progress: progress}, r)
 	return err
 }
 
@@ -160,6 +191,9 @@ func (a *Azure) Write(name string, source io.ReadSeeker, progress chan int64) er
 				return err
 			}
 			offset += int64(n)
+			if progress != nil {
+				progress <- int64(n)
+			}
 		}
 	}
 
@@ -179,7 +213,7 @@ func (az *Azure) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
 	ls, err := directoryURL.ListFilesAndDirectoriesSegment(ctx, azfile.Marker{},
 		azfile.ListFilesAndDirectoriesOptions{})
 	if err != nil {
-		return nil, err
+		return nil, az.mapError(err)
 	}
 	var infos []fs.FileInfo
 
@@ -222,14 +256,27 @@ func (a *Azure) Stat(name string) (fs.FileInfo, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	name = path.Join(a.dir, name)
 	fileUrl, err := a.getFileUrl(name)
 	if err != nil {
 		return nil, err
 	}
 	properties, err := fileUrl.GetProperties(ctx)
 	if err != nil {
-		return nil, err
+		err = a.mapError(err)
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		directoryUrl, err := a.getDirectoryUrl(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = directoryUrl.GetProperties(ctx); err != nil {
+			return nil, a.mapError(err)
+		}
+		return simpleFileInfo{
+			name:  path.Base(name),
+			isDir: true,
+		}, nil
 	}
 
 	return simpleFileInfo{
@@ -274,9 +321,30 @@ func (a *Azure) Delete(name string) error {
 		return err
 	}
 	_, err = fileUrl.Delete(ctx)
+	return a.mapError(err)
+}
+
+func (a *Azure) mapError(err error) error {
+	var storageErr azfile.StorageError
+	if errors.As(err, &storageErr) {
+		switch storageErr.ServiceCode() {
+		case azfile.ServiceCodeResourceNotFound, azfile.ServiceCodeParentNotFound, azfile.ServiceCodeShareNotFound:
+			return fs.ErrNotExist
+		}
+	}
 	return err
 }
 
+// IsRetryable returns true for throttling, timeouts and server errors
+func (a *Azure) IsRetryable(err error) bool {
+	var storageErr azfile.StorageError
+	if errors.As(err, &storageErr) && storageErr.Response() != nil {
+		code := storageErr.Response().StatusCode
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+	}
+	return isTransient(err)
+}
+
 func (a *Azure) Close() error {
 	return nil
 }
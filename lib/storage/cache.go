@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+const (
+	DefaultCacheSize = 256 * 1024 * 1024 // DefaultCacheSize is the maximal size of a cache when not specified in the URL
+)
+
+// DefaultCacheDir is the folder used when the cache parameter in the URL is true. When empty, the user cache dir is used.
+// Mobile applications should set it to a folder inside their sandbox.
+var DefaultCacheDir string
+
+// Cache is a read-through cache on a local folder. Files are revalidated with a Stat on the wrapped store
+// when their TTL expires and the least recently used files are evicted when the cache exceeds its maximal size.
+type Cache struct {
+	store Store
+	dir   string
+	ttl   time.Duration
+	index *cacheIndex
+}
+
+// cacheMeta is stored next to each cached file
+type cacheMeta struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	Validated time.Time `json:"validated"`
+}
+
+// cacheIndex tracks the size of a cache folder shared by all the stores that use it
+type cacheIndex struct {
+	lock    sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+}
+
+var cacheIndexes = map[string]*cacheIndex{}
+var cacheIndexesLock sync.Mutex
+
+// cacheParams are the URL parameters that enable and configure the cache
+var cacheParams = []string{"cache", "cacheSize", "cacheTTL"}
+
+// openCache wraps the store with a cache when the url contains the cache parameter or starts with cache+. The
+// parameter is either a local folder or true for the default folder, which is also used with cache+. The optional cacheSize defines the maximal size (e.g. 512M, 2G) and cacheTTL
+// how long a file is trusted before it is revalidated (e.g. 5m, default is 0 so that each read is revalidated).
+func openCache(store Store, params map[string]string) (Store, error) {
+	dir := params["cache"]
+	if dir == "" || dir == "true" || dir == "1" {
+		dir = DefaultCacheDir
+		if dir == "" {
+			userDir, err := os.UserCacheDir()
+			if core.IsErr(err, "cannot get user cache dir: %v") {
+				return nil, err
+			}
+			dir = filepath.Join(userDir, "stash")
+		}
+	}
+
+	maxSize := int64(DefaultCacheSize)
+	if v := params["cacheSize"]; v != "" {
+		var err error
+		maxSize, err = parseSize(v)
+		if err != nil || maxSize <= 0 {
+			return nil, core.Errorf("invalid cache size %s", v)
+		}
+	}
+
+	var ttl time.Duration
+	if v := params["cacheTTL"]; v != "" {
+		var err error
+		ttl, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, core.Errorf("invalid cache TTL %s: %v", v, err)
+		}
+	}
+
+	index, err := getCacheIndex(dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256([]byte(store.ID()))
+	storeDir := filepath.Join(dir, hex.EncodeToString(h[:8]))
+	err = os.MkdirAll(storeDir, 0755)
+	if core.IsErr(err, "cannot create cache folder %s: %v", storeDir) {
+		return nil, err
+	}
+
+	core.Info("cache for %s in %s, max size %d, ttl %s", store, storeDir, maxSize, ttl)
+	return &Cache{
+		store: store,
+		dir:   storeDir,
+		ttl:   ttl,
+		index: index,
+	}, nil
+}
+
+// getCacheIndex returns the index of a cache folder and computes its current size the first time
+func getCacheIndex(dir string, maxSize int64) (*cacheIndex, error) {
+	cacheIndexesLock.Lock()
+	defer cacheIndexesLock.Unlock()
+
+	if index, ok := cacheIndexes[dir]; ok {
+		if maxSize < index.maxSize {
+			index.maxSize = maxSize
+		}
+		return index, nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if core.IsErr(err, "cannot create cache folder %s: %v", dir) {
+		return nil, err
+	}
+
+	index := &cacheIndex{dir: dir, maxSize: maxSize}
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !strings.HasSuffix(p, ".meta") {
+			if info, err := d.Info(); err == nil {
+				index.size += info.Size()
+			}
+		}
+		return nil
+	})
+	cacheIndexes[dir] = index
+	return index, nil
+}
+
+// parseSize parses a size in bytes with an optional K, M or G suffix
+func parseSize(s string) (int64, error) {
+	mul := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mul = 1024
+	case strings.HasSuffix(s, "M"):
+		mul = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		mul = 1024 * 1024 * 1024
+	}
+	if mul > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	return v * mul, err
+}
+
+func (c *Cache) paths(name string) (data string, meta string) {
+	h := sha256.Sum256([]byte(name))
+	data = filepath.Join(c.dir, hex.EncodeToString(h[:]))
+	return data, data + ".meta"
+}
+
+// lookup returns the local copy of a file when it is fresh
+func (c *Cache) lookup(name string) (string, bool) {
+	dataPath, metaPath := c.paths(name)
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return "", false
+	}
+	var meta cacheMeta
+	if json.Unmarshal(data, &meta) != nil || meta.Name != name {
+		c.invalidate(name)
+		return "", false
+	}
+
+	now := time.Now()
+	if now.Sub(meta.Validated) >= c.ttl {
+		stat, err := c.store.Stat(name)
+		if err != nil || stat.Size() != meta.Size || !stat.ModTime().Equal(meta.ModTime) {
+			c.invalidate(name)
+			return "", false
+		}
+		meta.Validated = now
+		c.writeMeta(metaPath, meta)
+	}
+
+	// the modification time of the local copy tracks the last access for LRU eviction
+	if os.Chtimes(dataPath, now, now) != nil {
+		c.invalidate(name)
+		return "", false
+	}
+	return dataPath, true
+}
+
+func (c *Cache) writeMeta(metaPath string, meta cacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, data, 0644)
+}
+
+// invalidate removes the local copy of a file
+func (c *Cache) invalidate(name string) {
+	dataPath, metaPath := c.paths(name)
+	c.index.lock.Lock()
+	defer c.index.lock.Unlock()
+
+	os.Remove(metaPath)
+	if info, err := os.Stat(dataPath); err == nil {
+		if os.Remove(dataPath) == nil {
+			c.index.size -= info.Size()
+		}
+	}
+}
+
+// fill reads a file from the store into the cache and into dest
+func (c *Cache) fill(name string, stat os.FileInfo, dest io.Writer, progress chan int64) error {
+	dataPath, metaPath := c.paths(name)
+	tmp, err := os.CreateTemp(c.dir, "fill-*")
+	if core.IsErr(err, "cannot create temporary file in cache %s: %v", c.dir) {
+		return c.store.Read(name, nil, dest, progress)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = c.store.Read(name, nil, io.MultiWriter(tmp, dest), progress)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	c.invalidate(name)
+	c.index.lock.Lock()
+	defer c.index.lock.Unlock()
+	if os.Rename(tmp.Name(), dataPath) != nil {
+		return nil
+	}
+	c.index.size += stat.Size()
+	c.writeMeta(metaPath, cacheMeta{
+		Name:      name,
+		Size:      stat.Size(),
+		ModTime:   stat.ModTime(),
+		Validated: time.Now(),
+	})
+	c.index.evict()
+	return nil
+}
+
+// evict removes the least recently used files until the cache is below its maximal size. The lock must be held.
+func (i *cacheIndex) evict() {
+	if i.size <= i.maxSize {
+		return
+	}
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	filepath.WalkDir(i.dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !strings.HasSuffix(p, ".meta") {
+			if info, err := d.Info(); err == nil {
+				entries = append(entries, entry{p, info.Size(), info.ModTime()})
+			}
+		}
+		return nil
+	})
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].modTime.Before(entries[b].modTime)
+	})
+
+	for _, e := range entries {
+		if i.size <= i.maxSize {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			os.Remove(e.path + ".meta")
+			i.size -= e.size
+		}
+	}
+}
+
+func (c *Cache) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	if dataPath, ok := c.lookup(name); ok {
+		f, err := os.Open(dataPath)
+		if err == nil {
+			defer f.Close()
+			var r io.Reader = f
+			if rang != nil {
+				f.Seek(rang.From, io.SeekStart)
+				r = io.LimitReader(f, rang.To-rang.From)
+			}
+			n, err := io.Copy(dest, r)
+			if progress != nil {
+				progress <- n
+			}
+			return err
+		}
+	}
+
+	// partial reads are not cached
+	if rang != nil {
+		return c.store.Read(name, rang, dest, progress)
+	}
+
+	stat, err := c.store.Stat(name)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() || stat.Size() > c.index.maxSize {
+		return c.store.Read(name, nil, dest, progress)
+	}
+	return c.fill(name, stat, dest, progress)
+}
+
+func (c *Cache) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	c.invalidate(name)
+	return c.store.Write(name, source, progress)
+}
+
+func (c *Cache) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	c.invalidate(name)
+	return WriteIf(c.store, name, source, cond, progress)
+}
+
+func (c *Cache) WriteResumable(name string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	c.invalidate(name)
+	return WriteResumable(c.store, name, source, upload, save, progress)
+}
+
+func (c *Cache) AbortUpload(name string, upload Upload) error {
+	return AbortUpload(c.store, name, upload)
+}
+
+func (c *Cache) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
+	return c.store.ReadDir(dir, filter)
+}
+
+func (c *Cache) Stat(name string) (os.FileInfo, error) {
+	return c.store.Stat(name)
+}
+
+func (c *Cache) Delete(name string) error {
+	c.invalidate(name)
+	return c.store.Delete(name)
+}
+
+func (c *Cache) Unwrap() Store {
+	return c.store
+}
+
+func (c *Cache) ID() string {
+	return c.store.ID()
+}
+
+func (c *Cache) Close() error {
+	return c.store.Close()
+}
+
+func (c *Cache) String() string {
+	return c.store.String()
+}
+
+func (c *Cache) Describe() Description {
+	return c.store.Describe()
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open("mem://cache?cache=" + url.QueryEscape(dir) + "&cacheSize=8&cacheTTL=1h")
+	core.TestErr(t, err, "cannot open cache: %v")
+	defer c.Close()
+	m, _ := OpenMemory("mem://cache")
+
+	err = WriteFile(c, "a.txt", []byte("hello"))
+	core.TestErr(t, err, "cannot write file: %v")
+	data, err := ReadFile(c, "a.txt")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "hello", "wrong data: %s", data)
+
+	// within the TTL the local copy is used even if the remote changes
+	WriteFile(m, "a.txt", []byte("world"))
+	data, _ = ReadFile(c, "a.txt")
+	core.Assert(t, string(data) == "hello", "file not served from cache: %s", data)
+
+	var b bytes.Buffer
+	err = c.Read("a.txt", &Range{From: 1, To: 3}, &b, nil)
+	core.TestErr(t, err, "cannot read range: %v")
+	core.Assert(t, b.String() == "el", "wrong range: %s", b.String())
+
+	// writes through the cache invalidate the local copy
+	err = WriteFile(c, "a.txt", []byte("again"))
+	core.TestErr(t, err, "cannot write file: %v")
+	data, _ = ReadFile(c, "a.txt")
+	core.Assert(t, string(data) == "again", "stale data: %s", data)
+
+	// the least recently used file is evicted when the cache is full
+	WriteFile(c, "b.txt", []byte("12345"))
+	ReadFile(c, "b.txt")
+	dataPath, _ := c.(*Cache).paths("a.txt")
+	_, err = os.Stat(dataPath)
+	core.Assert(t, os.IsNotExist(err), "file not evicted: %v", err)
+
+	err = c.Delete("b.txt")
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = ReadFile(c, "b.txt")
+	core.Assert(t, os.IsNotExist(err), "file not deleted: %v", err)
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	c, err := Open("mem://cache2?cache=" + url.QueryEscape(t.TempDir()))
+	core.TestErr(t, err, "cannot open cache: %v")
+	defer c.Close()
+	m, _ := OpenMemory("mem://cache2")
+
+	WriteFile(c, "a.txt", []byte("hello"))
+	ReadFile(c, "a.txt")
+
+	time.Sleep(10 * time.Millisecond)
+	WriteFile(m, "a.txt", []byte("changed"))
+	data, err := ReadFile(c, "a.txt")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "changed", "stale data: %s", data)
+}
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+// RunConformance checks that a store follows the contract of the Store interface. The checks run in a new folder that
+// is deleted at the end. Any implementation of Store should pass it.
+func RunConformance(t *testing.T, s Store) {
+	dir := fmt.Sprintf("conformance-%d", core.SnowID())
+	c := Sub(s, dir, false)
+	defer s.Delete(dir)
+
+	t.Run("ReadWrite", func(t *testing.T) { conformReadWrite(t, c) })
+	t.Run("Overwrite", func(t *testing.T) { conformOverwrite(t, c) })
+	t.Run("NotExist", func(t *testing.T) { conformNotExist(t, c) })
+	t.Run("Range", func(t *testing.T) { conformRange(t, c) })
+	t.Run("Filter", func(t *testing.T) { conformFilter(t, c) })
+	t.Run("Hidden", func(t *testing.T) { conformHidden(t, c) })
+	t.Run("Progress", func(t *testing.T) { conformProgress(t, c) })
+	t.Run("Large", func(t *testing.T) { conformLarge(t, c) })
+	t.Run("Delete", func(t *testing.T) { conformDelete(t, c) })
+	t.Run("Resumable", func(t *testing.T) { conformResumable(t, c) })
+	t.Run("Root", func(t *testing.T) {
+		ls, err := s.ReadDir("", Filter{Prefix: "conformance-", OnlyFolders: true})
+		core.TestErr(t, err, "cannot list root: %v")
+		core.Assert(t, core.Contains(names(ls), dir), "root listing misses %s: %v", dir, names(ls))
+	})
+}
+
+// readAll reads a file into memory
+func readAll(t *testing.T, s Store, name string, rang *Range) []byte {
+	var b bytes.Buffer
+	err := s.Read(name, rang, &b, nil)
+	core.TestErr(t, err, "cannot read %s: %v", name)
+	return b.Bytes()
+}
+
+// names returns the sorted names of a listing
+func names(ls []fs.FileInfo) []string {
+	var n []string
+	for _, l := range ls {
+		n = append(n, l.Name())
+	}
+	sort.Strings(n)
+	return n
+}
+
+func assertNames(t *testing.T, ls []fs.FileInfo, expected ...string) {
+	t.Helper()
+	got := names(ls)
+	sort.Strings(expected)
+	core.Assert(t, fmt.Sprint(got) == fmt.Sprint(expected), "expected %v, got %v", expected, got)
+}
+
+func conformReadWrite(t *testing.T, s Store) {
+	data := core.GenerateRandomBytes(1000)
+	err := s.Write("rw/a/b/file", core.NewBytesReader(data), nil)
+	core.TestErr(t, err, "cannot write nested file: %v")
+	core.Assert(t, bytes.Equal(readAll(t, s, "rw/a/b/file", nil), data), "wrong content")
+
+	stat, err := s.Stat("rw/a/b/file")
+	core.TestErr(t, err, "cannot stat file: %v")
+	core.Assert(t, stat.Name() == "file", "wrong name %s", stat.Name())
+	core.Assert(t, stat.Size() == int64(len(data)), "wrong size %d", stat.Size())
+	core.Assert(t, !stat.IsDir(), "file reported as folder")
+
+	stat, err = s.Stat("rw/a")
+	core.TestErr(t, err, "cannot stat folder: %v")
+	core.Assert(t, stat.IsDir(), "folder reported as file")
+
+	err = s.Write("rw/empty", core.NewBytesReader(nil), nil)
+	core.TestErr(t, err, "cannot write empty file: %v")
+	core.Assert(t, len(readAll(t, s, "rw/empty", nil)) == 0, "empty file has content")
+}
+
+func conformOverwrite(t *testing.T, s Store) {
+	err := WriteFile(s, "overwrite", []byte("a longer first version"))
+	core.TestErr(t, err, "cannot write file: %v")
+	err = WriteFile(s, "overwrite", []byte("short"))
+	core.TestErr(t, err, "cannot overwrite file: %v")
+
+	data := readAll(t, s, "overwrite", nil)
+	core.Assert(t, string(data) == "short", "overwrite kept old content: %s", data)
+	stat, err := s.Stat("overwrite")
+	core.TestErr(t, err, "cannot stat file: %v")
+	core.Assert(t, stat.Size() == 5, "wrong size after overwrite: %d", stat.Size())
+}
+
+func conformNotExist(t *testing.T, s Store) {
+	_, err := s.Stat("missing")
+	core.Assert(t, os.IsNotExist(err), "stat on missing file: expected not exist, got %v", err)
+
+	err = s.Read("missing", nil, &bytes.Buffer{}, nil)
+	core.Assert(t, os.IsNotExist(err), "read on missing file: expected not exist, got %v", err)
+
+	err = s.Read("missing/nested", &Range{From: 0, To: 1}, &bytes.Buffer{}, nil)
+	core.Assert(t, os.IsNotExist(err), "range read on missing file: expected not exist, got %v", err)
+
+	// object stores have no folders, so listing a missing folder may return no entries
+	ls, err := s.ReadDir("missing", Filter{})
+	core.Assert(t, os.IsNotExist(err) || (err == nil && len(ls) == 0),
+		"list of missing folder: expected not exist or empty, got %v, %v", ls, err)
+
+	// deleting a missing file is either a no-op or a not exist error
+	err = s.Delete("missing")
+	core.Assert(t, err == nil || os.IsNotExist(err), "delete of missing file: got %v", err)
+}
+
+func conformRange(t *testing.T, s Store) {
+	data := core.GenerateRandomBytes(10000)
+	err := WriteFile(s, "range", data)
+	core.TestErr(t, err, "cannot write file: %v")
+
+	for _, r := range []Range{{0, 1}, {0, 10000}, {1, 4097}, {4096, 8192}, {9999, 10000}, {5000, 5000}} {
+		got := readAll(t, s, "range", &Range{From: r.From, To: r.To})
+		core.Assert(t, bytes.Equal(got, data[r.From:r.To]), "wrong content for range %d-%d: %d bytes",
+			r.From, r.To, len(got))
+	}
+}
+
+func conformFilter(t *testing.T, s Store) {
+	for _, n := range []string{"filter/a.txt", "filter/b.txt", "filter/c.bin", "filter/d/x", "filter/e/y"} {
+		err := WriteFile(s, n, []byte(n))
+		core.TestErr(t, err, "cannot write %s: %v", n)
+	}
+
+	ls, err := s.ReadDir("filter", Filter{})
+	core.TestErr(t, err, "cannot list: %v")
+	assertNames(t, ls, "a.txt", "b.txt", "c.bin", "d", "e")
+	for _, l := range ls {
+		core.Assert(t, l.IsDir() == (l.Name() == "d" || l.Name() == "e"), "wrong type for %s", l.Name())
+	}
+
+	ls, err = s.ReadDir("filter", Filter{Prefix: "b"})
+	core.TestErr(t, err, "cannot list with prefix: %v")
+	assertNames(t, ls, "b.txt")
+
+	ls, err = s.ReadDir("filter", Filter{Suffix: ".txt"})
+	core.TestErr(t, err, "cannot list with suffix: %v")
+	assertNames(t, ls, "a.txt", "b.txt")
+
+	ls, err = s.ReadDir("filter", Filter{AfterName: "b.txt"})
+	core.TestErr(t, err, "cannot list after name: %v")
+	assertNames(t, ls, "c.bin", "d", "e")
+
+	ls, err = s.ReadDir("filter", Filter{OnlyFiles: true})
+	core.TestErr(t, err, "cannot list only files: %v")
+	assertNames(t, ls, "a.txt", "b.txt", "c.bin")
+
+	ls, err = s.ReadDir("filter", Filter{OnlyFolders: true})
+	core.TestErr(t, err, "cannot list only folders: %v")
+	assertNames(t, ls, "d", "e")
+
+	ls, err = s.ReadDir("filter", Filter{OnlyFiles: true, MaxResults: 2})
+	core.TestErr(t, err, "cannot list with max results: %v")
+	core.Assert(t, len(ls) == 2, "expected 2 results, got %v", names(ls))
+
+	ls, err = s.ReadDir("filter", Filter{Function: func(i fs.FileInfo) bool { return i.Name() != "a.txt" && !i.IsDir() }})
+	core.TestErr(t, err, "cannot list with function: %v")
+	assertNames(t, ls, "b.txt", "c.bin")
+
+	// modification times on some services have a resolution of one second, while replicated stores may report
+	// slightly different times for the same file
+	stat, err := s.Stat("filter/c.bin")
+	core.TestErr(t, err, "cannot stat: %v")
+	time.Sleep(1100 * time.Millisecond)
+	err = WriteFile(s, "filter/f.txt", []byte("f"))
+	core.TestErr(t, err, "cannot write: %v")
+	ls, err = s.ReadDir("filter", Filter{OnlyFiles: true, After: stat.ModTime().Add(500 * time.Millisecond)})
+	core.TestErr(t, err, "cannot list after time: %v")
+	assertNames(t, ls, "f.txt")
+}
+
+func conformHidden(t *testing.T, s Store) {
+	err := WriteFile(s, "hidden/.secret", []byte("hidden"))
+	core.TestErr(t, err, "cannot write hidden file: %v")
+	err = WriteFile(s, "hidden/.dir/file", []byte("hidden"))
+	core.TestErr(t, err, "cannot write file in hidden folder: %v")
+
+	core.Assert(t, string(readAll(t, s, "hidden/.secret", nil)) == "hidden", "wrong content of hidden file")
+	ls, err := s.ReadDir("hidden", Filter{})
+	core.TestErr(t, err, "cannot list hidden files: %v")
+	assertNames(t, ls, ".dir", ".secret")
+}
+
+// collect sums the values sent on a progress channel until the returned function is called
+func collect() (chan int64, func() int64) {
+	progress := make(chan int64)
+	total := make(chan int64)
+	go func() {
+		var sum int64
+		for p := range progress {
+			sum += p
+		}
+		total <- sum
+	}()
+	return progress, func() int64 {
+		close(progress)
+		return <-total
+	}
+}
+
+func conformProgress(t *testing.T, s Store) {
+	data := core.GenerateRandomBytes(100000)
+
+	progress, total := collect()
+	err := s.Write("progress", core.NewBytesReader(data), progress)
+	core.TestErr(t, err, "cannot write with progress: %v")
+	core.Assert(t, total() == int64(len(data)), "wrong write progress")
+
+	progress, total = collect()
+	err = s.Read("progress", nil, &bytes.Buffer{}, progress)
+	core.TestErr(t, err, "cannot read with progress: %v")
+	core.Assert(t, total() == int64(len(data)), "wrong read progress")
+
+	progress, total = collect()
+	err = s.Read("progress", &Range{From: 100, To: 1100}, &bytes.Buffer{}, progress)
+	core.TestErr(t, err, "cannot read range with progress: %v")
+	core.Assert(t, total() == 1000, "wrong range read progress")
+}
+
+func conformLarge(t *testing.T, s Store) {
+	size := 32 * 1024 * 1024
+	if testing.Short() {
+		size = 4 * 1024 * 1024
+	}
+	data := core.GenerateRandomBytes(size)
+	err := s.Write("large", core.NewBytesReader(data), nil)
+	core.TestErr(t, err, "cannot write large file: %v")
+
+	stat, err := s.Stat("large")
+	core.TestErr(t, err, "cannot stat large file: %v")
+	core.Assert(t, stat.Size() == int64(size), "wrong size of large file: %d", stat.Size())
+	core.Assert(t, bytes.Equal(readAll(t, s, "large", nil), data), "wrong content of large file")
+
+	from := int64(size/2 - 1)
+	got := readAll(t, s, "large", &Range{From: from, To: from + 1024*1024})
+	core.Assert(t, bytes.Equal(got, data[from:from+1024*1024]), "wrong range of large file")
+}
+
+// brokenReader fails when the read position reaches failAt, like a dropped connection
+type brokenReader struct {
+	io.ReadSeeker
+	failAt int64
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	pos, _ := b.Seek(0, io.SeekCurrent)
+	if pos >= b.failAt {
+		return 0, errors.New("connection lost")
+	}
+	if int64(len(p)) > b.failAt-pos {
+		p = p[:b.failAt-pos]
+	}
+	return b.ReadSeeker.Read(p)
+}
+
+func conformResumable(t *testing.T, s Store) {
+	partSize := PartSize
+	PartSize = 5 * 1024 * 1024 // the minimum for S3
+	defer func() { PartSize = partSize }()
+
+	data := core.GenerateRandomBytes(int(2*PartSize + PartSize/2))
+	var saved Upload
+	save := func(u Upload) error { saved = u; return nil }
+
+	var upload Upload
+	err := WriteResumable(s, "resumable", &brokenReader{core.NewBytesReader(data), PartSize + 1000}, &upload, save, nil)
+	core.Assert(t, err != nil, "interrupted upload did not fail")
+	_, err = s.Stat("resumable")
+	core.Assert(t, os.IsNotExist(err), "interrupted upload is visible: %v", err)
+
+	// stores without resumable uploads start again from the beginning
+	upload = saved
+	progress, total := collect()
+	err = WriteResumable(s, "resumable", core.NewBytesReader(data), &upload, save, progress)
+	core.TestErr(t, err, "cannot resume upload: %v")
+	core.Assert(t, total() <= int64(len(data)), "resumed upload sent more than the file")
+	core.Assert(t, bytes.Equal(readAll(t, s, "resumable", nil), data), "wrong content after resume")
+
+	ls, err := s.ReadDir("", Filter{Prefix: ".upload-"})
+	core.TestErr(t, err, "cannot list: %v")
+	core.Assert(t, len(ls) == 0, "temporary upload files left: %v", names(ls))
+}
+
+func conformDelete(t *testing.T, s Store) {
+	for _, n := range []string{"delete/a", "delete/sub/b", "delete/sub/deep/c"} {
+		err := WriteFile(s, n, []byte(n))
+		core.TestErr(t, err, "cannot write %s: %v", n)
+	}
+
+	err := s.Delete("delete/a")
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = s.Stat("delete/a")
+	core.Assert(t, os.IsNotExist(err), "deleted file still exists: %v", err)
+
+	err = s.Delete("delete/sub")
+	core.TestErr(t, err, "cannot delete folder: %v")
+	_, err = s.Stat("delete/sub/deep/c")
+	core.Assert(t, os.IsNotExist(err), "file in deleted folder still exists: %v", err)
+	ls, err := s.ReadDir("delete", Filter{})
+	core.Assert(t, os.IsNotExist(err) || len(ls) == 0, "deleted folder still listed: %v", names(ls))
+}
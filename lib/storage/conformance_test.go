@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"net/url"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	urls := map[string]string{
+		"mem":    "mem://conformance",
+		"local":  "file://" + filepath.ToSlash(t.TempDir()),
+		"mirror": "mirror:///?s=mem%3A%2F%2Fconformance-m1&s=mem%3A%2F%2Fconformance-m2&w=2",
+		"ec":     "ec:///?s=mem%3A%2F%2Fconformance-e1&s=mem%3A%2F%2Fconformance-e2&s=mem%3A%2F%2Fconformance-e3&k=2",
+		"cache":  "mem://conformance-cache?cache=" + url.QueryEscape(t.TempDir()) + "&retry=3",
+	}
+	for id, url := range LoadTestURLs() {
+		if id != "mem" && id != "local" {
+			urls[id] = url
+		}
+	}
+
+	var ids []string
+	for id := range urls {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		t.Run(id, func(t *testing.T) {
+			s, err := Open(urls[id])
+			if err != nil {
+				t.Skipf("store %s is not available: %v", id, err)
+			}
+			defer s.Close()
+			RunConformance(t, s)
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/stregato/stash/lib/core"
+	"gopkg.in/yaml.v2"
+)
+
+// Credentials are the secrets of a store, such as the password of an SFTP server or the keys of an S3 bucket. A url
+// references them by name with the cred parameter, e.g. s3://host/bucket?cred=backup, so that the url can be stored
+// and shared without secrets.
+type Credentials struct {
+	User     string            `json:"user" yaml:"user"`         // User replaces the user in the url
+	Password string            `json:"password" yaml:"password"` // Password is added to the user in the url
+	Params   map[string]string `json:"params" yaml:"params"`     // Params are added to the query, e.g. a and s for S3
+}
+
+// CredentialProvider returns credentials by name
+type CredentialProvider interface {
+	// GetCredentials returns the credentials with the name; ok is false when the provider does not have them
+	GetCredentials(name string) (c Credentials, ok bool, err error)
+}
+
+// Kinds of credential providers, in the order they are asked
+const (
+	CallbackProvider = "callback" // CallbackProvider is set by the bindings
+	DBProvider       = "db"       // DBProvider keeps the credentials encrypted in the config DB
+	EnvProvider      = "env"      // EnvProvider reads the variable STASH_CRED_<NAME>
+	FileProvider     = "file"     // FileProvider reads the file in STASH_CREDENTIALS or credentials.yaml in the config folder
+)
+
+var credentialKinds = []string{CallbackProvider, DBProvider, EnvProvider, FileProvider}
+var credentialProviders = map[string]CredentialProvider{EnvProvider: envCredentials{}, FileProvider: fileCredentials{}}
+var credentialProvidersLock sync.Mutex
+
+// SetCredentialProvider sets the provider of a kind. A nil provider removes it
+func SetCredentialProvider(kind string, p CredentialProvider) {
+	credentialProvidersLock.Lock()
+	defer credentialProvidersLock.Unlock()
+
+	if !core.Contains(credentialKinds, kind) {
+		credentialKinds = append(credentialKinds, kind)
+	}
+	if p == nil {
+		delete(credentialProviders, kind)
+	} else {
+		credentialProviders[kind] = p
+	}
+}
+
+// GetCredentials asks the providers in order for the credentials with the name
+func GetCredentials(name string) (Credentials, error) {
+	return getCredentials(name, nil)
+}
+
+// getCredentials asks the providers in order for the credentials with the name, with the provider of an open, when
+// not nil, in place of the one of the DBProvider kind
+func getCredentials(name string, own CredentialProvider) (Credentials, error) {
+	credentialProvidersLock.Lock()
+	var providers []CredentialProvider
+	for _, kind := range credentialKinds {
+		p, ok := credentialProviders[kind]
+		if kind == DBProvider && own != nil {
+			p, ok = own, true
+		}
+		if ok {
+			providers = append(providers, p)
+		}
+	}
+	credentialProvidersLock.Unlock()
+
+	for _, p := range providers {
+		c, ok, err := p.GetCredentials(name)
+		if err != nil {
+			return Credentials{}, core.Errorw(err, "cannot get credentials %s: %v", name)
+		}
+		if ok {
+			return c, nil
+		}
+	}
+	return Credentials{}, core.Errorf("credentials %s not found", name)
+}
+
+// applyCredentials replaces the cred parameter of the url with the credentials it references
+func applyCredentials(connectionUrl string, name string, own CredentialProvider) (string, error) {
+	c, err := getCredentials(name, own)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(connectionUrl)
+	if err != nil {
+		return "", core.Errorw(err, "invalid url %s: %v", Redact(connectionUrl))
+	}
+	if c.User != "" || c.Password != "" {
+		user := c.User
+		if user == "" && u.User != nil {
+			user = u.User.Username()
+		}
+		if c.Password != "" {
+			u.User = url.UserPassword(user, c.Password)
+		} else {
+			u.User = url.User(user)
+		}
+	}
+	q := u.Query()
+	for k, v := range c.Params {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// ParseCredentials reads credentials from a query string, where user and password are the url user and the other
+// keys are parameters
+func ParseCredentials(query string) (Credentials, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return Credentials{}, err
+	}
+	c := Credentials{Params: map[string]string{}}
+	for k := range values {
+		switch k {
+		case "user":
+			c.User = values.Get(k)
+		case "password":
+			c.Password = values.Get(k)
+		default:
+			c.Params[k] = values.Get(k)
+		}
+	}
+	return c, nil
+}
+
+type envCredentials struct{}
+
+// GetCredentials reads the variable STASH_CRED_<NAME>, where the name is upper case and other characters than letters
+// and digits are replaced with _. The value is a query string, e.g. user=alice&password=secret or a=key&s=secret
+func (envCredentials) GetCredentials(name string) (Credentials, bool, error) {
+	variable := "STASH_CRED_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+
+	value, ok := os.LookupEnv(variable)
+	if !ok {
+		return Credentials{}, false, nil
+	}
+	c, err := ParseCredentials(value)
+	return c, err == nil, err
+}
+
+type fileCredentials struct{}
+
+// CredentialsFile returns the path of the credentials file, which is in STASH_CREDENTIALS or credentials.yaml in the
+// stash config folder
+func CredentialsFile() string {
+	if filename := os.Getenv("STASH_CREDENTIALS"); filename != "" {
+		return filename
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "stash", "credentials.yaml")
+}
+
+// GetCredentials reads the credentials from a yaml file with an entry for each name
+func (fileCredentials) GetCredentials(name string) (Credentials, bool, error) {
+	filename := CredentialsFile()
+	if filename == "" {
+		return Credentials{}, false, nil
+	}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return Credentials{}, false, nil
+	}
+	if err != nil {
+		return Credentials{}, false, err
+	}
+
+	var credentials map[string]Credentials
+	err = yaml.Unmarshal(data, &credentials)
+	if err != nil {
+		return Credentials{}, false, core.Errorw(err, "cannot parse credentials file %s: %v", filename)
+	}
+	c, ok := credentials[name]
+	return c, ok, nil
+}
+
+// secretParams are the query parameters that hold secrets
+var secretParams = []string{"s", "k", "passphrase", "password", "sig", "token"}
+
+// Redact hides the password and the secret parameters of a url, so that it can be logged. The store urls in mirror and
+// erasure coded urls are redacted as well.
+func Redact(connectionUrl string) string {
+	u, err := url.Parse(connectionUrl)
+	if err != nil {
+		return "<invalid url>"
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "***")
+	}
+
+	backend, _ := splitScheme(u.Scheme + ":")
+	nested := backend == "mirror:" || backend == "ec:"
+	var query []string
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch {
+		case nested && k == "s":
+			v, _ = url.QueryUnescape(v)
+			kv = k + "=" + url.QueryEscape(Redact(v))
+		case core.Contains(secretParams, k):
+			kv = k + "=***"
+		}
+		query = append(query, kv)
+	}
+	u.RawQuery = strings.Join(query, "&")
+	return u.String()
+}
@@ -0,0 +1,793 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/stregato/stash/lib/core"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	ecMagic     = "SEC1"
+	ecBlockSize = 1024 * 1024 // ecBlockSize is the maximal size of a block in a stripe
+)
+
+// ecHeader is stored at the beginning of every shard
+type ecHeader struct {
+	Magic     [4]byte
+	K         uint8    // K is the number of data shards
+	M         uint8    // M is the number of parity shards
+	Index     uint8    // Index is the position of the shard
+	Reserved  uint8    // Reserved for future use
+	BlockSize uint32   // BlockSize is the size of a block in each stripe
+	Size      int64    // Size is the size of the original object
+	Stamp     int64    // Stamp identifies the write operation that produced the shard
+	Hash      [32]byte // Hash is the blake2b hash of the shard content after the header
+}
+
+var ecHeaderSize = int64(binary.Size(ecHeader{}))
+
+// ErasureCode splits each object in k data shards and m parity shards, each stored on a different store.
+// Any k shards are enough to reconstruct the object.
+type ErasureCode struct {
+	stores []Store
+	k, m   int
+	quorum int
+	enc    reedsolomon.Encoder
+	id     string
+}
+
+// OpenErasureCode opens an erasure coded store. The url is in the format ec:///base?s=<url1>&s=<url2>&...&k=<data>
+// where each s parameter is the query-escaped URL of a store and k is the number of data shards. The remaining stores
+// hold parity shards. The optional w parameter defines how many shards must be written for a write to succeed
+// (default is all, minimum is k+1). The base path is applied to all stores.
+func OpenErasureCode(connectionUrl string) (Store, error) {
+	return openErasureCode(connectionUrl, OpenOptions{})
+}
+
+// openErasureCode opens the stores in the url with the options of the open
+func openErasureCode(connectionUrl string, options OpenOptions) (Store, error) {
+	u, err := url.Parse(connectionUrl)
+	if core.IsErr(err, "invalid url '%s': %v", Redact(connectionUrl)) {
+		return nil, err
+	}
+	if u.Scheme != "ec" {
+		return nil, core.Errorf("invalid scheme: %s", u.Scheme)
+	}
+
+	q := u.Query()
+	urls := q["s"]
+	k, err := strconv.Atoi(q.Get("k"))
+	if err != nil || k < 1 || k >= len(urls) || len(urls) > 255 {
+		return nil, core.Errorf("invalid number of data shards %s for %d stores in %s", q.Get("k"), len(urls),
+			Redact(connectionUrl))
+	}
+	m := len(urls) - k
+
+	quorum := len(urls)
+	if w := q.Get("w"); w != "" {
+		quorum, err = strconv.Atoi(w)
+		if err != nil || quorum <= k || quorum > len(urls) {
+			return nil, core.Errorf("invalid write quorum %s in %s", w, Redact(connectionUrl))
+		}
+	}
+
+	enc, err := reedsolomon.New(k, m)
+	if core.IsErr(err, "cannot create Reed-Solomon encoder with k=%d m=%d: %v", k, m) {
+		return nil, err
+	}
+
+	base := strings.Trim(u.Path, "/")
+	var stores []Store
+	var ids []string
+	for _, su := range urls {
+		s, err := OpenWith(su, options)
+		if err != nil {
+			for _, s := range stores {
+				s.Close()
+			}
+			return nil, core.Errorw(err, "cannot open shard store %s in %s: %v", Redact(su), Redact(connectionUrl))
+		}
+		ids = append(ids, s.ID())
+		if base != "" {
+			s = Sub(s, base, true)
+		}
+		stores = append(stores, s)
+	}
+
+	return &ErasureCode{
+		stores: stores,
+		k:      k,
+		m:      m,
+		quorum: quorum,
+		enc:    enc,
+		id:     fmt.Sprintf("ec://%s/%s?k=%d", strings.Join(ids, ","), base, k),
+	}, nil
+}
+
+func (e *ErasureCode) ID() string {
+	return e.id
+}
+
+// readHeaders reads the header of every shard. Missing or invalid shards have a nil header
+func (e *ErasureCode) readHeaders(name string) ([]*ecHeader, error) {
+	headers := make([]*ecHeader, len(e.stores))
+	var missing int
+	for i, s := range e.stores {
+		var buf bytes.Buffer
+		err := s.Read(name, &Range{From: 0, To: ecHeaderSize}, &buf, nil)
+		if os.IsNotExist(err) {
+			missing++
+			continue
+		}
+		if core.IsWarn(err, "cannot read shard %d of %s from %s: %v", i, name, s) {
+			continue
+		}
+		var h ecHeader
+		err = binary.Read(&buf, binary.LittleEndian, &h)
+		if core.IsWarn(err, "invalid header in shard %d of %s: %v", i, name) {
+			continue
+		}
+		if string(h.Magic[:]) != ecMagic || int(h.K) != e.k || int(h.M) != e.m || int(h.Index) != i {
+			core.IsWarn(os.ErrInvalid, "inconsistent header in shard %d of %s: %v", i, name)
+			continue
+		}
+		headers[i] = &h
+	}
+	if missing == len(e.stores) {
+		return nil, os.ErrNotExist
+	}
+	return headers, nil
+}
+
+// selectStamp returns the most recent write that has enough shards to be reconstructed
+func (e *ErasureCode) selectStamp(name string, headers []*ecHeader) (ecHeader, error) {
+	counts := map[int64]int{}
+	var selected *ecHeader
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		counts[h.Stamp]++
+		if counts[h.Stamp] >= e.k && (selected == nil || h.Stamp > selected.Stamp) {
+			selected = h
+		}
+	}
+	if selected == nil {
+		return ecHeader{}, core.Errorf("not enough shards to reconstruct %s on %s", name, e)
+	}
+	return *selected, nil
+}
+
+// readShard reads a full shard and verifies its hash
+func (e *ErasureCode) readShard(name string, i int, h ecHeader) (*spool, error) {
+	sp := &spool{}
+	err := e.stores[i].Read(name, nil, sp, nil)
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+
+	hasher, _ := blake2b.New256(nil)
+	sp.Seek(ecHeaderSize, io.SeekStart)
+	_, err = io.Copy(hasher, sp)
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+	if !bytes.Equal(hasher.Sum(nil), h.Hash[:]) {
+		sp.Close()
+		return nil, core.Errorf("corrupted shard %d of %s on %s", i, name, e.stores[i])
+	}
+	return sp, nil
+}
+
+// readShards reads k valid shards, preferring the data shards. The other shards are nil
+func (e *ErasureCode) readShards(name string, headers []*ecHeader, h ecHeader, all bool) ([]*spool, error) {
+	shards := make([]*spool, len(e.stores))
+	var found int
+	for i, sh := range headers {
+		if (found == e.k && !all) || sh == nil || sh.Stamp != h.Stamp {
+			continue
+		}
+		sp, err := e.readShard(name, i, *sh)
+		if core.IsWarn(err, "cannot read shard %d of %s: %v", i, name) {
+			continue
+		}
+		shards[i] = sp
+		found++
+	}
+	if found < e.k {
+		closeShards(shards)
+		return nil, core.Errorf("not enough valid shards to reconstruct %s on %s", name, e)
+	}
+	return shards, nil
+}
+
+func closeShards(shards []*spool) {
+	for _, sp := range shards {
+		if sp != nil {
+			sp.Close()
+		}
+	}
+}
+
+// decode reconstructs the object from the shards and writes the requested range to dest
+func (e *ErasureCode) decode(shards []*spool, h ecHeader, rang *Range, dest io.Writer) error {
+	from, to := int64(0), h.Size
+	if rang != nil {
+		from, to = rang.From, rang.To
+		if to > h.Size {
+			to = h.Size
+		}
+	}
+
+	bs := int64(h.BlockSize)
+	blocks := make([][]byte, len(shards))
+	buffers := make([][]byte, len(shards))
+	for s := int64(0); s*int64(e.k)*bs < to; s++ {
+		start := s * int64(e.k) * bs
+		if start+int64(e.k)*bs <= from {
+			continue
+		}
+
+		var missing bool
+		for i, sp := range shards {
+			if sp == nil {
+				blocks[i] = nil
+				missing = missing || i < e.k
+				continue
+			}
+			if buffers[i] == nil {
+				buffers[i] = make([]byte, bs)
+			}
+			blocks[i] = buffers[i]
+			_, err := sp.Seek(ecHeaderSize+s*bs, io.SeekStart)
+			if err == nil {
+				_, err = io.ReadFull(sp, blocks[i])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if missing {
+			err := e.enc.ReconstructData(blocks)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := 0; i < e.k; i++ {
+			lo, hi := start+int64(i)*bs, start+int64(i+1)*bs
+			if lo < from {
+				lo = from
+			}
+			if hi > to {
+				hi = to
+			}
+			if lo >= hi {
+				continue
+			}
+			off := lo - start - int64(i)*bs
+			_, err := dest.Write(blocks[i][off : off+hi-lo])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encode splits the source in shards with their headers
+func (e *ErasureCode) encode(source io.Reader, size int64) ([]*spool, error) {
+	n := e.k + e.m
+	bs := int64(ecBlockSize)
+	if perShard := (size + int64(e.k) - 1) / int64(e.k); perShard < bs {
+		bs = perShard
+	}
+
+	shards := make([]*spool, n)
+	hashes := make([]hash.Hash, n)
+	for i := range shards {
+		shards[i] = &spool{}
+		shards[i].Write(make([]byte, ecHeaderSize))
+		hashes[i], _ = blake2b.New256(nil)
+	}
+
+	blocks := make([][]byte, n)
+	stripe := make([]byte, int64(e.k)*bs)
+	for i := e.k; i < n; i++ {
+		blocks[i] = make([]byte, bs)
+	}
+	for left := size; left > 0; left -= int64(len(stripe)) {
+		clear(stripe)
+		_, err := io.ReadFull(source, stripe)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			closeShards(shards)
+			return nil, err
+		}
+		for i := 0; i < e.k; i++ {
+			blocks[i] = stripe[int64(i)*bs : int64(i+1)*bs]
+		}
+		err = e.enc.Encode(blocks)
+		if err != nil {
+			closeShards(shards)
+			return nil, err
+		}
+		for i, b := range blocks {
+			shards[i].Write(b)
+			hashes[i].Write(b)
+		}
+	}
+
+	stamp := core.Now().UnixNano()
+	for i, sp := range shards {
+		h := ecHeader{
+			K:         uint8(e.k),
+			M:         uint8(e.m),
+			Index:     uint8(i),
+			BlockSize: uint32(bs),
+			Size:      size,
+			Stamp:     stamp,
+		}
+		copy(h.Magic[:], ecMagic)
+		copy(h.Hash[:], hashes[i].Sum(nil))
+		sp.Seek(0, io.SeekStart)
+		binary.Write(sp, binary.LittleEndian, h)
+	}
+	return shards, nil
+}
+
+func (e *ErasureCode) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	headers, err := e.readHeaders(name)
+	if err != nil {
+		return err
+	}
+	h, err := e.selectStamp(name, headers)
+	if err != nil {
+		return err
+	}
+
+	w := &progressWriter{w: dest, progress: progress}
+	if rang != nil {
+		// nothing is written until the data shards are verified, so the decode can take over without duplicates
+		shards, err := e.rangeShards(name, headers, h, rang)
+		if err == nil {
+			defer closeShards(shards)
+			return e.readRange(shards, h, rang, w)
+		}
+		core.Info("cannot read range of %s from the data shards, decoding: %v", name, err)
+	}
+
+	shards, err := e.readShards(name, headers, h, false)
+	if err != nil {
+		return err
+	}
+	defer closeShards(shards)
+
+	return e.decode(shards, h, rang, w)
+}
+
+// rangeShards reads and verifies the data shards that hold a range, so that the range is read without a decode. It
+// fails when any of them is missing or corrupted. The other shards are nil
+func (e *ErasureCode) rangeShards(name string, headers []*ecHeader, h ecHeader, rang *Range) ([]*spool, error) {
+	bs := int64(h.BlockSize)
+	shards := make([]*spool, len(e.stores))
+	for off := rang.From; off < min(rang.To, h.Size); off += bs - off%bs {
+		i := off % (int64(e.k) * bs) / bs
+		if shards[i] != nil {
+			continue
+		}
+		if headers[i] == nil || headers[i].Stamp != h.Stamp {
+			closeShards(shards)
+			return nil, os.ErrNotExist
+		}
+		sp, err := e.readShard(name, int(i), *headers[i])
+		if err != nil {
+			closeShards(shards)
+			return nil, err
+		}
+		shards[i] = sp
+	}
+	return shards, nil
+}
+
+// readRange writes a range from the data shards returned by rangeShards
+func (e *ErasureCode) readRange(shards []*spool, h ecHeader, rang *Range, dest io.Writer) error {
+	bs := int64(h.BlockSize)
+	to := min(rang.To, h.Size)
+	for off := rang.From; off < to; {
+		stripe, pos := off/(int64(e.k)*bs), off%(int64(e.k)*bs)
+		i, blockOff := pos/bs, pos%bs
+		end := min(off+bs-blockOff, to)
+		_, err := shards[i].Seek(ecHeaderSize+stripe*bs+blockOff, io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(dest, shards[i], end-off)
+		}
+		if err != nil {
+			return err
+		}
+		off = end
+	}
+	return nil
+}
+
+func (e *ErasureCode) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	size, err := source.Seek(0, io.SeekEnd)
+	if core.IsErr(err, "cannot seek source for '%s': %v", name) {
+		return err
+	}
+	source.Seek(0, io.SeekStart)
+
+	shards, err := e.encode(source, size)
+	if err != nil {
+		return err
+	}
+	defer closeShards(shards)
+
+	err = e.writeShards(name, shards, nil)
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress <- size
+	}
+	return nil
+}
+
+// writeShards writes the shards to the stores. When only is not nil, only the shards with the given indexes are written
+func (e *ErasureCode) writeShards(name string, shards []*spool, only []int) error {
+	var succeeded int
+	var errs []string
+	for i, sp := range shards {
+		if sp == nil || (only != nil && !core.Contains(only, i)) {
+			continue
+		}
+		sp.Seek(0, io.SeekStart)
+		err := e.stores[i].Write(name, sp, nil)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", e.stores[i], err))
+			continue
+		}
+		succeeded++
+	}
+
+	if only == nil && succeeded < e.quorum {
+		return core.Errorf("write of %s reached %d shards out of the required %d: %s", name, succeeded, e.quorum,
+			strings.Join(errs, "; "))
+	}
+	if len(errs) > 0 {
+		core.Info("write of %s failed on some shards, run a repair to fix: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// repairFile rewrites the shards of a file that are missing, stale or corrupted
+func (e *ErasureCode) repairFile(name string) (bool, error) {
+	headers, err := e.readHeaders(name)
+	if err != nil {
+		return false, err
+	}
+	h, err := e.selectStamp(name, headers)
+	if err != nil {
+		return false, err
+	}
+
+	shards, err := e.readShards(name, headers, h, true)
+	if err != nil {
+		return false, err
+	}
+	defer closeShards(shards)
+
+	var broken []int
+	for i, sp := range shards {
+		if sp == nil {
+			broken = append(broken, i)
+		}
+	}
+	if len(broken) == 0 {
+		return false, nil
+	}
+
+	var buf spool
+	defer buf.Close()
+	err = e.decode(shards, h, nil, &buf)
+	if err != nil {
+		return false, err
+	}
+	buf.Seek(0, io.SeekStart)
+	rebuilt, err := e.encode(&buf, h.Size)
+	if err != nil {
+		return false, err
+	}
+	defer closeShards(rebuilt)
+
+	// the rebuilt shards must keep the stamp of the healthy ones
+	for _, sp := range rebuilt {
+		var rh ecHeader
+		sp.Seek(0, io.SeekStart)
+		binary.Read(sp, binary.LittleEndian, &rh)
+		rh.Stamp = h.Stamp
+		sp.Seek(0, io.SeekStart)
+		binary.Write(sp, binary.LittleEndian, rh)
+	}
+
+	err = e.writeShards(name, rebuilt, broken)
+	if err != nil {
+		return false, err
+	}
+	core.Info("repaired shards %v of %s on %s", broken, name, e)
+	return true, nil
+}
+
+// Repair walks the provided folder and rewrites the shards that are missing, stale or corrupted
+func (e *ErasureCode) Repair(dir string) (int, error) {
+	ls, err := e.listShards(dir, Filter{})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, l := range ls {
+		name := path.Join(dir, l.Name())
+		if l.IsDir() {
+			n, err := e.Repair(name)
+			count += n
+			if err != nil {
+				return count, err
+			}
+			continue
+		}
+		repaired, err := e.repairFile(name)
+		if core.IsWarn(err, "cannot repair %s: %v", name) {
+			continue
+		}
+		if repaired {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// listShards returns the union of the content of the folder on all the stores
+func (e *ErasureCode) listShards(dir string, filter Filter) ([]fs.FileInfo, error) {
+	var err error
+	var found bool
+	merged := map[string]fs.FileInfo{}
+	for _, s := range e.stores {
+		var ls []fs.FileInfo
+		ls, err = s.ReadDir(dir, filter)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				core.IsWarn(err, "cannot list %s on %s: %v", dir, s)
+			}
+			continue
+		}
+		found = true
+		for _, l := range ls {
+			if prev, ok := merged[l.Name()]; !ok || l.ModTime().After(prev.ModTime()) {
+				merged[l.Name()] = l
+			}
+		}
+	}
+	if !found {
+		return nil, err
+	}
+
+	names := core.Keys(merged)
+	sort.Strings(names)
+	var infos []fs.FileInfo
+	for _, n := range names {
+		infos = append(infos, merged[n])
+	}
+	return infos, nil
+}
+
+func (e *ErasureCode) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
+	ls, err := e.listShards(dir, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []fs.FileInfo
+	for _, l := range ls {
+		if filter.MaxResults > 0 && int64(len(infos)) >= filter.MaxResults {
+			break
+		}
+		if l.IsDir() {
+			infos = append(infos, l)
+			continue
+		}
+		// the size of the shard is not the size of the object, which is stored in the header
+		headers, err := e.readHeaders(path.Join(dir, l.Name()))
+		if err != nil {
+			continue
+		}
+		h, err := e.selectStamp(l.Name(), headers)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, simpleFileInfo{
+			name:    l.Name(),
+			size:    h.Size,
+			modTime: l.ModTime(),
+		})
+	}
+	return infos, nil
+}
+
+func (e *ErasureCode) Stat(name string) (os.FileInfo, error) {
+	var stat os.FileInfo
+	var err error
+	for _, s := range e.stores {
+		stat, err = s.Stat(name)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		return stat, nil
+	}
+
+	headers, err := e.readHeaders(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := e.selectStamp(name, headers)
+	if err != nil {
+		return nil, err
+	}
+	return simpleFileInfo{
+		name:    path.Base(name),
+		size:    h.Size,
+		modTime: stat.ModTime(),
+	}, nil
+}
+
+func (e *ErasureCode) Delete(name string) error {
+	var missing int
+	var errs []string
+	for _, s := range e.stores {
+		err := s.Delete(name)
+		switch {
+		case err == nil:
+		case os.IsNotExist(err):
+			missing++
+		default:
+			errs = append(errs, fmt.Sprintf("%s: %v", s, err))
+		}
+	}
+	if missing == len(e.stores) {
+		return os.ErrNotExist
+	}
+	if len(errs) > 0 {
+		return core.Errorf("cannot delete %s on some shards: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (e *ErasureCode) Close() error {
+	var err error
+	for _, s := range e.stores {
+		if e := s.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (e *ErasureCode) String() string {
+	return e.id
+}
+
+// Describe returns the cost of the erasure coded store: each shard is 1/k of the object
+func (e *ErasureCode) Describe() Description {
+	var d Description
+	for _, s := range e.stores {
+		sd := s.Describe()
+		d.ReadCost += sd.ReadCost / float64(len(e.stores))
+		d.WriteCost += sd.WriteCost / float64(e.k)
+	}
+	return d
+}
+
+// spool buffers data in memory and moves it to a temporary file when it exceeds maxSizeForMemoryCopy
+type spool struct {
+	buf  []byte
+	file *os.File
+	pos  int64
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.pos+int64(len(p)) > maxSizeForMemoryCopy {
+		f, err := os.CreateTemp("", "stash-spool")
+		if core.IsErr(err, "cannot create temporary file for spool: %v") {
+			return 0, err
+		}
+		_, err = f.Write(s.buf)
+		if err == nil {
+			_, err = f.Seek(s.pos, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.file, s.buf = f, nil
+	}
+	if s.file != nil {
+		n, err := s.file.Write(p)
+		s.pos += int64(n)
+		return n, err
+	}
+
+	end := s.pos + int64(len(p))
+	if end > int64(len(s.buf)) {
+		s.buf = append(s.buf, make([]byte, end-int64(len(s.buf)))...)
+	}
+	copy(s.buf[s.pos:], p)
+	s.pos = end
+	return len(p), nil
+}
+
+func (s *spool) Read(p []byte) (int, error) {
+	if s.file != nil {
+		n, err := s.file.Read(p)
+		s.pos += int64(n)
+		return n, err
+	}
+	if s.pos >= int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[s.pos:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *spool) Seek(offset int64, whence int) (int64, error) {
+	if s.file != nil {
+		pos, err := s.file.Seek(offset, whence)
+		s.pos = pos
+		return pos, err
+	}
+	switch whence {
+	case io.SeekStart:
+		s.pos = offset
+	case io.SeekCurrent:
+		s.pos += offset
+	case io.SeekEnd:
+		s.pos = int64(len(s.buf)) + offset
+	}
+	if s.pos < 0 {
+		s.pos = 0
+		return 0, os.ErrInvalid
+	}
+	return s.pos, nil
+}
+
+func (s *spool) Close() error {
+	s.buf = nil
+	if s.file != nil {
+		s.file.Close()
+		return os.Remove(s.file.Name())
+	}
+	return nil
+}
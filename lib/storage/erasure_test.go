@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+func TestErasureCode(t *testing.T) {
+	u := "ec:///test?k=2"
+	var shards []Store
+	for _, n := range []string{"a", "b", "c"} {
+		u += "&s=" + url.QueryEscape("mem://ec/"+n)
+		s, _ := OpenMemory("mem://ec/" + n)
+		shards = append(shards, s)
+	}
+	e, err := Open(u)
+	core.TestErr(t, err, "cannot open erasure code store: %v")
+	defer e.Close()
+
+	data := make([]byte, 3*1024*1024+17)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	err = WriteFile(e, "dir/data.bin", data)
+	core.TestErr(t, err, "cannot write file: %v")
+
+	stat, err := e.Stat("dir/data.bin")
+	core.TestErr(t, err, "cannot stat file: %v")
+	core.Assert(t, stat.Size() == int64(len(data)), "wrong size: %d", stat.Size())
+
+	var buf bytes.Buffer
+	err = e.Read("dir/data.bin", &Range{From: 1024*1024 - 10, To: 2*1024*1024 + 10}, &buf, nil)
+	core.TestErr(t, err, "cannot read range: %v")
+	core.Assert(t, bytes.Equal(buf.Bytes(), data[1024*1024-10:2*1024*1024+10]), "wrong range content")
+
+	// a corrupted data shard is not returned and the decode writes the range only once
+	original, err := ReadFile(shards[1], "test/dir/data.bin")
+	core.TestErr(t, err, "cannot read shard: %v")
+	corrupted := bytes.Clone(original)
+	corrupted[ecHeaderSize]++
+	err = WriteFile(shards[1], "test/dir/data.bin", corrupted)
+	core.TestErr(t, err, "cannot write shard: %v")
+	buf.Reset()
+	err = e.Read("dir/data.bin", &Range{From: 10, To: int64(len(data))}, &buf, nil)
+	core.TestErr(t, err, "cannot read range: %v")
+	core.Assert(t, bytes.Equal(buf.Bytes(), data[10:]), "wrong range content with a corrupted shard")
+	err = WriteFile(shards[1], "test/dir/data.bin", original)
+	core.TestErr(t, err, "cannot write shard: %v")
+
+	// a data shard is lost: the object is reconstructed from the parity
+	err = shards[0].Delete("test/dir/data.bin")
+	core.TestErr(t, err, "cannot delete shard: %v")
+
+	read, err := ReadFile(e, "dir/data.bin")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, bytes.Equal(read, data), "wrong content after reconstruction")
+
+	buf.Reset()
+	err = e.Read("dir/data.bin", &Range{From: 5, To: 100}, &buf, nil)
+	core.TestErr(t, err, "cannot read range: %v")
+	core.Assert(t, bytes.Equal(buf.Bytes(), data[5:100]), "wrong range content after reconstruction")
+
+	n, err := e.(Repairer).Repair("")
+	core.TestErr(t, err, "cannot repair: %v")
+	core.Assert(t, n == 1, "wrong number of repaired files: %d", n)
+
+	// the repaired shard replaces the lost parity
+	shards[2].Delete("test/dir/data.bin")
+	read, err = ReadFile(e, "dir/data.bin")
+	core.TestErr(t, err, "cannot read file after repair: %v")
+	core.Assert(t, bytes.Equal(read, data), "wrong content after repair")
+
+	// two shards lost: the object cannot be reconstructed
+	shards[1].Delete("test/dir/data.bin")
+	_, err = ReadFile(e, "dir/data.bin")
+	core.Assert(t, err != nil, "file should not be readable with one shard")
+
+	err = e.Delete("dir/data.bin")
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = e.Stat("dir/data.bin")
+	core.Assert(t, os.IsNotExist(err), "file should not exist: %v", err)
+
+	err = WriteFile(e, "empty.txt", nil)
+	core.TestErr(t, err, "cannot write empty file: %v")
+	read, err = ReadFile(e, "empty.txt")
+	core.TestErr(t, err, "cannot read empty file: %v")
+	core.Assert(t, len(read) == 0, "wrong empty content")
+
+	ls, err := e.ReadDir("", Filter{})
+	core.TestErr(t, err, "cannot list: %v")
+	core.Assert(t, len(ls) == 1 && ls[0].Name() == "empty.txt", "wrong entries: %v", ls)
+}
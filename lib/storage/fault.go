@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+// ErrInjectedFault is returned by a fault store when it simulates a failure. It wraps a transient network error so
+// that retries apply to it
+var ErrInjectedFault = fmt.Errorf("injected fault: %w", syscall.ECONNRESET)
+
+// faultPeers keeps the fault stores that share the same memory store
+var faultPeers = map[*Memory][]*Fault{}
+var faultPeersLock sync.Mutex
+
+// Fault wraps a memory store and injects latency, errors, partial writes, stale listings and clock skew following a
+// schedule generated from a seed. Different instances on the same name share the data, so they can simulate
+// different peers.
+type Fault struct {
+	store   *Memory
+	url     string
+	lock    sync.Mutex
+	rnd     *rand.Rand
+	enabled bool
+	ops     []string
+
+	latency time.Duration // latency is the maximal delay added to each operation
+	err     float64       // err is the probability that an operation fails
+	partial float64       // partial is the probability that a write stores only part of the content and fails
+	stale   float64       // stale is the probability that a written file is not yet visible in the listings of other peers
+	skew    time.Duration // skew is added to the modification time of the written files
+
+	hidden map[string]bool
+}
+
+// OpenFault opens a fault injection store. The url is in the format
+// fault://name?seed=1&latency=10ms&err=0.1&partial=0.05&stale=0.2&skew=2s&ops=read,write
+// where name is the shared memory store, seed initializes the schedule, latency is the maximal delay of each operation,
+// err, partial and stale are probabilities between 0 and 1, skew is the maximal clock skew (the actual skew is drawn
+// from the schedule in [-skew, skew]) and ops limits the injected errors to some operations (read, write, readDir,
+// stat, delete).
+func OpenFault(connectionUrl string) (Store, error) {
+	u, err := url.Parse(connectionUrl)
+	if core.IsErr(err, "invalid url '%s': %v", Redact(connectionUrl)) {
+		return nil, err
+	}
+	if u.Scheme != "fault" {
+		return nil, core.Errorf("invalid scheme: %s", u.Scheme)
+	}
+
+	m, err := OpenMemory("mem://" + u.Host + u.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	var seed int64
+	if v := q.Get("seed"); v != "" {
+		seed, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, core.Errorf("invalid seed %s in %s", v, Redact(connectionUrl))
+		}
+	}
+
+	f := &Fault{
+		store:   m.(*Memory),
+		url:     connectionUrl,
+		rnd:     rand.New(rand.NewSource(seed)),
+		enabled: true,
+		hidden:  map[string]bool{},
+	}
+	if v := q.Get("ops"); v != "" {
+		f.ops = strings.Split(v, ",")
+	}
+	for k, p := range map[string]*float64{"err": &f.err, "partial": &f.partial, "stale": &f.stale} {
+		if v := q.Get(k); v != "" {
+			*p, err = strconv.ParseFloat(v, 64)
+			if err != nil || *p < 0 || *p > 1 {
+				return nil, core.Errorf("invalid probability %s for %s in %s", v, k, Redact(connectionUrl))
+			}
+		}
+	}
+	for k, d := range map[string]*time.Duration{"latency": &f.latency, "skew": &f.skew} {
+		if v := q.Get(k); v != "" {
+			*d, err = time.ParseDuration(v)
+			if err != nil || *d < 0 {
+				return nil, core.Errorf("invalid duration %s for %s in %s", v, k, Redact(connectionUrl))
+			}
+		}
+	}
+	if f.skew > 0 {
+		f.skew = time.Duration(f.rnd.Int63n(int64(2*f.skew)+1)) - f.skew
+	}
+
+	faultPeersLock.Lock()
+	faultPeers[f.store] = append(faultPeers[f.store], f)
+	faultPeersLock.Unlock()
+	return f, nil
+}
+
+// SetEnabled turns the injection of faults on or off, e.g. to check that peers converge once the failures stop
+func (f *Fault) SetEnabled(enabled bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.enabled = enabled
+	if !enabled {
+		f.hidden = map[string]bool{}
+	}
+}
+
+// inject applies the latency and decides whether the operation fails
+func (f *Fault) inject(op string) error {
+	f.lock.Lock()
+	var delay time.Duration
+	if f.enabled && f.latency > 0 {
+		delay = time.Duration(f.rnd.Int63n(int64(f.latency) + 1))
+	}
+	fail := f.enabled && (f.ops == nil || core.Contains(f.ops, op)) && f.rnd.Float64() < f.err
+	f.lock.Unlock()
+
+	time.Sleep(delay)
+	if fail {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// chance returns true with the provided probability when faults are enabled
+func (f *Fault) chance(p float64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.enabled && p > 0 && f.rnd.Float64() < p
+}
+
+func (f *Fault) ID() string {
+	return f.store.ID()
+}
+
+func (f *Fault) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	if err := f.inject("read"); err != nil {
+		return err
+	}
+	return f.store.Read(name, rang, dest, progress)
+}
+
+func (f *Fault) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	if err := f.inject("write"); err != nil {
+		return err
+	}
+
+	if f.chance(f.partial) {
+		data, err := io.ReadAll(source)
+		if err != nil {
+			return err
+		}
+		f.store.Write(name, core.NewBytesReader(data[:len(data)/2]), nil)
+		return ErrInjectedFault
+	}
+
+	err := f.store.Write(name, source, progress)
+	if err != nil {
+		return err
+	}
+
+	if f.skew != 0 {
+		f.store.lock.Lock()
+		if mf, ok := f.store.data[name]; ok {
+			mf.simpleFileInfo.modTime = mf.simpleFileInfo.modTime.Add(f.skew)
+			f.store.data[name] = mf
+		}
+		f.store.lock.Unlock()
+	}
+	if f.chance(f.stale) {
+		f.hide(name)
+	}
+	return nil
+}
+
+// hide makes a file invisible to the listings of the other peers until it propagates
+func (f *Fault) hide(name string) {
+	faultPeersLock.Lock()
+	defer faultPeersLock.Unlock()
+	for _, p := range faultPeers[f.store] {
+		if p != f {
+			p.lock.Lock()
+			if p.enabled {
+				p.hidden[name] = true
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// ReadDir hides the files written recently by other peers to simulate eventual consistency. Each hidden file becomes visible
+// with 50% probability at every listing
+func (f *Fault) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
+	if err := f.inject("readDir"); err != nil {
+		return nil, err
+	}
+	ls, err := f.store.ReadDir(dir, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.hidden) == 0 {
+		return ls, nil
+	}
+
+	var visible []fs.FileInfo
+	for _, l := range ls {
+		name := strings.TrimPrefix(dir+"/"+l.Name(), "/")
+		if f.hidden[name] {
+			if f.rnd.Intn(2) == 0 {
+				continue
+			}
+			delete(f.hidden, name)
+		}
+		visible = append(visible, l)
+	}
+	return visible, nil
+}
+
+func (f *Fault) Stat(name string) (os.FileInfo, error) {
+	if err := f.inject("stat"); err != nil {
+		return nil, err
+	}
+	return f.store.Stat(name)
+}
+
+func (f *Fault) Delete(name string) error {
+	if err := f.inject("delete"); err != nil {
+		return err
+	}
+	return f.store.Delete(name)
+}
+
+func (f *Fault) Close() error {
+	faultPeersLock.Lock()
+	defer faultPeersLock.Unlock()
+	peers := faultPeers[f.store]
+	for i, p := range peers {
+		if p == f {
+			faultPeers[f.store] = append(peers[:i], peers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *Fault) String() string {
+	return f.url
+}
+
+func (f *Fault) Describe() Description {
+	return f.store.Describe()
+}
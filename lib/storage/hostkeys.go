@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/stregato/stash/lib/core"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyMismatch is returned when a server presents a host key different from the pinned, known or trusted one
+var ErrHostKeyMismatch = errors.New("host key mismatch")
+
+// HostKeyStore keeps the host keys trusted on first use
+type HostKeyStore interface {
+	// GetHostKey returns the trusted key of a host in wire format
+	GetHostKey(host string) (key []byte, ok bool)
+	// SetHostKey trusts a key for a host
+	SetHostKey(host string, key []byte) error
+}
+
+// HostKeys keeps the SFTP host keys trusted on first use by the opens without a HostKeys option. The default keeps
+// them in memory; a safe passes its config DB in the options instead, so that the keys survive a restart
+var HostKeys HostKeyStore = &memoryHostKeys{keys: map[string][]byte{}}
+
+type memoryHostKeys struct {
+	keys map[string][]byte
+	lock sync.Mutex
+}
+
+func (m *memoryHostKeys) GetHostKey(host string) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key, ok := m.keys[host]
+	return key, ok
+}
+
+func (m *memoryHostKeys) SetHostKey(host string, key []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.keys[host] = key
+	return nil
+}
+
+// hostKeyVerifier checks the host key of a server in order against the fingerprints pinned in the url, the
+// known_hosts file and the keys trusted on first use. The error of the last check is kept, since the ssh handshake
+// does not wrap it.
+type hostKeyVerifier struct {
+	fingerprints []string
+	knownHosts   string
+	hostKeys     HostKeyStore
+	err          error
+}
+
+// newHostKeyVerifier reads the pinned fingerprints from the fp parameters and the known_hosts file from the knownHosts
+// parameter, which defaults to ~/.ssh/known_hosts. Keys trusted on first use go to hostKeys, or HostKeys when nil
+func newHostKeyVerifier(params map[string][]string, hostKeys HostKeyStore) *hostKeyVerifier {
+	if hostKeys == nil {
+		hostKeys = HostKeys
+	}
+	v := &hostKeyVerifier{fingerprints: params["fp"], hostKeys: hostKeys}
+	if k := params["knownHosts"]; len(k) > 0 {
+		v.knownHosts = expandHome(k[0])
+	} else if homeDir, err := os.UserHomeDir(); err == nil {
+		v.knownHosts = filepath.Join(homeDir, ".ssh", "known_hosts")
+	}
+	return v
+}
+
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	v.err = v.verify(hostname, remote, key)
+	return v.err
+}
+
+func (v *hostKeyVerifier) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	if len(v.fingerprints) > 0 {
+		for _, fp := range v.fingerprints {
+			if fp == fingerprint || fp == strings.TrimPrefix(fingerprint, "SHA256:") ||
+				fp == ssh.FingerprintLegacyMD5(key) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s presented %s, while the url pins %s", ErrHostKeyMismatch, hostname,
+			fingerprint, strings.Join(v.fingerprints, ", "))
+	}
+
+	if _, err := os.Stat(v.knownHosts); err == nil {
+		callback, err := knownhosts.New(v.knownHosts)
+		if core.IsErr(err, "cannot read known hosts %s: %v", v.knownHosts) {
+			return err
+		}
+		err = callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+			return fmt.Errorf("%w: %s presented %s, which does not match %s:%d", ErrHostKeyMismatch, hostname,
+				fingerprint, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+		case !errors.As(err, &keyErr):
+			return err
+		}
+	}
+
+	host := knownhosts.Normalize(hostname)
+	trusted, ok := v.hostKeys.GetHostKey(host)
+	if !ok {
+		core.Info("trusting host key %s of %s on first use", fingerprint, host)
+		return v.hostKeys.SetHostKey(host, key.Marshal())
+	}
+	if bytes.Equal(trusted, key.Marshal()) {
+		return nil
+	}
+	expected := "an invalid key"
+	if k, err := ssh.ParsePublicKey(trusted); err == nil {
+		expected = ssh.FingerprintSHA256(k)
+	}
+	return fmt.Errorf("%w: %s presented %s, while %s was trusted on first use; if the key changed on purpose, "+
+		"pin it with fp=%s", ErrHostKeyMismatch, host, fingerprint, expected, url.QueryEscape(fingerprint))
+}
+
+// expandHome replaces a leading ~ with the home folder
+func expandHome(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(homeDir, p[2:])
+		}
+	}
+	return p
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"fmt"
 	"io"
 	"io/fs"
 	"net/url"
@@ -51,24 +52,15 @@ func (l *Local) Read(name string, rang *Range, dest io.Writer, progress chan int
 	if err != nil {
 		return core.Errorw(err, "cannot open file on %v:%v", l)
 	}
+	defer f.Close()
 
+	w := &progressWriter{w: dest, progress: progress}
 	if rang == nil {
-		_, err = io.Copy(dest, f)
+		_, err = io.Copy(w, f)
 	} else {
-		left := rang.To - rang.From
-		f.Seek(rang.From, 0)
-		var b [4096]byte
-
-		for left > 0 && err == nil {
-			var sz int64
-			if rang.From-rang.To > 4096 {
-				sz = 4096
-			} else {
-				sz = rang.From - rang.To
-			}
-			_, err = f.Read(b[0:sz])
-			dest.Write(b[0:sz])
-			left -= sz
+		_, err = f.Seek(rang.From, io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(w, f, rang.To-rang.From)
 		}
 	}
 	if err != nil {
@@ -95,7 +87,7 @@ func (l *Local) Write(name string, source io.ReadSeeker, progress chan int64) er
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, source)
+	_, err = io.Copy(&progressWriter{w: f, progress: progress}, source)
 	if err != nil {
 		os.Remove(n)
 		return core.Errorw(err, "cannot copy file on %v:%v", l)
@@ -104,6 +96,50 @@ func (l *Local) Write(name string, source io.ReadSeeker, progress chan int64) er
 	return err
 }
 
+// WriteResumable appends the parts to a temporary file, which replaces the destination when the upload is complete
+func (l *Local) WriteResumable(name string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	if upload.ID == "" {
+		*upload = Upload{ID: fmt.Sprint(core.SnowID())}
+	}
+	tmp := filepath.Join(l.base, uploadName(name, *upload))
+	err := createDir(tmp)
+	if err != nil {
+		return core.Errorw(err, "cannot create parent of %s: %v", tmp)
+	}
+
+	// the size of the temporary file is the actual offset, since the last part may not be saved
+	stat, err := os.Stat(tmp)
+	if err == nil {
+		upload.Offset = stat.Size()
+	} else {
+		upload.Offset = 0
+	}
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return core.Errorw(err, "cannot open upload file on %v:%v", l)
+	}
+	err = uploadParts(source, upload, save, progress, func(part []byte) (string, error) {
+		_, err := f.Write(part)
+		return "", err
+	})
+	f.Close()
+	if err != nil {
+		return core.Errorw(err, "cannot upload file on %v:%v", l)
+	}
+
+	return os.Rename(tmp, filepath.Join(l.base, name))
+}
+
+func (l *Local) AbortUpload(name string, upload Upload) error {
+	err := os.Remove(filepath.Join(l.base, uploadName(name, upload)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
 func (l *Local) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
 	result, err := os.ReadDir(filepath.Join(l.base, dir))
 	if err != nil {
@@ -68,7 +68,7 @@ func tryLock(s Store, dir, lockType string) (release chan bool, err error) {
 	for _, l := range ls {
 		if strings.HasPrefix(l.Name(), lockType) {
 			if l.ModTime().Add(LockExpire).Before(stat.ModTime()) {
-				s.Delete(l.Name())
+				s.Delete(path.Join(dir, l.Name()))
 				continue
 			}
 			if l.ModTime().Before(oldest.ModTime()) || (l.ModTime().Equal(oldest.ModTime()) && l.Name() < oldest.Name()) {
@@ -2,12 +2,15 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/fs"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/stregato/stash/lib/core"
 )
@@ -18,11 +21,14 @@ type _memoryFile struct {
 }
 
 type Memory struct {
-	url  string
-	data map[string]_memoryFile
+	url     string
+	data    map[string]_memoryFile
+	uploads map[string][]byte
+	lock    sync.RWMutex
 }
 
 var MemoryStores = map[string]*Memory{}
+var memoryStoresLock sync.Mutex
 
 func OpenMemory(connectionUrl string) (Store, error) {
 	u, err := url.Parse(connectionUrl)
@@ -33,10 +39,12 @@ func OpenMemory(connectionUrl string) (Store, error) {
 		return nil, os.ErrInvalid
 	}
 
+	memoryStoresLock.Lock()
+	defer memoryStoresLock.Unlock()
 	if m, ok := MemoryStores[connectionUrl]; ok {
 		return m, nil
 	}
-	m := &Memory{url: connectionUrl, data: map[string]_memoryFile{}}
+	m := &Memory{url: connectionUrl, data: map[string]_memoryFile{}, uploads: map[string][]byte{}}
 	MemoryStores[connectionUrl] = m
 	return m, nil
 }
@@ -46,11 +54,17 @@ func (m *Memory) ID() string {
 }
 
 func (m *Memory) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	m.lock.RLock()
 	f, ok := m.data[name]
+	m.lock.RUnlock()
 	if !ok {
 		return os.ErrNotExist
 	}
 
+	if rang != nil && (rang.From < 0 || rang.To > int64(len(f.content)) || rang.From > rang.To) {
+		return core.Errorf("invalid range %d-%d for %s/%s", rang.From, rang.To, m, name)
+	}
+
 	var err error
 	var w int64
 	if rang == nil {
@@ -69,6 +83,10 @@ func (m *Memory) Read(name string, rang *Range, dest io.Writer, progress chan in
 }
 
 func (m *Memory) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	return m.WriteIf(name, source, Condition{}, progress)
+}
+
+func (m *Memory) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
 	var buf bytes.Buffer
 
 	_, err := io.Copy(&buf, source)
@@ -80,6 +98,13 @@ func (m *Memory) Write(name string, source io.ReadSeeker, progress chan int64) e
 		progress <- int64(len(content))
 	}
 
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if f, ok := m.data[name]; ok {
+		if cond.IfNotExists || (!cond.IfUnmodifiedSince.IsZero() && f.simpleFileInfo.modTime.After(cond.IfUnmodifiedSince)) {
+			return ErrConditionNotMet
+		}
+	}
 	m.data[name] = _memoryFile{
 		simpleFileInfo: simpleFileInfo{
 			name:    path.Base(name),
@@ -93,15 +118,67 @@ func (m *Memory) Write(name string, source io.ReadSeeker, progress chan int64) e
 	return err
 }
 
+// WriteResumable keeps the parts in memory until the upload is complete
+func (m *Memory) WriteResumable(name string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	m.lock.Lock()
+	if upload.ID == "" || int64(len(m.uploads[upload.ID])) != upload.Offset {
+		*upload = Upload{ID: fmt.Sprint(core.SnowID())}
+		m.uploads[upload.ID] = nil
+	}
+	m.lock.Unlock()
+
+	err := uploadParts(source, upload, save, progress, func(part []byte) (string, error) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.uploads[upload.ID] = append(m.uploads[upload.ID], part...)
+		return "", nil
+	})
+	if err != nil {
+		return core.Errorw(err, "cannot upload %s/%s: %v", m, name)
+	}
+
+	m.lock.Lock()
+	content := m.uploads[upload.ID]
+	delete(m.uploads, upload.ID)
+	m.data[name] = _memoryFile{
+		simpleFileInfo: simpleFileInfo{
+			name:    path.Base(name),
+			size:    int64(len(content)),
+			modTime: core.Now(),
+		},
+		content: content,
+	}
+	m.lock.Unlock()
+	return nil
+}
+
+func (m *Memory) AbortUpload(name string, upload Upload) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.uploads, upload.ID)
+	return nil
+}
+
 func (m *Memory) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+
 	var infos []fs.FileInfo
 	subfolders := map[string]bool{}
 	for n, mf := range m.data {
-		if strings.HasPrefix(n, dir+"/") {
-			n = strings.TrimPrefix(n, dir+"/")
+		if strings.HasPrefix(n, prefix) {
+			n = strings.TrimPrefix(n, prefix)
 			parts := strings.Split(n, "/")
-			if len(parts) > 1 && !f.OnlyFiles {
-				subfolders[parts[0]] = true
+			if len(parts) > 1 {
+				if !f.OnlyFiles {
+					subfolders[parts[0]] = true
+				}
 			} else if matchFilter(mf.simpleFileInfo, f) {
 				infos = append(infos, mf.simpleFileInfo)
 			}
@@ -120,10 +197,17 @@ func (m *Memory) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
 		}
 	}
 
+	if f.MaxResults > 0 && int64(len(infos)) > f.MaxResults {
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+		infos = infos[:f.MaxResults]
+	}
 	return infos, nil
 }
 
 func (m *Memory) Stat(name string) (os.FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	l, ok := m.data[name]
 	if ok {
 		return l.simpleFileInfo, nil
@@ -141,13 +225,26 @@ func (m *Memory) Stat(name string) (os.FileInfo, error) {
 }
 
 func (m *Memory) Delete(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	_, ok := m.data[name]
 	if ok {
 		delete(m.data, name)
 		return nil
-	} else {
+	}
+
+	// a folder is deleted with all its content
+	for n := range m.data {
+		if strings.HasPrefix(n, name+"/") {
+			delete(m.data, n)
+			ok = true
+		}
+	}
+	if !ok {
 		return os.ErrNotExist
 	}
+	return nil
 }
 
 func (m *Memory) Close() error {
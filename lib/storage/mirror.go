@@ -0,0 +1,500 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	PreferLatency = "latency" // PreferLatency reads from the replica with the lowest observed latency
+	PreferCost    = "cost"    // PreferCost reads from the replica with the lowest read cost as per Describe
+
+	mirrorRepairQueue = 1024
+)
+
+// Repairer is implemented by stores that keep redundant copies of the data and can fix divergent replicas
+type Repairer interface {
+	// Repair walks the provided folder recursively and fixes the replicas that are missing or different. It returns
+	// the number of fixed objects
+	Repair(dir string) (int, error)
+}
+
+// Repair fixes the copies on the store or on the first wrapped store that supports it, e.g. a mirror under a cache or
+// retries
+func Repair(s Store, dir string) (int, error) {
+	for w := s; w != nil; w = Unwrap(w) {
+		if r, ok := w.(Repairer); ok {
+			return r.Repair(dir)
+		}
+	}
+	return 0, core.Errorf("store %s does not support repair", s)
+}
+
+// Mirror replicates every write on a set of stores and reads from the preferred replica
+type Mirror struct {
+	stores  []Store
+	quorum  int
+	prefer  string
+	latency []time.Duration
+	id      string
+	lock    sync.Mutex
+	repairs chan string
+	done    chan bool
+	closed  sync.Once
+}
+
+// OpenMirror opens a mirror store. The url is in the format mirror:///base?s=<url1>&s=<url2>&w=<quorum>&r=<latency|cost>
+// where each s parameter is the query-escaped URL of a replica, w is the number of replicas that must accept a write
+// (default is all) and r is the read preference (default is latency). The base path is applied to all replicas.
+func OpenMirror(connectionUrl string) (Store, error) {
+	return openMirror(connectionUrl, OpenOptions{})
+}
+
+// openMirror opens the stores in the url with the options of the open
+func openMirror(connectionUrl string, options OpenOptions) (Store, error) {
+	u, err := url.Parse(connectionUrl)
+	if core.IsErr(err, "invalid url '%s': %v", Redact(connectionUrl)) {
+		return nil, err
+	}
+	if u.Scheme != "mirror" {
+		return nil, core.Errorf("invalid scheme: %s", u.Scheme)
+	}
+
+	q := u.Query()
+	urls := q["s"]
+	if len(urls) == 0 {
+		return nil, core.Errorf("no replica defined in %s", Redact(connectionUrl))
+	}
+
+	quorum := len(urls)
+	if w := q.Get("w"); w != "" {
+		quorum, err = strconv.Atoi(w)
+		if err != nil || quorum < 1 || quorum > len(urls) {
+			return nil, core.Errorf("invalid write quorum %s in %s", w, Redact(connectionUrl))
+		}
+	}
+
+	prefer := q.Get("r")
+	switch prefer {
+	case "":
+		prefer = PreferLatency
+	case PreferLatency, PreferCost:
+	default:
+		return nil, core.Errorf("invalid read preference %s in %s", prefer, Redact(connectionUrl))
+	}
+
+	base := strings.Trim(u.Path, "/")
+	var stores []Store
+	var ids []string
+	for _, su := range urls {
+		s, err := OpenWith(su, options)
+		if err != nil {
+			for _, s := range stores {
+				s.Close()
+			}
+			return nil, core.Errorw(err, "cannot open replica %s in %s: %v", Redact(su), Redact(connectionUrl))
+		}
+		ids = append(ids, s.ID())
+		if base != "" {
+			s = Sub(s, base, true)
+		}
+		stores = append(stores, s)
+	}
+
+	m := &Mirror{
+		stores:  stores,
+		quorum:  quorum,
+		prefer:  prefer,
+		latency: make([]time.Duration, len(stores)),
+		id:      fmt.Sprintf("mirror://%s/%s", strings.Join(ids, ","), base),
+		repairs: make(chan string, mirrorRepairQueue),
+		done:    make(chan bool),
+	}
+	go m.repairJob()
+	return m, nil
+}
+
+func (m *Mirror) ID() string {
+	return m.id
+}
+
+// replicas returns the indexes of the stores in order of read preference
+func (m *Mirror) replicas() []int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	order := make([]int, len(m.stores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if m.prefer == PreferCost {
+			return m.stores[a].Describe().ReadCost < m.stores[b].Describe().ReadCost
+		}
+		return m.latency[a] < m.latency[b]
+	})
+	return order
+}
+
+// measure updates the moving average of the latency of a replica
+func (m *Mirror) measure(i int, start time.Time, err error) {
+	elapsed := time.Since(start)
+	if err != nil && !os.IsNotExist(err) {
+		elapsed = 10 * time.Second // penalize unreliable replicas
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.latency[i] == 0 {
+		m.latency[i] = elapsed
+	} else {
+		m.latency[i] = (m.latency[i]*7 + elapsed) / 8
+	}
+}
+
+// scheduleRepair queues a file for a background consistency check
+func (m *Mirror) scheduleRepair(name string) {
+	select {
+	case m.repairs <- name:
+	default:
+		core.Info("repair queue full on %s, skipping %s", m, name)
+	}
+}
+
+func (m *Mirror) repairJob() {
+	for {
+		select {
+		case name := <-m.repairs:
+			_, err := m.repairFile(name)
+			core.IsWarn(err, "cannot repair %s on %s: %v", name, m)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// MirrorDeleteGrace is the age below which a file missing on a quorum of replicas is not deleted by repair, since
+// writes reach the replicas one after the other
+var MirrorDeleteGrace = time.Minute
+
+// repairFile copies the most recent version of a file to the replicas where it is missing or different. When the
+// quorum is a majority, a file missing on a quorum of replicas was deleted, since a write leaves it on a majority, so
+// the remaining copies are deleted instead. With a smaller quorum a partial write looks the same, so the file is
+// always copied back.
+func (m *Mirror) repairFile(name string) (bool, error) {
+	stats := make([]fs.FileInfo, len(m.stores))
+	src := -1
+	var missing int
+	for i, s := range m.stores {
+		stat, err := s.Stat(name)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if err == nil && stat.IsDir() {
+			return false, nil
+		}
+		stats[i] = stat
+		if stat == nil {
+			missing++
+		} else if src == -1 || stat.ModTime().After(stats[src].ModTime()) {
+			src = i
+		}
+	}
+	if src == -1 {
+		return false, nil
+	}
+
+	if m.quorum*2 > len(m.stores) && missing >= m.quorum {
+		if core.Since(stats[src].ModTime()) < MirrorDeleteGrace {
+			return false, nil
+		}
+		for i, stat := range stats {
+			if stat == nil {
+				continue
+			}
+			err := m.stores[i].Delete(name)
+			if err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+			core.Info("deleted %s on replica %s, since it is missing on %d replicas", name, m.stores[i], missing)
+		}
+		return true, nil
+	}
+
+	var srcHash []byte
+	var repaired bool
+	for i, stat := range stats {
+		if i == src {
+			continue
+		}
+		if stat != nil && stat.Size() == stats[src].Size() {
+			// replicas with the same size may still differ, for instance in fixed size headers
+			var err error
+			if srcHash == nil {
+				srcHash, err = hashOfFile(m.stores[src], name)
+				if err != nil {
+					return repaired, err
+				}
+			}
+			h, err := hashOfFile(m.stores[i], name)
+			if err != nil {
+				return repaired, err
+			}
+			if bytes.Equal(h, srcHash) {
+				continue
+			}
+		}
+		err := CopyFile(m.stores[i], name, m.stores[src], name)
+		if err != nil {
+			return repaired, err
+		}
+		core.Info("repaired %s on replica %s from %s", name, m.stores[i], m.stores[src])
+		repaired = true
+	}
+	return repaired, nil
+}
+
+func hashOfFile(s Store, name string) ([]byte, error) {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Read(name, nil, h, nil)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Repair walks the provided folder on all replicas and fixes missing or divergent files
+func (m *Mirror) Repair(dir string) (int, error) {
+	ls, err := m.ReadDir(dir, Filter{})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, l := range ls {
+		name := path.Join(dir, l.Name())
+		if l.IsDir() {
+			n, err := m.Repair(name)
+			count += n
+			if err != nil {
+				return count, err
+			}
+			continue
+		}
+		repaired, err := m.repairFile(name)
+		if err != nil {
+			return count, err
+		}
+		if repaired {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *Mirror) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	var failure error
+	var missing bool
+	for _, i := range m.replicas() {
+		start := time.Now()
+		err := m.stores[i].Read(name, rang, dest, progress)
+		m.measure(i, start, err)
+		if err == nil {
+			if missing {
+				m.scheduleRepair(name)
+			}
+			return nil
+		}
+		if os.IsNotExist(err) {
+			missing = true
+			continue
+		}
+		core.IsWarn(err, "cannot read %s from replica %s: %v", name, m.stores[i])
+		failure = err
+
+		// the replica may have written part of the content, so a retry on another replica is only safe
+		// when the destination can be rewound
+		seeker, ok := dest.(io.Seeker)
+		if !ok {
+			return err
+		}
+		seeker.Seek(0, io.SeekStart)
+	}
+	if failure != nil {
+		return failure
+	}
+	return os.ErrNotExist
+}
+
+func (m *Mirror) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	var succeeded int
+	var errs []string
+	for j, i := range m.replicas() {
+		_, err := source.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		var p chan int64
+		if j == 0 {
+			p = progress
+		}
+		start := time.Now()
+		err = m.stores[i].Write(name, source, p)
+		m.measure(i, start, err)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", m.stores[i], err))
+			continue
+		}
+		succeeded++
+	}
+
+	if succeeded < m.quorum {
+		return core.Errorf("write of %s reached %d replicas out of the required %d: %s", name, succeeded,
+			m.quorum, strings.Join(errs, "; "))
+	}
+	if len(errs) > 0 {
+		core.Info("write of %s failed on some replicas, scheduling repair: %s", name, strings.Join(errs, "; "))
+		m.scheduleRepair(name)
+	}
+	return nil
+}
+
+func (m *Mirror) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
+	var err error
+	var found bool
+	merged := map[string]fs.FileInfo{}
+	for _, i := range m.replicas() {
+		start := time.Now()
+		var ls []fs.FileInfo
+		ls, err = m.stores[i].ReadDir(dir, filter)
+		m.measure(i, start, err)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				core.IsWarn(err, "cannot list %s on replica %s: %v", dir, m.stores[i])
+			}
+			continue
+		}
+		found = true
+		for _, l := range ls {
+			if prev, ok := merged[l.Name()]; !ok || l.ModTime().After(prev.ModTime()) {
+				merged[l.Name()] = l
+			}
+		}
+	}
+	if !found {
+		return nil, err
+	}
+
+	names := core.Keys(merged)
+	sort.Strings(names)
+	if filter.MaxResults > 0 && int64(len(names)) > filter.MaxResults {
+		names = names[:filter.MaxResults]
+	}
+
+	var infos []fs.FileInfo
+	for _, n := range names {
+		infos = append(infos, merged[n])
+	}
+	return infos, nil
+}
+
+func (m *Mirror) Stat(name string) (os.FileInfo, error) {
+	var failure error
+	var missing bool
+	for _, i := range m.replicas() {
+		start := time.Now()
+		stat, err := m.stores[i].Stat(name)
+		m.measure(i, start, err)
+		if err == nil {
+			if missing && !stat.IsDir() {
+				m.scheduleRepair(name)
+			}
+			return stat, nil
+		}
+		if os.IsNotExist(err) {
+			missing = true
+		} else {
+			failure = err
+		}
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *Mirror) Delete(name string) error {
+	var succeeded, missing int
+	var errs []string
+	for i, s := range m.stores {
+		start := time.Now()
+		err := s.Delete(name)
+		m.measure(i, start, err)
+		switch {
+		case err == nil:
+			succeeded++
+		case os.IsNotExist(err):
+			missing++
+		default:
+			errs = append(errs, fmt.Sprintf("%s: %v", s, err))
+		}
+	}
+
+	if missing == len(m.stores) {
+		return os.ErrNotExist
+	}
+	if succeeded+missing < m.quorum {
+		return core.Errorf("delete of %s reached %d replicas out of the required %d: %s", name, succeeded+missing,
+			m.quorum, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (m *Mirror) Close() error {
+	m.closed.Do(func() { close(m.done) })
+	var err error
+	for _, s := range m.stores {
+		if e := s.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (m *Mirror) String() string {
+	return m.id
+}
+
+// Describe returns the cost of the mirror: reads hit the cheapest replica while writes hit all replicas
+func (m *Mirror) Describe() Description {
+	var d Description
+	for i, s := range m.stores {
+		sd := s.Describe()
+		if i == 0 || sd.ReadCost < d.ReadCost {
+			d.ReadCost = sd.ReadCost
+		}
+		d.WriteCost += sd.WriteCost
+	}
+	return d
+}
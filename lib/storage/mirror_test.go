@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+func TestMirror(t *testing.T) {
+	u := "mirror:///test?s=" + url.QueryEscape("mem://mirror/a") + "&s=" + url.QueryEscape("mem://mirror/b") +
+		"&s=" + url.QueryEscape("mem://mirror/c") + "&w=2&r=cost"
+	m, err := Open(u)
+	core.TestErr(t, err, "cannot open mirror: %v")
+	defer m.Close()
+
+	a, _ := OpenMemory("mem://mirror/a")
+	b, _ := OpenMemory("mem://mirror/b")
+	c, _ := OpenMemory("mem://mirror/c")
+
+	err = WriteFile(m, "dir/hello.txt", []byte("hello"))
+	core.TestErr(t, err, "cannot write file: %v")
+
+	for _, s := range []Store{a, b, c} {
+		data, err := ReadFile(s, "test/dir/hello.txt")
+		core.TestErr(t, err, "cannot read replica %s: %v", s)
+		core.Assert(t, string(data) == "hello", "wrong data on replica %s: %s", s, data)
+	}
+
+	// a replica loses the file: reads succeed and the file is repaired in background
+	err = a.Delete("test/dir/hello.txt")
+	core.TestErr(t, err, "cannot delete file: %v")
+
+	data, err := ReadFile(m, "dir/hello.txt")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "hello", "wrong data: %s", data)
+
+	for i := 0; i < 50; i++ {
+		if _, err = a.Stat("test/dir/hello.txt"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	core.TestErr(t, err, "file not repaired on replica: %v")
+
+	// explicit repair of a divergent replica
+	for _, s := range []Store{b, c} {
+		err = WriteFile(s, "test/dir/other.txt", []byte("other"))
+		core.TestErr(t, err, "cannot write file: %v")
+	}
+	n, err := m.(Repairer).Repair("")
+	core.TestErr(t, err, "cannot repair mirror: %v")
+	core.Assert(t, n == 1, "wrong number of repaired files: %d", n)
+	data, err = ReadFile(a, "test/dir/other.txt")
+	core.TestErr(t, err, "cannot read repaired file: %v")
+	core.Assert(t, string(data) == "other", "wrong data: %s", data)
+
+	// replicas with the same size but different content take the newest
+	err = WriteFile(c, "test/dir/hello.txt", []byte("HELLO"))
+	core.TestErr(t, err, "cannot write file: %v")
+	n, err = m.(Repairer).Repair("")
+	core.TestErr(t, err, "cannot repair mirror: %v")
+	core.Assert(t, n == 1, "wrong number of repaired files: %d", n)
+	for _, s := range []Store{a, b} {
+		data, err = ReadFile(s, "test/dir/hello.txt")
+		core.TestErr(t, err, "cannot read repaired file: %v")
+		core.Assert(t, string(data) == "HELLO", "divergent replica %s not repaired: %s", s, data)
+	}
+
+	// a file missing on a quorum of replicas was deleted and is not copied back
+	grace := MirrorDeleteGrace
+	MirrorDeleteGrace = 0
+	defer func() { MirrorDeleteGrace = grace }()
+	err = WriteFile(a, "test/dir/deleted.txt", []byte("deleted"))
+	core.TestErr(t, err, "cannot write file: %v")
+	n, err = m.(Repairer).Repair("")
+	core.TestErr(t, err, "cannot repair mirror: %v")
+	core.Assert(t, n == 1, "wrong number of repaired files: %d", n)
+	_, err = a.Stat("test/dir/deleted.txt")
+	core.Assert(t, os.IsNotExist(err), "deleted file resurrected: %v", err)
+
+	ls, err := m.ReadDir("dir", Filter{})
+	core.TestErr(t, err, "cannot list mirror: %v")
+	core.Assert(t, len(ls) == 2, "wrong number of files: %d", len(ls))
+
+	err = m.Delete("dir/hello.txt")
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = m.Stat("dir/hello.txt")
+	core.Assert(t, os.IsNotExist(err), "file not deleted: %v", err)
+
+	// a repeated close is harmless like on the other stores
+	m.Close()
+}
+
+func TestRepairMinority(t *testing.T) {
+	u := "mirror:///test?s=" + url.QueryEscape("mem://minority/a") + "&s=" + url.QueryEscape("mem://minority/b") +
+		"&s=" + url.QueryEscape("mem://minority/c") + "&w=1"
+	m, err := Open(u)
+	core.TestErr(t, err, "cannot open mirror: %v")
+	defer m.Close()
+
+	grace := MirrorDeleteGrace
+	MirrorDeleteGrace = 0
+	defer func() { MirrorDeleteGrace = grace }()
+
+	// with a write quorum of 1, a file on a single replica is a partial write and not a delete
+	a, _ := OpenMemory("mem://minority/a")
+	err = WriteFile(a, "test/x", []byte("x"))
+	core.TestErr(t, err, "cannot write file: %v")
+	n, err := m.(Repairer).Repair("")
+	core.TestErr(t, err, "cannot repair mirror: %v")
+	core.Assert(t, n == 1, "wrong number of repaired files: %d", n)
+	for _, r := range []string{"a", "b", "c"} {
+		s, _ := OpenMemory("mem://minority/" + r)
+		data, err := ReadFile(s, "test/x")
+		core.TestErr(t, err, "file not replicated on %s: %v", r)
+		core.Assert(t, string(data) == "x", "wrong data on %s: %s", r, data)
+	}
+}
+
+func TestRepairWrapped(t *testing.T) {
+	u := "retry+mirror:///test?s=" + url.QueryEscape("mem://wrapped/a") + "&s=" + url.QueryEscape("mem://wrapped/b")
+	m, err := Open(u)
+	core.TestErr(t, err, "cannot open mirror: %v")
+	defer m.Close()
+
+	b, _ := OpenMemory("mem://wrapped/b")
+	err = WriteFile(b, "test/safe/x", []byte("x"))
+	core.TestErr(t, err, "cannot write file: %v")
+	err = WriteFile(b, "test/other/y", []byte("y"))
+	core.TestErr(t, err, "cannot write file: %v")
+
+	// the sub limits the repair to its folder
+	n, err := Repair(Sub(m, "safe", false), "")
+	core.TestErr(t, err, "cannot repair wrapped mirror: %v")
+	core.Assert(t, n == 1, "wrong number of repaired files: %d", n)
+
+	a, _ := OpenMemory("mem://wrapped/a")
+	_, err = a.Stat("test/safe/x")
+	core.TestErr(t, err, "file not repaired: %v")
+	_, err = a.Stat("test/other/y")
+	core.Assert(t, os.IsNotExist(err), "file outside the sub repaired")
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+// Opener opens a store from a url with the options of the open
+type Opener func(connectionUrl string, options OpenOptions) (Store, error)
+
+// Wrapper wraps a store with additional behavior, such as retries or a cache. The params are the query parameters of
+// the url that the wrapper registered.
+type Wrapper func(s Store, params map[string]string) (Store, error)
+
+type wrapper struct {
+	params []string
+	wrap   Wrapper
+}
+
+var (
+	openers      = map[string]Opener{}
+	wrappers     = map[string]wrapper{}
+	wrapperOrder []string
+	registryLock sync.RWMutex
+)
+
+func init() {
+	Register("sftp", openSFTP)
+	Register("s3", plain(OpenS3))
+	Register("file", plain(OpenLocal))
+	Register("dav", plain(OpenWebDAV))
+	Register("davs", plain(OpenWebDAV))
+	Register("azure", plain(OpenAzure))
+	Register("azblob", plain(OpenAzureBlob))
+	Register("mem", plain(OpenMemory))
+	Register("mirror", openMirror)
+	Register("ec", openErasureCode)
+	Register("fault", plain(OpenFault))
+
+	RegisterWrapper("retry", retryParams, openRetry)
+	RegisterWrapper("cache", cacheParams, openCache)
+}
+
+// Register adds a backend for urls with the scheme, e.g. Register("myobj", OpenMyObj) for myobj://... urls.
+// A scheme registered again replaces the previous opener, built-in ones included.
+func Register(scheme string, opener Opener) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if opener == nil {
+		delete(openers, scheme)
+	} else {
+		openers[scheme] = opener
+	}
+}
+
+// plain adapts an opener that has no use for the options of the open
+func plain(open func(connectionUrl string) (Store, error)) Opener {
+	return func(connectionUrl string, _ OpenOptions) (Store, error) {
+		return open(connectionUrl)
+	}
+}
+
+// RegisterWrapper adds a wrapper that composes with any backend. The wrapper applies when the url scheme has it as
+// prefix, e.g. cache+retry+s3://, where the rightmost wrapper is the closest to the backend, or when the url has a
+// query parameter with the same name as the wrapper. The params are removed from the url and passed to the wrapper.
+func RegisterWrapper(scheme string, params []string, wrap Wrapper) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if !core.Contains(wrapperOrder, scheme) {
+		wrapperOrder = append(wrapperOrder, scheme)
+	}
+	if !core.Contains(params, scheme) {
+		params = append([]string{scheme}, params...)
+	}
+	wrappers[scheme] = wrapper{params, wrap}
+}
+
+// Schemes returns the registered backend and wrapper schemes
+func Schemes() (backends []string, wrapped []string) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	for scheme := range openers {
+		backends = append(backends, scheme)
+	}
+	sort.Strings(backends)
+	wrapped = append(wrapped, wrapperOrder...)
+	return backends, wrapped
+}
+
+// splitScheme separates the wrappers from the backend scheme of a url, e.g. cache+retry+s3://host returns
+// s3://host and [cache retry]
+func splitScheme(connectionUrl string) (string, []string) {
+	scheme, rest, ok := strings.Cut(connectionUrl, ":")
+	if !ok || !strings.Contains(scheme, "+") {
+		return connectionUrl, nil
+	}
+	layers := strings.Split(scheme, "+")
+	return layers[len(layers)-1] + ":" + rest, layers[:len(layers)-1]
+}
+
+// open opens the backend of the url with the registered opener for its scheme
+func open(connectionUrl string, options OpenOptions) (Store, error) {
+	scheme, _, _ := strings.Cut(connectionUrl, ":")
+
+	registryLock.RLock()
+	opener, ok := openers[scheme]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, core.Errorf("unsupported store schema in %s", Redact(connectionUrl))
+	}
+	return opener(connectionUrl, options)
+}
+
+// wrap applies the wrappers enabled by query parameters, in the order they are registered, and then the wrappers in
+// the scheme, from the rightmost one
+func wrap(s Store, layers []string, params map[string]string) (Store, error) {
+	registryLock.RLock()
+	var applied []wrapper
+	for _, name := range wrapperOrder {
+		if params[name] != "" && !core.Contains(layers, name) {
+			applied = append(applied, wrappers[name])
+		}
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		w, ok := wrappers[layers[i]]
+		if !ok {
+			registryLock.RUnlock()
+			return nil, core.Errorf("unsupported store wrapper %s", layers[i])
+		}
+		applied = append(applied, w)
+	}
+	registryLock.RUnlock()
+
+	for _, w := range applied {
+		wrapped, err := w.wrap(s, params)
+		if err != nil {
+			return nil, err
+		}
+		s = wrapped
+	}
+	return s, nil
+}
+
+// wrapperParams returns the query parameters of all the wrappers
+func wrapperParams() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	var params []string
+	for _, name := range wrapperOrder {
+		params = append(params, wrappers[name].params...)
+	}
+	return params
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+func TestRegister(t *testing.T) {
+	var opened string
+	Register("custom", func(connectionUrl string, _ OpenOptions) (Store, error) {
+		opened = connectionUrl
+		return OpenMemory("mem://custom")
+	})
+	defer Register("custom", nil)
+
+	s, err := Open("custom://host/path?x=1")
+	core.TestErr(t, err, "cannot open custom store: %v")
+	core.Assert(t, opened == "custom://host/path?x=1", "wrong url: %s", opened)
+	_, ok := s.(*Memory)
+	core.Assert(t, ok, "unexpected wrappers on %s", s)
+	s.Close()
+
+	// wrappers in the scheme compose with any backend, the rightmost being the closest to it
+	s, err = Open("cache+retry+custom://host/path?x=1&cache=" + t.TempDir())
+	core.TestErr(t, err, "cannot open wrapped custom store: %v")
+	core.Assert(t, opened == "custom://host/path?x=1", "wrong url: %s", opened)
+	c, ok := s.(*Cache)
+	core.Assert(t, ok, "expected cache, got %T", s)
+	r, ok := c.Unwrap().(*Retry)
+	core.Assert(t, ok, "expected retry, got %T", c.Unwrap())
+	core.Assert(t, r.attempts == DefaultRetryAttempts, "wrong attempts: %d", r.attempts)
+	RunConformance(t, s)
+	s.Close()
+
+	// wrappers in the query keep their order
+	s, err = Open("custom://host?retry=2")
+	core.TestErr(t, err, "cannot open custom store with retry: %v")
+	r, ok = s.(*Retry)
+	core.Assert(t, ok && r.attempts == 2, "expected retry with 2 attempts, got %T", s)
+	s.Close()
+
+	_, err = Open("unknown+custom://host")
+	core.Assert(t, err != nil, "unknown wrapper accepted")
+	Register("custom", nil)
+	_, err = Open("custom://host")
+	core.Assert(t, err != nil, "removed scheme still opens")
+
+	backends, wrappers := Schemes()
+	core.Assert(t, core.Contains(backends, "s3") && core.Contains(wrappers, "cache"), "missing built-in schemes")
+}
@@ -0,0 +1,521 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+const (
+	DefaultRetryBackoff    = 200 * time.Millisecond // DefaultRetryBackoff is the delay before the first retry
+	DefaultRetryMaxBackoff = 10 * time.Second       // DefaultRetryMaxBackoff is the maximal delay between retries
+	DefaultRetryAttempts   = 3                      // DefaultRetryAttempts is used when the retry scheme has no retry parameter
+)
+
+// retryParams are the URL parameters that enable and configure retries
+var retryParams = []string{"retry", "retryBackoff", "retryMaxBackoff", "timeout"}
+
+// Classifier is implemented by stores that can tell transient errors, which are worth a retry, from permanent ones
+type Classifier interface {
+	IsRetryable(err error) bool
+}
+
+// RetryStats collects the outcome of the operations on a retry store
+type RetryStats struct {
+	Operations int64 `json:"operations"` // Operations is the number of operations
+	Retries    int64 `json:"retries"`    // Retries is the number of retried attempts
+	Timeouts   int64 `json:"timeouts"`   // Timeouts is the number of attempts that exceeded the deadline
+	Failures   int64 `json:"failures"`   // Failures is the number of operations that failed after all the attempts
+}
+
+// Retry retries the operations on a store that fail with a transient error, using exponential backoff with jitter.
+// Each attempt can have a deadline.
+type Retry struct {
+	store      Store
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+	lock       sync.Mutex
+	stats      RetryStats
+	abandoned  int // abandoned is the number of attempts that exceeded the deadline and are still running
+}
+
+// MaxAbandonedAttempts bounds the attempts that exceeded their deadline and still run, since stores cannot interrupt
+// an operation. Once reached, new attempts fail at once until some of the abandoned ones return.
+var MaxAbandonedAttempts = 64
+
+// openRetry wraps the store with retries when the url contains the retry parameter, which is the maximal number of
+// attempts, or starts with retry+ (e.g. retry+sftp://...), which uses DefaultRetryAttempts. The optional retryBackoff and retryMaxBackoff define the delays between attempts (e.g. 200ms, 10s)
+// and timeout the deadline of each attempt (e.g. 30s, default is no deadline).
+func openRetry(store Store, params map[string]string) (Store, error) {
+	var err error
+	attempts := DefaultRetryAttempts
+	if v := params["retry"]; v != "" && v != "true" {
+		attempts, err = strconv.Atoi(v)
+	}
+	if err != nil || attempts < 1 {
+		return nil, core.Errorf("invalid number of attempts %s", params["retry"])
+	}
+
+	r := &Retry{
+		store:      store,
+		attempts:   attempts,
+		backoff:    DefaultRetryBackoff,
+		maxBackoff: DefaultRetryMaxBackoff,
+	}
+	for k, d := range map[string]*time.Duration{
+		"retryBackoff":    &r.backoff,
+		"retryMaxBackoff": &r.maxBackoff,
+		"timeout":         &r.timeout,
+	} {
+		if v := params[k]; v != "" {
+			*d, err = time.ParseDuration(v)
+			if err != nil || *d < 0 {
+				return nil, core.Errorf("invalid duration %s for %s", v, k)
+			}
+		}
+	}
+	return r, nil
+}
+
+// Stats returns the outcome of the operations since the store was opened
+func (r *Retry) Stats() RetryStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stats
+}
+
+// GetRetryStats returns the statistics of the retry layer in the store, if any
+func GetRetryStats(s Store) (RetryStats, bool) {
+	for s != nil {
+		if r, ok := s.(*Retry); ok {
+			return r.Stats(), true
+		}
+		s = Unwrap(s)
+	}
+	return RetryStats{}, false
+}
+
+// Unwrap returns the store wrapped by a cache, retry or sub store, or nil
+func Unwrap(s Store) Store {
+	switch w := s.(type) {
+	case interface{ Unwrap() Store }:
+		return w.Unwrap()
+	case *sub:
+		return w.Store
+	}
+	return nil
+}
+
+func (r *Retry) Unwrap() Store {
+	return r.store
+}
+
+func (r *Retry) count(f func(s *RetryStats)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f(&r.stats)
+}
+
+// isRetryable classifies an error with the wrapped store when possible
+func (r *Retry) isRetryable(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	for w := r.store; w != nil; w = Unwrap(w) {
+		if c, ok := w.(Classifier); ok {
+			return c.IsRetryable(err)
+		}
+	}
+	return isTransient(err)
+}
+
+// isTransient is the default classification for network errors
+func isTransient(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrExist), errors.Is(err, fs.ErrPermission),
+		errors.Is(err, fs.ErrInvalid):
+		return false
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ETIMEDOUT):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// delay returns the backoff before the provided attempt, with a random jitter of up to 50%
+func (r *Retry) delay(attempt int) time.Duration {
+	d := r.backoff
+	for i := 1; i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// call runs an attempt with the deadline of the store. On timeout the attempt is abandoned: the abandon function
+// stops its transfer, if any, and the returned channel receives its result once it returns. The attempt after an
+// abandoned one waits up to another deadline for it, so that attempts on the same file do not overlap unless the
+// store hangs.
+func (r *Retry) call(f func() error, abandon func(), prev chan error) (chan error, error) {
+	if r.timeout == 0 {
+		return nil, f()
+	}
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-time.After(r.timeout):
+		}
+	}
+
+	r.lock.Lock()
+	if r.abandoned >= MaxAbandonedAttempts {
+		r.stats.Timeouts++
+		r.lock.Unlock()
+		return nil, os.ErrDeadlineExceeded
+	}
+	r.lock.Unlock()
+
+	var lock sync.Mutex
+	var finished, abandoned bool
+	done := make(chan error, 1)
+	go func() {
+		err := f()
+		lock.Lock()
+		finished = true
+		if abandoned {
+			r.count(func(s *RetryStats) { r.abandoned-- })
+		}
+		lock.Unlock()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return nil, err
+	case <-time.After(r.timeout):
+		lock.Lock()
+		defer lock.Unlock()
+		if finished {
+			return nil, <-done
+		}
+		abandoned = true
+		if abandon != nil {
+			abandon()
+		}
+		r.count(func(s *RetryStats) {
+			s.Timeouts++
+			r.abandoned++
+		})
+		return done, os.ErrDeadlineExceeded
+	}
+}
+
+// attempt prepares an operation in the calling goroutine and returns the function that performs it and the function
+// that stops it when the deadline expires, if any
+type attempt func() (run func() error, abandon func())
+
+// do runs an operation until it succeeds, the error is permanent or the attempts are exhausted
+func (r *Retry) do(op, name string, next attempt) error {
+	r.count(func(s *RetryStats) { s.Operations++ })
+	var prev chan error
+	for i := 1; ; i++ {
+		run, abandon := next()
+		var err error
+		prev, err = r.call(run, abandon, prev)
+		if err == nil {
+			return nil
+		}
+		if i >= r.attempts || !r.isRetryable(err) {
+			if i > 1 || r.isRetryable(err) {
+				r.count(func(s *RetryStats) { s.Failures++ })
+			}
+			return err
+		}
+
+		d := r.delay(i)
+		core.Info("attempt %d of %s %s on %s failed, retrying in %s: %v", i, op, name, r.store, d, err)
+		r.count(func(s *RetryStats) { s.Retries++ })
+		time.Sleep(d)
+	}
+}
+
+// guardedWriter counts the bytes written and stops writing once the attempt is abandoned
+type guardedWriter struct {
+	lock      sync.Mutex
+	w         io.Writer
+	written   int64
+	abandoned bool
+}
+
+func (g *guardedWriter) Write(p []byte) (int, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.abandoned {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := g.w.Write(p)
+	g.written += int64(n)
+	return n, err
+}
+
+func (g *guardedWriter) abandon() int64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.abandoned = true
+	return g.written
+}
+
+// guardedReader stops reading from the source once the attempt is abandoned
+type guardedReader struct {
+	lock      sync.Mutex
+	r         io.ReadSeeker
+	abandoned bool
+}
+
+func (g *guardedReader) Read(p []byte) (int, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.abandoned {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return g.r.Read(p)
+}
+
+func (g *guardedReader) Seek(offset int64, whence int) (int64, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.abandoned {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return g.r.Seek(offset, whence)
+}
+
+func (g *guardedReader) abandon() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.abandoned = true
+}
+
+// Read retries a failed read from the first byte that was not received
+func (r *Retry) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	var received int64
+	var g *guardedWriter
+	return r.do("read", name, func() (func() error, func()) {
+		if g != nil {
+			received += g.abandon()
+		}
+		g = &guardedWriter{w: dest}
+		w, offset := g, received
+		run := func() error {
+			if offset == 0 {
+				return r.store.Read(name, rang, w, progress)
+			}
+			next := &Range{From: offset}
+			if rang != nil {
+				next.From, next.To = rang.From+offset, rang.To
+			} else {
+				stat, err := r.store.Stat(name)
+				if err != nil {
+					return err
+				}
+				next.To = stat.Size()
+			}
+			return r.store.Read(name, next, w, progress)
+		}
+		return run, func() { w.abandon() }
+	})
+}
+
+// Write retries a failed write from the original position of the source
+func (r *Retry) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	start, err := source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	var g *guardedReader
+	return r.do("write", name, func() (func() error, func()) {
+		if g != nil {
+			g.abandon()
+		}
+		g = &guardedReader{r: source}
+		rd := g
+		run := func() error {
+			_, err := rd.Seek(start, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			return r.store.Write(name, rd, progress)
+		}
+		return run, rd.abandon
+	})
+}
+
+// WriteIf retries a failed conditional write from the original position of the source. When an abandoned attempt
+// completes after all, the next attempt may find the condition not met
+func (r *Retry) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	start, err := source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	var g *guardedReader
+	return r.do("writeIf", name, func() (func() error, func()) {
+		if g != nil {
+			g.abandon()
+		}
+		g = &guardedReader{r: source}
+		rd := g
+		run := func() error {
+			_, err := rd.Seek(start, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			return WriteIf(r.store, name, rd, cond, progress)
+		}
+		return run, rd.abandon
+	})
+}
+
+// WriteResumable retries a failed upload from the last saved state, so that the parts already uploaded are not sent
+// again. Abandoned attempts do not update the state
+func (r *Retry) WriteResumable(name string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	var lock sync.Mutex
+	var g *guardedReader
+	return r.do("writeResumable", name, func() (func() error, func()) {
+		if g != nil {
+			g.abandon()
+		}
+		g = &guardedReader{r: source}
+		rd, stop := g, new(bool)
+
+		lock.Lock()
+		u := *upload
+		u.Parts = append([]string(nil), upload.Parts...)
+		lock.Unlock()
+
+		saveAttempt := func(state Upload) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if *stop {
+				return os.ErrDeadlineExceeded
+			}
+			*upload = state
+			upload.Parts = append([]string(nil), state.Parts...)
+			if save != nil {
+				return save(state)
+			}
+			return nil
+		}
+		run := func() error {
+			return WriteResumable(r.store, name, rd, &u, saveAttempt, progress)
+		}
+		return run, func() {
+			lock.Lock()
+			*stop = true
+			lock.Unlock()
+			rd.abandon()
+		}
+	})
+}
+
+// AbortUpload retries a failed discard of the parts of an upload
+func (r *Retry) AbortUpload(name string, upload Upload) error {
+	return r.do("abortUpload", name, func() (func() error, func()) {
+		return func() error {
+			return AbortUpload(r.store, name, upload)
+		}, nil
+	})
+}
+
+func (r *Retry) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
+	var lock sync.Mutex
+	var ls []fs.FileInfo
+	err := r.do("readDir", dir, func() (func() error, func()) {
+		return func() error {
+			l, err := r.store.ReadDir(dir, filter)
+			if err == nil {
+				lock.Lock()
+				ls = l
+				lock.Unlock()
+			}
+			return err
+		}, nil
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+	return ls, err
+}
+
+func (r *Retry) Stat(name string) (os.FileInfo, error) {
+	var lock sync.Mutex
+	var stat os.FileInfo
+	err := r.do("stat", name, func() (func() error, func()) {
+		return func() error {
+			s, err := r.store.Stat(name)
+			if err == nil {
+				lock.Lock()
+				stat = s
+				lock.Unlock()
+			}
+			return err
+		}, nil
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+	return stat, err
+}
+
+// Delete retries a failed delete. A missing file after a retry is considered deleted by the previous attempt
+func (r *Retry) Delete(name string) error {
+	var attempts int
+	err := r.do("delete", name, func() (func() error, func()) {
+		attempts++
+		return func() error {
+			return r.store.Delete(name)
+		}, nil
+	})
+	if attempts > 1 && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (r *Retry) ID() string {
+	return r.store.ID()
+}
+
+func (r *Retry) Close() error {
+	return r.store.Close()
+}
+
+func (r *Retry) String() string {
+	return r.store.String()
+}
+
+func (r *Retry) Describe() Description {
+	return r.store.Describe()
+}
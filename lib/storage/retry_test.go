@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+// flaky fails the first operations with a transient error after a partial transfer. Abandoned attempts keep running,
+// so the fields are guarded by the lock
+type flaky struct {
+	Store
+	lock     sync.Mutex
+	failures int
+	delay    time.Duration
+}
+
+func (f *flaky) set(failures int, delay time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures, f.delay = failures, delay
+}
+
+func (f *flaky) remaining() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.failures
+}
+
+// fail tells whether the operation must fail and counts the failure
+func (f *flaky) fail() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return true
+	}
+	return false
+}
+
+func (f *flaky) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	f.lock.Lock()
+	delay := f.delay
+	f.lock.Unlock()
+	time.Sleep(delay)
+	if f.fail() {
+		var b bytes.Buffer
+		err := f.Store.Read(name, rang, &b, nil)
+		if err != nil {
+			return err
+		}
+		dest.Write(b.Bytes()[:b.Len()/2])
+		return syscall.ECONNRESET
+	}
+	return f.Store.Read(name, rang, dest, progress)
+}
+
+func (f *flaky) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	if f.fail() {
+		io.CopyN(io.Discard, source, 3)
+		return syscall.ECONNRESET
+	}
+	return f.Store.Write(name, source, progress)
+}
+
+// strict classifies all errors as permanent
+type strict struct {
+	*flaky
+}
+
+func (s strict) IsRetryable(err error) bool {
+	return false
+}
+
+func TestRetry(t *testing.T) {
+	m, err := OpenMemory("mem://retry")
+	core.TestErr(t, err, "cannot open memory store: %v")
+	f := &flaky{Store: m}
+	r, err := openRetry(f, map[string]string{"retry": "3", "retryBackoff": "1ms"})
+	core.TestErr(t, err, "cannot open retry store: %v")
+
+	f.set(2, 0)
+	err = WriteFile(r, "a.txt", []byte("hello world"))
+	core.TestErr(t, err, "cannot write file: %v")
+
+	// reads resume from the first missing byte
+	f.set(2, 0)
+	data, err := ReadFile(r, "a.txt")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "hello world", "wrong data: %s", data)
+
+	f.set(1, 0)
+	var b bytes.Buffer
+	err = r.Read("a.txt", &Range{From: 2, To: 10}, &b, nil)
+	core.TestErr(t, err, "cannot read range: %v")
+	core.Assert(t, b.String() == "llo worl", "wrong range: %s", b.String())
+
+	f.set(5, 0)
+	_, err = ReadFile(r, "a.txt")
+	core.Assert(t, err == syscall.ECONNRESET, "expected failure after all attempts: %v", err)
+	f.set(0, 0)
+
+	_, err = ReadFile(r, "missing.txt")
+	core.Assert(t, os.IsNotExist(err), "expected not exist: %v", err)
+
+	stats, ok := GetRetryStats(r)
+	core.Assert(t, ok, "missing retry stats")
+	core.Assert(t, stats.Operations == 5 && stats.Retries == 7 && stats.Failures == 1, "wrong stats: %v", stats)
+
+	// attempts that exceed the deadline are abandoned
+	r, err = openRetry(f, map[string]string{"retry": "2", "retryBackoff": "1ms", "timeout": "20ms"})
+	core.TestErr(t, err, "cannot open retry store: %v")
+	f.set(0, 50*time.Millisecond)
+	_, err = ReadFile(r, "a.txt")
+	core.Assert(t, err == os.ErrDeadlineExceeded, "expected timeout: %v", err)
+	stats, _ = GetRetryStats(r)
+	core.Assert(t, stats.Timeouts == 2, "wrong number of timeouts: %d", stats.Timeouts)
+
+	// attempts wait for the abandoned one and no more than MaxAbandonedAttempts keep running
+	maxAbandoned := MaxAbandonedAttempts
+	defer func() { MaxAbandonedAttempts = maxAbandoned }()
+	MaxAbandonedAttempts = 1
+	r, err = openRetry(f, map[string]string{"retry": "3", "retryBackoff": "1ms", "timeout": "20ms"})
+	core.TestErr(t, err, "cannot open retry store: %v")
+	f.set(0, 100*time.Millisecond)
+	_, err = ReadFile(r, "a.txt")
+	core.Assert(t, err == os.ErrDeadlineExceeded, "expected timeout: %v", err)
+	rs := r.(*Retry)
+	rs.lock.Lock()
+	abandoned := rs.abandoned
+	rs.lock.Unlock()
+	core.Assert(t, abandoned == 1, "wrong number of abandoned attempts: %d", abandoned)
+	time.Sleep(150 * time.Millisecond)
+	rs.lock.Lock()
+	abandoned = rs.abandoned
+	rs.lock.Unlock()
+	core.Assert(t, abandoned == 0, "abandoned attempts still counted: %d", abandoned)
+	f.set(0, 0)
+
+	// the classifier of a store under other layers decides what is retried
+	r, err = openRetry(Sub(strict{f}, "sub", false), map[string]string{"retry": "3", "retryBackoff": "1ms"})
+	core.TestErr(t, err, "cannot open retry store: %v")
+	f.set(2, 0)
+	err = WriteFile(r, "a.txt", []byte("hello world"))
+	core.Assert(t, err == syscall.ECONNRESET, "expected permanent failure: %v", err)
+	core.Assert(t, f.remaining() == 1, "permanent failure retried: %d", f.remaining())
+}
+
+// dropping fails once with a transient error when the read reaches failAt
+type dropping struct {
+	io.ReadSeeker
+	failAt int64
+}
+
+func (d *dropping) Read(p []byte) (int, error) {
+	pos, _ := d.Seek(0, io.SeekCurrent)
+	if d.failAt > 0 && pos+int64(len(p)) > d.failAt {
+		d.failAt = 0
+		return 0, syscall.ECONNRESET
+	}
+	return d.ReadSeeker.Read(p)
+}
+
+func TestRetryResumable(t *testing.T) {
+	m, err := OpenMemory("mem://retry-resumable")
+	core.TestErr(t, err, "cannot open memory store: %v")
+	r, err := openRetry(m, map[string]string{"retry": "3", "retryBackoff": "1ms"})
+	core.TestErr(t, err, "cannot open retry store: %v")
+
+	partSize := PartSize
+	PartSize = 1024
+	defer func() { PartSize = partSize }()
+
+	data := core.GenerateRandomBytes(10*1024 + 100)
+	var saved []Upload
+	save := func(u Upload) error { saved = append(saved, u); return nil }
+
+	// the second attempt continues from the last saved part
+	var upload Upload
+	progress, total := collect()
+	err = WriteResumable(r, "a", &dropping{core.NewBytesReader(data), 3500}, &upload, save, progress)
+	core.TestErr(t, err, "cannot write with retries: %v")
+	core.Assert(t, total() == int64(len(data)), "parts uploaded again after retry")
+	core.Assert(t, upload.Offset == int64(len(data)), "wrong final state: %v", upload)
+	for i := 1; i < len(saved); i++ {
+		core.Assert(t, saved[i].Offset > saved[i-1].Offset, "upload restarted: %v", saved)
+	}
+
+	got, err := ReadFile(r, "a")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, bytes.Equal(got, data), "wrong content after retry")
+
+	err = AbortUpload(r, "a", Upload{ID: "missing"})
+	core.TestErr(t, err, "cannot abort upload: %v")
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/aws/smithy-go/logging"
 	"github.com/sirupsen/logrus"
@@ -37,17 +39,21 @@ func (l s3logger) Logf(classification logging.Classification, format string, v .
 
 func OpenS3(connectionUrl string) (Store, error) {
 	u, err := url.Parse(connectionUrl)
-	if core.IsErr(err, "invalid url '%s': %v", connectionUrl) {
+	if core.IsErr(err, "invalid url '%s': %v", Redact(connectionUrl)) {
 		return nil, err
 	}
 
+	q := u.Query()
+	scheme := "https"
+	if q.Get("tls") == "false" {
+		scheme = "http"
+	}
 	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 		return aws.Endpoint{
-			URL: fmt.Sprintf("https://%s", u.Host),
+			URL: fmt.Sprintf("%s://%s", scheme, u.Host),
 		}, nil
 	})
 
-	q := u.Query()
 	verbose := q.Get("v")
 	accessKey := q.Get("a")
 	secret := q.Get("s")
@@ -59,7 +65,7 @@ func OpenS3(connectionUrl string) (Store, error) {
 
 	parts := strings.Split(strings.TrimLeft(u.Path, "/"), "/")
 	if len(parts) == 0 {
-		return nil, core.Errorf("missing bucket in %s", connectionUrl)
+		return nil, core.Errorf("missing bucket in %s", Redact(connectionUrl))
 	}
 	bucket := parts[0]
 	dir := strings.Join(parts[1:], "/")
@@ -98,8 +104,10 @@ func OpenS3(connectionUrl string) (Store, error) {
 		return nil, err
 	}
 
+	// local services such as MinIO need the bucket in the path instead of the host name
+	pathStyle := q.Get("pathStyle") == "true"
 	s := &S3{
-		client: s3.NewFromConfig(cfg),
+		client: s3.NewFromConfig(cfg, func(o *s3.Options) { o.UsePathStyle = pathStyle }),
 		id:     repr,
 		bucket: bucket,
 		dir:    dir,
@@ -133,24 +141,30 @@ func (s *S3) createBucketIfNeeded() error {
 func (s *S3) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
 	name = path.Join(s.dir, name)
 
-	rawObject, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: &s.bucket,
 		Key:    &name,
-		//		Range:  r,
-	})
+	}
+	if rang != nil {
+		if rang.To <= rang.From {
+			return nil
+		}
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", rang.From, rang.To-1))
+	}
+
+	rawObject, err := s.client.GetObject(context.TODO(), input)
 	if err != nil {
 		err = s.mapError(err)
 		if os.IsNotExist(err) || core.IsErr(err, "cannot read %s/%s: %v", s, name) {
 			return err
 		}
 	}
+	defer rawObject.Body.Close()
 
-	_, err = io.Copy(dest, rawObject.Body)
+	_, err = io.Copy(&progressWriter{w: dest, progress: progress}, rawObject.Body)
 	if core.IsErr(err, "cannot read %s/%s: %v", s, name) {
 		return err
 	}
-
-	rawObject.Body.Close()
 	return nil
 }
 
@@ -163,13 +177,98 @@ func (s *S3) Write(name string, source io.ReadSeeker, progress chan int64) error
 	}
 	source.Seek(0, io.SeekStart)
 
+	// the client may read the source more than once to sign the request, so progress is reported at the end
 	_, err = s.client.PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket:        &s.bucket,
 		Key:           &name,
 		Body:          source,
 		ContentLength: &size,
 	})
-	core.IsErr(err, "cannot write %s/%s: %v", s, name)
+	if core.IsErr(err, "cannot write %s/%s: %v", s, name) {
+		return s.mapError(err)
+	}
+	if progress != nil {
+		progress <- size
+	}
+	return nil
+}
+
+// WriteResumable uploads the file with S3 multipart. The ETags of the uploaded parts are kept in the upload state, so
+// that the upload can be completed after a restart
+func (s *S3) WriteResumable(name string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	key := path.Join(s.dir, name)
+
+	resumed := upload.ID != ""
+	err := s.writeParts(key, source, upload, save, progress)
+	var noSuchUpload *types.NoSuchUpload
+	if resumed && errors.As(err, &noSuchUpload) {
+		core.Info("multipart upload of %s/%s expired, starting again", s, name)
+		*upload = Upload{}
+		err = s.writeParts(key, source, upload, save, progress)
+	}
+	if core.IsErr(err, "cannot upload %s/%s: %v", s, name) {
+		return s.mapError(err)
+	}
+	return nil
+}
+
+func (s *S3) writeParts(key string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	if upload.ID == "" {
+		res, err := s.client.CreateMultipartUpload(context.TODO(), &s3.CreateMultipartUploadInput{
+			Bucket: &s.bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return err
+		}
+		*upload = Upload{ID: *res.UploadId}
+	}
+
+	err := uploadParts(source, upload, save, progress, func(part []byte) (string, error) {
+		size := int64(len(part))
+		res, err := s.client.UploadPart(context.TODO(), &s3.UploadPartInput{
+			Bucket:        &s.bucket,
+			Key:           &key,
+			UploadId:      &upload.ID,
+			PartNumber:    aws.Int32(int32(len(upload.Parts) + 1)),
+			Body:          bytes.NewReader(part),
+			ContentLength: &size,
+		})
+		if err != nil {
+			return "", err
+		}
+		return *res.ETag, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []types.CompletedPart
+	for i, etag := range upload.Parts {
+		parts = append(parts, types.CompletedPart{ETag: aws.String(etag), PartNumber: aws.Int32(int32(i + 1))})
+	}
+	_, err = s.client.CompleteMultipartUpload(context.TODO(), &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        &upload.ID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+func (s *S3) AbortUpload(name string, upload Upload) error {
+	key := path.Join(s.dir, name)
+	_, err := s.client.AbortMultipartUpload(context.TODO(), &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		UploadId: &upload.ID,
+	})
+	var noSuchUpload *types.NoSuchUpload
+	if errors.As(err, &noSuchUpload) {
+		return nil
+	}
 	return s.mapError(err)
 }
 
@@ -264,6 +363,23 @@ func (s *S3) mapError(err error) error {
 	}
 }
 
+// IsRetryable returns true for throttling, timeouts and server errors
+func (s *S3) IsRetryable(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable", "Throttling", "ThrottlingException":
+			return true
+		}
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		code := respErr.HTTPStatusCode()
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+	}
+	return isTransient(err)
+}
+
 func (s *S3) Stat(name string) (fs.FileInfo, error) {
 	name = path.Join(s.dir, name)
 
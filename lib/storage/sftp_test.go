@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stregato/stash/lib/core"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newTestKey generates an ed25519 key
+func newTestKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	core.TestErr(t, err, "cannot generate key: %v")
+	signer, err := ssh.NewSignerFromKey(private)
+	core.TestErr(t, err, "cannot create signer: %v")
+	return private, signer
+}
+
+// startTestSFTPServer runs an SFTP server on a random local port that accepts the password "secret" and the user key
+func startTestSFTPServer(t *testing.T, hostKey ssh.Signer, userKey ssh.PublicKey) string {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password for %s", c.User())
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", c.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	core.TestErr(t, err, "cannot listen: %v")
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTP(conn, config)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveTestSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	hostKeys := HostKeys
+	HostKeys = &memoryHostKeys{keys: map[string][]byte{}}
+	defer func() { HostKeys = hostKeys }()
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	_, hostKey := newTestKey(t)
+	userPrivate, userKey := newTestKey(t)
+	addr := startTestSFTPServer(t, hostKey, userKey.PublicKey())
+
+	dir := t.TempDir()
+	base := fmt.Sprintf("sftp://user:secret@%s%s?knownHosts=%s", addr, filepath.ToSlash(dir),
+		url.QueryEscape(filepath.Join(dir, "known_hosts")))
+
+	// the host key is trusted on first use
+	s, err := Open(base)
+	core.TestErr(t, err, "cannot open sftp: %v")
+	RunConformance(t, s)
+	s.Close()
+
+	_, otherKey := newTestKey(t)
+	HostKeys.SetHostKey(knownhosts.Normalize(addr), otherKey.PublicKey().Marshal())
+	_, err = Open(base)
+	core.Assert(t, errors.Is(err, ErrHostKeyMismatch), "expected host key mismatch, got %v", err)
+
+	// a pinned fingerprint replaces the trusted key
+	fp := url.QueryEscape(ssh.FingerprintSHA256(hostKey.PublicKey()))
+	s, err = Open(base + "&fp=" + fp)
+	core.TestErr(t, err, "cannot open sftp with pinned fingerprint: %v")
+	s.Close()
+	_, err = Open(base + "&fp=" + url.QueryEscape(ssh.FingerprintSHA256(otherKey.PublicKey())))
+	core.Assert(t, errors.Is(err, ErrHostKeyMismatch), "expected host key mismatch, got %v", err)
+
+	// a known_hosts file has precedence over the trusted keys
+	line := fmt.Sprintf("%s %s", knownhosts.Normalize(addr), ssh.MarshalAuthorizedKey(hostKey.PublicKey()))
+	err = os.WriteFile(filepath.Join(dir, "known_hosts"), []byte(line), 0600)
+	core.TestErr(t, err, "cannot write known hosts: %v")
+	s, err = Open(base)
+	core.TestErr(t, err, "cannot open sftp with known hosts: %v")
+	s.Close()
+	os.Remove(filepath.Join(dir, "known_hosts"))
+	HostKeys = &memoryHostKeys{keys: map[string][]byte{}}
+
+	// the host keys of an open stay in the store of its options
+	own := &memoryHostKeys{keys: map[string][]byte{}}
+	s, err = OpenWith("retry+"+base, OpenOptions{HostKeys: own})
+	core.TestErr(t, err, "cannot open sftp with own host keys: %v")
+	s.Close()
+	_, ok := own.GetHostKey(knownhosts.Normalize(addr))
+	core.Assert(t, ok, "host key not trusted in the store of the options")
+	_, ok = HostKeys.GetHostKey(knownhosts.Normalize(addr))
+	core.Assert(t, !ok, "host key trusted in the package store")
+
+	// private key in the url and in a file
+	block, err := ssh.MarshalPrivateKey(userPrivate, "")
+	core.TestErr(t, err, "cannot marshal private key: %v")
+	pemKey := pem.EncodeToMemory(block)
+	noPassword := fmt.Sprintf("sftp://user@%s%s?knownHosts=%s", addr, filepath.ToSlash(dir),
+		url.QueryEscape(filepath.Join(dir, "known_hosts")))
+	s, err = Open(noPassword + "&k=" + url.QueryEscape(base64.StdEncoding.EncodeToString(pemKey)))
+	core.TestErr(t, err, "cannot open sftp with key: %v")
+	s.Close()
+
+	keyFile := filepath.Join(dir, "id_ed25519")
+	err = os.WriteFile(keyFile, pemKey, 0600)
+	core.TestErr(t, err, "cannot write key: %v")
+	s, err = Open(noPassword + "&key=" + url.QueryEscape(keyFile))
+	core.TestErr(t, err, "cannot open sftp with key file: %v")
+	s.Close()
+
+	// ssh-agent
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: userPrivate})
+	core.TestErr(t, err, "cannot add key to agent: %v")
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	core.TestErr(t, err, "cannot listen on agent socket: %v")
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	s, err = Open(noPassword + "&agent=true")
+	core.TestErr(t, err, "cannot open sftp with agent: %v")
+	s.Close()
+
+	_, err = Open(fmt.Sprintf("sftp://user:wrong@%s%s", addr, filepath.ToSlash(dir)))
+	core.Assert(t, err != nil, "wrong password accepted")
+}
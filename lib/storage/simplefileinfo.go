@@ -13,7 +13,18 @@ func matchFilter(f fs.FileInfo, filter Filter) bool {
 		(filter.After.IsZero() || f.ModTime().After(filter.After)) &&
 		name > filter.AfterName &&
 		(!filter.OnlyFiles || !f.IsDir()) &&
-		(!filter.OnlyFolders || f.IsDir())
+		(!filter.OnlyFolders || f.IsDir()) &&
+		(filter.Function == nil || filter.Function(f))
+}
+
+// Match returns true when the file passes the filter
+func (filter Filter) Match(f fs.FileInfo) bool {
+	return matchFilter(f, filter)
+}
+
+// NewFileInfo returns the information of a file, for stores implemented outside this package
+func NewFileInfo(name string, size int64, isDir bool, modTime time.Time) fs.FileInfo {
+	return simpleFileInfo{name: name, size: size, isDir: isDir, modTime: modTime}
 }
 
 type simpleFileInfo struct {
@@ -13,15 +13,51 @@ import (
 
 func TestS3(t *testing.T) {
 	credentials := LoadTestURLs()
+	if credentials["s3"] == "" {
+		t.Skip("no s3 url in the test urls")
+	}
 	testStore(t, credentials["s3"])
 
 }
 
 func TestWebdav(t *testing.T) {
 	credentials := LoadTestURLs()
+	if credentials["dav"] == "" {
+		t.Skip("no dav url in the test urls")
+	}
 	testStore(t, credentials["dav"])
 }
 
+func TestAzureBlob(t *testing.T) {
+	credentials := LoadTestURLs()
+	if credentials["azblob"] == "" {
+		t.Skip("no azblob url, e.g. an Azurite emulator, in the test urls")
+	}
+	testStore(t, credentials["azblob"])
+}
+
+func TestWriteIf(t *testing.T) {
+	s, err := Open("mem://writeif")
+	core.TestErr(t, err, "cannot open store: %v", err)
+	defer s.Close()
+
+	err = WriteIf(s, "a", core.NewBytesReader([]byte("first")), Condition{IfNotExists: true}, nil)
+	core.TestErr(t, err, "cannot write new file: %v", err)
+	err = WriteIf(s, "a", core.NewBytesReader([]byte("second")), Condition{IfNotExists: true}, nil)
+	core.Assert(t, err == ErrConditionNotMet, "expected condition not met, got %v", err)
+
+	stat, err := s.Stat("a")
+	core.TestErr(t, err, "cannot stat file: %v", err)
+	err = WriteIf(s, "a", core.NewBytesReader([]byte("third")), Condition{IfUnmodifiedSince: stat.ModTime()}, nil)
+	core.TestErr(t, err, "cannot write unmodified file: %v", err)
+	err = WriteIf(s, "a", core.NewBytesReader([]byte("fourth")), Condition{IfUnmodifiedSince: stat.ModTime().Add(-time.Second)}, nil)
+	core.Assert(t, err == ErrConditionNotMet, "expected condition not met, got %v", err)
+
+	data, err := ReadFile(s, "a")
+	core.TestErr(t, err, "cannot read file: %v", err)
+	core.Assert(t, string(data) == "third", "wrong content %s", data)
+}
+
 func testStore(t *testing.T, url string) {
 	s, err := Open(url)
 	core.TestErr(t, err, "cannot open store: %v", err)
@@ -141,3 +177,32 @@ func testReadWrite(t *testing.T, s Store) {
 		core.TestErr(t, err, "cannot delete file: %v", err)
 	}
 }
+
+func TestWriteResumable(t *testing.T) {
+	s, err := Open("mem://resumable")
+	core.TestErr(t, err, "cannot open store: %v", err)
+	defer s.Close()
+
+	partSize := PartSize
+	PartSize = 1024
+	defer func() { PartSize = partSize }()
+
+	data := core.GenerateRandomBytes(10*1024 + 100)
+	var saved []Upload
+	save := func(u Upload) error { saved = append(saved, u); return nil }
+
+	var upload Upload
+	err = WriteResumable(s, "a", &brokenReader{core.NewBytesReader(data), 3500}, &upload, save, nil)
+	core.Assert(t, err != nil, "interrupted upload did not fail")
+	core.Assert(t, len(saved) == 3 && saved[2].Offset == 3072, "wrong saved state: %v", saved)
+
+	progress, total := collect()
+	err = WriteResumable(s, "a", core.NewBytesReader(data), &upload, save, progress)
+	core.TestErr(t, err, "cannot resume upload: %v", err)
+	core.Assert(t, total() == int64(len(data))-3072, "resumed upload did not start from the offset")
+	core.Assert(t, saved[len(saved)-1].Offset == int64(len(data)), "wrong final state: %v", saved[len(saved)-1])
+
+	got, err := ReadFile(s, "a")
+	core.TestErr(t, err, "cannot read file: %v", err)
+	core.Assert(t, bytes.Equal(got, data), "wrong content after resume")
+}
@@ -1,11 +1,14 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -30,8 +33,8 @@ const (
 )
 
 type Range struct {
-	From int64
-	To   int64
+	From int64 `json:"from"` // From is the first byte
+	To   int64 `json:"to"`   // To is the byte after the last one
 }
 
 type Filter struct {
@@ -79,45 +82,125 @@ type Store interface {
 	Describe() Description
 }
 
-// Open creates a new exchanger giving a provided configuration
-func Open(connectionUrl string) (Store, error) {
-	switch {
-	case strings.HasPrefix(connectionUrl, "sftp://"):
-		return OpenSFTP(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "s3://"):
-		return OpenS3(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "file:/"):
-		return OpenLocal(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "dav://"):
-		return OpenWebDAV(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "davs://"):
-		return OpenWebDAV(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "mem://"):
-		return OpenMemory(connectionUrl)
+// ErrConditionNotMet is returned by a conditional write when the condition does not hold
+var ErrConditionNotMet = errors.New("write condition not met")
+
+// Condition restricts a write to a file that does not exist yet or that was not modified after a time
+type Condition struct {
+	IfNotExists       bool      // IfNotExists requires the file not to exist
+	IfUnmodifiedSince time.Time // IfUnmodifiedSince requires the file not to be modified after the time, when not zero
+}
+
+// ConditionalWriter is implemented by stores that can check a condition and write a file atomically
+type ConditionalWriter interface {
+	// WriteIf writes the file when the condition holds, otherwise it returns ErrConditionNotMet
+	WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error
+}
+
+// WriteIf writes a file with a condition on the store or on the first wrapped store that supports it
+func WriteIf(s Store, name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	for w := s; w != nil; w = Unwrap(w) {
+		if c, ok := w.(ConditionalWriter); ok {
+			return c.WriteIf(name, source, cond, progress)
+		}
 	}
+	return core.Errorf("store %s does not support conditional writes", s)
+}
 
-	return nil, core.Errorf("unsupported store schema in %s", connectionUrl)
+// OpenOptions are the settings of an open that belong to the caller, e.g. a safe and its DB, rather than to the process
+type OpenOptions struct {
+	HostKeys    HostKeyStore       // HostKeys keeps the SFTP host keys trusted on first use; when nil, the package HostKeys
+	Credentials CredentialProvider // Credentials takes the place of the provider of the DBProvider kind, when not nil
 }
 
-func LoadTestURLs() (urls map[string]string) {
-	homeDir, err := os.UserHomeDir()
-	if core.IsErr(err, "cannot get user home dir: %v", err) {
-		panic(err)
+// Open creates a new exchanger giving a provided configuration. The backend is chosen by the url scheme among the
+// registered ones (see Register). The cred parameter references the credentials of the store by name (see
+// GetCredentials). Wrappers such as retries (see openRetry) and a local cache (see openCache) apply when the scheme
+// has them as prefix, e.g. cache+retry+s3://, or when the url contains their parameter, e.g. retry=3
+func Open(connectionUrl string) (Store, error) {
+	return OpenWith(connectionUrl, OpenOptions{})
+}
+
+// OpenWith opens a store like Open with the provided options, which apply also to the stores in a mirror or erasure
+// code url
+func OpenWith(connectionUrl string, options OpenOptions) (Store, error) {
+	connectionUrl, layers := splitScheme(connectionUrl)
+	connectionUrl, params := splitParams(connectionUrl, append([]string{"cred"}, wrapperParams()...))
+	if params["cred"] != "" {
+		var err error
+		connectionUrl, err = applyCredentials(connectionUrl, params["cred"], options.Credentials)
+		if err != nil {
+			return nil, err
+		}
 	}
-	filename := path.Join(homeDir, "stash_test_urls.yaml")
-	_, err = os.Stat(filename)
+	s, err := open(connectionUrl, options)
 	if err != nil {
-		filename = "../test_urls.yaml"
+		return nil, err
 	}
 
-	data, err := os.ReadFile(filename)
-	if core.IsErr(err, "cannot read file %s: %v", filename) {
-		panic(err)
+	wrapped, err := wrap(s, layers, params)
+	if err != nil {
+		s.Close()
+		return nil, err
 	}
+	return wrapped, nil
+}
 
-	err = yaml.Unmarshal(data, &urls)
-	if core.IsErr(err, "cannot parse file %s: %v", filename) {
-		panic(err)
+// splitParams removes the provided keys from the query of the url and returns them separately
+func splitParams(connectionUrl string, keys []string) (string, map[string]string) {
+	params := map[string]string{}
+	base, query, found := strings.Cut(connectionUrl, "?")
+	if !found {
+		return connectionUrl, params
+	}
+
+	var kept []string
+	for _, kv := range strings.Split(query, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		if core.Contains(keys, k) {
+			params[k], _ = url.QueryUnescape(v)
+		} else {
+			kept = append(kept, kv)
+		}
+	}
+	if len(kept) == 0 {
+		return base, params
+	}
+	return base + "?" + strings.Join(kept, "&"), params
+}
+
+// LoadTestURLs returns the store urls for tests. They are read from the file in the STASH_TEST_URLS environment variable,
+// ~/stash_test_urls.yaml or ../test_urls.yaml. The mem and local ids are always defined, so tests run without any file.
+func LoadTestURLs() (urls map[string]string) {
+	urls = map[string]string{
+		"mem":   "mem://test",
+		"local": "file://" + filepath.ToSlash(filepath.Join(os.TempDir(), "stash_test")),
+	}
+
+	var filenames []string
+	if filename := os.Getenv("STASH_TEST_URLS"); filename != "" {
+		filenames = append(filenames, filename)
+	}
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		filenames = append(filenames, path.Join(homeDir, "stash_test_urls.yaml"))
+	}
+	filenames = append(filenames, "../test_urls.yaml")
+
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+
+		var loaded map[string]string
+		err = yaml.Unmarshal(data, &loaded)
+		if core.IsErr(err, "cannot parse file %s: %v", filename) {
+			panic(err)
+		}
+		for k, v := range loaded {
+			urls[k] = v
+		}
+		break
 	}
 	return urls
 }
@@ -131,7 +214,7 @@ func NewTestStore(id string) Store {
 	}
 
 	store, err := Open(url)
-	if core.IsErr(err, "cannot open store %s: %v", url) {
+	if core.IsErr(err, "cannot open store %s: %v", Redact(url)) {
 		panic(err)
 	}
 	ls, _ := store.ReadDir("", Filter{})
@@ -41,6 +41,27 @@ func (s *sub) Write(name string, source io.ReadSeeker, progress chan int64) erro
 	return s.Store.Write(path.Join(s.Base, name), source, progress)
 }
 
+// WriteIf writes a file with a condition on the wrapped store
+func (s *sub) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	return WriteIf(s.Store, path.Join(s.Base, name), source, cond, progress)
+}
+
+// WriteResumable writes a file with a resumable upload on the wrapped store
+func (s *sub) WriteResumable(name string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	return WriteResumable(s.Store, path.Join(s.Base, name), source, upload, save, progress)
+}
+
+// AbortUpload discards the parts of an upload on the wrapped store
+func (s *sub) AbortUpload(name string, upload Upload) error {
+	return AbortUpload(s.Store, path.Join(s.Base, name), upload)
+}
+
+// Repair fixes the copies of the folder on the wrapped store
+func (s *sub) Repair(dir string) (int, error) {
+	return Repair(s.Store, path.Join(s.Base, dir))
+}
+
 // Stat provides statistics about a file
 func (s *sub) Stat(name string) (os.FileInfo, error) {
 	return s.Store.Stat(path.Join(s.Base, name))
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/stregato/stash/lib/core"
+)
+
+// PartSize is the size of the parts of a resumable upload. Files not larger than a part are written in one go.
+// S3 requires parts of at least 5MB, except the last one.
+var PartSize int64 = 8 * 1024 * 1024
+
+// Upload is the state of a resumable upload. It is saved after every part, so that an interrupted upload can continue
+// from Offset, even after a restart
+type Upload struct {
+	ID     string   `json:"id"`     // ID identifies the upload on the store
+	Offset int64    `json:"offset"` // Offset is the number of bytes already uploaded
+	Parts  []string `json:"parts"`  // Parts are the identifiers of the uploaded parts, for stores that need them
+}
+
+// ResumableWriter is implemented by stores that upload a file in parts, so that an interrupted upload can continue
+type ResumableWriter interface {
+	// WriteResumable writes the source from upload.Offset and calls save after every part. The file is visible only
+	// when all the parts are uploaded. When the store lost the upload, it starts again from the beginning
+	WriteResumable(name string, source io.ReadSeeker, upload *Upload, save func(Upload) error, progress chan int64) error
+
+	// AbortUpload discards the parts of an upload
+	AbortUpload(name string, upload Upload) error
+}
+
+// WriteResumable writes a file with a resumable upload on the store or on the first wrapped store that supports it.
+// Small files and stores without resumable uploads use a plain write.
+func WriteResumable(s Store, name string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	size, err := source.Seek(0, io.SeekEnd)
+	if core.IsErr(err, "cannot seek source for '%s': %v", name) {
+		return err
+	}
+	_, err = source.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if size > PartSize {
+		for w := s; w != nil; w = Unwrap(w) {
+			if r, ok := w.(ResumableWriter); ok {
+				return r.WriteResumable(name, source, upload, save, progress)
+			}
+		}
+	}
+	return s.Write(name, source, progress)
+}
+
+// AbortUpload discards the parts of an upload on the store or on the first wrapped store that supports it
+func AbortUpload(s Store, name string, upload Upload) error {
+	if upload.ID == "" {
+		return nil
+	}
+	for w := s; w != nil; w = Unwrap(w) {
+		if r, ok := w.(ResumableWriter); ok {
+			return r.AbortUpload(name, upload)
+		}
+	}
+	return nil
+}
+
+// uploadParts reads the source from upload.Offset in parts of PartSize and passes them to writePart, which returns an
+// optional identifier of the part. The state is saved after every part.
+func uploadParts(source io.ReadSeeker, upload *Upload, save func(Upload) error, progress chan int64,
+	writePart func(part []byte) (string, error)) error {
+	_, err := source.Seek(upload.Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, PartSize)
+	for {
+		n, err := io.ReadFull(source, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		id, err := writePart(buf[:n])
+		if err != nil {
+			return err
+		}
+		if id != "" {
+			upload.Parts = append(upload.Parts, id)
+		}
+		upload.Offset += int64(n)
+		if save != nil {
+			err = save(*upload)
+			if err != nil {
+				return core.Errorw(err, "cannot save upload state: %v")
+			}
+		}
+		if progress != nil {
+			progress <- int64(n)
+		}
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// uploadName returns the name of the temporary file that holds an upload until it is complete
+func uploadName(name string, upload Upload) string {
+	dir, base := path.Split(name)
+	return path.Join(dir, fmt.Sprintf(".upload-%s-%s", base, upload.ID))
+}
@@ -172,3 +172,31 @@ func Dump(store Store, dir string, content bool) string {
 	}
 	return builder.String()
 }
+
+// progressWriter reports the bytes written on a progress channel
+type progressWriter struct {
+	w        io.Writer
+	progress chan int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if p.progress != nil && n > 0 {
+		p.progress <- int64(n)
+	}
+	return n, err
+}
+
+// progressReader reports the bytes read on a progress channel. It is used when the source is read only once
+type progressReader struct {
+	r        io.Reader
+	progress chan int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if p.progress != nil && n > 0 {
+		p.progress <- int64(n)
+	}
+	return n, err
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -13,14 +16,17 @@ import (
 )
 
 type WebDAV struct {
-	c   *gowebdav.Client
-	p   string
-	url string
+	c      *gowebdav.Client
+	p      string
+	url    string
+	root   string
+	auth   gowebdav.Authorizer // auth is shared with the client, so that requests outside the client authenticate alike
+	client *http.Client        // client has the transport of the gowebdav client
 }
 
 func OpenWebDAV(connectionUrl string) (Store, error) {
 	u, err := url.Parse(connectionUrl)
-	if core.IsErr(err, "invalid url '%s': %v", connectionUrl) {
+	if core.IsErr(err, "invalid url '%s': %v", Redact(connectionUrl)) {
 		return nil, err
 	}
 
@@ -36,16 +42,22 @@ func OpenWebDAV(connectionUrl string) (Store, error) {
 	}
 
 	password, _ := u.User.Password()
-	c := gowebdav.NewClient(conn, u.User.Username(), password)
+	auth := gowebdav.NewAutoAuth(u.User.Username(), password)
+	client := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	c := gowebdav.NewAuthClient(conn, auth)
+	c.SetTransport(client.Transport)
 	err = c.Connect()
-	if core.IsErr(err, "cannot connect to WebDAV '%s': %v", connectionUrl) {
+	if core.IsErr(err, "cannot connect to WebDAV '%s': %v", Redact(connectionUrl)) {
 		return nil, err
 	}
 
 	w := &WebDAV{
-		c:   c,
-		p:   u.Path,
-		url: connectionUrl,
+		c:      c,
+		p:      u.Path,
+		url:    fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, u.Path), // without credentials
+		root:   conn,
+		auth:   auth,
+		client: client,
 	}
 
 	return w, nil
@@ -58,53 +70,147 @@ func (w *WebDAV) ID() string {
 func (w *WebDAV) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
 	p := path.Join(w.p, name)
 
-	r, err := w.c.ReadStream(p)
-	if core.IsErr(err, "cannot read WebDAV file %s: %v", p) {
-		return err
-	}
-
-	var written int64
+	var r io.ReadCloser
+	var err error
 	if rang == nil {
-		for err == nil {
-			written, err = io.CopyN(dest, r, 1024*1024)
-			if progress != nil {
-				progress <- written
-			}
-		}
+		r, err = w.c.ReadStream(p)
 	} else {
-		written, err = io.CopyN(io.Discard, r, rang.From)
-		if core.IsErr(err, "cannot discard %n bytes in range GET on %s: %v", rang.From, p) {
-			return err
-		}
-		if written != rang.From {
-			core.IsErr(io.ErrShortWrite, "Cannot read %d bytes in GET %s: %v")
-			return io.ErrShortWrite
-		}
-
-		written, err = io.CopyN(dest, r, rang.To-rang.From)
-		if progress != nil {
-			progress <- written
+		if rang.To <= rang.From {
+			return nil
 		}
+		r, err = w.c.ReadStreamRange(p, rang.From, rang.To-rang.From)
 	}
-	if err != nil && err != io.EOF {
-		core.IsErr(err, "cannot read from GET response on %s: %v", p)
+	if gowebdav.IsErrNotFound(err) {
+		return os.ErrNotExist
+	}
+	if core.IsErr(err, "cannot read WebDAV file %s: %v", p) {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(&progressWriter{w: dest, progress: progress}, r)
+	if core.IsErr(err, "cannot read from GET response on %s: %v", p) {
 		return err
 	}
-	r.Close()
 	return nil
 }
 
 func (w *WebDAV) Write(name string, source io.ReadSeeker, progress chan int64) error {
 	p := path.Join(w.p, name)
 
-	err := w.c.WriteStream(p, source, 0)
+	err := w.c.WriteStream(p, &progressReader{r: source, progress: progress}, 0)
 	if core.IsErr(err, "cannot write WebDAV file %s: %v", p) {
 		return err
 	}
+	return nil
+}
+
+// errPartialUpdate is returned when the server does not support partial updates
+var errPartialUpdate = errors.New("partial updates not supported")
+
+// WriteResumable uploads the file in chunks to a temporary file, which replaces the destination when the upload is
+// complete. The first chunk is a PUT, the others are appended with the partial update PATCH of SabreDAV servers, such as
+// Nextcloud and ownCloud. When the server does not support it, the file is written in one go.
+func (w *WebDAV) WriteResumable(name string, source io.ReadSeeker, upload *Upload, save func(Upload) error,
+	progress chan int64) error {
+	start, err := source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if upload.ID == "" {
+		*upload = Upload{ID: fmt.Sprint(core.SnowID())}
+	}
+	tmp := path.Join(w.p, uploadName(name, *upload))
 
+	// the size of the temporary file is the actual offset, since the last chunk may not be saved
+	stat, err := w.c.Stat(tmp)
+	if err == nil {
+		upload.Offset = stat.Size()
+	} else {
+		upload.Offset = 0
+	}
+
+	err = uploadParts(source, upload, save, progress, func(part []byte) (string, error) {
+		if upload.Offset == 0 {
+			return "", w.c.Write(tmp, part, 0)
+		}
+		return "", w.patch(tmp, upload.Offset, part)
+	})
+	if err == errPartialUpdate {
+		core.Info("WebDAV server %s does not support partial updates, writing %s in one go", w, name)
+		w.c.Remove(tmp)
+		*upload = Upload{}
+		_, err = source.Seek(start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		return w.Write(name, source, progress)
+	}
+	if core.IsErr(err, "cannot upload WebDAV file %s: %v", tmp) {
+		return err
+	}
+
+	err = w.c.Rename(tmp, path.Join(w.p, name), true)
+	core.IsErr(err, "cannot move WebDAV upload %s to %s: %v", tmp, name)
+	return err
+}
+
+// patch writes a chunk at the offset of a file with a SabreDAV partial update. The request goes through the transport
+// and the authentication of the gowebdav client, which has no method for it
+func (w *WebDAV) patch(p string, offset int64, chunk []byte) error {
+	auth, body := w.auth.NewAuthenticator(bytes.NewReader(chunk))
+	defer auth.Close()
+
+	var resp *http.Response
+	for {
+		req, err := http.NewRequest("PATCH", gowebdav.PathEscape(gowebdav.Join(w.root, p)), body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-sabredav-partialupdate")
+		req.Header.Set("X-Update-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(chunk))-1))
+		err = auth.Authorize(w.client, req, p)
+		if err != nil {
+			return err
+		}
+
+		resp, err = w.client.Do(req)
+		if err != nil {
+			return err
+		}
+		redo, err := auth.Verify(w.client, resp, p)
+		if err != nil || !redo {
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			break
+		}
+		resp.Body.Close()
+		body, err = req.GetBody()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented ||
+		resp.StatusCode == http.StatusUnsupportedMediaType:
+		return errPartialUpdate
+	case resp.StatusCode >= 300:
+		return &fs.PathError{Op: "PATCH", Path: p, Err: gowebdav.StatusError{Status: resp.StatusCode}}
+	}
 	return nil
 }
 
+func (w *WebDAV) AbortUpload(name string, upload Upload) error {
+	err := w.c.Remove(path.Join(w.p, uploadName(name, upload)))
+	if gowebdav.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
 func (w *WebDAV) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
 	p := path.Join(w.p, dir)
 
@@ -145,6 +251,17 @@ func (w *WebDAV) Stat(name string) (fs.FileInfo, error) {
 	return f, err
 }
 
+// IsRetryable returns true for throttling, timeouts and server errors
+func (w *WebDAV) IsRetryable(err error) bool {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		if se, ok := pathErr.Err.(gowebdav.StatusError); ok {
+			return se.Status == http.StatusRequestTimeout || se.Status == http.StatusTooManyRequests || se.Status >= 500
+		}
+	}
+	return isTransient(err)
+}
+
 func (w *WebDAV) Rename(old, new string) error {
 	o := path.Join(w.p, old)
 	n := path.Join(w.p, new)
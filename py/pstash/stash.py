@@ -1,3 +1,5 @@
+import ctypes
+import threading
 import json
 import os
 import appdirs
@@ -10,13 +12,92 @@ from functools import lru_cache
 
 from .options import CreateOptions, OpenOptions, ListOptions, Users, ListDirsOptions, PutOptions, GetOptions, SetUsersOptions
 from .stashd import e8, j8, o8, Data
-from .stashb import lib, consume
+from .stashb import lib, consume, CredentialsCallback, StoreCallbacks
 
 
 def set_stash_log_level(level: str):
     r = lib.stash_setLogLevel(e8(level))
     return consume(r)
 
+# the callback and its last result must stay alive while the library uses them
+_credentials_callback = None
+_credentials_buffer = None
+
+def set_credentials_callback(callback):
+    """Sets a function that returns the credentials referenced in store urls with the cred parameter.
+    The function gets the name and returns a dict with user, password and params, or None."""
+    global _credentials_callback
+
+    def call(name):
+        global _credentials_buffer
+        c = callback(name.decode("utf-8")) if callback else None
+        if c is None:
+            return None
+        _credentials_buffer = ctypes.create_string_buffer(j8(c))
+        return ctypes.addressof(_credentials_buffer)
+
+    _credentials_callback = CredentialsCallback(call) if callback else None
+    r = lib.stash_setCredentialsCallback(_credentials_callback)
+    return consume(r)
+
+def set_credentials(db, identity, name: str, user: str = "", password: str = "", params: dict = {}):
+    """Saves credentials in the database, encrypted with the identity"""
+    r = lib.stash_setCredentials(db.hnd, o8(identity), e8(name),
+                                 j8({"user": user, "password": password, "params": params}))
+    return consume(r)
+
+# the registered stores and the results of their callbacks must stay alive while the library uses them
+_stores = {}
+_store_results = threading.local()
+
+def _keep(data: bytes):
+    """keeps the data alive until the next callback on the same thread and returns its address"""
+    _store_results.buffer = ctypes.create_string_buffer(data, len(data))
+    return ctypes.addressof(_store_results.buffer)
+
+def _store_call(f):
+    def call(*args):
+        try:
+            return f(*args)
+        except FileNotFoundError:
+            return _keep(b"file does not exist")
+        except Exception as e:
+            return _keep(str(e).encode("utf-8"))
+    return call
+
+def _out(out, data: bytes):
+    out[0].ptr = _keep(data)
+    out[0].len = len(data)
+
+def register_store(scheme: str, store):
+    """Registers a backend for urls with the scheme, e.g. myobj://... The store implements read_dir(url, name),
+    read(url, name, start, end), write(url, name, data), stat(url, name) and remove(url, name), where end is -1 for the
+    end of the file. read_dir and stat return dicts with name, size, modTime (RFC 3339) and isDir. A missing file raises
+    FileNotFoundError. A None store removes the backend."""
+    if store is None:
+        _stores.pop(scheme, None)
+        return consume(lib.stash_registerStore(e8(scheme), None))
+
+    def read_dir(url, name, out):
+        _out(out, j8(store.read_dir(url.decode("utf-8"), name.decode("utf-8"))))
+    def read(url, name, start, end, out):
+        _out(out, bytes(store.read(url.decode("utf-8"), name.decode("utf-8"), start, end)))
+    def write(url, name, data):
+        store.write(url.decode("utf-8"), name.decode("utf-8"), ctypes.string_at(data.ptr, data.len))
+    def stat(url, name, out):
+        _out(out, j8(store.stat(url.decode("utf-8"), name.decode("utf-8"))))
+    def remove(url, name):
+        store.remove(url.decode("utf-8"), name.decode("utf-8"))
+
+    callbacks = StoreCallbacks(*[t(_store_call(f)) for (_, t), f in
+                                 zip(StoreCallbacks._fields_, [read_dir, read, write, stat, remove])])
+    _stores[scheme] = callbacks
+    return consume(lib.stash_registerStore(e8(scheme), ctypes.byref(callbacks)))
+
+def get_schemes():
+    """Returns the schemes of the registered backends and wrappers"""
+    return consume(lib.stash_getSchemes())
+
 class Identity:
     def __init__(self, nick: str):
         r = consume(lib.stash_newIdentity(e8(nick)))
@@ -79,6 +160,11 @@ class Config:
     "store configuration"
     description: str = ""
     quota: int = 0
+    compression: str = ""
+    dedup: bool = False
+    keepVersions: int = 0
+    keepDays: int = 0
+    trashDays: int = 0
     signature: str = ""
     
 class Safe():
@@ -122,6 +208,12 @@ class Safe():
         r = lib.stash_getKeys(self.hnd, e8(groupName), expectedMinimumLenght)
         return consume(r)    
 
+    def scrub(self, delete: bool = False, grace_period: float = 0):
+        "check the consistency of the safe; with delete, remove orphans older than grace_period seconds"
+        options = {"delete": delete, "gracePeriod": int(grace_period * 1e9)}
+        r = lib.stash_scrub(self.hnd, j8(options))
+        return consume(r)
+
     def fs(self):
         rq = lib.stash_openFS(self.hnd)
         consume(rq)
@@ -221,6 +313,56 @@ class Rows:
         if self.hnd:
             lib.stash_closeRows(self.hnd)
 
+class Reader:
+    "reader of a file in the safe, fetched in ranges as it is read"
+    def read(self, size: int = 1024*1024):
+        r = lib.stash_read(self.hnd, size)
+        return base64.b64decode(consume(r))
+
+    def seek(self, offset: int, whence: int = 0):
+        r = lib.stash_seek(self.hnd, offset, whence)
+        return consume(r)
+
+    def close(self):
+        if self.hnd:
+            r = lib.stash_closeReader(self.hnd)
+            self.hnd = 0
+            consume(r)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        self.close()
+
+    def __del__(self):
+        self.close()
+
+class Writer:
+    "writer of a new file in the safe, uploaded as it is written"
+    def write(self, data: bytes):
+        d = Data.from_byte_array(data)
+        r = lib.stash_write(self.hnd, d.ptr, d.len)
+        consume(r)
+        return len(data)
+
+    def close(self):
+        "complete the file and return its information"
+        if self.hnd:
+            r = lib.stash_closeWriter(self.hnd)
+            self.hnd = 0
+            self.file = consume(r)
+        return self.file
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        self.close()
+
+    def __del__(self):
+        self.close()
+
 class FS:
     def list(self, path: str = "", listOptions: ListOptions = ListOptions()):
         r = lib.stash_list(self.hnd, e8(path), o8(listOptions))
@@ -252,11 +394,121 @@ class FS:
         r = lib.stash_getData(self.hnd, e8(src), o8(getOptions))
         return base64.b64decode(consume(r))
 
+    def open(self, path: str):
+        "open a file for reading"
+        r = lib.stash_open(self.hnd, e8(path))
+        reader = Reader()
+        reader.file = consume(r)
+        reader.hnd = r.hnd
+        return reader
+
+    def create(self, path: str, putOptions: PutOptions = PutOptions()):
+        "create a new version of a file, which is uploaded as it is written"
+        r = lib.stash_create(self.hnd, e8(path), o8(putOptions))
+        consume(r)
+        writer = Writer()
+        writer.file = None
+        writer.hnd = r.hnd
+        return writer
+
     def delete(self, path: str):
-        "delete a file"
+        "delete a file with all its versions, or a directory with all its content"
         r = lib.stash_delete(self.hnd, e8(path))
         return consume(r)
+
+    def delete_version(self, path: str, version: int):
+        "delete a version of a file"
+        r = lib.stash_deleteVersion(self.hnd, e8(path), version)
+        return consume(r)
     
+    def versions(self, path: str):
+        "list the versions of a file, the latest first"
+        r = lib.stash_versions(self.hnd, e8(path))
+        return consume(r)
+
+    def restore(self, path: str, version: int):
+        "make a copy of a version the latest version of a file"
+        r = lib.stash_restore(self.hnd, e8(path), version)
+        return consume(r)
+
+    def prune(self, path: str, versions: int = 0, days: int = 0):
+        "delete the versions of a file beyond the most recent versions and older than days"
+        r = lib.stash_prune(self.hnd, e8(path), j8({"versions": versions, "days": days}))
+        return consume(r)
+
+    def list_trash(self):
+        "list the deleted files that can be restored"
+        r = lib.stash_listTrash(self.hnd)
+        return consume(r)
+
+    def undelete(self, id: int):
+        "restore a deleted file from the trash"
+        r = lib.stash_undelete(self.hnd, id)
+        return consume(r)
+
+    def empty_trash(self):
+        "delete permanently the files in the trash"
+        r = lib.stash_emptyTrash(self.hnd)
+        return consume(r)
+
+    def collect_chunks(self):
+        "delete the chunks of deduplicated files that no file references"
+        r = lib.stash_collectChunks(self.hnd)
+        return consume(r)
+
+    def mkdir(self, path: str):
+        "create a directory"
+        r = lib.stash_mkdir(self.hnd, e8(path))
+        return consume(r)
+
+    def rmdir(self, path: str):
+        "remove an empty directory"
+        r = lib.stash_rmdir(self.hnd, e8(path))
+        return consume(r)
+
+    def move(self, old_path: str, new_path: str):
+        "move a file or a directory with all its content"
+        r = lib.stash_move(self.hnd, e8(old_path), e8(new_path))
+        return consume(r)
+
+    def sync(self, local_dir: str, remote_dir: str, mode: str = "", ignore: list = []):
+        "synchronize a local directory with a directory in the safe once; mode is upload, download or two-way"
+        r = lib.stash_syncFolder(self.hnd, e8(local_dir), e8(remote_dir), j8({"mode": mode, "ignore": ignore}))
+        return consume(r)
+
+    def set_group(self, path: str, group: str, rotate_key: bool = False):
+        "change the group of a file, with all its versions, or of a directory"
+        r = lib.stash_setGroup(self.hnd, e8(path), e8(group), j8({"rotateKey": rotate_key}))
+        return consume(r)
+
+    def set_group_tree(self, dir: str, group: str, rotate_key: bool = False):
+        "change the group of a directory with all its content"
+        r = lib.stash_setGroupTree(self.hnd, e8(dir), e8(group), j8({"rotateKey": rotate_key}))
+        return consume(r)
+
+    def set_policy(self, dir: str, default_group: str = "", allowed_groups: list = [], default_tags: list = [],
+                   keep_versions: int = 0, keep_days: int = 0):
+        "set the rules for a directory and its subdirectories; only administrators can"
+        policy = {"dir": dir, "defaultGroup": default_group, "allowedGroups": allowed_groups,
+                  "defaultTags": default_tags, "retention": {"versions": keep_versions, "days": keep_days}}
+        r = lib.stash_setPolicy(self.hnd, j8(policy))
+        return consume(r)
+
+    def delete_policy(self, dir: str):
+        "remove the rules of a directory"
+        r = lib.stash_deletePolicy(self.hnd, e8(dir))
+        return consume(r)
+
+    def policies(self):
+        "return the policies of the directories"
+        r = lib.stash_policies(self.hnd)
+        return consume(r)
+
+    def policy_of(self, dir: str):
+        "return the rules that apply to a directory"
+        r = lib.stash_policyOf(self.hnd, e8(dir))
+        return consume(r)
+
     def rename(self, old_path: str, new_path: str):
         "rename a file"
         r = lib.stash_rename(self.hnd, e8(old_path), e8(new_path))
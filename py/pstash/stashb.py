@@ -39,6 +39,9 @@ lib.stash_getGroups.restype = Result
 lib.stash_getKeys.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_long]
 lib.stash_getKeys.restype = Result
 
+lib.stash_scrub.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
+lib.stash_scrub.restype = Result
+
 lib.stash_openFS.argtypes = [ctypes.c_ulonglong]
 lib.stash_openFS.restype = Result
 
@@ -63,9 +66,84 @@ lib.stash_getFile.restype = Result
 lib.stash_getData.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p]
 lib.stash_getData.restype = Result
 
+lib.stash_open.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
+lib.stash_open.restype = Result
+
+lib.stash_read.argtypes = [ctypes.c_ulonglong, ctypes.c_int]
+lib.stash_read.restype = Result
+
+lib.stash_seek.argtypes = [ctypes.c_ulonglong, ctypes.c_longlong, ctypes.c_int]
+lib.stash_seek.restype = Result
+
+lib.stash_closeReader.argtypes = [ctypes.c_ulonglong]
+lib.stash_closeReader.restype = Result
+
+lib.stash_create.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p]
+lib.stash_create.restype = Result
+
+lib.stash_write.argtypes = [ctypes.c_ulonglong, ctypes.c_void_p, ctypes.c_size_t]
+lib.stash_write.restype = Result
+
+lib.stash_closeWriter.argtypes = [ctypes.c_ulonglong]
+lib.stash_closeWriter.restype = Result
+
 lib.stash_delete.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
 lib.stash_delete.restype = Result
 
+lib.stash_deleteVersion.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_ulonglong]
+lib.stash_deleteVersion.restype = Result
+
+lib.stash_versions.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
+lib.stash_versions.restype = Result
+
+lib.stash_restore.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_ulonglong]
+lib.stash_restore.restype = Result
+
+lib.stash_prune.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p]
+lib.stash_prune.restype = Result
+
+lib.stash_listTrash.argtypes = [ctypes.c_ulonglong]
+lib.stash_listTrash.restype = Result
+
+lib.stash_undelete.argtypes = [ctypes.c_ulonglong, ctypes.c_ulonglong]
+lib.stash_undelete.restype = Result
+
+lib.stash_emptyTrash.argtypes = [ctypes.c_ulonglong]
+lib.stash_emptyTrash.restype = Result
+
+lib.stash_collectChunks.argtypes = [ctypes.c_ulonglong]
+lib.stash_collectChunks.restype = Result
+
+lib.stash_mkdir.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
+lib.stash_mkdir.restype = Result
+
+lib.stash_rmdir.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
+lib.stash_rmdir.restype = Result
+
+lib.stash_move.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p]
+lib.stash_move.restype = Result
+
+lib.stash_syncFolder.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p]
+lib.stash_syncFolder.restype = Result
+
+lib.stash_setGroup.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p]
+lib.stash_setGroup.restype = Result
+
+lib.stash_setGroupTree.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p]
+lib.stash_setGroupTree.restype = Result
+
+lib.stash_setPolicy.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
+lib.stash_setPolicy.restype = Result
+
+lib.stash_deletePolicy.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
+lib.stash_deletePolicy.restype = Result
+
+lib.stash_policies.argtypes = [ctypes.c_ulonglong]
+lib.stash_policies.restype = Result
+
+lib.stash_policyOf.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p]
+lib.stash_policyOf.restype = Result
+
 lib.stash_rename.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p]
 lib.stash_rename.restype = Result
 
@@ -122,6 +200,30 @@ lib.stash_download.restype = Result
 lib.stash_rewind.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_ulonglong]
 lib.stash_rewind.restype = Result
 
+CredentialsCallback = ctypes.CFUNCTYPE(ctypes.c_void_p, ctypes.c_char_p)
+
+lib.stash_setCredentialsCallback.argtypes = [CredentialsCallback]
+lib.stash_setCredentialsCallback.restype = Result
+
+lib.stash_setCredentials.argtypes = [ctypes.c_ulonglong, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p]
+lib.stash_setCredentials.restype = Result
+
+class StoreCallbacks(ctypes.Structure):
+    _fields_ = [
+        ("readDir", ctypes.CFUNCTYPE(ctypes.c_void_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.POINTER(Data))),
+        ("read", ctypes.CFUNCTYPE(ctypes.c_void_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_longlong,
+                                  ctypes.c_longlong, ctypes.POINTER(Data))),
+        ("write", ctypes.CFUNCTYPE(ctypes.c_void_p, ctypes.c_char_p, ctypes.c_char_p, Data)),
+        ("stat", ctypes.CFUNCTYPE(ctypes.c_void_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.POINTER(Data))),
+        ("remove", ctypes.CFUNCTYPE(ctypes.c_void_p, ctypes.c_char_p, ctypes.c_char_p)),
+    ]
+
+lib.stash_registerStore.argtypes = [ctypes.c_char_p, ctypes.POINTER(StoreCallbacks)]
+lib.stash_registerStore.restype = Result
+
+lib.stash_getSchemes.argtypes = []
+lib.stash_getSchemes.restype = Result
+
 def consume(r):
     try:
         if r.err: